@@ -18,3 +18,33 @@ type Backend interface {
 	// it returns ErrInvalidCredentials.
 	Login(connInfo *imap.ConnInfo, username, password string) (User, error)
 }
+
+// CertificateBackend is a Backend supporting logins with TLS client
+// certificates, using the SASL EXTERNAL mechanism (RFC 4422 appendix A). The
+// server only offers EXTERNAL to clients which have sent a certificate verified
+// according to the server TLS configuration. Clients whose TLS connection ends
+// at a trusted proxy cannot use EXTERNAL.
+type CertificateBackend interface {
+	Backend
+
+	// LoginCertificate authenticates the user identified by the verified TLS
+	// client certificate in connInfo.TLS. identity is the user the client
+	// requests to act as, empty if it's the user derived from the certificate.
+	// If the certificate doesn't identify a user allowed to act as identity, it
+	// returns ErrInvalidCredentials.
+	LoginCertificate(connInfo *imap.ConnInfo, identity string) (User, error)
+}
+
+// ExtendedBackend is a Backend that supports IMAP extensions which require
+// data only the backend can provide, for instance STATUS=SIZE (RFC 8438),
+// SAVEDATE (RFC 8514) or OBJECTID (RFC 8474). The server takes care of parsing
+// and formatting the related status items, fetch items and search keys, the
+// backend must populate MailboxStatus and Message fields when they are
+// requested. The capabilities are advertised to authenticated clients.
+type ExtendedBackend interface {
+	Backend
+
+	// Capabilities returns the list of capabilities supported by the backend,
+	// e.g. "STATUS=SIZE", "SAVEDATE" or "OBJECTID".
+	Capabilities() []string
+}
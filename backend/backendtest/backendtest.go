@@ -0,0 +1,279 @@
+// Package backendtest provides a conformance test suite for IMAP backends.
+//
+// The suite checks that a backend follows the contracts documented in the
+// backend package, which are derived from RFC 3501. It can be run from the
+// tests of any backend:
+//
+//	func TestBackend(t *testing.T) {
+//		backendtest.RunTests(t, func() backend.Backend {
+//			return mybackend.New(t.TempDir())
+//		})
+//	}
+package backendtest
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// The credentials used by the test suite. Backends returned by the newBackend
+// function passed to RunTests must accept them.
+const (
+	Username = "username"
+	Password = "password"
+)
+
+// updateTimeout is the maximum duration to wait for a backend update.
+const updateTimeout = 5 * time.Second
+
+type test struct {
+	name string
+	f    func(t *testing.T, be backend.Backend)
+}
+
+var tests = []test{
+	{"Login", testLogin},
+	{"ListMailboxes", testListMailboxes},
+	{"GetMailbox", testGetMailbox},
+	{"CreateMailbox", testCreateMailbox},
+	{"CreateMailbox_Hierarchy", testCreateMailboxHierarchy},
+	{"DeleteMailbox", testDeleteMailbox},
+	{"DeleteMailbox_Inferiors", testDeleteMailboxInferiors},
+	{"DeleteMailbox_Uid", testDeleteMailboxUid},
+	{"RenameMailbox", testRenameMailbox},
+	{"RenameMailbox_Hierarchy", testRenameMailboxHierarchy},
+	{"RenameMailbox_Inbox", testRenameMailboxInbox},
+	{"SetSubscribed", testSetSubscribed},
+	{"Status", testStatus},
+	{"CreateMessage", testCreateMessage},
+	{"CreateMessage_Uid", testCreateMessageUid},
+	{"ListMessages", testListMessages},
+	{"ListMessages_Uid", testListMessagesUid},
+	{"SearchMessages", testSearchMessages},
+	{"UpdateMessagesFlags", testUpdateMessagesFlags},
+	{"CopyMessages", testCopyMessages},
+	{"Expunge", testExpunge},
+	{"Updates", testUpdates},
+}
+
+// RunTests runs the conformance test suite. newBackend is called once per test
+// and must return a backend in which the user Username with the password
+// Password can log in. Tests leave existing mailboxes and messages untouched,
+// except for INBOX rename tests.
+func RunTests(t *testing.T, newBackend func() backend.Backend) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.f(t, newBackend())
+		})
+	}
+}
+
+// Login logs in as Username. The user is logged out when the test completes.
+func Login(t *testing.T, be backend.Backend) backend.User {
+	t.Helper()
+
+	u, err := be.Login(nil, Username, Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	t.Cleanup(func() { u.Logout() })
+	return u
+}
+
+// GetMailbox returns a mailbox of a user, failing the test on error.
+func GetMailbox(t *testing.T, u backend.User, name string) backend.Mailbox {
+	t.Helper()
+
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		t.Fatalf("Expected no error while getting mailbox %v, got: %v", name, err)
+	}
+	return mbox
+}
+
+func createMailbox(t *testing.T, u backend.User, name string) backend.Mailbox {
+	t.Helper()
+
+	if err := u.CreateMailbox(name); err != nil {
+		t.Fatalf("Expected no error while creating mailbox %v, got: %v", name, err)
+	}
+	return GetMailbox(t, u, name)
+}
+
+// delimiter returns the hierarchy delimiter of a user's mailboxes. If the
+// backend has a flat hierarchy, the test is skipped.
+func delimiter(t *testing.T, u backend.User) string {
+	t.Helper()
+
+	info, err := GetMailbox(t, u, "INBOX").Info()
+	if err != nil {
+		t.Fatal("Expected no error while getting mailbox info, got:", err)
+	}
+	if info.Delimiter == "" {
+		t.Skip("Backend doesn't support hierarchies")
+	}
+	return info.Delimiter
+}
+
+// MailboxNames returns the sorted names of the mailboxes of a user. If
+// subscribed is set, only subscribed mailboxes are returned.
+func MailboxNames(t *testing.T, u backend.User, subscribed bool) []string {
+	t.Helper()
+
+	mailboxes, err := u.ListMailboxes(subscribed)
+	if err != nil {
+		t.Fatal("Expected no error while listing mailboxes, got:", err)
+	}
+
+	var names []string
+	for _, mbox := range mailboxes {
+		names = append(names, mbox.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func listNames(t *testing.T, u backend.User, subscribed bool) map[string]bool {
+	t.Helper()
+
+	names := make(map[string]bool)
+	for _, name := range MailboxNames(t, u, subscribed) {
+		names[name] = true
+	}
+	return names
+}
+
+// GetStatus returns the status of a mailbox, failing the test on error.
+func GetStatus(t *testing.T, mbox backend.Mailbox, items ...imap.StatusItem) *imap.MailboxStatus {
+	t.Helper()
+
+	status, err := mbox.Status(items)
+	if err != nil {
+		t.Fatal("Expected no error while getting mailbox status, got:", err)
+	}
+	return status
+}
+
+// testDate is the internal date of test messages. It has no sub-second part
+// so that backends storing dates with a one second precision can round-trip
+// it.
+var testDate = time.Date(2016, 5, 11, 14, 31, 59, 0, time.UTC)
+
+func testMessage(subject, body string) string {
+	return "From: contact@example.org\r\n" +
+		"To: contact@example.org\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: Wed, 11 May 2016 14:31:59 +0000\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		body + "\r\n"
+}
+
+func createMessage(t *testing.T, mbox backend.Mailbox, flags []string, msg string) {
+	t.Helper()
+
+	if err := mbox.CreateMessage(flags, testDate, bytes.NewBufferString(msg)); err != nil {
+		t.Fatal("Expected no error while creating message, got:", err)
+	}
+}
+
+// createMessages creates a message for each set of flags.
+func createMessages(t *testing.T, mbox backend.Mailbox, flags ...[]string) {
+	t.Helper()
+
+	for i, f := range flags {
+		createMessage(t, mbox, f, testMessage("Message "+string(rune('A'+i)), "Hi there :)"))
+	}
+}
+
+// ListMessages returns the messages of a mailbox in a sequence set, such as
+// "1:*". If uid is set, seqSet contains UIDs.
+func ListMessages(t *testing.T, mbox backend.Mailbox, uid bool, seqSet string, items ...imap.FetchItem) []*imap.Message {
+	t.Helper()
+
+	set, err := imap.ParseSeqSet(seqSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *imap.Message)
+	done := make(chan []*imap.Message)
+	go func() {
+		var msgs []*imap.Message
+		for msg := range ch {
+			msgs = append(msgs, msg)
+		}
+		done <- msgs
+	}()
+
+	if err := mbox.ListMessages(uid, set, items, ch); err != nil {
+		t.Error("Expected no error while listing messages, got:", err)
+	}
+	return <-done
+}
+
+// listUids returns the UIDs of all messages in a mailbox.
+func listUids(t *testing.T, mbox backend.Mailbox) []uint32 {
+	t.Helper()
+
+	var uids []uint32
+	for i, msg := range ListMessages(t, mbox, false, "1:*", imap.FetchUid) {
+		if msg.SeqNum != uint32(i+1) {
+			t.Errorf("Expected sequence number %v, got %v", i+1, msg.SeqNum)
+		}
+		uids = append(uids, msg.Uid)
+	}
+	return uids
+}
+
+// listFlags returns the flags of all messages in a mailbox, without \Recent
+// and sorted.
+func listFlags(t *testing.T, mbox backend.Mailbox) [][]string {
+	t.Helper()
+
+	var flags [][]string
+	for _, msg := range ListMessages(t, mbox, false, "1:*", imap.FetchFlags) {
+		flags = append(flags, normalizeFlags(msg.Flags))
+	}
+	return flags
+}
+
+func normalizeFlags(flags []string) []string {
+	l := []string{}
+	for _, flag := range flags {
+		flag = imap.CanonicalFlag(flag)
+		if flag != imap.RecentFlag {
+			l = append(l, flag)
+		}
+	}
+	sort.Strings(l)
+	return l
+}
+
+func updateFlags(t *testing.T, mbox backend.Mailbox, uid bool, seqSet string, op imap.FlagsOp, flags ...string) {
+	t.Helper()
+
+	set, err := imap.ParseSeqSet(seqSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.UpdateMessagesFlags(uid, set, op, flags); err != nil {
+		t.Fatal("Expected no error while updating flags, got:", err)
+	}
+}
+
+func checkStrictlyIncreasing(t *testing.T, uids []uint32) {
+	t.Helper()
+
+	for i := 1; i < len(uids); i++ {
+		if uids[i] <= uids[i-1] {
+			t.Errorf("Expected strictly increasing UIDs, got %v", uids)
+			return
+		}
+	}
+}
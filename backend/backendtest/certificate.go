@@ -0,0 +1,25 @@
+package backendtest
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// CertificateBackend wraps a backend to implement backend.CertificateBackend
+// in tests. The user is named by the common name of the verified client
+// certificate, or is Username if there is none. It's logged in with Password.
+type CertificateBackend struct {
+	backend.Backend
+}
+
+// LoginCertificate implements backend.CertificateBackend.
+func (be CertificateBackend) LoginCertificate(connInfo *imap.ConnInfo, identity string) (backend.User, error) {
+	username := Username
+	if connInfo != nil && connInfo.TLS != nil && len(connInfo.TLS.VerifiedChains) > 0 {
+		username = connInfo.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	if identity != "" && identity != username {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return be.Login(connInfo, username, Password)
+}
@@ -0,0 +1,318 @@
+package backendtest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/textproto"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func testStatus(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+	createMessages(t, mbox, []string{imap.SeenFlag}, nil, []string{imap.SeenFlag, imap.FlaggedFlag})
+	uids := listUids(t, mbox)
+
+	status := GetStatus(t, mbox, imap.StatusMessages, imap.StatusRecent, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen)
+	if status.Name != "Test" {
+		t.Errorf("Expected name Test, got %v", status.Name)
+	}
+	if status.Messages != 3 {
+		t.Errorf("Expected 3 messages, got %v", status.Messages)
+	}
+	if status.Recent != 3 {
+		t.Errorf("Expected 3 recent messages, got %v", status.Recent)
+	}
+	if status.Unseen != 1 {
+		t.Errorf("Expected 1 unseen message, got %v", status.Unseen)
+	}
+	if status.UnseenSeqNum != 2 {
+		t.Errorf("Expected first unseen message 2, got %v", status.UnseenSeqNum)
+	}
+	if len(uids) == 3 && status.UidNext <= uids[2] {
+		t.Errorf("Expected UIDNEXT greater than %v, got %v", uids[2], status.UidNext)
+	}
+	if status.UidValidity == 0 {
+		t.Error("Expected non-zero UIDVALIDITY")
+	}
+	if status.PermanentFlags == nil {
+		t.Error("Expected PERMANENTFLAGS to be populated")
+	}
+}
+
+func testCreateMessage(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+
+	body := testMessage("Hello", "Hi there :)")
+	flags := []string{imap.SeenFlag, "$Label1"}
+	createMessage(t, mbox, flags, body)
+
+	section := &imap.BodySectionName{}
+	items := []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchUid, section.FetchItem()}
+	msgs := ListMessages(t, mbox, false, "1:*", items...)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message, got %v", len(msgs))
+	}
+	msg := msgs[0]
+
+	if msg.SeqNum != 1 || msg.Uid == 0 {
+		t.Errorf("Expected sequence number 1 and a non-zero UID, got %v and %v", msg.SeqNum, msg.Uid)
+	}
+	if want := normalizeFlags(flags); !reflect.DeepEqual(normalizeFlags(msg.Flags), want) {
+		t.Errorf("Expected flags %v, got %v", want, msg.Flags)
+	}
+	if !msg.InternalDate.Equal(testDate) {
+		t.Errorf("Expected internal date %v, got %v", testDate, msg.InternalDate)
+	}
+	if msg.Size != uint32(len(body)) {
+		t.Errorf("Expected size %v, got %v", len(body), msg.Size)
+	}
+
+	l := msg.GetBody(section)
+	if l == nil {
+		t.Fatal("Expected a message body")
+	}
+	b, err := ioutil.ReadAll(l)
+	if err != nil {
+		t.Fatal("Expected no error while reading body, got:", err)
+	}
+	if string(b) != body {
+		t.Errorf("Expected body %q, got %q", body, string(b))
+	}
+
+	// The current time is used if the date is zero
+	if err := mbox.CreateMessage(nil, time.Time{}, bytes.NewBufferString(body)); err != nil {
+		t.Fatal("Expected no error while creating message, got:", err)
+	}
+	msgs = ListMessages(t, mbox, false, "2", imap.FetchInternalDate)
+	if len(msgs) != 1 || time.Since(msgs[0].InternalDate) > time.Hour {
+		t.Errorf("Expected internal date to be the current time, got %v", msgs)
+	}
+}
+
+func testCreateMessageUid(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+
+	createMessages(t, mbox, nil, nil)
+	uidNext := GetStatus(t, mbox, imap.StatusUidNext).UidNext
+	createMessages(t, mbox, []string{imap.DeletedFlag})
+
+	uids := listUids(t, mbox)
+	checkStrictlyIncreasing(t, uids)
+	if len(uids) != 3 || uids[2] < uidNext {
+		t.Fatalf("Expected 3 messages and last UID at least %v, got %v", uidNext, uids)
+	}
+
+	// UIDs of expunged messages are not reused
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expected no error while expunging, got:", err)
+	}
+	createMessages(t, mbox, nil)
+	newUids := listUids(t, mbox)
+	if len(newUids) != 3 || newUids[2] <= uids[2] {
+		t.Errorf("Expected last UID greater than %v, got %v", uids[2], newUids)
+	}
+}
+
+func testListMessages(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+	createMessages(t, mbox, nil, nil, nil)
+
+	msgs := ListMessages(t, mbox, false, "2:3", imap.FetchEnvelope)
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %v", len(msgs))
+	}
+	for i, msg := range msgs {
+		if msg.SeqNum != uint32(i+2) {
+			t.Errorf("Expected sequence number %v, got %v", i+2, msg.SeqNum)
+		}
+	}
+	if msgs[0].Envelope == nil || msgs[0].Envelope.Subject != "Message B" {
+		t.Errorf("Expected subject Message B, got %v", msgs[0].Envelope)
+	}
+
+	msgs = ListMessages(t, mbox, false, "3:*", imap.FetchFlags)
+	if len(msgs) != 1 || msgs[0].SeqNum != 3 {
+		t.Errorf("Expected 3:* to match the last message, got %v", msgs)
+	}
+}
+
+func testListMessagesUid(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+	createMessages(t, mbox, nil, nil, nil)
+	uids := listUids(t, mbox)
+	if len(uids) != 3 {
+		t.Fatalf("Expected 3 messages, got %v", len(uids))
+	}
+
+	set := new(imap.SeqSet)
+	set.AddNum(uids[1])
+	msgs := ListMessages(t, mbox, true, set.String(), imap.FetchUid)
+	if len(msgs) != 1 || msgs[0].SeqNum != 2 || msgs[0].Uid != uids[1] {
+		t.Errorf("Expected message 2 with UID %v, got %v", uids[1], msgs)
+	}
+
+	set = new(imap.SeqSet)
+	set.AddRange(uids[1], 0)
+	msgs = ListMessages(t, mbox, true, set.String(), imap.FetchUid)
+	if len(msgs) != 2 || msgs[0].Uid != uids[1] || msgs[1].Uid != uids[2] {
+		t.Errorf("Expected messages with UIDs %v, got %v", uids[1:], msgs)
+	}
+
+	set = new(imap.SeqSet)
+	set.AddNum(uids[2] + 1)
+	if msgs := ListMessages(t, mbox, true, set.String(), imap.FetchUid); len(msgs) != 0 {
+		t.Errorf("Expected no message for an unused UID, got %v", msgs)
+	}
+}
+
+func testSearchMessages(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+	createMessages(t, mbox, []string{imap.SeenFlag}, nil)
+	createMessage(t, mbox, []string{imap.FlaggedFlag}, testMessage("Message C", "Hello world"))
+	uids := listUids(t, mbox)
+
+	header := make(textproto.MIMEHeader)
+	header.Add("Subject", "Message B")
+
+	tests := []struct {
+		criteria *imap.SearchCriteria
+		seqNums  []uint32
+	}{
+		{&imap.SearchCriteria{}, []uint32{1, 2, 3}},
+		{&imap.SearchCriteria{WithFlags: []string{imap.SeenFlag}}, []uint32{1}},
+		{&imap.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}}, []uint32{2, 3}},
+		{&imap.SearchCriteria{Header: header}, []uint32{2}},
+		{&imap.SearchCriteria{Body: []string{"world"}}, []uint32{3}},
+		{&imap.SearchCriteria{Not: []*imap.SearchCriteria{{WithFlags: []string{imap.FlaggedFlag}}}}, []uint32{1, 2}},
+	}
+
+	for i, test := range tests {
+		seqNums, err := mbox.SearchMessages(false, test.criteria)
+		if err != nil {
+			t.Fatalf("Expected no error while searching #%v, got: %v", i, err)
+		}
+		if !equalIds(seqNums, test.seqNums) {
+			t.Errorf("Expected sequence numbers %v for search #%v, got %v", test.seqNums, i, seqNums)
+		}
+
+		ids, err := mbox.SearchMessages(true, test.criteria)
+		if err != nil {
+			t.Fatalf("Expected no error while searching #%v, got: %v", i, err)
+		}
+		var want []uint32
+		for _, seqNum := range test.seqNums {
+			want = append(want, uids[seqNum-1])
+		}
+		if !equalIds(ids, want) {
+			t.Errorf("Expected UIDs %v for search #%v, got %v", want, i, ids)
+		}
+	}
+}
+
+func equalIds(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testUpdateMessagesFlags(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+	createMessages(t, mbox, nil, nil, nil)
+	uids := listUids(t, mbox)
+	if len(uids) != 3 {
+		t.Fatalf("Expected 3 messages, got %v", len(uids))
+	}
+
+	updateFlags(t, mbox, false, "1", imap.SetFlags, imap.SeenFlag, imap.FlaggedFlag)
+	set := new(imap.SeqSet)
+	set.AddNum(uids[1])
+	updateFlags(t, mbox, true, set.String(), imap.AddFlags, imap.AnsweredFlag)
+	updateFlags(t, mbox, false, "1", imap.RemoveFlags, imap.FlaggedFlag)
+	updateFlags(t, mbox, false, "1:*", imap.AddFlags, imap.DraftFlag)
+	updateFlags(t, mbox, false, "3", imap.AddFlags, "$Label1")
+
+	want := [][]string{
+		normalizeFlags([]string{imap.DraftFlag, imap.SeenFlag}),
+		normalizeFlags([]string{imap.AnsweredFlag, imap.DraftFlag}),
+		normalizeFlags([]string{"$Label1", imap.DraftFlag}),
+	}
+	if flags := listFlags(t, mbox); !reflect.DeepEqual(flags, want) {
+		t.Errorf("Expected flags %v, got %v", want, flags)
+	}
+}
+
+func testCopyMessages(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+	createMessages(t, mbox, []string{imap.SeenFlag}, []string{imap.FlaggedFlag}, nil)
+	dest := createMailbox(t, u, "Dest")
+	createMessages(t, dest, nil)
+
+	set, _ := imap.ParseSeqSet("1:2")
+	if err := mbox.CopyMessages(false, set, "Dest"); err != nil {
+		t.Fatal("Expected no error while copying messages, got:", err)
+	}
+
+	want := [][]string{{}, {imap.SeenFlag}, {imap.FlaggedFlag}}
+	if flags := listFlags(t, dest); !reflect.DeepEqual(flags, want) {
+		t.Errorf("Expected flags %v, got %v", want, flags)
+	}
+	checkStrictlyIncreasing(t, listUids(t, dest))
+
+	msgs := ListMessages(t, dest, false, "2", imap.FetchEnvelope, imap.FetchInternalDate)
+	if len(msgs) != 1 || msgs[0].Envelope == nil || msgs[0].Envelope.Subject != "Message A" {
+		t.Errorf("Expected copied message to have subject Message A, got %v", msgs)
+	} else if !msgs[0].InternalDate.Equal(testDate) {
+		t.Errorf("Expected internal date %v, got %v", testDate, msgs[0].InternalDate)
+	}
+
+	// The source mailbox is left untouched
+	if status := GetStatus(t, mbox, imap.StatusMessages); status.Messages != 3 {
+		t.Errorf("Expected 3 messages in the source mailbox, got %v", status.Messages)
+	}
+
+	if err := mbox.CopyMessages(false, set, "Idontexist"); err == nil {
+		t.Error("Expected an error when copying to a mailbox that doesn't exist")
+	}
+}
+
+func testExpunge(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+	createMessages(t, mbox, nil, []string{imap.DeletedFlag}, []string{imap.SeenFlag}, nil)
+	uids := listUids(t, mbox)
+	if len(uids) != 4 {
+		t.Fatalf("Expected 4 messages, got %v", len(uids))
+	}
+	updateFlags(t, mbox, false, "4", imap.AddFlags, imap.DeletedFlag)
+
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expected no error while expunging, got:", err)
+	}
+
+	if remaining := listUids(t, mbox); !equalIds(remaining, []uint32{uids[0], uids[2]}) {
+		t.Errorf("Expected UIDs %v, got %v", []uint32{uids[0], uids[2]}, remaining)
+	}
+	want := [][]string{{}, {imap.SeenFlag}}
+	if flags := listFlags(t, mbox); !reflect.DeepEqual(flags, want) {
+		t.Errorf("Expected flags %v, got %v", want, flags)
+	}
+}
@@ -0,0 +1,97 @@
+package backendtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// receiveUpdates reads updates from a backend and forwards them to the
+// returned channel.
+func receiveUpdates(t *testing.T, be backend.Backend) <-chan backend.Update {
+	updater, ok := be.(backend.BackendUpdater)
+	if !ok {
+		t.Skip("Backend doesn't implement BackendUpdater")
+	}
+
+	updates := updater.Updates()
+	received := make(chan backend.Update, 100)
+	go func() {
+		for update := range updates {
+			select {
+			case received <- update:
+			default:
+			}
+			close(update.Done())
+		}
+	}()
+	return received
+}
+
+// waitUpdate waits for an update accepted by f.
+func waitUpdate(t *testing.T, updates <-chan backend.Update, desc string, f func(update backend.Update) bool) {
+	t.Helper()
+
+	timer := time.NewTimer(updateTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case update := <-updates:
+			if update.Username() != "" && update.Username() != Username {
+				continue
+			}
+			if f(update) {
+				return
+			}
+		case <-timer.C:
+			t.Fatal("Expected " + desc)
+		}
+	}
+}
+
+func testUpdates(t *testing.T, be backend.Backend) {
+	updates := receiveUpdates(t, be)
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+	createMailbox(t, u, "Dest")
+
+	createMessages(t, mbox, nil, nil)
+	waitUpdate(t, updates, "a mailbox update after creating a message", func(update backend.Update) bool {
+		mboxUpdate, ok := update.(*backend.MailboxUpdate)
+		return ok && mboxUpdate.Mailbox() == "Test" && mboxUpdate.Messages == 2
+	})
+
+	updateFlags(t, mbox, false, "1", imap.AddFlags, imap.DeletedFlag)
+	waitUpdate(t, updates, "a message update after updating flags", func(update backend.Update) bool {
+		msgUpdate, ok := update.(*backend.MessageUpdate)
+		if !ok || msgUpdate.Mailbox() != "Test" || msgUpdate.SeqNum != 1 {
+			return false
+		}
+		for _, flag := range msgUpdate.Flags {
+			if flag == imap.DeletedFlag {
+				return true
+			}
+		}
+		return false
+	})
+
+	set, _ := imap.ParseSeqSet("2")
+	if err := mbox.CopyMessages(false, set, "Dest"); err != nil {
+		t.Fatal("Expected no error while copying messages, got:", err)
+	}
+	waitUpdate(t, updates, "a mailbox update after copying a message", func(update backend.Update) bool {
+		mboxUpdate, ok := update.(*backend.MailboxUpdate)
+		return ok && mboxUpdate.Mailbox() == "Dest" && mboxUpdate.Messages == 1
+	})
+
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expected no error while expunging, got:", err)
+	}
+	waitUpdate(t, updates, "an expunge update after expunging a message", func(update backend.Update) bool {
+		expungeUpdate, ok := update.(*backend.ExpungeUpdate)
+		return ok && expungeUpdate.Mailbox() == "Test" && expungeUpdate.SeqNum == 1
+	})
+}
@@ -0,0 +1,239 @@
+package backendtest
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func testLogin(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	if u.Username() != Username {
+		t.Errorf("Expected username %v, got %v", Username, u.Username())
+	}
+
+	if _, err := be.Login(nil, Username, Password+"-invalid"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials for an invalid password, got: %v", err)
+	}
+}
+
+func testListMailboxes(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	createMailbox(t, u, "Test")
+
+	names := listNames(t, u, false)
+	if !names["INBOX"] || !names["Test"] {
+		t.Errorf("Expected INBOX and Test to be listed, got %v", names)
+	}
+}
+
+func testGetMailbox(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+
+	// INBOX is case-insensitive
+	if mbox := GetMailbox(t, u, "iNbOx"); mbox.Name() != "INBOX" {
+		t.Errorf("Expected mailbox name INBOX, got %v", mbox.Name())
+	}
+
+	if _, err := u.GetMailbox("Idontexist"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected ErrNoSuchMailbox, got: %v", err)
+	}
+}
+
+func testCreateMailbox(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+
+	mbox := createMailbox(t, u, "Test")
+	if mbox.Name() != "Test" {
+		t.Errorf("Expected mailbox name Test, got %v", mbox.Name())
+	}
+	if status := GetStatus(t, mbox, imap.StatusMessages); status.Messages != 0 {
+		t.Errorf("Expected a new mailbox to be empty, got %v messages", status.Messages)
+	}
+
+	if err := u.CreateMailbox("Test"); err == nil {
+		t.Error("Expected an error when creating an existing mailbox")
+	}
+	if err := u.CreateMailbox("INBOX"); err == nil {
+		t.Error("Expected an error when creating INBOX")
+	}
+}
+
+func testCreateMailboxHierarchy(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	delim := delimiter(t, u)
+
+	// Superior names are created
+	createMailbox(t, u, "a"+delim+"b"+delim+"c")
+	names := listNames(t, u, false)
+	for _, name := range []string{"a", "a" + delim + "b", "a" + delim + "b" + delim + "c"} {
+		if !names[name] {
+			t.Errorf("Expected mailbox %v to exist, got %v", name, names)
+		}
+	}
+
+	// A trailing delimiter declares an intent to create inferior names
+	if err := u.CreateMailbox("d" + delim); err != nil {
+		t.Fatal("Expected no error while creating a mailbox with a trailing delimiter, got:", err)
+	}
+	createMailbox(t, u, "d"+delim+"e")
+}
+
+func testDeleteMailbox(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	createMailbox(t, u, "Test")
+
+	if err := u.DeleteMailbox("Test"); err != nil {
+		t.Fatal("Expected no error while deleting mailbox, got:", err)
+	}
+	if _, err := u.GetMailbox("Test"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected ErrNoSuchMailbox for a deleted mailbox, got: %v", err)
+	}
+	if names := listNames(t, u, false); names["Test"] {
+		t.Errorf("Expected a deleted mailbox not to be listed, got %v", names)
+	}
+
+	if err := u.DeleteMailbox("Test"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected ErrNoSuchMailbox, got: %v", err)
+	}
+	if err := u.DeleteMailbox("INBOX"); err == nil {
+		t.Error("Expected an error when deleting INBOX")
+	}
+}
+
+func testDeleteMailboxInferiors(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	delim := delimiter(t, u)
+	createMailbox(t, u, "foo")
+	createMailbox(t, u, "foo"+delim+"bar")
+
+	if err := u.DeleteMailbox("foo"); err != nil {
+		t.Fatal("Expected no error while deleting mailbox, got:", err)
+	}
+
+	// Inferior names must not be removed
+	GetMailbox(t, u, "foo"+delim+"bar")
+}
+
+func testDeleteMailboxUid(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+	createMessages(t, mbox, nil, nil)
+	before := GetStatus(t, mbox, imap.StatusUidNext, imap.StatusUidValidity)
+	uids := listUids(t, mbox)
+
+	if err := u.DeleteMailbox("Test"); err != nil {
+		t.Fatal("Expected no error while deleting mailbox, got:", err)
+	}
+
+	// The new incarnation must not reuse UIDs, unless its UIDVALIDITY changed
+	mbox = createMailbox(t, u, "Test")
+	createMessages(t, mbox, nil)
+	after := GetStatus(t, mbox, imap.StatusUidValidity)
+	if after.UidValidity == before.UidValidity {
+		newUids := listUids(t, mbox)
+		if len(newUids) != 1 || newUids[0] <= uids[len(uids)-1] || newUids[0] < before.UidNext {
+			t.Errorf("Expected UID greater than %v, got %v", uids, newUids)
+		}
+	}
+}
+
+func testRenameMailbox(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Old")
+	createMessages(t, mbox, []string{imap.SeenFlag})
+	createMailbox(t, u, "Existing")
+
+	if err := u.RenameMailbox("Old", "New"); err != nil {
+		t.Fatal("Expected no error while renaming mailbox, got:", err)
+	}
+	if _, err := u.GetMailbox("Old"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected ErrNoSuchMailbox for the old name, got: %v", err)
+	}
+	mbox = GetMailbox(t, u, "New")
+	if flags := listFlags(t, mbox); len(flags) != 1 || len(flags[0]) != 1 || flags[0][0] != imap.SeenFlag {
+		t.Errorf("Expected renamed mailbox to contain a seen message, got flags %v", flags)
+	}
+
+	if err := u.RenameMailbox("Idontexist", "Other"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected ErrNoSuchMailbox, got: %v", err)
+	}
+	if err := u.RenameMailbox("New", "Existing"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("Expected ErrMailboxAlreadyExists, got: %v", err)
+	}
+}
+
+func testRenameMailboxHierarchy(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	delim := delimiter(t, u)
+	createMailbox(t, u, "foo"+delim+"bar")
+
+	// Inferior names are renamed, superior names are created
+	if err := u.RenameMailbox("foo", "baz"+delim+"rag"); err != nil {
+		t.Fatal("Expected no error while renaming mailbox, got:", err)
+	}
+
+	names := listNames(t, u, false)
+	for _, name := range []string{"baz", "baz" + delim + "rag", "baz" + delim + "rag" + delim + "bar"} {
+		if !names[name] {
+			t.Errorf("Expected mailbox %v to exist, got %v", name, names)
+		}
+	}
+	for _, name := range []string{"foo", "foo" + delim + "bar"} {
+		if names[name] {
+			t.Errorf("Expected mailbox %v not to exist, got %v", name, names)
+		}
+	}
+}
+
+func testRenameMailboxInbox(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	inbox := GetMailbox(t, u, "INBOX")
+	createMessages(t, inbox, []string{imap.FlaggedFlag})
+	before := GetStatus(t, inbox, imap.StatusMessages, imap.StatusUidValidity)
+
+	if err := u.RenameMailbox("INBOX", "Old"); err != nil {
+		t.Fatal("Expected no error while renaming INBOX, got:", err)
+	}
+
+	// All messages are moved to the new mailbox, leaving INBOX empty
+	inbox = GetMailbox(t, u, "INBOX")
+	if status := GetStatus(t, inbox, imap.StatusMessages); status.Messages != 0 {
+		t.Errorf("Expected INBOX to be empty, got %v messages", status.Messages)
+	}
+	old := GetMailbox(t, u, "Old")
+	status := GetStatus(t, old, imap.StatusMessages, imap.StatusUidValidity)
+	if status.Messages != before.Messages {
+		t.Errorf("Expected %v messages in the new mailbox, got %v", before.Messages, status.Messages)
+	}
+	// The new mailbox isn't a renamed INBOX, it gets a new UIDVALIDITY
+	if status.UidValidity == before.UidValidity {
+		t.Errorf("Expected the new mailbox to get a new UIDVALIDITY, got %v", status.UidValidity)
+	}
+
+	// INBOX can still receive messages
+	createMessages(t, inbox, nil)
+	if status := GetStatus(t, inbox, imap.StatusMessages); status.Messages != 1 {
+		t.Errorf("Expected 1 message in INBOX, got %v", status.Messages)
+	}
+}
+
+func testSetSubscribed(t *testing.T, be backend.Backend) {
+	u := Login(t, be)
+	mbox := createMailbox(t, u, "Test")
+
+	if err := mbox.SetSubscribed(true); err != nil {
+		t.Fatal("Expected no error while subscribing, got:", err)
+	}
+	if names := listNames(t, u, true); !names["Test"] {
+		t.Errorf("Expected Test to be subscribed, got %v", names)
+	}
+
+	if err := mbox.SetSubscribed(false); err != nil {
+		t.Fatal("Expected no error while unsubscribing, got:", err)
+	}
+	if names := listNames(t, u, true); names["Test"] {
+		t.Errorf("Expected Test not to be subscribed, got %v", names)
+	}
+}
@@ -0,0 +1,137 @@
+package backendutil
+
+import (
+	"context"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// Login calls BackendContext.LoginContext if it's implemented, and Backend.Login otherwise.
+func Login(ctx context.Context, be backend.Backend, connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	if be, ok := be.(backend.BackendContext); ok {
+		return be.LoginContext(ctx, connInfo, username, password)
+	}
+	return be.Login(connInfo, username, password)
+}
+
+// LoginCertificate calls CertificateBackendContext.LoginCertificateContext if it's implemented, and CertificateBackend.LoginCertificate otherwise.
+func LoginCertificate(ctx context.Context, be backend.CertificateBackend, connInfo *imap.ConnInfo, identity string) (backend.User, error) {
+	if be, ok := be.(backend.CertificateBackendContext); ok {
+		return be.LoginCertificateContext(ctx, connInfo, identity)
+	}
+	return be.LoginCertificate(connInfo, identity)
+}
+
+// ListMailboxes calls UserContext.ListMailboxesContext if it's implemented, and User.ListMailboxes otherwise.
+func ListMailboxes(ctx context.Context, u backend.User, subscribed bool) ([]backend.Mailbox, error) {
+	if u, ok := u.(backend.UserContext); ok {
+		return u.ListMailboxesContext(ctx, subscribed)
+	}
+	return u.ListMailboxes(subscribed)
+}
+
+// GetMailbox calls UserContext.GetMailboxContext if it's implemented, and User.GetMailbox otherwise.
+func GetMailbox(ctx context.Context, u backend.User, name string) (backend.Mailbox, error) {
+	if u, ok := u.(backend.UserContext); ok {
+		return u.GetMailboxContext(ctx, name)
+	}
+	return u.GetMailbox(name)
+}
+
+// CreateMailbox calls UserContext.CreateMailboxContext if it's implemented, and User.CreateMailbox otherwise.
+func CreateMailbox(ctx context.Context, u backend.User, name string) error {
+	if u, ok := u.(backend.UserContext); ok {
+		return u.CreateMailboxContext(ctx, name)
+	}
+	return u.CreateMailbox(name)
+}
+
+// DeleteMailbox calls UserContext.DeleteMailboxContext if it's implemented, and User.DeleteMailbox otherwise.
+func DeleteMailbox(ctx context.Context, u backend.User, name string) error {
+	if u, ok := u.(backend.UserContext); ok {
+		return u.DeleteMailboxContext(ctx, name)
+	}
+	return u.DeleteMailbox(name)
+}
+
+// RenameMailbox calls UserContext.RenameMailboxContext if it's implemented, and User.RenameMailbox otherwise.
+func RenameMailbox(ctx context.Context, u backend.User, existingName, newName string) error {
+	if u, ok := u.(backend.UserContext); ok {
+		return u.RenameMailboxContext(ctx, existingName, newName)
+	}
+	return u.RenameMailbox(existingName, newName)
+}
+
+// Status calls MailboxContext.StatusContext if it's implemented, and Mailbox.Status otherwise.
+func Status(ctx context.Context, mbox backend.Mailbox, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	if mbox, ok := mbox.(backend.MailboxContext); ok {
+		return mbox.StatusContext(ctx, items)
+	}
+	return mbox.Status(items)
+}
+
+// SetSubscribed calls MailboxContext.SetSubscribedContext if it's implemented, and Mailbox.SetSubscribed otherwise.
+func SetSubscribed(ctx context.Context, mbox backend.Mailbox, subscribed bool) error {
+	if mbox, ok := mbox.(backend.MailboxContext); ok {
+		return mbox.SetSubscribedContext(ctx, subscribed)
+	}
+	return mbox.SetSubscribed(subscribed)
+}
+
+// Check calls MailboxContext.CheckContext if it's implemented, and Mailbox.Check otherwise.
+func Check(ctx context.Context, mbox backend.Mailbox) error {
+	if mbox, ok := mbox.(backend.MailboxContext); ok {
+		return mbox.CheckContext(ctx)
+	}
+	return mbox.Check()
+}
+
+// ListMessages calls MailboxContext.ListMessagesContext if it's implemented, and Mailbox.ListMessages otherwise.
+func ListMessages(ctx context.Context, mbox backend.Mailbox, uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	if mbox, ok := mbox.(backend.MailboxContext); ok {
+		return mbox.ListMessagesContext(ctx, uid, seqset, items, ch)
+	}
+	return mbox.ListMessages(uid, seqset, items, ch)
+}
+
+// SearchMessages calls MailboxContext.SearchMessagesContext if it's implemented, and Mailbox.SearchMessages otherwise.
+func SearchMessages(ctx context.Context, mbox backend.Mailbox, uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	if mbox, ok := mbox.(backend.MailboxContext); ok {
+		return mbox.SearchMessagesContext(ctx, uid, criteria)
+	}
+	return mbox.SearchMessages(uid, criteria)
+}
+
+// CreateMessage calls MailboxContext.CreateMessageContext if it's implemented, and Mailbox.CreateMessage otherwise.
+func CreateMessage(ctx context.Context, mbox backend.Mailbox, flags []string, date time.Time, body imap.Literal) error {
+	if mbox, ok := mbox.(backend.MailboxContext); ok {
+		return mbox.CreateMessageContext(ctx, flags, date, body)
+	}
+	return mbox.CreateMessage(flags, date, body)
+}
+
+// UpdateMessagesFlags calls MailboxContext.UpdateMessagesFlagsContext if it's implemented, and Mailbox.UpdateMessagesFlags otherwise.
+func UpdateMessagesFlags(ctx context.Context, mbox backend.Mailbox, uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	if mbox, ok := mbox.(backend.MailboxContext); ok {
+		return mbox.UpdateMessagesFlagsContext(ctx, uid, seqset, op, flags)
+	}
+	return mbox.UpdateMessagesFlags(uid, seqset, op, flags)
+}
+
+// CopyMessages calls MailboxContext.CopyMessagesContext if it's implemented, and Mailbox.CopyMessages otherwise.
+func CopyMessages(ctx context.Context, mbox backend.Mailbox, uid bool, seqset *imap.SeqSet, dest string) error {
+	if mbox, ok := mbox.(backend.MailboxContext); ok {
+		return mbox.CopyMessagesContext(ctx, uid, seqset, dest)
+	}
+	return mbox.CopyMessages(uid, seqset, dest)
+}
+
+// Expunge calls MailboxContext.ExpungeContext if it's implemented, and Mailbox.Expunge otherwise.
+func Expunge(ctx context.Context, mbox backend.Mailbox) error {
+	if mbox, ok := mbox.(backend.MailboxContext); ok {
+		return mbox.ExpungeContext(ctx)
+	}
+	return mbox.Expunge()
+}
@@ -0,0 +1,104 @@
+package backendutil
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// dotlockTimeout is the maximum duration to wait for a dotlock.
+	dotlockTimeout = 30 * time.Second
+	// dotlockStale is the age after which a dotlock is considered abandoned.
+	dotlockStale = 5 * time.Minute
+)
+
+// dotlockRefresh is the interval at which held dotlocks are touched, so that
+// they aren't considered abandoned by other processes.
+var dotlockRefresh = time.Minute
+
+// Dotlock creates a lock file named path.lock, as done by MDAs and mail
+// clients, waiting for other processes to release it. Lock files older than
+// five minutes are considered abandoned and are removed, so the lock file is
+// touched regularly while it's held. It returns a function releasing the lock.
+func Dotlock(path string) (unlock func(), err error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(dotlockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			fi, err := f.Stat()
+			f.Close()
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, err
+			}
+			return holdDotlock(lockPath, fi), nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if fi, err := os.Stat(lockPath); err == nil && time.Since(fi.ModTime()) > dotlockStale {
+			breakDotlock(lockPath, fi)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("backendutil: timeout waiting for lock %v", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// holdDotlock touches the lock file until the returned function is called,
+// which removes it if it's still ours.
+func holdDotlock(lockPath string, fi os.FileInfo) (unlock func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(dotlockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				now := time.Now()
+				os.Chtimes(lockPath, now, now)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			if cur, err := os.Stat(lockPath); err == nil && os.SameFile(fi, cur) {
+				os.Remove(lockPath)
+			}
+		})
+	}
+}
+
+// breakDotlock removes the abandoned lock file described by fi. Another
+// process may break the same lock, or create a new one, between the call to
+// stat and the removal: the lock file is first moved to a name unique to this
+// process, and given back if it turns out not to be the abandoned one.
+func breakDotlock(lockPath string, fi os.FileInfo) {
+	tmpPath := fmt.Sprintf("%v.%d.%d", lockPath, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(lockPath, tmpPath); err != nil {
+		return
+	}
+	defer os.Remove(tmpPath)
+
+	cur, err := os.Stat(tmpPath)
+	if err == nil && os.SameFile(fi, cur) && cur.ModTime().Equal(fi.ModTime()) {
+		return
+	}
+	// The lock is still in use, this fails if a new lock has been created
+	// in the meantime
+	os.Link(tmpPath, lockPath)
+}
@@ -0,0 +1,146 @@
+package backendutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDotlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mailbox")
+
+	unlock, err := Dotlock(path)
+	if err != nil {
+		t.Fatal("Expected no error while locking, got:", err)
+	}
+	if _, err := os.Stat(path + ".lock"); err != nil {
+		t.Fatal("Expected a lock file, got:", err)
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := Dotlock(path)
+		if err != nil {
+			t.Error("Expected no error while locking, got:", err)
+		} else {
+			unlock()
+		}
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("Expected the second lock to wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	<-locked
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Error("Expected the lock file to be removed, got:", err)
+	}
+}
+
+func TestDotlock_stale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mailbox")
+	if err := ioutil.WriteFile(path+".lock", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path+".lock", old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := Dotlock(path)
+	if err != nil {
+		t.Fatal("Expected an abandoned lock to be removed, got:", err)
+	}
+	unlock()
+}
+
+func TestDotlock_refresh(t *testing.T) {
+	defer func(d time.Duration) { dotlockRefresh = d }(dotlockRefresh)
+	dotlockRefresh = 10 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "mailbox")
+	unlock, err := Dotlock(path)
+	if err != nil {
+		t.Fatal("Expected no error while locking, got:", err)
+	}
+	defer unlock()
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path+".lock", old, old); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	fi, err := os.Stat(path + ".lock")
+	if err != nil {
+		t.Fatal("Expected the lock file to exist, got:", err)
+	}
+	if time.Since(fi.ModTime()) > dotlockStale {
+		t.Error("Expected the held lock file to be touched")
+	}
+}
+
+func TestBreakDotlock_refreshed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mailbox")
+	lockPath := path + ".lock"
+	if err := ioutil.WriteFile(lockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is refreshed by its owner after it has been found stale
+	now := time.Now()
+	if err := os.Chtimes(lockPath, now, now); err != nil {
+		t.Fatal(err)
+	}
+	breakDotlock(lockPath, fi)
+
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Fatal("Expected the lock in use not to be removed, got:", err)
+	}
+	if matches, _ := filepath.Glob(lockPath + ".*"); len(matches) != 0 {
+		t.Errorf("Expected no leftover file, got %v", matches)
+	}
+}
+
+func TestBreakDotlock_replaced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mailbox")
+	lockPath := path + ".lock"
+	if err := ioutil.WriteFile(lockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process breaks the lock and acquires a new one
+	os.Remove(lockPath)
+	unlock, err := Dotlock(path)
+	if err != nil {
+		t.Fatal("Expected no error while locking, got:", err)
+	}
+	defer unlock()
+	breakDotlock(lockPath, fi)
+
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Fatal("Expected the new lock not to be removed, got:", err)
+	}
+}
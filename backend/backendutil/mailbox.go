@@ -0,0 +1,68 @@
+package backendutil
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// lastUidValidity is the last value returned by NewUidValidity.
+var lastUidValidity uint32
+
+// NewUidValidity returns a UIDVALIDITY value for a new mailbox, based on the
+// current time. Values are strictly increasing within a process, so that a
+// mailbox deleted and created again in the same second gets a new
+// UIDVALIDITY.
+func NewUidValidity() uint32 {
+	for {
+		last := atomic.LoadUint32(&lastUidValidity)
+		v := uint32(time.Now().Unix())
+		if v <= last {
+			v = last + 1
+		}
+		if atomic.CompareAndSwapUint32(&lastUidValidity, last, v) {
+			return v
+		}
+	}
+}
+
+// RecentSet contains the UIDs of the messages whose \Recent flag has been
+// claimed by a session. RFC 3501 section 2.3.2 requires a message to be recent
+// in a single session: backends usually store whether a message is recent
+// until a session claims it, then keep track of claimed messages in a
+// RecentSet per session. The zero value is an empty set, ready to use.
+type RecentSet struct {
+	locker sync.Mutex
+	uids   map[uint32]bool
+}
+
+// Add adds messages to the set.
+func (s *RecentSet) Add(uids ...uint32) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.uids == nil {
+		s.uids = make(map[uint32]bool)
+	}
+	for _, uid := range uids {
+		s.uids[uid] = true
+	}
+}
+
+// Has checks whether a message is in the set.
+func (s *RecentSet) Has(uid uint32) bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.uids[uid]
+}
+
+// Flags returns the flags of a message as seen by the session: \Recent is
+// appended if the message is in the set. flags is left unchanged.
+func (s *RecentSet) Flags(uid uint32, flags []string) []string {
+	if !s.Has(uid) {
+		return flags
+	}
+	return append(append([]string(nil), flags...), imap.RecentFlag)
+}
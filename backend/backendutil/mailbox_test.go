@@ -0,0 +1,42 @@
+package backendutil
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestNewUidValidity(t *testing.T) {
+	last := NewUidValidity()
+	for i := 0; i < 10; i++ {
+		v := NewUidValidity()
+		if v <= last {
+			t.Fatalf("Expected UIDVALIDITY greater than %v, got %v", last, v)
+		}
+		last = v
+	}
+}
+
+func TestRecentSet(t *testing.T) {
+	var s RecentSet
+	if s.Has(1) {
+		t.Error("Expected an empty set")
+	}
+
+	s.Add(1, 3)
+	if !s.Has(1) || s.Has(2) || !s.Has(3) {
+		t.Error("Expected the set to contain 1 and 3")
+	}
+
+	flags := []string{imap.SeenFlag}
+	if got := s.Flags(1, flags); !reflect.DeepEqual(got, []string{imap.SeenFlag, imap.RecentFlag}) {
+		t.Errorf("Expected \\Recent to be appended, got %v", got)
+	}
+	if got := s.Flags(2, flags); !reflect.DeepEqual(got, []string{imap.SeenFlag}) {
+		t.Errorf("Expected flags to be unchanged, got %v", got)
+	}
+	if len(flags) != 1 {
+		t.Errorf("Expected the flags slice to be left unchanged, got %v", flags)
+	}
+}
@@ -0,0 +1,45 @@
+package backendutil
+
+import (
+	"sync"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+// Notifier sends backend updates to the server. Backends can use it to
+// implement backend.BackendUpdater. The zero value is ready to use.
+type Notifier struct {
+	locker  sync.Mutex
+	updates chan backend.Update
+}
+
+// Updates implements backend.BackendUpdater.
+func (n *Notifier) Updates() <-chan backend.Update {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	if n.updates == nil {
+		n.updates = make(chan backend.Update)
+	}
+	return n.updates
+}
+
+// Notify sends updates and waits for them to be broadcast. Updates are dropped
+// if Updates has never been called. It must be called without holding locks
+// needed by the backend, since the server may call the backend while
+// broadcasting.
+func (n *Notifier) Notify(updates ...backend.Update) {
+	n.locker.Lock()
+	ch := n.updates
+	n.locker.Unlock()
+
+	if ch == nil {
+		return
+	}
+	for _, update := range updates {
+		// Done lazily creates the channel, call it before sharing the update
+		done := update.Done()
+		ch <- update
+		<-done
+	}
+}
@@ -0,0 +1,33 @@
+package backendutil
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+func TestNotifier(t *testing.T) {
+	var n Notifier
+
+	// Updates are dropped until Updates is called
+	n.Notify(backend.NewUpdate("username", "INBOX"))
+
+	updates := n.Updates()
+	received := make(chan backend.Update, 2)
+	go func() {
+		for update := range updates {
+			received <- update
+			close(update.Done())
+		}
+	}()
+
+	n.Notify(backend.NewUpdate("username", "INBOX"), backend.NewUpdate("username", "Archive"))
+	for _, name := range []string{"INBOX", "Archive"} {
+		if update := <-received; update.Mailbox() != name {
+			t.Errorf("Expected an update for %v, got %v", name, update.Mailbox())
+		}
+	}
+	if len(received) != 0 {
+		t.Errorf("Expected no other update, got %v", len(received))
+	}
+}
@@ -0,0 +1,115 @@
+package backendutil
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// PreviewMaxLen is the maximum length of a message preview, in characters. See
+// RFC 8970 section 3.
+const PreviewMaxLen = 256
+
+// previewReadLimit is the maximum number of decoded bytes read from a text part
+// when generating a preview.
+const previewReadLimit = 64 * 1024
+
+func isAttachment(header textproto.Header) bool {
+	disp, _, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	return strings.EqualFold(disp, "attachment")
+}
+
+// findPreviewText walks the MIME tree and returns the best text candidates for
+// a preview. It stops as soon as a text/plain part is found.
+func findPreviewText(header textproto.Header, body io.Reader) (plain, htmlText []byte, err error) {
+	if mr := multipartReader(header, body); mr != nil {
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, htmlText, err
+			}
+
+			partPlain, partHTML, err := findPreviewText(p.Header, p)
+			if err != nil {
+				continue
+			}
+			if partPlain != nil {
+				return partPlain, nil, nil
+			}
+			if htmlText == nil {
+				htmlText = partHTML
+			}
+		}
+		return nil, htmlText, nil
+	}
+
+	if isAttachment(header) {
+		return nil, nil, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 section 5.2: default to text/plain
+		mediaType = "text/plain"
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return nil, nil, nil
+	}
+
+	r, err := decodeText(header, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, previewReadLimit))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if mediaType == "text/html" {
+		return nil, b, nil
+	}
+	return b, nil, nil
+}
+
+// normalizePreview collapses whitespace and truncates s to PreviewMaxLen
+// characters.
+func normalizePreview(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= PreviewMaxLen {
+		return s
+	}
+
+	n := 0
+	for i := range s {
+		if n == PreviewMaxLen {
+			return s[:i]
+		}
+		n++
+	}
+	return s
+}
+
+// FetchPreview generates a preview of a message's text, as defined in RFC 8970.
+// The first text/plain part which isn't an attachment is used. If there is no
+// such part, the first text/html part is used instead.
+func FetchPreview(header textproto.Header, body io.Reader) (string, error) {
+	plain, htmlText, err := findPreviewText(header, body)
+	if err != nil && plain == nil && htmlText == nil {
+		return "", err
+	}
+
+	var s string
+	if plain != nil {
+		s = string(plain)
+	} else {
+		s = stripHTML(htmlText)
+	}
+
+	return normalizePreview(strings.ToValidUTF8(s, "")), nil
+}
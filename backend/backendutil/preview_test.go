@@ -0,0 +1,79 @@
+package backendutil
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+var previewTests = []struct {
+	name    string
+	mail    string
+	preview string
+}{
+	{
+		name:    "multipart",
+		mail:    testMailString,
+		preview: testTextBodyString,
+	},
+	{
+		name:    "html",
+		mail:    testHTMLString,
+		preview: "What's your name?",
+	},
+	{
+		name: "html-script",
+		mail: "Content-Type: text/html\r\n" +
+			"\r\n" +
+			"<html><head><title>Hi</title></head><body>" +
+			"<script>alert('hi')</script><p>Tom &amp; Jerry</p></body></html>",
+		preview: "Tom & Jerry",
+	},
+	{
+		name: "base64",
+		mail: "Content-Type: text/plain; charset=utf-8\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"0J/RgNC+0LLQtdGA0LrQsCE=\r\n",
+		preview: "Проверка!",
+	},
+	{
+		name: "quoted-printable",
+		mail: "Content-Type: text/plain; charset=utf-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"caf=C3=A9 =\r\n" +
+			"au   lait\r\n",
+		preview: "café au lait",
+	},
+	{
+		name:    "attachment",
+		mail:    testAttachmentString,
+		preview: "",
+	},
+	{
+		name:    "truncated",
+		mail:    "\r\n" + strings.Repeat("é", 300),
+		preview: strings.Repeat("é", PreviewMaxLen),
+	},
+}
+
+func TestFetchPreview(t *testing.T) {
+	for _, test := range previewTests {
+		bufferedBody := bufio.NewReader(strings.NewReader(test.mail))
+
+		header, err := textproto.ReadHeader(bufferedBody)
+		if err != nil {
+			t.Fatalf("Expected no error while reading mail for %v, got: %v", test.name, err)
+		}
+
+		preview, err := FetchPreview(header, bufferedBody)
+		if err != nil {
+			t.Errorf("Expected no error while fetching preview for %v, got: %v", test.name, err)
+		} else if preview != test.preview {
+			t.Errorf("Expected preview for %v to be %q, got %q", test.name, test.preview, preview)
+		}
+	}
+}
@@ -1,161 +1,543 @@
 package backendutil
 
 import (
+	"bufio"
 	"bytes"
-	"fmt"
+	"errors"
 	"io"
+	"io/ioutil"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/text/cases"
 )
 
-func matchString(s, substr string) bool {
-	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+// foldString returns a case-folded version of s, suitable for case-insensitive
+// comparisons.
+func foldString(s string) string {
+	return cases.Fold().String(s)
 }
 
-func bufferBody(e *message.Entity) (*bytes.Buffer, error) {
-	b := new(bytes.Buffer)
-	if _, err := io.Copy(b, e.Body); err != nil {
-		return nil, err
+// matchString checks whether the case-folded string folded contains substr.
+func matchString(folded, substr string) bool {
+	return strings.Contains(folded, foldString(substr))
+}
+
+type countWriter struct {
+	n int
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	w.n += len(b)
+	return len(b), nil
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+var errScanDone = errors.New("backendutil: all search strings found")
+
+// textScanner is an io.Writer looking for a set of strings in the text written
+// to it. Only a window of the last bytes written is kept in memory, so that
+// strings spanning several writes are found.
+type textScanner struct {
+	needles   [][]byte
+	found     []bool
+	remaining int
+
+	window []byte
+	keep   int
+	// Bytes of an incomplete UTF-8 sequence at the end of the last write
+	partial []byte
+}
+
+func newTextScanner(needles []string) *textScanner {
+	s := &textScanner{
+		needles: make([][]byte, len(needles)),
+		found:   make([]bool, len(needles)),
+	}
+	for i, needle := range needles {
+		s.needles[i] = []byte(needle)
+		if needle == "" {
+			s.found[i] = true
+			continue
+		}
+		s.remaining++
+		if len(needle)-1 > s.keep {
+			s.keep = len(needle) - 1
+		}
+	}
+	return s
+}
+
+func (s *textScanner) Write(b []byte) (int, error) {
+	if s.remaining == 0 {
+		return 0, errScanDone
+	}
+
+	// Case folding operates on runes, don't split UTF-8 sequences
+	buf := append(s.partial, b...)
+	n := len(buf)
+	for i := n - 1; i >= 0 && i >= n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				n = i
+			}
+			break
+		}
+	}
+	s.partial = append([]byte(nil), buf[n:]...)
+
+	s.window = append(s.window, foldString(string(buf[:n]))...)
+	for i, needle := range s.needles {
+		if !s.found[i] && bytes.Contains(s.window, needle) {
+			s.found[i] = true
+			s.remaining--
+		}
+	}
+
+	if len(s.window) > s.keep {
+		s.window = append(s.window[:0], s.window[len(s.window)-s.keep:]...)
+	}
+
+	if s.remaining == 0 {
+		return len(b), errScanDone
+	}
+	return len(b), nil
+}
+
+// Metadata contains message attributes that are not part of the message
+// content.
+type Metadata struct {
+	SeqNum uint32
+	Uid    uint32
+	// The internal date.
+	Date  time.Time
+	Flags []string
+	// True if the message has the \Recent flag. Backends can use this field
+	// instead of including \Recent in Flags.
+	Recent bool
+	// The RFC822.SIZE of the message. If zero, the size is computed from the
+	// message content.
+	Size uint32
+	// The date the message was saved to its mailbox, see RFC 8514. If zero, the
+	// mailbox doesn't support save dates: the internal date is used instead and
+	// the SAVEDATESUPPORTED search key doesn't match.
+	SaveDate time.Time
+	// The email and thread object identifiers, see RFC 8474.
+	EmailId  string
+	ThreadId string
+	// The current time, used to evaluate OLDER and YOUNGER search keys. If
+	// zero, time.Now is used.
+	Now time.Time
+}
+
+// needsSize checks whether c or one of its sub-criteria contains a LARGER or
+// SMALLER search key.
+func needsSize(c *imap.SearchCriteria) bool {
+	if c.Larger > 0 || c.Smaller > 0 {
+		return true
+	}
+	for _, not := range c.Not {
+		if needsSize(not) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if needsSize(or[0]) || needsSize(or[1]) {
+			return true
+		}
+	}
+	for _, fuzzy := range c.Fuzzy {
+		if needsSize(fuzzy) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectText appends the case-folded BODY and TEXT search strings of c and its
+// sub-criteria to needles.
+func collectText(needles []string, c *imap.SearchCriteria) []string {
+	for _, s := range c.Body {
+		needles = append(needles, foldString(s))
 	}
-	e.Body = b
-	return b, nil
+	for _, s := range c.Text {
+		needles = append(needles, foldString(s))
+	}
+	for _, not := range c.Not {
+		needles = collectText(needles, not)
+	}
+	for _, or := range c.Or {
+		needles = collectText(needles, or[0])
+		needles = collectText(needles, or[1])
+	}
+	for _, fuzzy := range c.Fuzzy {
+		needles = collectText(needles, fuzzy)
+	}
+	return needles
 }
 
-func matchBody(e *message.Entity, substr string) (bool, error) {
-	if s, ok := e.Body.(fmt.Stringer); ok {
-		return matchString(s.String(), substr), nil
+// matcher evaluates search criteria against a single message. The message
+// content is only read if needed, and at most once: the body is scanned for all
+// search strings of the criteria in a single pass.
+type matcher struct {
+	md *Metadata
+
+	open    func() (io.ReadCloser, error)
+	entity  *message.Entity
+	opened  bool
+	openErr error
+	closer  io.Closer
+
+	header textproto.Header
+	body   io.Reader
+	// True if the body's transfer encoding and charset have already been
+	// decoded
+	decoded bool
+	// Counts the bytes of the raw message, if available
+	raw *countReader
+	// The entity body bytes read so far, so that the entity isn't consumed
+	buffered *bytes.Buffer
+
+	// The top-level criteria, used to collect all search strings
+	criteria   *imap.SearchCriteria
+	found      map[string]bool
+	size       uint32
+	scanned    bool
+	scanErr    error
+	headerText *string
+}
+
+func (m *matcher) openMessage() error {
+	if m.opened {
+		return m.openErr
+	}
+	m.opened = true
+
+	if m.entity != nil {
+		m.buffered = new(bytes.Buffer)
+		m.header = m.entity.Header.Header
+		m.body = io.TeeReader(m.entity.Body, m.buffered)
+		m.decoded = true
+		return nil
 	}
 
-	b, err := bufferBody(e)
+	rc, err := m.open()
 	if err != nil {
-		return false, err
+		m.openErr = err
+		return err
+	}
+	m.closer = rc
+
+	m.raw = &countReader{r: rc}
+	br := bufio.NewReader(m.raw)
+	m.header, m.openErr = textproto.ReadHeader(br)
+	m.body = br
+	return m.openErr
+}
+
+func (m *matcher) close() error {
+	if m.closer != nil {
+		return m.closer.Close()
+	}
+	return nil
+}
+
+// restoreEntity puts back the entity body bytes read while matching, so that
+// the caller can still read the whole body.
+func (m *matcher) restoreEntity() {
+	if m.buffered != nil && m.buffered.Len() > 0 {
+		m.entity.Body = io.MultiReader(m.buffered, m.entity.Body)
 	}
-	return matchString(b.String(), substr), nil
 }
 
-type lengther interface {
-	Len() int
+// scan reads the message body, looking for search strings and computing the
+// message size if necessary.
+func (m *matcher) scan() error {
+	if m.scanned {
+		return m.scanErr
+	}
+	m.scanned = true
+
+	if m.scanErr = m.openMessage(); m.scanErr != nil {
+		return m.scanErr
+	}
+
+	body := &countReader{r: m.body}
+
+	needles := collectText(nil, m.criteria)
+	if len(needles) > 0 {
+		s := newTextScanner(needles)
+		err := writeText(s, m.header, body, m.decoded)
+		if err != nil && err != errScanDone {
+			m.scanErr = err
+			return err
+		}
+
+		m.found = make(map[string]bool, len(needles))
+		for i, needle := range needles {
+			m.found[needle] = s.found[i]
+		}
+	}
+
+	if m.md.Size > 0 {
+		m.size = m.md.Size
+	} else if needsSize(m.criteria) {
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			m.scanErr = err
+			return err
+		}
+
+		if m.raw != nil {
+			m.size = uint32(m.raw.n)
+		} else {
+			// The entity body is decoded, encode it again to get the size
+			// of the raw message
+			var w countWriter
+			textproto.WriteHeader(&w, m.header)
+			n, err := encodedLen(m.header, bytes.NewReader(m.buffered.Bytes()))
+			if err != nil {
+				m.scanErr = err
+				return err
+			}
+			m.size = uint32(int64(w.n) + n)
+		}
+	}
+
+	return nil
 }
 
-func bodyLen(e *message.Entity) (int, error) {
-	if l, ok := e.Body.(lengther); ok {
-		return l.Len(), nil
+// encodedLen returns the length of a decoded body once encoded with the
+// transfer encoding specified in header. Bodies in an unknown transfer encoding
+// haven't been decoded, so their length is returned as is.
+func encodedLen(header textproto.Header, body io.Reader) (int64, error) {
+	var h message.Header
+	if enc := header.Get("Content-Transfer-Encoding"); enc != "" {
+		h.Set("Content-Transfer-Encoding", enc)
 	}
 
-	b, err := bufferBody(e)
+	var cw countWriter
+	w, err := message.CreateWriter(&cw, h)
 	if err != nil {
+		return io.Copy(ioutil.Discard, body)
+	}
+	// Don't count the header written by CreateWriter
+	cw.n = 0
+
+	if _, err := io.Copy(w, body); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
 		return 0, err
 	}
-	return b.Len(), nil
+	return int64(cw.n), nil
 }
 
-// Match returns true if a message and its metadata matches the provided
-// criteria.
-func Match(e *message.Entity, seqNum, uid uint32, date time.Time, flags []string, c *imap.SearchCriteria) (bool, error) {
-	// TODO: support encoded header fields for Bcc, Cc, From, To
-	// TODO: add header size for Larger and Smaller
+// headerString returns the case-folded decoded message header.
+func (m *matcher) headerString() string {
+	if m.headerText != nil {
+		return *m.headerText
+	}
 
-	h := mail.Header{Header: e.Header}
+	var sb strings.Builder
+	writeHeaderText(&sb, m.header)
 
-	if !c.SentBefore.IsZero() || !c.SentSince.IsZero() {
-		t, err := h.Date()
-		if err != nil {
-			return false, err
+	s := foldString(sb.String())
+	m.headerText = &s
+	return s
+}
+
+func (m *matcher) matchHeader(key string, wantValues []string) bool {
+	ok := m.header.Has(key)
+	for _, wantValue := range wantValues {
+		if wantValue == "" {
+			if !ok {
+				return false
+			}
+			continue
+		}
+
+		found := false
+		for fields := m.header.FieldsByKey(key); fields.Next(); {
+			decoded := decodeHeaderValue(fields.Value())
+			if matchString(foldString(decoded), wantValue) {
+				found = true
+				break
+			}
 		}
-		t = t.Round(24 * time.Hour)
+		if !found {
+			return false
+		}
+	}
+	return true
+}
 
-		if !c.SentBefore.IsZero() && !t.Before(c.SentBefore) {
+func (m *matcher) match(c *imap.SearchCriteria) (bool, error) {
+	// Check metadata first, it doesn't require the message content
+	if c.SeqNum != nil || c.Uid != nil {
+		if !matchSeqNumAndUid(m.md.SeqNum, m.md.Uid, c) {
 			return false, nil
 		}
-		if !c.SentSince.IsZero() && !t.After(c.SentSince) {
+	}
+
+	if c.WithFlags != nil || c.WithoutFlags != nil {
+		if !matchFlags(m.md.Flags, m.md.Recent, c) {
 			return false, nil
 		}
 	}
 
-	for key, wantValues := range c.Header {
-		ok := e.Header.Has(key)
-		for _, wantValue := range wantValues {
-			if wantValue == "" && !ok {
-				return false, nil
-			}
-			if wantValue != "" {
-				ok := false
-				values := e.Header.FieldsByKey(key)
-				for values.Next() {
-					decoded, _ := values.Text()
-					if matchString(decoded, wantValue) {
-						ok = true
-						break
-					}
-				}
-				if !ok {
-					return false, nil
-				}
-			}
+	if !c.Since.IsZero() || !c.Before.IsZero() {
+		if !matchDate(m.md.Date.In(time.Local), c.Since, c.Before) {
+			return false, nil
 		}
 	}
-	for _, body := range c.Body {
-		if ok, err := matchBody(e, body); err != nil || !ok {
-			return false, err
+
+	if c.Older > 0 || c.Younger > 0 {
+		now := m.md.Now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		if !matchWithin(m.md.Date, now, c) {
+			return false, nil
 		}
 	}
-	for _, text := range c.Text {
-		// TODO: also match header fields
-		if ok, err := matchBody(e, text); err != nil || !ok {
+
+	if c.SaveDateSupported && m.md.SaveDate.IsZero() {
+		return false, nil
+	}
+
+	if !c.SavedSince.IsZero() || !c.SavedBefore.IsZero() {
+		saveDate := m.md.SaveDate
+		if saveDate.IsZero() {
+			saveDate = m.md.Date
+		}
+		if !matchDate(saveDate.In(time.Local), c.SavedSince, c.SavedBefore) {
+			return false, nil
+		}
+	}
+
+	for _, id := range c.EmailId {
+		if id != m.md.EmailId {
+			return false, nil
+		}
+	}
+	for _, id := range c.ThreadId {
+		if id != m.md.ThreadId {
+			return false, nil
+		}
+	}
+
+	if m.md.Size > 0 {
+		if c.Larger > 0 && m.md.Size <= c.Larger {
+			return false, nil
+		}
+		if c.Smaller > 0 && m.md.Size >= c.Smaller {
+			return false, nil
+		}
+	}
+
+	// Then check the header
+	if !c.SentBefore.IsZero() || !c.SentSince.IsZero() || len(c.Header) > 0 || len(c.Text) > 0 {
+		if err := m.openMessage(); err != nil {
 			return false, err
 		}
 	}
 
-	if c.Larger > 0 || c.Smaller > 0 {
-		n, err := bodyLen(e)
+	if !c.SentBefore.IsZero() || !c.SentSince.IsZero() {
+		h := mail.Header{Header: message.Header{Header: m.header}}
+		t, err := h.Date()
 		if err != nil {
-			return false, err
+			return false, nil
 		}
 
-		if c.Larger > 0 && uint32(n) < c.Larger {
+		// The date is compared as written in the Date header field, in its
+		// own timezone
+		if !matchDate(t, c.SentSince, c.SentBefore) {
 			return false, nil
 		}
-		if c.Smaller > 0 && uint32(n) > c.Smaller {
+	}
+
+	for key, wantValues := range c.Header {
+		if !m.matchHeader(key, wantValues) {
 			return false, nil
 		}
 	}
 
-	if !c.Since.IsZero() || !c.Before.IsZero() {
-		if !matchDate(date, c) {
+	// Finally check the body
+	if m.md.Size == 0 && (c.Larger > 0 || c.Smaller > 0) {
+		if err := m.scan(); err != nil {
+			return false, err
+		}
+
+		if c.Larger > 0 && m.size <= c.Larger {
+			return false, nil
+		}
+		if c.Smaller > 0 && m.size >= c.Smaller {
 			return false, nil
 		}
 	}
 
-	if c.WithFlags != nil || c.WithoutFlags != nil {
-		if !matchFlags(flags, c) {
+	for _, body := range c.Body {
+		if err := m.scan(); err != nil {
+			return false, err
+		}
+		if !m.found[foldString(body)] {
 			return false, nil
 		}
 	}
+	for _, text := range c.Text {
+		if matchString(m.headerString(), text) {
+			continue
+		}
 
-	if c.SeqNum != nil || c.Uid != nil {
-		if !matchSeqNumAndUid(seqNum, uid, c) {
+		if err := m.scan(); err != nil {
+			return false, err
+		}
+		if !m.found[foldString(text)] {
 			return false, nil
 		}
 	}
 
 	for _, not := range c.Not {
-		ok, err := Match(e, seqNum, uid, date, flags, not)
+		ok, err := m.match(not)
 		if err != nil || ok {
 			return false, err
 		}
 	}
 	for _, or := range c.Or {
-		ok1, err := Match(e, seqNum, uid, date, flags, or[0])
+		ok1, err := m.match(or[0])
 		if err != nil {
 			return ok1, err
 		}
+		if ok1 {
+			continue
+		}
+
+		ok2, err := m.match(or[1])
+		if err != nil || !ok2 {
+			return false, err
+		}
+	}
 
-		ok2, err := Match(e, seqNum, uid, date, flags, or[1])
-		if err != nil || (!ok1 && !ok2) {
+	// Any algorithm can be used for fuzzy matching, exact matches are good
+	// enough
+	for _, fuzzy := range c.Fuzzy {
+		ok, err := m.match(fuzzy)
+		if err != nil || !ok {
 			return false, err
 		}
 	}
@@ -163,19 +545,69 @@ func Match(e *message.Entity, seqNum, uid uint32, date time.Time, flags []string
 	return true, nil
 }
 
-func matchFlags(flags []string, c *imap.SearchCriteria) bool {
+// Match returns true if a message and its metadata matches the provided
+// criteria.
+//
+// Internal dates are compared with a granularity of one day in the server's
+// local timezone, as defined by time.Local. Header fields are decoded as
+// defined in RFC 2047 before being compared. BODY and TEXT search keys only
+// look at decoded text parts and embedded messages. String comparisons are
+// case-insensitive. FUZZY search keys (RFC 6203) are evaluated like exact ones.
+//
+// The size of the message is computed by encoding the entity body again, which
+// can differ from the original message, e.g. if its charset was converted.
+// MatchReader or the Size field of Metadata should be used to get exact sizes.
+//
+// The message body is left unread: the bytes read to evaluate the criteria are
+// kept in memory, and the entity body is replaced to include them.
+func Match(e *message.Entity, seqNum, uid uint32, date time.Time, flags []string, c *imap.SearchCriteria) (bool, error) {
+	md := &Metadata{
+		SeqNum: seqNum,
+		Uid:    uid,
+		Date:   date,
+		Flags:  flags,
+	}
+	return MatchMetadata(e, md, c)
+}
+
+// MatchMetadata is like Match, but also supports search criteria that need
+// extended message metadata.
+func MatchMetadata(e *message.Entity, md *Metadata, c *imap.SearchCriteria) (bool, error) {
+	m := &matcher{md: md, entity: e, criteria: c}
+	ok, err := m.match(c)
+	m.restoreEntity()
+	return ok, err
+}
+
+// MatchReader is like MatchMetadata, but takes a function opening the raw
+// message instead of a parsed entity. open is called at most once, and only if
+// the criteria can't be evaluated with the metadata alone. The message is read
+// incrementally, so that memory usage doesn't depend on the message size.
+func MatchReader(open func() (io.ReadCloser, error), md *Metadata, c *imap.SearchCriteria) (bool, error) {
+	m := &matcher{md: md, open: open, criteria: c}
+	ok, err := m.match(c)
+	if closeErr := m.close(); err == nil {
+		err = closeErr
+	}
+	return ok, err
+}
+
+func matchFlags(flags []string, recent bool, c *imap.SearchCriteria) bool {
 	flagsMap := make(map[string]bool)
 	for _, f := range flags {
-		flagsMap[f] = true
+		flagsMap[imap.CanonicalFlag(f)] = true
+	}
+	if recent {
+		flagsMap[imap.RecentFlag] = true
 	}
 
 	for _, f := range c.WithFlags {
-		if !flagsMap[f] {
+		if !flagsMap[imap.CanonicalFlag(f)] {
 			return false
 		}
 	}
 	for _, f := range c.WithoutFlags {
-		if flagsMap[f] {
+		if flagsMap[imap.CanonicalFlag(f)] {
 			return false
 		}
 	}
@@ -193,12 +625,32 @@ func matchSeqNumAndUid(seqNum uint32, uid uint32, c *imap.SearchCriteria) bool {
 	return true
 }
 
-func matchDate(date time.Time, c *imap.SearchCriteria) bool {
-	date = date.Round(24 * time.Hour)
-	if !c.Since.IsZero() && !date.After(c.Since) {
+// dateOnly returns the date of t, disregarding time and timezone.
+func dateOnly(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// matchDate checks that date is within or later than since, and earlier than
+// before, with a granularity of one day. Dates are compared in the timezone of
+// date, so the caller must convert it to the appropriate timezone first.
+func matchDate(date, since, before time.Time) bool {
+	date = dateOnly(date)
+	if !since.IsZero() && date.Before(dateOnly(since)) {
+		return false
+	}
+	if !before.IsZero() && !date.Before(dateOnly(before)) {
+		return false
+	}
+	return true
+}
+
+func matchWithin(date, now time.Time, c *imap.SearchCriteria) bool {
+	age := now.Sub(date)
+	if c.Older > 0 && age <= c.Older {
 		return false
 	}
-	if !c.Before.IsZero() && !date.Before(c.Before) {
+	if c.Younger > 0 && age > c.Younger {
 		return false
 	}
 	return true
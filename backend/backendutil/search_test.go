@@ -1,6 +1,9 @@
 package backendutil
 
 import (
+	"bufio"
+	"io"
+	"io/ioutil"
 	"net/textproto"
 	"strings"
 	"testing"
@@ -12,6 +15,10 @@ import (
 
 var testInternalDate = time.Unix(1483997966, 0)
 
+var testLateInternalDate = time.Date(2017, time.January, 9, 23, 30, 0, 0, time.Local)
+var testDay = time.Date(2017, time.January, 9, 0, 0, 0, 0, time.UTC)
+var testSentDay = time.Date(2016, time.June, 18, 0, 0, 0, 0, time.UTC)
+
 var matchTests = []struct {
 	criteria *imap.SearchCriteria
 	seqNum   uint32
@@ -290,6 +297,46 @@ var matchTests = []struct {
 		},
 		res: true,
 	},
+	{
+		date:     testLateInternalDate,
+		criteria: &imap.SearchCriteria{Since: testDay},
+		res:      true,
+	},
+	{
+		date:     testLateInternalDate,
+		criteria: &imap.SearchCriteria{Before: testDay},
+		res:      false,
+	},
+	{
+		date:     testLateInternalDate,
+		criteria: &imap.SearchCriteria{Since: testDay, Before: testDay.Add(24 * time.Hour)},
+		res:      true,
+	},
+	{
+		date:     testLateInternalDate,
+		criteria: &imap.SearchCriteria{Since: testDay.Add(24 * time.Hour)},
+		res:      false,
+	},
+	{
+		criteria: &imap.SearchCriteria{SentSince: testSentDay, SentBefore: testSentDay.Add(24 * time.Hour)},
+		res:      true,
+	},
+	{
+		criteria: &imap.SearchCriteria{SentBefore: testSentDay},
+		res:      false,
+	},
+	{
+		criteria: &imap.SearchCriteria{
+			Fuzzy: []*imap.SearchCriteria{{Body: []string{"your name"}}},
+		},
+		res: true,
+	},
+	{
+		criteria: &imap.SearchCriteria{
+			Fuzzy: []*imap.SearchCriteria{{Body: []string{"goodbye"}}},
+		},
+		res: false,
+	},
 }
 
 func TestMatch(t *testing.T) {
@@ -360,3 +407,495 @@ d-encoding.`
 		t.Error("Expected match for encoded body")
 	}
 }
+
+var matchMetadataTests = []struct {
+	criteria *imap.SearchCriteria
+	md       *Metadata
+	res      bool
+}{
+	{
+		md:       &Metadata{Date: testInternalDate, SaveDate: testInternalDate.Add(72 * time.Hour)},
+		criteria: &imap.SearchCriteria{SavedSince: testInternalDate.Add(48 * time.Hour)},
+		res:      true,
+	},
+	{
+		md:       &Metadata{Date: testInternalDate},
+		criteria: &imap.SearchCriteria{SavedSince: testInternalDate.Add(48 * time.Hour)},
+		res:      false,
+	},
+	{
+		md:       &Metadata{Date: testInternalDate, SaveDate: testInternalDate.Add(72 * time.Hour)},
+		criteria: &imap.SearchCriteria{SavedBefore: testInternalDate.Add(48 * time.Hour)},
+		res:      false,
+	},
+	{
+		md:       &Metadata{Date: testInternalDate, SaveDate: testInternalDate},
+		criteria: &imap.SearchCriteria{SaveDateSupported: true},
+		res:      true,
+	},
+	{
+		md:       &Metadata{Date: testInternalDate},
+		criteria: &imap.SearchCriteria{SaveDateSupported: true},
+		res:      false,
+	},
+	{
+		md:       &Metadata{Date: testInternalDate, Now: testInternalDate.Add(2 * time.Hour)},
+		criteria: &imap.SearchCriteria{Older: time.Hour},
+		res:      true,
+	},
+	{
+		md:       &Metadata{Date: testInternalDate, Now: testInternalDate.Add(2 * time.Hour)},
+		criteria: &imap.SearchCriteria{Younger: time.Hour},
+		res:      false,
+	},
+	{
+		md:       &Metadata{Date: testInternalDate, Now: testInternalDate.Add(2 * time.Hour)},
+		criteria: &imap.SearchCriteria{Older: time.Hour, Younger: 3 * time.Hour},
+		res:      true,
+	},
+	{
+		md:       &Metadata{Size: 4242},
+		criteria: &imap.SearchCriteria{Larger: 4000, Smaller: 4300},
+		res:      true,
+	},
+	{
+		md:       &Metadata{Flags: []string{imap.SeenFlag}, Recent: true},
+		criteria: &imap.SearchCriteria{WithFlags: []string{imap.RecentFlag}},
+		res:      true,
+	},
+	{
+		md:       &Metadata{EmailId: "M6d99ac3275bb4e", ThreadId: "T64b478a75b7ea9"},
+		criteria: &imap.SearchCriteria{EmailId: []string{"M6d99ac3275bb4e"}, ThreadId: []string{"T64b478a75b7ea9"}},
+		res:      true,
+	},
+	{
+		md:       &Metadata{EmailId: "M6d99ac3275bb4e"},
+		criteria: &imap.SearchCriteria{ThreadId: []string{"T64b478a75b7ea9"}},
+		res:      false,
+	},
+	{
+		md:       &Metadata{EmailId: "M6d99ac3275bb4e"},
+		criteria: &imap.SearchCriteria{EmailId: []string{"M6d99ac3275bb4e", "Mf2b0a1e3c4d5e6"}},
+		res:      false,
+	},
+	{
+		md: &Metadata{EmailId: "M6d99ac3275bb4e"},
+		criteria: &imap.SearchCriteria{
+			Not: []*imap.SearchCriteria{{EmailId: []string{"M6d99ac3275bb4e"}}},
+		},
+		res: false,
+	},
+}
+
+func TestMatchMetadata(t *testing.T) {
+	for i, test := range matchMetadataTests {
+		e, err := message.Read(strings.NewReader(testMailString))
+		if err != nil {
+			t.Fatal("Expected no error while reading entity, got:", err)
+		}
+
+		ok, err := MatchMetadata(e, test.md, test.criteria)
+		if err != nil {
+			t.Fatal("Expected no error while matching entity, got:", err)
+		}
+
+		if test.res && !ok {
+			t.Errorf("Expected #%v to match search criteria", i+1)
+		}
+		if !test.res && ok {
+			t.Errorf("Expected #%v not to match search criteria", i+1)
+		}
+	}
+}
+
+const testConformanceMailString = "Date: Wed, 17 Jul 1996 02:23:25 -0700\r\n" +
+	"From: =?utf-8?q?J=C3=B6rg?= <joerg@example.org>\r\n" +
+	"To: Taki Tachibana <taki.tachibana@example.org>\r\n" +
+	"Cc: Mitsuha Miyamizu <mitsuha.miyamizu@example.org>\r\n" +
+	"Bcc: =?utf-8?b?5LiJ6JGJ?= <mitsuha.miyamizu@example.org>\r\n" +
+	"Subject: =?utf-8?q?R=C3=A9union?= de famille\r\n" +
+	"Message-Id: <conformance@example.org>\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Le d=C3=AEner est pr=C3=AAt.\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PHA+QnJpbmcgPGI+Y3JvaXNzYW50czwvYj4gJmFtcDsgamFtPC9wPg==\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"c2VjcmV0YmluYXJ5\r\n" +
+	"--b\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"From: grandma@example.org\r\n" +
+	"Subject: Forwarded\r\n" +
+	"\r\n" +
+	"Recipe inside.\r\n" +
+	"--b--\r\n"
+
+var testConformanceMetadata = &Metadata{
+	SeqNum: 7,
+	Uid:    42,
+	Date:   time.Date(1996, time.July, 20, 12, 0, 0, 0, time.Local),
+	Flags:  []string{imap.SeenFlag, imap.AnsweredFlag, "$Important"},
+	Recent: true,
+}
+
+// matchConformanceTests covers every search key defined in RFC 3501 section
+// 6.4.4.
+var matchConformanceTests = []struct {
+	query string
+	res   bool
+}{
+	{"ALL", true},
+	{"ANSWERED", true},
+	{"UNANSWERED", false},
+	{"DELETED", false},
+	{"UNDELETED", true},
+	{"DRAFT", false},
+	{"UNDRAFT", true},
+	{"FLAGGED", false},
+	{"UNFLAGGED", true},
+	{"SEEN", true},
+	{"UNSEEN", false},
+	{"RECENT", true},
+	{"NEW", false},
+	{"OLD", false},
+	{"KEYWORD $Important", true},
+	{"KEYWORD $important", true},
+	{"KEYWORD $Junk", false},
+	{"UNKEYWORD $Important", false},
+	{"UNKEYWORD $Junk", true},
+	{`FROM "jörg"`, true},
+	{`FROM "JÖRG"`, true},
+	{"FROM joerg@example.org", true},
+	{"FROM taki", false},
+	{"TO taki", true},
+	{"TO mitsuha", false},
+	{"CC miyamizu", true},
+	{`BCC "三葉"`, true},
+	{`BCC "=?utf-8?"`, false},
+	{`SUBJECT "réunion de"`, true},
+	{"SUBJECT forwarded", false},
+	{`HEADER Message-Id "conformance@"`, true},
+	{`HEADER Message-Id ""`, true},
+	{`HEADER X-Mailer ""`, false},
+	{`BODY "dîner est prêt"`, true},
+	{`BODY "DÎNER"`, true},
+	{`BODY "& jam"`, true},
+	{`BODY "<b>"`, false},
+	{`BODY "=C3"`, false},
+	{"BODY secretbinary", false},
+	{"BODY recipe", true},
+	{"BODY réunion", false},
+	{"TEXT réunion", true},
+	{"TEXT croissants", true},
+	{"TEXT grandma", true},
+	{"TEXT secretbinary", false},
+	{`BEFORE "20-Jul-1996"`, false},
+	{`BEFORE "21-Jul-1996"`, true},
+	{`ON "20-Jul-1996"`, true},
+	{`ON "19-Jul-1996"`, false},
+	{`SINCE "20-Jul-1996"`, true},
+	{`SINCE "21-Jul-1996"`, false},
+	{`SENTBEFORE "17-Jul-1996"`, false},
+	{`SENTBEFORE "18-Jul-1996"`, true},
+	{`SENTON "17-Jul-1996"`, true},
+	{`SENTSINCE "17-Jul-1996"`, true},
+	{`SENTSINCE "18-Jul-1996"`, false},
+	{"LARGER 100", true},
+	{"LARGER 100000", false},
+	{"SMALLER 100000", true},
+	{"SMALLER 100", false},
+	{"UID 42", true},
+	{"UID 1:41,43", false},
+	{"5:10", true},
+	{"1:6,8", false},
+	{"NOT SEEN", false},
+	{"NOT DELETED", true},
+	{"OR DELETED SEEN", true},
+	{"OR DELETED DRAFT", false},
+	{"OR (DELETED DRAFT) (SEEN RECENT)", true},
+	{`SEEN FROM "jörg" NOT DELETED BODY croissants`, true},
+}
+
+func TestMatchConformance(t *testing.T) {
+	for _, test := range matchConformanceTests {
+		r := imap.NewReader(bufio.NewReader(strings.NewReader("(" + test.query + ")\r\n")))
+		fields, err := r.ReadFields()
+		if err != nil {
+			t.Fatalf("Cannot read search criteria %q: %v", test.query, err)
+		}
+
+		c := new(imap.SearchCriteria)
+		if err := c.ParseWithCharset(fields[0].([]interface{}), nil); err != nil {
+			t.Fatalf("Cannot parse search criteria %q: %v", test.query, err)
+		}
+
+		e, err := message.Read(strings.NewReader(testConformanceMailString))
+		if err != nil {
+			t.Fatal("Expected no error while reading entity, got:", err)
+		}
+
+		md := *testConformanceMetadata
+		ok, err := MatchMetadata(e, &md, c)
+		if err != nil {
+			t.Fatalf("Expected no error while matching %q, got: %v", test.query, err)
+		}
+
+		if ok != test.res {
+			t.Errorf("Expected %q to return %v, got %v", test.query, test.res, ok)
+		}
+	}
+}
+
+type testOpener struct {
+	s      string
+	opened int
+	closed int
+}
+
+func (o *testOpener) open() (io.ReadCloser, error) {
+	o.opened++
+	return &testReadCloser{strings.NewReader(o.s), o}, nil
+}
+
+type testReadCloser struct {
+	io.Reader
+	o *testOpener
+}
+
+func (rc *testReadCloser) Close() error {
+	rc.o.closed++
+	return nil
+}
+
+var matchReaderTests = []struct {
+	criteria *imap.SearchCriteria
+	md       *Metadata
+	res      bool
+	opened   bool
+}{
+	{
+		md:       &Metadata{Uid: 42},
+		criteria: &imap.SearchCriteria{Uid: &imap.SeqSet{Set: []imap.Seq{{Start: 1, Stop: 10}}}},
+		res:      false,
+		opened:   false,
+	},
+	{
+		md:       &Metadata{Flags: []string{imap.SeenFlag}},
+		criteria: &imap.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}, Body: []string{"name"}},
+		res:      false,
+		opened:   false,
+	},
+	{
+		md:       &Metadata{Size: 4242},
+		criteria: &imap.SearchCriteria{Larger: 100},
+		res:      true,
+		opened:   false,
+	},
+	{
+		md:       &Metadata{},
+		criteria: &imap.SearchCriteria{Larger: uint32(len(testMailString) - 1)},
+		res:      true,
+		opened:   true,
+	},
+	{
+		md:       &Metadata{},
+		criteria: &imap.SearchCriteria{Smaller: uint32(len(testMailString))},
+		res:      false,
+		opened:   true,
+	},
+	{
+		md: &Metadata{},
+		criteria: &imap.SearchCriteria{
+			Body: []string{"your NAME"},
+			Not:  []*imap.SearchCriteria{{Text: []string{"taki"}}},
+		},
+		res:    false,
+		opened: true,
+	},
+	{
+		md: &Metadata{},
+		criteria: &imap.SearchCriteria{
+			Header: textproto.MIMEHeader{"Subject": {"your name"}},
+			Body:   []string{"mitsuha"},
+		},
+		res:    true,
+		opened: true,
+	},
+}
+
+func TestMatchReader(t *testing.T) {
+	for i, test := range matchReaderTests {
+		o := &testOpener{s: testMailString}
+		ok, err := MatchReader(o.open, test.md, test.criteria)
+		if err != nil {
+			t.Fatal("Expected no error while matching message, got:", err)
+		}
+
+		if ok != test.res {
+			t.Errorf("Expected #%v to return %v, got %v", i+1, test.res, ok)
+		}
+		if test.opened && o.opened != 1 {
+			t.Errorf("Expected #%v to open the message once, got %v", i+1, o.opened)
+		} else if !test.opened && o.opened != 0 {
+			t.Errorf("Expected #%v not to open the message", i+1)
+		}
+		if o.closed != o.opened {
+			t.Errorf("Expected #%v to close the message", i+1)
+		}
+	}
+}
+
+func TestMatchReader_largeBody(t *testing.T) {
+	// Put search strings across the boundaries of the 32KiB buffers used to
+	// read the body
+	var sb strings.Builder
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for i := 0; i < 8; i++ {
+		sb.WriteString(strings.Repeat("a", 32*1024-4))
+		if i%2 == 0 {
+			sb.WriteString("needle")
+		} else {
+			sb.WriteString("xxxé")
+		}
+	}
+	s := sb.String()
+
+	tests := []struct {
+		body string
+		res  bool
+	}{
+		{"NEEDLE", true},
+		{"aaaneedleaaa", true},
+		{"xxxÉ", true},
+		{"needleneedle", false},
+	}
+
+	for _, test := range tests {
+		o := &testOpener{s: s}
+		c := &imap.SearchCriteria{Body: []string{test.body}}
+		ok, err := MatchReader(o.open, &Metadata{}, c)
+		if err != nil {
+			t.Fatal("Expected no error while matching message, got:", err)
+		}
+		if ok != test.res {
+			t.Errorf("Expected BODY %q to return %v, got %v", test.body, test.res, ok)
+		}
+	}
+}
+
+func TestMatch_encodedSize(t *testing.T) {
+	messages := []string{
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"SGksIHRoaXMgbWVzc2FnZSBpcyBlbmNvZGVkIGluIGJhc2U2NC4=",
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"R=C3=A9union de famille =3D =C3=A0 la maison",
+	}
+
+	for _, s := range messages {
+		n := uint32(len(s))
+		tests := []struct {
+			criteria *imap.SearchCriteria
+			res      bool
+		}{
+			{&imap.SearchCriteria{Larger: n - 1}, true},
+			{&imap.SearchCriteria{Larger: n}, false},
+			{&imap.SearchCriteria{Smaller: n + 1}, true},
+			{&imap.SearchCriteria{Smaller: n}, false},
+		}
+
+		for _, test := range tests {
+			e, err := message.Read(strings.NewReader(s))
+			if err != nil {
+				t.Fatal("Expected no error while reading entity, got:", err)
+			}
+			ok, err := Match(e, 0, 0, time.Now(), nil, test.criteria)
+			if err != nil {
+				t.Fatal("Expected no error while matching entity, got:", err)
+			}
+			if ok != test.res {
+				t.Errorf("Expected LARGER %v SMALLER %v on a %v bytes message to return %v, got %v", test.criteria.Larger, test.criteria.Smaller, n, test.res, ok)
+			}
+
+			o := &testOpener{s: s}
+			ok, err = MatchReader(o.open, &Metadata{}, test.criteria)
+			if err != nil {
+				t.Fatal("Expected no error while matching message, got:", err)
+			}
+			if ok != test.res {
+				t.Errorf("Expected MatchReader to return %v like Match, got %v", test.res, ok)
+			}
+		}
+	}
+}
+
+func TestMatch_entityBody(t *testing.T) {
+	e, err := message.Read(strings.NewReader(testMailString))
+	if err != nil {
+		t.Fatal("Expected no error while reading entity, got:", err)
+	}
+
+	c := &imap.SearchCriteria{Body: []string{"name"}, Larger: 1}
+	if ok, err := Match(e, 0, 0, time.Now(), nil, c); err != nil {
+		t.Fatal("Expected no error while matching entity, got:", err)
+	} else if !ok {
+		t.Error("Expected entity to match")
+	}
+
+	b, err := ioutil.ReadAll(e.Body)
+	if err != nil {
+		t.Fatal("Expected no error while reading entity body, got:", err)
+	}
+	if string(b) != testBodyString {
+		t.Errorf("Expected entity body to be left unread, got:\n%v", string(b))
+	}
+}
+
+func TestMatch_acrossParts(t *testing.T) {
+	const msg = "Content-Type: multipart/alternative; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"foo\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"bar\r\n" +
+		"--b--\r\n"
+
+	for _, test := range []struct {
+		body string
+		res  bool
+	}{
+		{"foo", true},
+		{"bar", true},
+		{"foobar", false},
+	} {
+		e, err := message.Read(strings.NewReader(msg))
+		if err != nil {
+			t.Fatal("Expected no error while reading entity, got:", err)
+		}
+
+		c := &imap.SearchCriteria{Body: []string{test.body}}
+		if ok, err := Match(e, 0, 0, time.Now(), nil, c); err != nil {
+			t.Fatal("Expected no error while matching entity, got:", err)
+		} else if ok != test.res {
+			t.Errorf("Expected BODY %q to return %v, got %v", test.body, test.res, ok)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package backendutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+)
+
+var headerWordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		if imap.CharsetReader != nil {
+			return imap.CharsetReader(charset, input)
+		}
+		return nil, fmt.Errorf("backendutil: unhandled charset %q", charset)
+	},
+}
+
+// decodeHeaderValue decodes RFC 2047 encoded words in a header field value. If
+// the value cannot be decoded, it is returned as-is.
+func decodeHeaderValue(s string) string {
+	dec, err := headerWordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return dec
+}
+
+// decodeText returns a reader that decodes a text part's content transfer
+// encoding and converts its charset to UTF-8.
+func decodeText(header textproto.Header, body io.Reader) (io.Reader, error) {
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	_, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	charset := strings.ToLower(params["charset"])
+	if charset == "" || charset == "utf-8" || charset == "us-ascii" {
+		return body, nil
+	}
+
+	if imap.CharsetReader == nil {
+		return nil, fmt.Errorf("backendutil: unhandled charset %q", charset)
+	}
+	return imap.CharsetReader(charset, body)
+}
+
+const (
+	htmlStateText = iota
+	htmlStateTag
+	htmlStateComment
+	htmlStateSkip
+)
+
+// maxHTMLTagLen is the maximum number of bytes of a tag kept in memory. The
+// rest of the tag is discarded.
+const maxHTMLTagLen = 256
+
+// maxHTMLEntityLen is the maximum length of a character reference which can be
+// split across two writes.
+const maxHTMLEntityLen = 32
+
+// htmlTextWriter removes tags, comments, scripts and style sheets from an HTML
+// document and unescapes entities. It uses a bounded amount of memory
+// regardless of the size of the document.
+type htmlTextWriter struct {
+	w     io.Writer
+	state int
+	text  []byte
+	tag   []byte
+	// The closing tag looked for in htmlStateSkip, e.g. "</script"
+	skip string
+}
+
+func newHTMLTextWriter(w io.Writer) *htmlTextWriter {
+	return &htmlTextWriter{w: w}
+}
+
+// flush writes pending text. If partial is set to true, a trailing incomplete
+// character reference is kept for the next write.
+func (hw *htmlTextWriter) flush(partial bool) error {
+	n := len(hw.text)
+	if partial {
+		if i := bytes.LastIndexByte(hw.text, '&'); i >= 0 && n-i < maxHTMLEntityLen && bytes.IndexByte(hw.text[i:], ';') < 0 {
+			n = i
+		}
+	}
+
+	if n > 0 {
+		if _, err := io.WriteString(hw.w, html.UnescapeString(string(hw.text[:n]))); err != nil {
+			return err
+		}
+	}
+	hw.text = append(hw.text[:0], hw.text[n:]...)
+	return nil
+}
+
+func (hw *htmlTextWriter) endTag() {
+	// Tags are replaced with a space so that words in different blocks
+	// don't get concatenated
+	hw.text = append(hw.text, ' ')
+	hw.state = htmlStateText
+
+	tag := strings.ToLower(string(hw.tag))
+	for _, name := range []string{"script", "style", "head"} {
+		if tag == name || strings.HasPrefix(tag, name+" ") {
+			hw.state = htmlStateSkip
+			hw.skip = "</" + name
+			break
+		}
+	}
+	hw.tag = hw.tag[:0]
+}
+
+func (hw *htmlTextWriter) Write(b []byte) (int, error) {
+	for _, c := range b {
+		switch hw.state {
+		case htmlStateText:
+			if c != '<' {
+				hw.text = append(hw.text, c)
+				continue
+			}
+			if err := hw.flush(false); err != nil {
+				return 0, err
+			}
+			hw.state = htmlStateTag
+		case htmlStateTag:
+			if c == '>' {
+				hw.endTag()
+				continue
+			}
+			if len(hw.tag) < maxHTMLTagLen {
+				hw.tag = append(hw.tag, c)
+			}
+			if string(hw.tag) == "!--" {
+				hw.state = htmlStateComment
+				hw.tag = hw.tag[:0]
+			}
+		case htmlStateComment:
+			if c == '>' && string(hw.tag) == "--" {
+				hw.state = htmlStateText
+				hw.tag = hw.tag[:0]
+				continue
+			}
+			hw.tag = append(hw.tag, c)
+			if len(hw.tag) > 2 {
+				hw.tag = append(hw.tag[:0], hw.tag[1:]...)
+			}
+		case htmlStateSkip:
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			hw.tag = append(hw.tag, c)
+			if len(hw.tag) > len(hw.skip) {
+				hw.tag = append(hw.tag[:0], hw.tag[1:]...)
+			}
+			if string(hw.tag) == hw.skip {
+				// Parse the closing tag as a regular tag
+				hw.state = htmlStateTag
+				hw.tag = append(hw.tag[:0], hw.skip[1:]...)
+			}
+		}
+	}
+
+	if len(hw.text) >= 4096 {
+		if err := hw.flush(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Close flushes pending text. It doesn't close the underlying writer.
+func (hw *htmlTextWriter) Close() error {
+	return hw.flush(false)
+}
+
+// stripHTML removes tags, comments, scripts and style sheets from an HTML
+// document and unescapes entities.
+func stripHTML(b []byte) string {
+	var sb strings.Builder
+	hw := newHTMLTextWriter(&sb)
+	hw.Write(b)
+	hw.Close()
+	return sb.String()
+}
+
+// writeHeaderText writes the decoded header fields to w.
+func writeHeaderText(w io.Writer, header textproto.Header) error {
+	for fields := header.Fields(); fields.Next(); {
+		line := fields.Key() + ": " + decodeHeaderValue(fields.Value()) + "\n"
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// textPartSeparator is written between the parts of a multipart body, so that
+// search strings can't match across parts. Search strings can't contain NUL
+// characters.
+const textPartSeparator = "\x00"
+
+// writeText writes the decoded text of a message body to w. Text parts are
+// decoded and stripped from HTML markup, embedded messages are written with
+// their header and other parts are skipped. If decoded is set to true, body's
+// transfer encoding and charset have already been decoded.
+func writeText(w io.Writer, header textproto.Header, body io.Reader, decoded bool) error {
+	if mr := multipartReader(header, body); mr != nil {
+		for i := 0; ; i++ {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if i > 0 {
+				if _, err := io.WriteString(w, textPartSeparator); err != nil {
+					return err
+				}
+			}
+			if err := writeText(w, p.Header, p, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 section 5.2: default to text/plain
+		mediaType = "text/plain"
+	}
+	if !strings.HasPrefix(mediaType, "text/") && mediaType != "message/rfc822" {
+		return nil
+	}
+
+	if !decoded {
+		if body, err = decodeText(header, body); err != nil {
+			// Parts in an unknown charset can't be searched, skip them
+			return nil
+		}
+	}
+
+	switch mediaType {
+	case "text/html":
+		hw := newHTMLTextWriter(w)
+		if _, err := io.Copy(hw, body); err != nil {
+			return err
+		}
+		return hw.Close()
+	case "message/rfc822":
+		br := bufio.NewReader(body)
+		h, err := textproto.ReadHeader(br)
+		if err != nil {
+			return err
+		}
+		if err := writeHeaderText(w, h); err != nil {
+			return err
+		}
+		return writeText(w, h, br, false)
+	default:
+		_, err := io.Copy(w, body)
+		return err
+	}
+}
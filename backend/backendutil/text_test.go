@@ -0,0 +1,55 @@
+package backendutil
+
+import (
+	"strings"
+	"testing"
+)
+
+var htmlTextTests = []struct {
+	html string
+	text string
+}{
+	{
+		html: "<p>Hello <b>world</b></p>",
+		text: " Hello  world  ",
+	},
+	{
+		html: "<!-- <p>hidden</p> -->Caf&eacute; &amp; cr&#xE8;me",
+		text: "Café & crème",
+	},
+	{
+		html: "<HEAD><title>Title</title></HEAD><body>Body</body>",
+		text: "   Body ",
+	},
+	{
+		html: "a<script type=\"text/javascript\">if (a < b) {}</script>b<STYLE>p {}</style>c",
+		text: "a  b  c",
+	},
+	{
+		html: "unterminated <p",
+		text: "unterminated ",
+	},
+}
+
+func TestHTMLTextWriter(t *testing.T) {
+	for _, test := range htmlTextTests {
+		if got := stripHTML([]byte(test.html)); got != test.text {
+			t.Errorf("stripHTML(%q) = %q, want %q", test.html, got, test.text)
+		}
+
+		// Write byte by byte to check that state is kept across writes
+		var sb strings.Builder
+		hw := newHTMLTextWriter(&sb)
+		for i := 0; i < len(test.html); i++ {
+			if _, err := hw.Write([]byte{test.html[i]}); err != nil {
+				t.Fatal("Expected no error while writing HTML, got:", err)
+			}
+		}
+		if err := hw.Close(); err != nil {
+			t.Fatal("Expected no error while closing writer, got:", err)
+		}
+		if got := sb.String(); got != test.text {
+			t.Errorf("htmlTextWriter(%q) = %q, want %q", test.html, got, test.text)
+		}
+	}
+}
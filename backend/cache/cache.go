@@ -0,0 +1,94 @@
+// Package cache implements a backend wrapper caching immutable message data.
+//
+// The envelope, body structure, size and header of a message never change as
+// long as its UID is valid. They are cached in memory, keyed by mailbox,
+// UIDVALIDITY and UID, so that FETCH commands requesting them don't need to
+// parse messages again. The least recently used entries are evicted once the
+// cache is full.
+//
+// Cached entries of a mailbox are removed when its UIDVALIDITY changes, and
+// entries of expunged messages are removed when they are expunged through the
+// wrapper. The UIDVALIDITY is checked when the status of the mailbox is
+// requested, for instance when it's selected, and after expunge updates.
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+var errNoCertificates = errors.New("cache: wrapped backend doesn't support certificates")
+
+// Backend is a backend wrapper caching message data.
+type Backend struct {
+	backend.Backend
+
+	cache *lru
+
+	updatesOnce sync.Once
+	updates     chan backend.Update
+}
+
+// New wraps a backend. At most maxEntries messages are cached.
+func New(be backend.Backend, maxEntries int) *Backend {
+	return &Backend{Backend: be, cache: newLRU(maxEntries)}
+}
+
+func (be *Backend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	return be.LoginContext(context.Background(), connInfo, username, password)
+}
+
+// LoginCertificate implements backend.CertificateBackend. It fails if the
+// wrapped backend doesn't support certificates.
+func (be *Backend) LoginCertificate(connInfo *imap.ConnInfo, identity string) (backend.User, error) {
+	return be.LoginCertificateContext(context.Background(), connInfo, identity)
+}
+
+// Capabilities implements backend.ExtendedBackend. It returns the capabilities
+// of the wrapped backend, if any.
+func (be *Backend) Capabilities() []string {
+	if extended, ok := be.Backend.(backend.ExtendedBackend); ok {
+		return extended.Capabilities()
+	}
+	return nil
+}
+
+// Updates implements backend.BackendUpdater. It returns the updates of the
+// wrapped backend, or nil if it doesn't send updates.
+func (be *Backend) Updates() <-chan backend.Update {
+	be.updatesOnce.Do(func() {
+		updater, ok := be.Backend.(backend.BackendUpdater)
+		if !ok {
+			return
+		}
+		updates := updater.Updates()
+		if updates == nil {
+			return
+		}
+
+		be.updates = make(chan backend.Update)
+		go be.forward(updates)
+	})
+
+	if be.updates == nil {
+		return nil
+	}
+	return be.updates
+}
+
+// forward sends the updates of the wrapped backend. The UIDVALIDITY of a
+// mailbox is checked again after messages have been expunged from it, since
+// they may have been expunged because the mailbox has been removed.
+func (be *Backend) forward(updates <-chan backend.Update) {
+	for update := range updates {
+		if update, ok := update.(*backend.ExpungeUpdate); ok {
+			mk := mailboxKey{username: update.Username(), mailbox: update.Mailbox()}
+			be.cache.invalidateUidValidity(mk)
+		}
+		be.updates <- update
+	}
+}
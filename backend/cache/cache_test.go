@@ -0,0 +1,298 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendtest"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+const testMessage = "From: contact@example.org\r\n" +
+	"To: contact@example.org\r\n" +
+	"Subject: A little message, just for you\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hi there :)"
+
+// countingMailbox records the items requested to the wrapped mailbox, and
+// counts status requests. If uidValidity is set, it replaces the UIDVALIDITY
+// of the wrapped mailbox.
+type countingMailbox struct {
+	backend.Mailbox
+
+	requests    [][]imap.FetchItem
+	statuses    int
+	uidValidity uint32
+}
+
+func (mbox *countingMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	mbox.statuses++
+	status, err := mbox.Mailbox.Status(items)
+	if err == nil && mbox.uidValidity != 0 {
+		status.UidValidity = mbox.uidValidity
+	}
+	return status, err
+}
+
+func (mbox *countingMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	mbox.requests = append(mbox.requests, items)
+	return mbox.Mailbox.ListMessages(uid, seqset, items, ch)
+}
+
+func newTestMailbox(t *testing.T, maxEntries int) (*Backend, *Mailbox, *countingMailbox) {
+	be := New(memory.New(), maxEntries)
+
+	u, err := be.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	user := u.(*User)
+	inner, err := user.User.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal("Expected no error while getting INBOX, got:", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := inner.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+			t.Fatal("Expected no error while creating a message, got:", err)
+		}
+	}
+
+	counting := &countingMailbox{Mailbox: inner}
+	return be, &Mailbox{Mailbox: counting, user: user}, counting
+}
+
+func listAll(t *testing.T, mbox backend.Mailbox, items []imap.FetchItem) []*imap.Message {
+	t.Helper()
+
+	seqSet, _ := imap.ParseSeqSet("1:*")
+	messages, err := listMessages(context.Background(), mbox, false, seqSet, items)
+	if err != nil {
+		t.Fatal("Expected no error while listing messages, got:", err)
+	}
+	return messages
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.RunTests(t, func() backend.Backend {
+		return New(memory.New(), 100)
+	})
+}
+
+func TestLoginCertificate(t *testing.T) {
+	u, err := New(backendtest.CertificateBackend{Backend: memory.New()}, 100).LoginCertificate(nil, "")
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	if _, ok := u.(*User); !ok {
+		t.Errorf("Expected the user to be wrapped, got %T", u)
+	}
+
+	if _, err := New(memory.New(), 100).LoginCertificate(nil, ""); err == nil {
+		t.Error("Expected an error when the wrapped backend doesn't support certificates")
+	}
+}
+
+func TestListMessages(t *testing.T) {
+	be, mbox, counting := newTestMailbox(t, 100)
+
+	section, _ := imap.ParseBodySectionName("BODY.PEEK[HEADER.FIELDS (Subject)]")
+	items := []imap.FetchItem{imap.FetchFlags, imap.FetchEnvelope, imap.FetchBodyStructure, imap.FetchRFC822Size, section.FetchItem()}
+	want := listAll(t, counting.Mailbox, items)
+
+	for i := 0; i < 2; i++ {
+		counting.requests = nil
+		counting.statuses = 0
+		messages := listAll(t, mbox, items)
+
+		if len(messages) != len(want) {
+			t.Fatalf("Expected %v messages, got %v", len(want), len(messages))
+		}
+		for j, msg := range messages {
+			if msg.SeqNum != want[j].SeqNum || msg.Size != want[j].Size {
+				t.Errorf("Invalid message %v: %+v", j, msg)
+			}
+			if !reflect.DeepEqual(msg.Envelope, want[j].Envelope) {
+				t.Errorf("Expected envelope %+v, got %+v", want[j].Envelope, msg.Envelope)
+			}
+			if !reflect.DeepEqual(msg.BodyStructure, want[j].BodyStructure) {
+				t.Errorf("Expected body structure %+v, got %+v", want[j].BodyStructure, msg.BodyStructure)
+			}
+			if _, ok := msg.Items[imap.FetchUid]; ok {
+				t.Error("Expected UID not to be returned")
+			}
+
+			b, _ := ioutil.ReadAll(getBody(msg, section))
+			if s := string(b); s != "Subject: A little message, just for you\r\n\r\n" {
+				t.Errorf("Invalid header: %q", s)
+			}
+		}
+
+		// The second time, data is retrieved from the cache
+		wantRequests := 2
+		if i > 0 {
+			wantRequests = 1
+		}
+		if len(counting.requests) != wantRequests {
+			t.Errorf("Expected %v requests to the wrapped mailbox, got %v", wantRequests, counting.requests)
+		}
+		// The UIDVALIDITY is only requested the first time
+		wantStatuses := 1
+		if i > 0 {
+			wantStatuses = 0
+		}
+		if counting.statuses != wantStatuses {
+			t.Errorf("Expected %v status requests to the wrapped mailbox, got %v", wantStatuses, counting.statuses)
+		}
+	}
+
+	if n := be.cache.len(); n != len(want) {
+		t.Errorf("Expected %v cached entries, got %v", len(want), n)
+	}
+}
+
+func TestListMessages_Seen(t *testing.T) {
+	_, mbox, counting := newTestMailbox(t, 100)
+
+	// Sections setting the \Seen flag are fetched from the wrapped mailbox
+	items := []imap.FetchItem{"BODY[HEADER]"}
+	listAll(t, mbox, items)
+	listAll(t, mbox, items)
+	if len(counting.requests) != 2 || !reflect.DeepEqual(counting.requests[1], items) {
+		t.Errorf("Expected requests to be forwarded, got %v", counting.requests)
+	}
+}
+
+func TestListMessages_Evict(t *testing.T) {
+	be, mbox, counting := newTestMailbox(t, 1)
+
+	items := []imap.FetchItem{imap.FetchEnvelope}
+	listAll(t, mbox, items)
+	if n := be.cache.len(); n != 1 {
+		t.Errorf("Expected 1 cached entry, got %v", n)
+	}
+
+	counting.requests = nil
+	listAll(t, mbox, items)
+	if len(counting.requests) != 2 {
+		t.Errorf("Expected evicted entries to be fetched again, got %v", counting.requests)
+	}
+}
+
+func TestExpunge(t *testing.T) {
+	be, mbox, _ := newTestMailbox(t, 100)
+
+	listAll(t, mbox, []imap.FetchItem{imap.FetchEnvelope})
+
+	seqSet, _ := imap.ParseSeqSet("1")
+	if err := mbox.UpdateMessagesFlags(false, seqSet, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal("Expected no error while updating flags, got:", err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expected no error while expunging, got:", err)
+	}
+
+	if n := be.cache.len(); n != 2 {
+		t.Errorf("Expected 2 cached entries after expunge, got %v", n)
+	}
+}
+
+func TestUidValidity(t *testing.T) {
+	be, mbox, counting := newTestMailbox(t, 100)
+
+	items := []imap.FetchItem{imap.FetchEnvelope}
+	listAll(t, mbox, items)
+
+	// The new UIDVALIDITY is noticed when the mailbox is selected again
+	counting.uidValidity = 42
+	counting.requests = nil
+	if _, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity}); err != nil {
+		t.Fatal("Expected no error while getting status, got:", err)
+	}
+	listAll(t, mbox, items)
+	if len(counting.requests) != 2 {
+		t.Errorf("Expected entries to be fetched again after UIDVALIDITY change, got %v", counting.requests)
+	}
+	if n := be.cache.len(); n != 3 {
+		t.Errorf("Expected old entries to be removed, got %v cached entries", n)
+	}
+}
+
+func TestUidValidity_ExpungeUpdate(t *testing.T) {
+	be, mbox, counting := newTestMailbox(t, 100)
+	updates := be.Updates()
+
+	items := []imap.FetchItem{imap.FetchEnvelope}
+	listAll(t, mbox, items)
+
+	// Another session expunges a message
+	other, err := be.Backend.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	inbox, err := other.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal("Expected no error while getting INBOX, got:", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		seqSet, _ := imap.ParseSeqSet("1")
+		if err := inbox.UpdateMessagesFlags(false, seqSet, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+			done <- err
+			return
+		}
+		done <- inbox.Expunge()
+	}()
+	for {
+		update := <-updates
+		close(update.Done())
+		if _, ok := update.(*backend.ExpungeUpdate); ok {
+			break
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Expected no error while expunging, got:", err)
+	}
+
+	counting.statuses = 0
+	listAll(t, mbox, items)
+	if counting.statuses != 1 {
+		t.Errorf("Expected the UIDVALIDITY to be checked again, got %v status requests", counting.statuses)
+	}
+}
+
+func TestRenameMailbox_Inferiors(t *testing.T) {
+	be := New(memory.New(), 100)
+	u := backendtest.Login(t, be)
+
+	for _, name := range []string{"a", "a/b"} {
+		if err := u.CreateMailbox(name); err != nil {
+			t.Fatal("Expected no error while creating a mailbox, got:", err)
+		}
+	}
+	mbox := backendtest.GetMailbox(t, u, "a/b")
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("Expected no error while creating a message, got:", err)
+	}
+	listAll(t, mbox, []imap.FetchItem{imap.FetchEnvelope})
+	if n := be.cache.len(); n != 1 {
+		t.Fatalf("Expected 1 cached entry, got %v", n)
+	}
+
+	if err := u.RenameMailbox("a", "c"); err != nil {
+		t.Fatal("Expected no error while renaming a mailbox, got:", err)
+	}
+	if n := be.cache.len(); n != 0 {
+		t.Errorf("Expected entries of inferior mailboxes to be removed, got %v cached entries", n)
+	}
+	if _, ok := be.cache.uidValidity(mailboxKey{username: backendtest.Username, mailbox: "a/b"}); ok {
+		t.Error("Expected the UIDVALIDITY of inferior mailboxes to be forgotten")
+	}
+}
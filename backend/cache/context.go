@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// The methods below forward contexts to the wrapped backend, they would be
+// hidden by the embedded interfaces otherwise.
+
+func (be *Backend) LoginContext(ctx context.Context, connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := backendutil.Login(ctx, be.Backend, connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &User{User: u, be: be}, nil
+}
+
+func (be *Backend) LoginCertificateContext(ctx context.Context, connInfo *imap.ConnInfo, identity string) (backend.User, error) {
+	certBe, ok := be.Backend.(backend.CertificateBackend)
+	if !ok {
+		return nil, errNoCertificates
+	}
+	u, err := backendutil.LoginCertificate(ctx, certBe, connInfo, identity)
+	if err != nil {
+		return nil, err
+	}
+	return &User{User: u, be: be}, nil
+}
+
+func (mbox *Mailbox) SetSubscribedContext(ctx context.Context, subscribed bool) error {
+	return backendutil.SetSubscribed(ctx, mbox.Mailbox, subscribed)
+}
+
+func (mbox *Mailbox) CheckContext(ctx context.Context) error {
+	return backendutil.Check(ctx, mbox.Mailbox)
+}
+
+func (mbox *Mailbox) SearchMessagesContext(ctx context.Context, uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return backendutil.SearchMessages(ctx, mbox.Mailbox, uid, criteria)
+}
+
+func (mbox *Mailbox) CreateMessageContext(ctx context.Context, flags []string, date time.Time, body imap.Literal) error {
+	return backendutil.CreateMessage(ctx, mbox.Mailbox, flags, date, body)
+}
+
+func (mbox *Mailbox) UpdateMessagesFlagsContext(ctx context.Context, uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return backendutil.UpdateMessagesFlags(ctx, mbox.Mailbox, uid, seqset, op, flags)
+}
+
+func (mbox *Mailbox) CopyMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, dest string) error {
+	return backendutil.CopyMessages(ctx, mbox.Mailbox, uid, seqset, dest)
+}
+
+var (
+	_ backend.BackendContext            = (*Backend)(nil)
+	_ backend.CertificateBackendContext = (*Backend)(nil)
+	_ backend.ExtendedBackend           = (*Backend)(nil)
+	_ backend.UserContext               = (*User)(nil)
+	_ backend.MailboxContext            = (*Mailbox)(nil)
+	_ backend.SelectMailbox             = (*Mailbox)(nil)
+)
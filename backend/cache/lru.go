@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+)
+
+// mailboxKey identifies a mailbox.
+type mailboxKey struct {
+	username string
+	mailbox  string
+}
+
+// key identifies a message.
+type key struct {
+	mailboxKey
+	uidValidity uint32
+	uid         uint32
+}
+
+// entry contains the cached data of a message. Entries are never modified
+// once added to the cache, fields are nil or false if they haven't been
+// fetched yet.
+type entry struct {
+	envelope      *imap.Envelope
+	bodyStructure *imap.BodyStructure
+	body          *imap.BodyStructure
+	size          uint32
+	hasSize       bool
+	header        []byte
+}
+
+// lruItem is an element of the LRU list.
+type lruItem struct {
+	key   key
+	entry *entry
+}
+
+// lru is a least-recently-used cache of message entries.
+type lru struct {
+	max int
+
+	locker   sync.Mutex
+	list     *list.List
+	elements map[key]*list.Element
+	// The last UIDVALIDITY seen for each mailbox
+	uidValidities map[mailboxKey]uint32
+	// Mailboxes whose UIDVALIDITY may have changed since it has been seen
+	unchecked map[mailboxKey]bool
+}
+
+func newLRU(max int) *lru {
+	return &lru{
+		max:           max,
+		list:          list.New(),
+		elements:      make(map[key]*list.Element),
+		uidValidities: make(map[mailboxKey]uint32),
+		unchecked:     make(map[mailboxKey]bool),
+	}
+}
+
+// get returns the entry of a message, or nil if it isn't cached.
+func (c *lru) get(k key) *entry {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	el, ok := c.elements[k]
+	if !ok {
+		return nil
+	}
+	c.list.MoveToFront(el)
+	return el.Value.(*lruItem).entry
+}
+
+// add adds or replaces the entry of a message, and evicts the least recently
+// used entries if the cache is full.
+func (c *lru) add(k key, e *entry) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if el, ok := c.elements[k]; ok {
+		el.Value.(*lruItem).entry = e
+		c.list.MoveToFront(el)
+		return
+	}
+
+	c.elements[k] = c.list.PushFront(&lruItem{key: k, entry: e})
+	for c.list.Len() > c.max {
+		c.removeElement(c.list.Back())
+	}
+}
+
+// remove removes the entry of a message.
+func (c *lru) remove(k key) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if el, ok := c.elements[k]; ok {
+		c.removeElement(el)
+	}
+}
+
+// removeMailbox removes all entries of a mailbox.
+func (c *lru) removeMailbox(mk mailboxKey) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.removeMailboxLocked(mk)
+	delete(c.uidValidities, mk)
+	delete(c.unchecked, mk)
+}
+
+// removeMailboxes removes all entries of a mailbox and of the mailboxes whose
+// name starts with its name, such as its inferior mailboxes.
+func (c *lru) removeMailboxes(mk mailboxKey) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	matches := func(k mailboxKey) bool {
+		return k.username == mk.username && strings.HasPrefix(k.mailbox, mk.mailbox)
+	}
+	for el := c.list.Front(); el != nil; {
+		next := el.Next()
+		if matches(el.Value.(*lruItem).key.mailboxKey) {
+			c.removeElement(el)
+		}
+		el = next
+	}
+	for k := range c.uidValidities {
+		if matches(k) {
+			delete(c.uidValidities, k)
+			delete(c.unchecked, k)
+		}
+	}
+}
+
+// checkUidValidity removes all entries of a mailbox if its UIDVALIDITY has
+// changed since the last call.
+func (c *lru) checkUidValidity(mk mailboxKey, uidValidity uint32) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if last, ok := c.uidValidities[mk]; ok && last != uidValidity {
+		c.removeMailboxLocked(mk)
+	}
+	c.uidValidities[mk] = uidValidity
+	delete(c.unchecked, mk)
+}
+
+// uidValidity returns the last UIDVALIDITY seen for a mailbox. ok is false if
+// it isn't known or if it needs to be checked again.
+func (c *lru) uidValidity(mk mailboxKey) (uidValidity uint32, ok bool) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	uidValidity, ok = c.uidValidities[mk]
+	return uidValidity, ok && !c.unchecked[mk]
+}
+
+// invalidateUidValidity requires the UIDVALIDITY of a mailbox to be checked
+// again before cached entries are used.
+func (c *lru) invalidateUidValidity(mk mailboxKey) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if _, ok := c.uidValidities[mk]; ok {
+		c.unchecked[mk] = true
+	}
+}
+
+func (c *lru) removeMailboxLocked(mk mailboxKey) {
+	for el := c.list.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*lruItem).key.mailboxKey == mk {
+			c.removeElement(el)
+		}
+		el = next
+	}
+}
+
+func (c *lru) removeElement(el *list.Element) {
+	c.list.Remove(el)
+	delete(c.elements, el.Value.(*lruItem).key)
+}
+
+// len returns the number of cached entries.
+func (c *lru) len() int {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.list.Len()
+}
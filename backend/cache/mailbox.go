@@ -0,0 +1,380 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message/textproto"
+)
+
+// headerSection is the section used to fetch the header of a message.
+var headerSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+	Peek:         true,
+}
+
+// Mailbox wraps a mailbox of the wrapped backend.
+type Mailbox struct {
+	backend.Mailbox
+
+	user *User
+}
+
+// cachedSection parses a fetch item, and returns the section if it can be
+// extracted from the cached header of a message. Sections which set the \Seen
+// flag are left to the wrapped backend.
+func cachedSection(item imap.FetchItem) *imap.BodySectionName {
+	section, err := imap.ParseBodySectionName(item)
+	if err != nil || !section.Peek || section.Specifier != imap.HeaderSpecifier || len(section.Path) > 0 {
+		return nil
+	}
+	return section
+}
+
+func isCached(item imap.FetchItem) bool {
+	switch item {
+	case imap.FetchEnvelope, imap.FetchBodyStructure, imap.FetchBody, imap.FetchRFC822Size:
+		return true
+	}
+	return cachedSection(item) != nil
+}
+
+// has checks whether an entry contains the data needed by items.
+func (e *entry) has(items []imap.FetchItem) bool {
+	if e == nil {
+		return false
+	}
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			if e.envelope == nil {
+				return false
+			}
+		case imap.FetchBodyStructure:
+			if e.bodyStructure == nil {
+				return false
+			}
+		case imap.FetchBody:
+			if e.body == nil {
+				return false
+			}
+		case imap.FetchRFC822Size:
+			if !e.hasSize {
+				return false
+			}
+		default:
+			if e.header == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// merge returns a new entry with the data of e and msg.
+func (e *entry) merge(msg *imap.Message) (*entry, error) {
+	merged := new(entry)
+	if e != nil {
+		*merged = *e
+	}
+
+	for item := range msg.Items {
+		switch item {
+		case imap.FetchEnvelope:
+			merged.envelope = msg.Envelope
+		case imap.FetchBodyStructure:
+			merged.bodyStructure = msg.BodyStructure
+		case imap.FetchBody:
+			merged.body = msg.BodyStructure
+		case imap.FetchRFC822Size:
+			merged.size = msg.Size
+			merged.hasSize = true
+		}
+	}
+	if l := getBody(msg, headerSection); l != nil {
+		b, err := ioutil.ReadAll(l)
+		if err != nil {
+			return nil, err
+		}
+		merged.header = b
+	}
+	return merged, nil
+}
+
+// getBody returns a body section of a message returned by the wrapped backend.
+// Unlike Message.GetBody, it doesn't ignore the PEEK flag, which is kept by
+// backends.
+func getBody(msg *imap.Message, section *imap.BodySectionName) imap.Literal {
+	for s, l := range msg.Body {
+		if s.Equal(section) {
+			return l
+		}
+	}
+	return nil
+}
+
+// fetchItems returns the items needed to fill entries for items.
+func fetchItems(items []imap.FetchItem) []imap.FetchItem {
+	fetch := []imap.FetchItem{imap.FetchUid}
+	header := false
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope, imap.FetchBodyStructure, imap.FetchBody, imap.FetchRFC822Size:
+			fetch = append(fetch, item)
+		default:
+			header = true
+		}
+	}
+	if header {
+		fetch = append(fetch, headerSection.FetchItem())
+	}
+	return fetch
+}
+
+// listMessages lists messages of a mailbox in a slice.
+func listMessages(ctx context.Context, mbox backend.Mailbox, uid bool, seqset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
+	ch := make(chan *imap.Message)
+	done := make(chan []*imap.Message)
+	go func() {
+		var messages []*imap.Message
+		for msg := range ch {
+			messages = append(messages, msg)
+		}
+		done <- messages
+	}()
+
+	err := backendutil.ListMessages(ctx, mbox, uid, seqset, items, ch)
+	messages := <-done
+	return messages, err
+}
+
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	return mbox.StatusContext(context.Background(), items)
+}
+
+// StatusContext implements backend.MailboxContext. The UIDVALIDITY is checked
+// when it's requested, for instance when the mailbox is selected.
+func (mbox *Mailbox) StatusContext(ctx context.Context, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := backendutil.Status(ctx, mbox.Mailbox, items)
+	if err != nil {
+		return nil, err
+	}
+	if status.UidValidity != 0 {
+		mbox.user.be.cache.checkUidValidity(mbox.user.mailboxKey(mbox.Name()), status.UidValidity)
+	}
+	return status, nil
+}
+
+// uidValidity returns the UIDVALIDITY of the mailbox. It's only requested to
+// the wrapped mailbox if it isn't known or may have changed.
+func (mbox *Mailbox) uidValidity(ctx context.Context) (uint32, error) {
+	mk := mbox.user.mailboxKey(mbox.Name())
+	if uidValidity, ok := mbox.user.be.cache.uidValidity(mk); ok {
+		return uidValidity, nil
+	}
+
+	status, err := backendutil.Status(ctx, mbox.Mailbox, []imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return 0, err
+	}
+	mbox.user.be.cache.checkUidValidity(mk, status.UidValidity)
+	return status.UidValidity, nil
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.ListMessagesContext(context.Background(), uid, seqset, items, ch)
+}
+
+func (mbox *Mailbox) ListMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	var cached, other []imap.FetchItem
+	for _, item := range items {
+		if isCached(item) {
+			cached = append(cached, item)
+		} else if item != imap.FetchUid {
+			other = append(other, item)
+		}
+	}
+	if len(cached) == 0 {
+		return backendutil.ListMessages(ctx, mbox.Mailbox, uid, seqset, items, ch)
+	}
+
+	defer close(ch)
+
+	uidValidity, err := mbox.uidValidity(ctx)
+	if err != nil {
+		return err
+	}
+	mk := mbox.user.mailboxKey(mbox.Name())
+	keyOf := func(uid uint32) key {
+		return key{mailboxKey: mk, uidValidity: uidValidity, uid: uid}
+	}
+
+	// Fetch other items and UIDs, then fetch data missing from the cache
+	messages, err := mbox.listMessages(ctx, uid, seqset, append(other, imap.FetchUid))
+	if err != nil {
+		return err
+	}
+
+	entries := make([]*entry, len(messages))
+	var missing imap.SeqSet
+	for i, msg := range messages {
+		entries[i] = mbox.user.be.cache.get(keyOf(msg.Uid))
+		if !entries[i].has(cached) {
+			missing.AddNum(msg.Uid)
+		}
+	}
+
+	if !missing.Empty() {
+		fetched, err := mbox.listMessages(ctx, true, &missing, fetchItems(cached))
+		if err != nil {
+			return err
+		}
+
+		byUid := make(map[uint32]*entry, len(fetched))
+		for _, msg := range fetched {
+			k := keyOf(msg.Uid)
+			e, err := mbox.user.be.cache.get(k).merge(msg)
+			if err != nil {
+				return err
+			}
+			mbox.user.be.cache.add(k, e)
+			byUid[msg.Uid] = e
+		}
+		for i, msg := range messages {
+			if e, ok := byUid[msg.Uid]; ok {
+				entries[i] = e
+			}
+		}
+	}
+
+	for i, msg := range messages {
+		if !entries[i].has(cached) {
+			// The message has been expunged in the meantime
+			continue
+		}
+		res, err := buildMessage(msg, entries[i], items)
+		if err != nil {
+			return err
+		}
+		ch <- res
+	}
+	return nil
+}
+
+func (mbox *Mailbox) listMessages(ctx context.Context, uid bool, seqset *imap.SeqSet, items []imap.FetchItem) ([]*imap.Message, error) {
+	return listMessages(ctx, mbox.Mailbox, uid, seqset, items)
+}
+
+// buildMessage creates a message with the requested items, from a message
+// returned by the wrapped backend and a cache entry.
+func buildMessage(msg *imap.Message, e *entry, items []imap.FetchItem) (*imap.Message, error) {
+	res := imap.NewMessage(msg.SeqNum, items)
+	res.Flags = msg.Flags
+	res.InternalDate = msg.InternalDate
+	res.Uid = msg.Uid
+	res.SaveDate = msg.SaveDate
+	res.EmailId = msg.EmailId
+	res.ThreadId = msg.ThreadId
+	res.Preview = msg.Preview
+
+	var header *textproto.Header
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			res.Envelope = e.envelope
+		case imap.FetchBodyStructure, imap.FetchBody:
+			// The top-level Extended field is set when formatting the message,
+			// make a copy to avoid modifying cached data
+			src := e.bodyStructure
+			if item == imap.FetchBody {
+				src = e.body
+			}
+			bs := *src
+			res.BodyStructure = &bs
+		case imap.FetchRFC822Size:
+			res.Size = e.size
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				res.Items[item] = msg.Items[item]
+				break
+			}
+			if cachedSection(item) == nil {
+				res.Body[section] = getBody(msg, section)
+				break
+			}
+
+			if header == nil {
+				h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(e.header)))
+				if err != nil {
+					return nil, err
+				}
+				header = &h
+			}
+			l, err := backendutil.FetchBodySection(*header, bytes.NewReader(nil), section)
+			if err != nil {
+				return nil, err
+			}
+			res.Body[section] = l
+		}
+	}
+	return res, nil
+}
+
+func (mbox *Mailbox) Expunge() error {
+	return mbox.ExpungeContext(context.Background())
+}
+
+func (mbox *Mailbox) ExpungeContext(ctx context.Context) error {
+	uids, err := backendutil.SearchMessages(ctx, mbox.Mailbox, true, &imap.SearchCriteria{
+		WithFlags: []string{imap.DeletedFlag},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := backendutil.Expunge(ctx, mbox.Mailbox); err != nil {
+		return err
+	}
+
+	uidValidity, err := mbox.uidValidity(ctx)
+	if err != nil {
+		return err
+	}
+	mk := mbox.user.mailboxKey(mbox.Name())
+	for _, uid := range uids {
+		mbox.user.be.cache.remove(key{mailboxKey: mk, uidValidity: uidValidity, uid: uid})
+	}
+	return nil
+}
+
+// Select implements backend.SelectMailbox. It selects the wrapped mailbox, if
+// it supports it.
+func (mbox *Mailbox) Select(readOnly bool) error {
+	if selecter, ok := mbox.Mailbox.(backend.SelectMailbox); ok {
+		return selecter.Select(readOnly)
+	}
+	return nil
+}
+
+// Recent implements backend.SelectMailbox.
+func (mbox *Mailbox) Recent(uid uint32) bool {
+	if selecter, ok := mbox.Mailbox.(backend.SelectMailbox); ok {
+		return selecter.Recent(uid)
+	}
+	return false
+}
+
+// Poll implements backend.MailboxPoller. It polls the wrapped mailbox, if it
+// supports it.
+func (mbox *Mailbox) Poll() error {
+	if poller, ok := mbox.Mailbox.(backend.MailboxPoller); ok {
+		return poller.Poll()
+	}
+	return nil
+}
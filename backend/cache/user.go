@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// User wraps a user of the wrapped backend.
+type User struct {
+	backend.User
+
+	be *Backend
+}
+
+func (u *User) mailboxKey(name string) mailboxKey {
+	return mailboxKey{username: u.Username(), mailbox: name}
+}
+
+func (u *User) wrapMailbox(mbox backend.Mailbox) *Mailbox {
+	return &Mailbox{Mailbox: mbox, user: u}
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	return u.ListMailboxesContext(context.Background(), subscribed)
+}
+
+func (u *User) ListMailboxesContext(ctx context.Context, subscribed bool) ([]backend.Mailbox, error) {
+	mailboxes, err := backendutil.ListMailboxes(ctx, u.User, subscribed)
+	if err != nil {
+		return nil, err
+	}
+	for i, mbox := range mailboxes {
+		mailboxes[i] = u.wrapMailbox(mbox)
+	}
+	return mailboxes, nil
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	return u.GetMailboxContext(context.Background(), name)
+}
+
+func (u *User) GetMailboxContext(ctx context.Context, name string) (backend.Mailbox, error) {
+	mbox, err := backendutil.GetMailbox(ctx, u.User, name)
+	if err != nil {
+		return nil, err
+	}
+	return u.wrapMailbox(mbox), nil
+}
+
+func (u *User) CreateMailboxContext(ctx context.Context, name string) error {
+	return backendutil.CreateMailbox(ctx, u.User, name)
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	return u.DeleteMailboxContext(context.Background(), name)
+}
+
+func (u *User) DeleteMailboxContext(ctx context.Context, name string) error {
+	if err := backendutil.DeleteMailbox(ctx, u.User, name); err != nil {
+		return err
+	}
+	u.be.cache.removeMailbox(u.mailboxKey(name))
+	return nil
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	return u.RenameMailboxContext(context.Background(), existingName, newName)
+}
+
+func (u *User) RenameMailboxContext(ctx context.Context, existingName, newName string) error {
+	if err := backendutil.RenameMailbox(ctx, u.User, existingName, newName); err != nil {
+		return err
+	}
+	// Inferior mailboxes are renamed too, a mailbox created later with one of
+	// the old names must not reuse their entries
+	u.be.cache.removeMailboxes(u.mailboxKey(existingName))
+	return nil
+}
@@ -0,0 +1,57 @@
+package backend
+
+import (
+	"context"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// The interfaces below are optional variants of Backend, User and Mailbox
+// methods accepting a context. The server uses them when they are implemented,
+// and falls back to the methods without a context otherwise.
+//
+// The context is cancelled when the command is complete, when the connection
+// is closed or when the server is closed. Backends should abort long-running
+// operations and return the context error once it's done. Backend wrappers
+// should implement these interfaces too, and forward contexts with the
+// functions of the backendutil package.
+
+// BackendContext is a Backend supporting contexts.
+type BackendContext interface {
+	// LoginContext is like Backend.Login, with a context.
+	LoginContext(ctx context.Context, connInfo *imap.ConnInfo, username, password string) (User, error)
+}
+
+// CertificateBackendContext is a CertificateBackend supporting contexts.
+type CertificateBackendContext interface {
+	// LoginCertificateContext is like CertificateBackend.LoginCertificate,
+	// with a context.
+	LoginCertificateContext(ctx context.Context, connInfo *imap.ConnInfo, identity string) (User, error)
+}
+
+// UserContext is a User supporting contexts. Each method is like the User
+// method with the same name, without the Context suffix.
+type UserContext interface {
+	ListMailboxesContext(ctx context.Context, subscribed bool) ([]Mailbox, error)
+	GetMailboxContext(ctx context.Context, name string) (Mailbox, error)
+	CreateMailboxContext(ctx context.Context, name string) error
+	DeleteMailboxContext(ctx context.Context, name string) error
+	RenameMailboxContext(ctx context.Context, existingName, newName string) error
+}
+
+// MailboxContext is a Mailbox supporting contexts. Each method is like the
+// Mailbox method with the same name, without the Context suffix.
+type MailboxContext interface {
+	StatusContext(ctx context.Context, items []imap.StatusItem) (*imap.MailboxStatus, error)
+	SetSubscribedContext(ctx context.Context, subscribed bool) error
+	CheckContext(ctx context.Context) error
+	// ListMessagesContext must close ch when it returns, even if the context is
+	// cancelled.
+	ListMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error
+	SearchMessagesContext(ctx context.Context, uid bool, criteria *imap.SearchCriteria) ([]uint32, error)
+	CreateMessageContext(ctx context.Context, flags []string, date time.Time, body imap.Literal) error
+	UpdateMessagesFlagsContext(ctx context.Context, uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error
+	CopyMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, dest string) error
+	ExpungeContext(ctx context.Context) error
+}
@@ -0,0 +1,212 @@
+// Package kv implements an IMAP backend storing users, mailboxes and messages
+// in a single file, with the bbolt embedded key-value store.
+//
+// Message contents are stored once per distinct content, keyed by their
+// SHA-256 hash, and are shared between copies. Each command is executed in a
+// single transaction, so that COPY and EXPUNGE are atomic.
+//
+// The UIDVALIDITY and next UID of deleted and renamed mailboxes are kept, so
+// that a new mailbox created with the same name doesn't reuse UIDs.
+//
+// The database file is locked while the backend is open, it cannot be shared
+// between processes.
+package kv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Delimiter is the mailbox hierarchy delimiter.
+const Delimiter = "/"
+
+var (
+	// ErrNoSuchUser is returned when updating or deleting a user that doesn't
+	// exist.
+	ErrNoSuchUser = errors.New("kv: no such user")
+	// ErrUserAlreadyExists is returned when creating a user that already
+	// exists.
+	ErrUserAlreadyExists = errors.New("kv: user already exists")
+)
+
+// Backend is a key-value store backend.
+type Backend struct {
+	db *bolt.DB
+
+	locker  sync.Mutex
+	updates chan backend.Update
+}
+
+// Open opens the database at path, creating it if it doesn't exist.
+func Open(path string) (*Backend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{usersBucket, blobsBucket, refsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Backend{db: db}, nil
+}
+
+// Close closes the database.
+func (be *Backend) Close() error {
+	return be.db.Close()
+}
+
+func validUsername(username string) bool {
+	return username != "" && !strings.ContainsAny(username, "\x00")
+}
+
+// CreateUser creates a new user with an empty INBOX.
+func (be *Backend) CreateUser(username, password string) error {
+	if !validUsername(username) {
+		return errors.New("kv: invalid username")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return be.db.Update(func(tx *bolt.Tx) error {
+		ub, err := tx.Bucket(usersBucket).CreateBucket([]byte(username))
+		if err == bolt.ErrBucketExists {
+			return ErrUserAlreadyExists
+		} else if err != nil {
+			return err
+		}
+
+		if err := ub.Put(passwordKey, []byte(hash)); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{mailboxesBucket, messagesBucket, subscriptionsBucket} {
+			if _, err := ub.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return createMailbox(tx, ub, imap.InboxName)
+	})
+}
+
+// SetPassword changes the password of a user.
+func (be *Backend) SetPassword(username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return be.db.Update(func(tx *bolt.Tx) error {
+		ub := userBucket(tx, username)
+		if ub == nil {
+			return ErrNoSuchUser
+		}
+		return ub.Put(passwordKey, []byte(hash))
+	})
+}
+
+// DeleteUser deletes a user and all of its messages.
+func (be *Backend) DeleteUser(username string) error {
+	return be.db.Update(func(tx *bolt.Tx) error {
+		ub := userBucket(tx, username)
+		if ub == nil {
+			return ErrNoSuchUser
+		}
+
+		err := ub.Bucket(mailboxesBucket).ForEach(func(k, v []byte) error {
+			var rec mailboxRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if rec.Deleted {
+				return nil
+			}
+			return deleteMessages(tx, ub, &rec)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(usersBucket).DeleteBucket([]byte(username))
+	})
+}
+
+func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	var hash string
+	err := be.db.View(func(tx *bolt.Tx) error {
+		if ub := userBucket(tx, username); ub != nil {
+			hash = string(ub.Get(passwordKey))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if hash == "" || !checkPassword(hash, password) {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return &User{be: be, username: username}, nil
+}
+
+// Capabilities implements backend.ExtendedBackend.
+func (be *Backend) Capabilities() []string {
+	return []string{"STATUS=SIZE", "SAVEDATE", "OBJECTID", "PREVIEW", "WITHIN"}
+}
+
+// Updates implements backend.BackendUpdater.
+func (be *Backend) Updates() <-chan backend.Update {
+	be.locker.Lock()
+	defer be.locker.Unlock()
+
+	if be.updates == nil {
+		be.updates = make(chan backend.Update)
+	}
+	return be.updates
+}
+
+// notify sends updates and waits for them to be broadcast. Updates are dropped
+// if Updates has never been called.
+func (be *Backend) notify(updates []backend.Update) {
+	be.locker.Lock()
+	ch := be.updates
+	be.locker.Unlock()
+
+	if ch == nil {
+		return
+	}
+	for _, update := range updates {
+		// Done lazily creates the channel, call it before sharing the update
+		done := update.Done()
+		ch <- update
+		<-done
+	}
+}
+
+// newObjectId generates a new random object identifier, as defined in RFC
+// 8474.
+func newObjectId() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,18 @@
+module github.com/emersion/go-imap/backend/kv
+
+go 1.27.1
+
+require (
+	github.com/emersion/go-imap v1.0.0
+	github.com/emersion/go-message v0.10.4-0.20190609165112-592ace5bc1ca
+	go.etcd.io/bbolt v1.4.3
+)
+
+require (
+	github.com/emersion/go-textwrapper v0.0.0-20160606182133-d0e65e56babe // indirect
+	github.com/martinlindhe/base36 v0.0.0-20190418230009-7c6542dfbb41 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/text v0.3.2 // indirect
+)
+
+replace github.com/emersion/go-imap => ../..
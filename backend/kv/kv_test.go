@@ -0,0 +1,504 @@
+package kv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendtest"
+	bolt "go.etcd.io/bbolt"
+)
+
+const testMessage = "From: contact@example.org\r\n" +
+	"To: contact@example.org\r\n" +
+	"Subject: A little message, just for you\r\n" +
+	"Date: Wed, 11 May 2016 14:31:59 +0000\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hi there :)"
+
+func newTestBackend(t *testing.T, path string) (*Backend, backend.User) {
+	be, err := Open(path)
+	if err != nil {
+		t.Fatal("Expected no error while opening the database, got:", err)
+	}
+	t.Cleanup(func() { be.Close() })
+
+	if err := be.CreateUser("username", "password"); err != nil && err != ErrUserAlreadyExists {
+		t.Fatal("Expected no error while creating user, got:", err)
+	}
+
+	return be, backendtest.Login(t, be)
+}
+
+// receiveUpdates closes updates and forwards them to the returned channel.
+func receiveUpdates(be *Backend) <-chan backend.Update {
+	updates := be.Updates()
+	received := make(chan backend.Update, 10)
+	go func() {
+		for update := range updates {
+			received <- update
+			close(update.Done())
+		}
+	}()
+	return received
+}
+
+func countBlobs(t *testing.T, be *Backend) int {
+	var n int
+	be.db.View(func(tx *bolt.Tx) error {
+		n = countKeys(tx.Bucket(blobsBucket))
+		return nil
+	})
+	return n
+}
+
+func TestLogin(t *testing.T) {
+	be, _ := newTestBackend(t, filepath.Join(t.TempDir(), "imap.db"))
+
+	if _, err := be.Login(nil, "username", "wrong"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Expected invalid credentials error, got: %v", err)
+	}
+	if _, err := be.Login(nil, "unknown", "password"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Expected invalid credentials error, got: %v", err)
+	}
+	if err := be.CreateUser("username", "password"); err != ErrUserAlreadyExists {
+		t.Errorf("Expected user already exists error, got: %v", err)
+	}
+
+	if err := be.SetPassword("username", "new password"); err != nil {
+		t.Fatal("Expected no error while setting password, got:", err)
+	}
+	if _, err := be.Login(nil, "username", "new password"); err != nil {
+		t.Errorf("Expected no error while logging in with the new password, got: %v", err)
+	}
+
+	if err := be.DeleteUser("username"); err != nil {
+		t.Fatal("Expected no error while deleting user, got:", err)
+	}
+	if _, err := be.Login(nil, "username", "new password"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Expected invalid credentials error, got: %v", err)
+	}
+	if err := be.DeleteUser("username"); err != ErrNoSuchUser {
+		t.Errorf("Expected no such user error, got: %v", err)
+	}
+}
+
+func TestMailbox_CreateMessage(t *testing.T) {
+	_, u := newTestBackend(t, filepath.Join(t.TempDir(), "imap.db"))
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	date := time.Date(2016, time.May, 11, 14, 31, 59, 0, time.UTC)
+	flags := []string{imap.SeenFlag, "$Important"}
+	if err := mbox.CreateMessage(flags, date, bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("Expected no error while creating message, got:", err)
+	}
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchEmailId, "BODY[]"}
+	msgs := backendtest.ListMessages(t, mbox, false, "1:*", items...)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one message, got %v", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.Uid != 1 {
+		t.Errorf("Expected UID 1, got %v", msg.Uid)
+	}
+	sort.Strings(msg.Flags)
+	if want := []string{"$important", imap.RecentFlag, imap.SeenFlag}; !reflect.DeepEqual(msg.Flags, want) {
+		t.Errorf("Invalid flags: got %v, want %v", msg.Flags, want)
+	}
+	if !msg.InternalDate.Equal(date) {
+		t.Errorf("Invalid internal date: got %v, want %v", msg.InternalDate, date)
+	}
+	if msg.Size != uint32(len(testMessage)) {
+		t.Errorf("Invalid size: got %v, want %v", msg.Size, len(testMessage))
+	}
+	if msg.EmailId == "" {
+		t.Error("Expected an EMAILID")
+	}
+	section, _ := imap.ParseBodySectionName("BODY[]")
+	if b, _ := ioutil.ReadAll(msg.GetBody(section)); string(b) != testMessage {
+		t.Errorf("Invalid body: got %q", string(b))
+	}
+}
+
+func TestMailbox_recent(t *testing.T) {
+	be, u := newTestBackend(t, filepath.Join(t.TempDir(), "imap.db"))
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchFlags)
+
+	other, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+
+	// The claimed \Recent flag belongs to the session, not to the Mailbox
+	// returned by GetMailbox
+	for _, test := range []struct {
+		name   string
+		user   backend.User
+		recent bool
+	}{
+		{"same session", u, true},
+		{"other session", other, false},
+	} {
+		mbox := backendtest.GetMailbox(t, test.user, "INBOX")
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusRecent})
+		if err != nil {
+			t.Fatal("Expected no error while getting status, got:", err)
+		}
+		want := []string{}
+		if test.recent {
+			want = append(want, imap.RecentFlag)
+		}
+		if status.Recent != uint32(len(want)) {
+			t.Errorf("Expected %v recent messages in %v, got %v", len(want), test.name, status.Recent)
+		}
+		if msgs := backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchFlags); !reflect.DeepEqual(append([]string{}, msgs[0].Flags...), want) {
+			t.Errorf("Expected flags %v in %v, got %v", want, test.name, msgs[0].Flags)
+		}
+	}
+}
+
+func TestMailbox_recentExamine(t *testing.T) {
+	be, u := newTestBackend(t, filepath.Join(t.TempDir(), "imap.db"))
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	// EXAMINE doesn't claim the \Recent flag
+	if err := mbox.(backend.SelectMailbox).Select(true); err != nil {
+		t.Fatal("Expected no error while examining mailbox, got:", err)
+	}
+	backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchUid, imap.FetchFlags)
+	if _, err := mbox.SearchMessages(true, imap.NewSearchCriteria()); err != nil {
+		t.Fatal("Expected no error while searching messages, got:", err)
+	}
+
+	other, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	otherMbox := backendtest.GetMailbox(t, other, "INBOX")
+	if err := otherMbox.(backend.SelectMailbox).Select(false); err != nil {
+		t.Fatal("Expected no error while selecting mailbox, got:", err)
+	}
+	msgs := backendtest.ListMessages(t, otherMbox, false, "1:*", imap.FetchUid, imap.FetchFlags)
+	if !otherMbox.(backend.SelectMailbox).Recent(msgs[0].Uid) {
+		t.Error("Expected the message to be recent for the session which selected the mailbox")
+	}
+	if want := []string{imap.RecentFlag}; !reflect.DeepEqual(msgs[0].Flags, want) {
+		t.Errorf("Expected flags %v, got %v", want, msgs[0].Flags)
+	}
+}
+
+func TestMailbox_persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imap.db")
+	be, u := newTestBackend(t, path)
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	for i := 0; i < 3; i++ {
+		if err := mbox.CreateMessage([]string{imap.FlaggedFlag}, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mbox.SetSubscribed(true); err != nil {
+		t.Fatal(err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.Close()
+
+	// Reopen the database
+	_, u = newTestBackend(t, path)
+	mbox = backendtest.GetMailbox(t, u, "INBOX")
+
+	newStatus, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext, imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newStatus.UidValidity != status.UidValidity {
+		t.Errorf("UIDVALIDITY changed: got %v, want %v", newStatus.UidValidity, status.UidValidity)
+	}
+	if newStatus.UidNext != 4 || newStatus.Messages != 3 {
+		t.Errorf("Invalid status: got UIDNEXT %v and MESSAGES %v", newStatus.UidNext, newStatus.Messages)
+	}
+
+	// The \Recent flag hasn't been claimed before closing the database
+	msgs := backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchUid, imap.FetchFlags)
+	for i, msg := range msgs {
+		if msg.Uid != uint32(i+1) || !reflect.DeepEqual(msg.Flags, []string{imap.FlaggedFlag, imap.RecentFlag}) {
+			t.Errorf("Invalid message #%v: UID %v, flags %v", i+1, msg.Uid, msg.Flags)
+		}
+	}
+
+	mailboxes, err := u.ListMailboxes(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mailboxes) != 1 || mailboxes[0].Name() != "INBOX" {
+		t.Errorf("Invalid subscribed mailboxes: %v", mailboxes)
+	}
+}
+
+func TestMailbox_Expunge(t *testing.T) {
+	be, u := newTestBackend(t, filepath.Join(t.TempDir(), "imap.db"))
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	for i := 0; i < 3; i++ {
+		body := testMessage + string(rune('a'+i))
+		if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := receiveUpdates(be)
+
+	seqSet, _ := imap.ParseSeqSet("1,3")
+	if err := mbox.UpdateMessagesFlags(false, seqSet, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal("Expected no error while updating flags, got:", err)
+	}
+	for _, seqNum := range []uint32{1, 3} {
+		update, ok := (<-received).(*backend.MessageUpdate)
+		if !ok || update.Message.SeqNum != seqNum || !reflect.DeepEqual(update.Message.Flags, []string{imap.DeletedFlag}) {
+			t.Errorf("Invalid message update: %+v", update)
+		}
+	}
+
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expected no error while expunging, got:", err)
+	}
+	for _, seqNum := range []uint32{3, 1} {
+		update, ok := (<-received).(*backend.ExpungeUpdate)
+		if !ok || update.SeqNum != seqNum {
+			t.Errorf("Expected expunge update for %v, got %+v", seqNum, update)
+		}
+	}
+
+	msgs := backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchUid)
+	if len(msgs) != 1 || msgs[0].Uid != 2 {
+		t.Errorf("Expected only message with UID 2 to remain, got %v", msgs)
+	}
+	if n := countBlobs(t, be); n != 1 {
+		t.Errorf("Expected expunged contents to be removed, got %v blobs", n)
+	}
+}
+
+func TestMailbox_SearchMessages(t *testing.T) {
+	_, u := newTestBackend(t, filepath.Join(t.TempDir(), "imap.db"))
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	if err := mbox.CreateMessage([]string{imap.SeenFlag}, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	criteria := &imap.SearchCriteria{
+		WithoutFlags: []string{imap.SeenFlag},
+		Body:         []string{"hi there"},
+	}
+	ids, err := mbox.SearchMessages(true, criteria)
+	if err != nil {
+		t.Fatal("Expected no error while searching, got:", err)
+	}
+	if !reflect.DeepEqual(ids, []uint32{2}) {
+		t.Errorf("Invalid search results: %v", ids)
+	}
+}
+
+func TestMailbox_CopyMessages(t *testing.T) {
+	be, u := newTestBackend(t, filepath.Join(t.TempDir(), "imap.db"))
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	date := time.Date(2016, time.May, 11, 14, 31, 59, 0, time.UTC)
+	if err := mbox.CreateMessage([]string{"$Important"}, date, bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	seqSet, _ := imap.ParseSeqSet("1")
+	if err := mbox.CopyMessages(false, seqSet, "Archive"); err != nil {
+		t.Fatal("Expected no error while copying, got:", err)
+	}
+	if err := mbox.CopyMessages(false, seqSet, "Missing"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected no such mailbox error, got: %v", err)
+	}
+
+	items := []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, imap.FetchEmailId}
+	msgs := backendtest.ListMessages(t, backendtest.GetMailbox(t, u, "Archive"), false, "1:*", items...)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one message, got %v", len(msgs))
+	}
+	if !reflect.DeepEqual(msgs[0].Flags, []string{"$important", imap.RecentFlag}) {
+		t.Errorf("Invalid flags: %v", msgs[0].Flags)
+	}
+	if !msgs[0].InternalDate.Equal(date) {
+		t.Errorf("Invalid internal date: %v", msgs[0].InternalDate)
+	}
+	if orig := backendtest.ListMessages(t, mbox, false, "1:*", items...); msgs[0].EmailId != orig[0].EmailId {
+		t.Errorf("Expected copies to share the same EMAILID, got %v and %v", msgs[0].EmailId, orig[0].EmailId)
+	}
+
+	// Contents are shared between copies
+	if n := countBlobs(t, be); n != 1 {
+		t.Errorf("Expected one blob, got %v", n)
+	}
+	if err := u.DeleteMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, be); n != 1 {
+		t.Errorf("Expected the blob to be kept, got %v blobs", n)
+	}
+}
+
+func TestUser_mailboxes(t *testing.T) {
+	_, u := newTestBackend(t, filepath.Join(t.TempDir(), "imap.db"))
+
+	if err := u.CreateMailbox("Work/Projects"); err != nil {
+		t.Fatal("Expected no error while creating mailbox, got:", err)
+	}
+	if err := u.CreateMailbox("Work"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("Expected mailbox already exists error, got: %v", err)
+	}
+	if err := u.CreateMailbox("Work//Bad"); err == nil {
+		t.Error("Expected an error when creating a mailbox with an empty name part")
+	}
+
+	names := backendtest.MailboxNames(t, u, false)
+	if want := []string{"INBOX", "Work", "Work/Projects"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Invalid mailboxes: got %v, want %v", names, want)
+	}
+
+	if err := u.RenameMailbox("Work", "Jobs"); err != nil {
+		t.Fatal("Expected no error while renaming mailbox, got:", err)
+	}
+	names = backendtest.MailboxNames(t, u, false)
+	if want := []string{"INBOX", "Jobs", "Jobs/Projects"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Invalid mailboxes after rename: got %v, want %v", names, want)
+	}
+
+	mbox := backendtest.GetMailbox(t, u, "Jobs/Projects")
+	if err := mbox.SetSubscribed(true); err != nil {
+		t.Fatal(err)
+	}
+	if names := backendtest.MailboxNames(t, u, true); !reflect.DeepEqual(names, []string{"Jobs/Projects"}) {
+		t.Errorf("Invalid subscribed mailboxes: %v", names)
+	}
+
+	if err := u.DeleteMailbox("Jobs"); err != nil {
+		t.Fatal("Expected no error while deleting mailbox, got:", err)
+	}
+	if err := u.DeleteMailbox("INBOX"); err == nil {
+		t.Error("Expected an error when deleting INBOX")
+	}
+	names = backendtest.MailboxNames(t, u, false)
+	if want := []string{"INBOX", "Jobs/Projects"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Invalid mailboxes after delete: got %v, want %v", names, want)
+	}
+
+	if _, err := u.GetMailbox("Jobs"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected no such mailbox error, got: %v", err)
+	}
+}
+
+func TestUser_DeleteMailbox_uidNext(t *testing.T) {
+	_, u := newTestBackend(t, filepath.Join(t.TempDir(), "imap.db"))
+
+	items := []imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext}
+	for _, name := range []string{"Archive", "Old"} {
+		if err := u.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+		mbox := backendtest.GetMailbox(t, u, name)
+		for i := 0; i < 2; i++ {
+			if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	status, err := backendtest.GetMailbox(t, u, "Archive").Status(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new incarnation must not reuse UIDs
+	if err := u.DeleteMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	newStatus, err := backendtest.GetMailbox(t, u, "Archive").Status(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newStatus.UidValidity != status.UidValidity || newStatus.UidNext != status.UidNext {
+		t.Errorf("Invalid status after re-creating: got %v %v, want %v %v",
+			newStatus.UidValidity, newStatus.UidNext, status.UidValidity, status.UidNext)
+	}
+
+	// Same after a rename
+	if err := u.RenameMailbox("Archive", "Renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	newStatus, err = backendtest.GetMailbox(t, u, "Archive").Status(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newStatus.UidNext != status.UidNext {
+		t.Errorf("Invalid UIDNEXT after renaming: got %v, want %v", newStatus.UidNext, status.UidNext)
+	}
+}
+
+func TestUser_RenameMailbox_inbox(t *testing.T) {
+	be, u := newTestBackend(t, filepath.Join(t.TempDir(), "imap.db"))
+	inbox := backendtest.GetMailbox(t, u, "INBOX")
+	if err := inbox.CreateMessage([]string{"$Important"}, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	received := receiveUpdates(be)
+
+	if err := u.RenameMailbox("INBOX", "Old"); err != nil {
+		t.Fatal("Expected no error while renaming INBOX, got:", err)
+	}
+	if update, ok := (<-received).(*backend.ExpungeUpdate); !ok || update.Mailbox() != "INBOX" || update.SeqNum != 1 {
+		t.Errorf("Expected an expunge update, got %+v", update)
+	}
+
+	if msgs := backendtest.ListMessages(t, inbox, false, "1:*", imap.FetchUid); len(msgs) != 0 {
+		t.Errorf("Expected INBOX to be empty, got %v messages", len(msgs))
+	}
+
+	msgs := backendtest.ListMessages(t, backendtest.GetMailbox(t, u, "Old"), false, "1:*", imap.FetchFlags)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one message in the renamed mailbox, got %v", len(msgs))
+	}
+	if !reflect.DeepEqual(msgs[0].Flags, []string{"$important", imap.RecentFlag}) {
+		t.Errorf("Invalid flags: %v", msgs[0].Flags)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.RunTests(t, func() backend.Backend {
+		be, _ := newTestBackend(t, filepath.Join(t.TempDir(), "imap.db"))
+		return be
+	})
+}
@@ -0,0 +1,558 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message/textproto"
+	bolt "go.etcd.io/bbolt"
+)
+
+var permanentFlags = []string{
+	imap.AnsweredFlag,
+	imap.FlaggedFlag,
+	imap.DeletedFlag,
+	imap.SeenFlag,
+	imap.DraftFlag,
+	"\\*",
+}
+
+var errMessageRemoved = errors.New("kv: message has been removed")
+
+type Mailbox struct {
+	user *User
+	name string
+
+	// Set if the mailbox has been selected read-only, recent messages aren't
+	// claimed
+	readOnly bool
+}
+
+// message is a message record with its sequence number and UID.
+type message struct {
+	messageRecord
+	seqNum uint32
+	uid    uint32
+}
+
+// forEach calls f for each message of a mailbox, in UID order.
+func forEach(b *bolt.Bucket, f func(seqNum, uid uint32, msg *messageRecord) error) error {
+	var seqNum uint32
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		seqNum++
+
+		var msg messageRecord
+		if err := json.Unmarshal(v, &msg); err != nil {
+			return err
+		}
+		if err := f(seqNum, binary.BigEndian.Uint32(k), &msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func contains(uid bool, seqSet *imap.SeqSet, seqNum, msgUid uint32) bool {
+	if uid {
+		return seqSet.Contains(msgUid)
+	}
+	return seqSet.Contains(seqNum)
+}
+
+func (mbox *Mailbox) newUpdate() backend.Update {
+	return backend.NewUpdate(mbox.user.username, mbox.name)
+}
+
+// view runs f in a read-only transaction on the mailbox.
+func (mbox *Mailbox) view(f func(tx *bolt.Tx, rec *mailboxRecord, msgs *bolt.Bucket) error) error {
+	return mbox.user.view(func(tx *bolt.Tx, ub *bolt.Bucket) error {
+		rec, err := getMailboxRecord(ub, mbox.name)
+		if err != nil {
+			return err
+		}
+		return f(tx, rec, mailboxMessages(ub, rec))
+	})
+}
+
+// update runs f in a read-write transaction on the mailbox. The mailbox record
+// is saved after f returns.
+func (mbox *Mailbox) update(f func(tx *bolt.Tx, rec *mailboxRecord, msgs *bolt.Bucket) ([]backend.Update, error)) error {
+	return mbox.user.update(func(tx *bolt.Tx, ub *bolt.Bucket) ([]backend.Update, error) {
+		rec, err := getMailboxRecord(ub, mbox.name)
+		if err != nil {
+			return nil, err
+		}
+		updates, err := f(tx, rec, mailboxMessages(ub, rec))
+		if err != nil {
+			return nil, err
+		}
+		return updates, putMailbox(ub, mbox.name, rec)
+	})
+}
+
+// messages returns the messages of the mailbox. If seqSet is nil, all messages
+// are returned. The \Recent flag of the returned messages is claimed by the
+// session, unless the mailbox is read-only.
+func (mbox *Mailbox) messages(uid bool, seqSet *imap.SeqSet) ([]message, error) {
+	var messages []message
+	var recent []uint32
+	err := mbox.view(func(tx *bolt.Tx, rec *mailboxRecord, msgs *bolt.Bucket) error {
+		return forEach(msgs, func(seqNum, msgUid uint32, msg *messageRecord) error {
+			if seqSet == nil || contains(uid, seqSet, seqNum, msgUid) {
+				messages = append(messages, message{*msg, seqNum, msgUid})
+				if msg.Recent {
+					recent = append(recent, msgUid)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil || len(recent) == 0 || mbox.readOnly {
+		return messages, err
+	}
+
+	return messages, mbox.claimRecent(recent)
+}
+
+// claimRecent gives the \Recent flag of messages to the session, unless
+// another session has already claimed it.
+func (mbox *Mailbox) claimRecent(uids []uint32) error {
+	var claimed []uint32
+	err := mbox.update(func(tx *bolt.Tx, rec *mailboxRecord, msgs *bolt.Bucket) ([]backend.Update, error) {
+		claimed = nil
+		for _, uid := range uids {
+			var msg messageRecord
+			if ok, err := getJSON(msgs, uidKey(uid), &msg); err != nil {
+				return nil, err
+			} else if !ok || !msg.Recent {
+				continue
+			}
+
+			msg.Recent = false
+			if err := putJSON(msgs, uidKey(uid), &msg); err != nil {
+				return nil, err
+			}
+			claimed = append(claimed, uid)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	mbox.user.recentSet(mbox.name).Add(claimed...)
+	return nil
+}
+
+// isRecent checks whether a message has been claimed by the session.
+func (mbox *Mailbox) isRecent(uid uint32) bool {
+	return mbox.user.recentSet(mbox.name).Has(uid)
+}
+
+// flags returns the flags of a message as seen by the session.
+func (mbox *Mailbox) flags(msg *message) []string {
+	if !mbox.isRecent(msg.uid) {
+		return msg.Flags
+	}
+	return append(append([]string(nil), msg.Flags...), imap.RecentFlag)
+}
+
+// blob reads message contents.
+func (mbox *Mailbox) blob(key string) ([]byte, error) {
+	var b []byte
+	err := mbox.user.be.db.View(func(tx *bolt.Tx) error {
+		b = getBlob(tx, key)
+		return nil
+	})
+	if err == nil && b == nil {
+		err = errMessageRemoved
+	}
+	return b, err
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{
+		Delimiter: Delimiter,
+		Name:      mbox.name,
+	}
+	return info, nil
+}
+
+// Select implements backend.SelectMailbox.
+func (mbox *Mailbox) Select(readOnly bool) error {
+	mbox.readOnly = readOnly
+	if readOnly {
+		return nil
+	}
+	_, err := mbox.messages(false, nil)
+	return err
+}
+
+// Recent implements backend.SelectMailbox.
+func (mbox *Mailbox) Recent(uid uint32) bool {
+	return mbox.isRecent(uid)
+}
+
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(mbox.name, items)
+	status.PermanentFlags = permanentFlags
+
+	err := mbox.view(func(tx *bolt.Tx, rec *mailboxRecord, msgs *bolt.Bucket) error {
+		status.UidNext = rec.UidNext
+		status.UidValidity = rec.UidValidity
+		status.MailboxId = rec.Id
+
+		flagsMap := make(map[string]bool)
+		return forEach(msgs, func(seqNum, uid uint32, msg *messageRecord) error {
+			status.Messages++
+			status.Size += uint64(msg.Size)
+			if msg.Recent || mbox.isRecent(uid) {
+				status.Recent++
+			}
+
+			seen := false
+			for _, flag := range msg.Flags {
+				if flag == imap.SeenFlag {
+					seen = true
+				}
+				if !flagsMap[flag] {
+					flagsMap[flag] = true
+					status.Flags = append(status.Flags, flag)
+				}
+			}
+			if !seen {
+				status.Unseen++
+				if status.UnseenSeqNum == 0 {
+					status.UnseenSeqNum = seqNum
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+func (mbox *Mailbox) SetSubscribed(subscribed bool) error {
+	return mbox.user.setSubscribed(mbox.name, subscribed)
+}
+
+func (mbox *Mailbox) Check() error {
+	return nil
+}
+
+// emailId returns the RFC 8474 EMAILID of a message. Messages with the same
+// contents share the same blob, and thus the same EMAILID.
+func (msg *message) emailId() string {
+	return "M" + msg.Blob[:24]
+}
+
+func (mbox *Mailbox) fetch(msg *message, items []imap.FetchItem) (*imap.Message, error) {
+	var b []byte
+	headerAndBody := func() (textproto.Header, io.Reader, error) {
+		if b == nil {
+			var err error
+			if b, err = mbox.blob(msg.Blob); err != nil {
+				return textproto.Header{}, nil, err
+			}
+		}
+		body := bufio.NewReader(bytes.NewReader(b))
+		hdr, err := textproto.ReadHeader(body)
+		return hdr, body, err
+	}
+
+	fetched := imap.NewMessage(msg.seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = mbox.flags(msg)
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.Date
+		case imap.FetchRFC822Size:
+			fetched.Size = msg.Size
+		case imap.FetchUid:
+			fetched.Uid = msg.uid
+		case imap.FetchSaveDate:
+			fetched.SaveDate = msg.SaveDate
+		case imap.FetchEmailId:
+			fetched.EmailId = msg.emailId()
+		case imap.FetchThreadId:
+			// Threads are not supported, leave ThreadId empty
+		case imap.FetchPreview:
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Preview, _ = backendutil.FetchPreview(hdr, body)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+		}
+	}
+
+	return fetched, nil
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	// Contents are read in separate transactions, so that a slow client
+	// doesn't keep a transaction open
+	messages, err := mbox.messages(uid, seqSet)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		m, err := mbox.fetch(&messages[i], items)
+		if err == errMessageRemoved {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		ch <- m
+	}
+
+	return nil
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	messages, err := mbox.messages(false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for i := range messages {
+		msg := &messages[i]
+
+		md := &backendutil.Metadata{
+			SeqNum:   msg.seqNum,
+			Uid:      msg.uid,
+			Date:     msg.Date,
+			Flags:    mbox.flags(msg),
+			Size:     msg.Size,
+			SaveDate: msg.SaveDate,
+			EmailId:  msg.emailId(),
+		}
+		open := func() (io.ReadCloser, error) {
+			b, err := mbox.blob(msg.Blob)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}
+
+		ok, err := backendutil.MatchReader(open, md, criteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		id := msg.seqNum
+		if uid {
+			id = msg.uid
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// canonicalFlags canonicalizes flags and removes \Recent, which cannot be
+// changed by clients.
+func canonicalFlags(flags []string) []string {
+	l := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		if flag = imap.CanonicalFlag(flag); flag != imap.RecentFlag {
+			l = append(l, flag)
+		}
+	}
+	return l
+}
+
+// appendMessage adds a message to a mailbox, and returns an update with the new
+// number of messages.
+func appendMessage(rec *mailboxRecord, msgs *bolt.Bucket, msg *messageRecord, update backend.Update) (backend.Update, error) {
+	uid := rec.UidNext
+	rec.UidNext++
+	if err := putJSON(msgs, uidKey(uid), msg); err != nil {
+		return nil, err
+	}
+
+	status := imap.NewMailboxStatus("", []imap.StatusItem{imap.StatusMessages})
+	status.Messages = uint32(countKeys(msgs))
+	return &backend.MailboxUpdate{Update: update, MailboxStatus: status}, nil
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	return mbox.update(func(tx *bolt.Tx, rec *mailboxRecord, msgs *bolt.Bucket) ([]backend.Update, error) {
+		key, err := putBlob(tx, b)
+		if err != nil {
+			return nil, err
+		}
+
+		msg := &messageRecord{
+			Date:     date,
+			SaveDate: time.Now(),
+			Size:     uint32(len(b)),
+			Flags:    canonicalFlags(flags),
+			Blob:     key,
+			Recent:   true,
+		}
+		update, err := appendMessage(rec, msgs, msg, mbox.newUpdate())
+		if err != nil {
+			return nil, err
+		}
+		return []backend.Update{update}, nil
+	})
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return mbox.update(func(tx *bolt.Tx, rec *mailboxRecord, msgs *bolt.Bucket) ([]backend.Update, error) {
+		var updates []backend.Update
+		err := forEach(msgs, func(seqNum, msgUid uint32, msg *messageRecord) error {
+			if !contains(uid, seqset, seqNum, msgUid) {
+				return nil
+			}
+
+			msg.Flags = canonicalFlags(backendutil.UpdateFlags(msg.Flags, op, flags))
+			if err := putJSON(msgs, uidKey(msgUid), msg); err != nil {
+				return err
+			}
+
+			m := imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+			m.Flags = msg.Flags
+			m.Uid = msgUid
+			updates = append(updates, &backend.MessageUpdate{Update: mbox.newUpdate(), Message: m})
+			return nil
+		})
+		return updates, err
+	})
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	destName = imap.CanonicalMailboxName(destName)
+
+	return mbox.user.update(func(tx *bolt.Tx, ub *bolt.Bucket) ([]backend.Update, error) {
+		rec, err := getMailboxRecord(ub, mbox.name)
+		if err != nil {
+			return nil, err
+		}
+		dest, err := getMailboxRecord(ub, destName)
+		if err != nil {
+			return nil, err
+		}
+		destMsgs := mailboxMessages(ub, dest)
+
+		// Collect messages first, the source and destination may be the
+		// same mailbox
+		var copied []*messageRecord
+		err = forEach(mailboxMessages(ub, rec), func(seqNum, msgUid uint32, msg *messageRecord) error {
+			if contains(uid, seqset, seqNum, msgUid) {
+				copied = append(copied, msg)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var update backend.Update
+		for _, msg := range copied {
+			if err := refBlob(tx, msg.Blob, 1); err != nil {
+				return nil, err
+			}
+			msg.SaveDate = time.Now()
+			msg.Recent = true
+			update, err = appendMessage(dest, destMsgs, msg, backend.NewUpdate(mbox.user.username, destName))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if update == nil {
+			return nil, nil
+		}
+		return []backend.Update{update}, putMailbox(ub, destName, dest)
+	})
+}
+
+func (mbox *Mailbox) Expunge() error {
+	return mbox.update(func(tx *bolt.Tx, rec *mailboxRecord, msgs *bolt.Bucket) ([]backend.Update, error) {
+		var seqNums, uids []uint32
+		err := forEach(msgs, func(seqNum, uid uint32, msg *messageRecord) error {
+			for _, flag := range msg.Flags {
+				if flag == imap.DeletedFlag {
+					seqNums = append(seqNums, seqNum)
+					uids = append(uids, uid)
+					return refBlob(tx, msg.Blob, -1)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Send expunges from the end, so that sequence numbers stay valid
+		var updates []backend.Update
+		for i := len(uids) - 1; i >= 0; i-- {
+			if err := msgs.Delete(uidKey(uids[i])); err != nil {
+				return nil, err
+			}
+			updates = append(updates, &backend.ExpungeUpdate{
+				Update: mbox.newUpdate(),
+				SeqNum: seqNums[i],
+				Uid:    uids[i],
+			})
+		}
+		return updates, nil
+	})
+}
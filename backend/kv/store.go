@@ -0,0 +1,257 @@
+package kv
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Top-level buckets.
+var (
+	usersBucket = []byte("users")
+	blobsBucket = []byte("blobs")
+	refsBucket  = []byte("refs")
+	metaBucket  = []byte("meta")
+)
+
+// Keys of the meta bucket.
+var uidValidityKey = []byte("uidvalidity")
+
+// Keys and buckets of a user bucket.
+var (
+	passwordKey         = []byte("password")
+	mailboxesBucket     = []byte("mailboxes")
+	messagesBucket      = []byte("messages")
+	subscriptionsBucket = []byte("subscriptions")
+)
+
+// mailboxRecord is stored in the mailboxes bucket of a user, keyed by mailbox
+// name. Deleted mailboxes are kept to preserve their UID counters.
+type mailboxRecord struct {
+	Id          string
+	UidValidity uint32
+	UidNext     uint32
+	// The key of the mailbox messages in the messages bucket of the user
+	Messages uint64 `json:",omitempty"`
+	Deleted  bool   `json:",omitempty"`
+}
+
+// messageRecord is stored in the messages bucket of a mailbox, keyed by UID.
+// The message contents are stored in the blobs bucket, keyed by their SHA-256
+// hash.
+type messageRecord struct {
+	Date     time.Time
+	SaveDate time.Time
+	Size     uint32
+	Flags    []string
+	Blob     string
+	// Set until a session claims the \Recent flag of the message
+	Recent bool `json:",omitempty"`
+}
+
+func uidKey(uid uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uid)
+	return b
+}
+
+func idKey(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+func userBucket(tx *bolt.Tx, username string) *bolt.Bucket {
+	return tx.Bucket(usersBucket).Bucket([]byte(username))
+}
+
+func getJSON(b *bolt.Bucket, key []byte, v interface{}) (bool, error) {
+	data := b.Get(key)
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// getMailboxRecord returns the record of an existing mailbox.
+func getMailboxRecord(ub *bolt.Bucket, name string) (*mailboxRecord, error) {
+	var rec mailboxRecord
+	ok, err := getJSON(ub.Bucket(mailboxesBucket), []byte(name), &rec)
+	if err != nil {
+		return nil, err
+	} else if !ok || rec.Deleted {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return &rec, nil
+}
+
+func putMailbox(ub *bolt.Bucket, name string, rec *mailboxRecord) error {
+	return putJSON(ub.Bucket(mailboxesBucket), []byte(name), rec)
+}
+
+func mailboxMessages(ub *bolt.Bucket, rec *mailboxRecord) *bolt.Bucket {
+	return ub.Bucket(messagesBucket).Bucket(idKey(rec.Messages))
+}
+
+func countKeys(b *bolt.Bucket) int {
+	n := 0
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+// newMessagesBucket creates an empty messages bucket for a mailbox.
+func newMessagesBucket(ub *bolt.Bucket, rec *mailboxRecord) error {
+	b := ub.Bucket(messagesBucket)
+	id, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	rec.Messages = id
+	_, err = b.CreateBucket(idKey(id))
+	return err
+}
+
+// nextUidValidity returns a new UIDVALIDITY value. It's based on the current
+// time, so that values aren't reused if the database is re-created.
+func nextUidValidity(tx *bolt.Tx) (uint32, error) {
+	b := tx.Bucket(metaBucket)
+
+	v := uint32(time.Now().Unix())
+	if last := b.Get(uidValidityKey); last != nil {
+		if l := binary.BigEndian.Uint32(last); v <= l {
+			v = l + 1
+		}
+	}
+	return v, b.Put(uidValidityKey, uidKey(v))
+}
+
+// putBlob stores message contents and returns their key. Identical contents
+// are only stored once.
+func putBlob(tx *bolt.Tx, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+
+	if tx.Bucket(blobsBucket).Get([]byte(key)) == nil {
+		if err := tx.Bucket(blobsBucket).Put([]byte(key), data); err != nil {
+			return "", err
+		}
+	}
+	return key, refBlob(tx, key, 1)
+}
+
+// refBlob adds delta to the reference count of a blob, and deletes it when it's
+// no longer referenced.
+func refBlob(tx *bolt.Tx, key string, delta int64) error {
+	refs := tx.Bucket(refsBucket)
+
+	var n int64
+	if b := refs.Get([]byte(key)); b != nil {
+		n = int64(binary.BigEndian.Uint64(b))
+	}
+	n += delta
+
+	if n <= 0 {
+		if err := refs.Delete([]byte(key)); err != nil {
+			return err
+		}
+		return tx.Bucket(blobsBucket).Delete([]byte(key))
+	}
+	return refs.Put([]byte(key), idKey(uint64(n)))
+}
+
+// getBlob returns a copy of message contents, which remains valid after the
+// transaction.
+func getBlob(tx *bolt.Tx, key string) []byte {
+	data := tx.Bucket(blobsBucket).Get([]byte(key))
+	if data == nil {
+		return nil
+	}
+	return append([]byte(nil), data...)
+}
+
+// deleteMessages removes all messages of a mailbox.
+func deleteMessages(tx *bolt.Tx, ub *bolt.Bucket, rec *mailboxRecord) error {
+	b := mailboxMessages(ub, rec)
+	if b == nil {
+		return nil
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		var msg messageRecord
+		if err := json.Unmarshal(v, &msg); err != nil {
+			return err
+		}
+		return refBlob(tx, msg.Blob, -1)
+	})
+	if err != nil {
+		return err
+	}
+	return ub.Bucket(messagesBucket).DeleteBucket(idKey(rec.Messages))
+}
+
+const (
+	pbkdf2Iterations = 100000
+	pbkdf2KeyLen     = 32
+)
+
+// hashPassword hashes a password with PBKDF2.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, pbkdf2KeyLen)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", pbkdf2Iterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1
+}
@@ -0,0 +1,352 @@
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	bolt "go.etcd.io/bbolt"
+)
+
+// User is a session of a user. Each login creates a new session.
+type User struct {
+	be       *Backend
+	username string
+
+	// Messages whose \Recent flag has been claimed by this session, by
+	// mailbox name
+	recentLocker sync.Mutex
+	recent       map[string]*backendutil.RecentSet
+}
+
+// recentSet returns the messages of a mailbox whose \Recent flag has been
+// claimed by the session.
+func (u *User) recentSet(name string) *backendutil.RecentSet {
+	u.recentLocker.Lock()
+	defer u.recentLocker.Unlock()
+
+	if u.recent == nil {
+		u.recent = make(map[string]*backendutil.RecentSet)
+	}
+	set, ok := u.recent[name]
+	if !ok {
+		set = new(backendutil.RecentSet)
+		u.recent[name] = set
+	}
+	return set
+}
+
+// renameRecentSets moves the claimed \Recent flags of a renamed mailbox and
+// of its inferior hierarchical names. The messages of INBOX are moved to the
+// new mailbox, but not its inferior hierarchical names.
+func (u *User) renameRecentSets(existingName, newName string) {
+	u.recentLocker.Lock()
+	defer u.recentLocker.Unlock()
+
+	for name, set := range u.recent {
+		var to string
+		switch {
+		case name == existingName:
+			to = newName
+		case existingName != imap.InboxName && strings.HasPrefix(name, existingName+Delimiter):
+			to = newName + strings.TrimPrefix(name, existingName)
+		default:
+			continue
+		}
+		delete(u.recent, name)
+		u.recent[to] = set
+	}
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+// view runs f in a read-only transaction on the user bucket.
+func (u *User) view(f func(tx *bolt.Tx, ub *bolt.Bucket) error) error {
+	return u.be.db.View(func(tx *bolt.Tx) error {
+		ub := userBucket(tx, u.username)
+		if ub == nil {
+			return ErrNoSuchUser
+		}
+		return f(tx, ub)
+	})
+}
+
+// update runs f in a read-write transaction on the user bucket, and sends the
+// returned updates once it's committed.
+func (u *User) update(f func(tx *bolt.Tx, ub *bolt.Bucket) ([]backend.Update, error)) error {
+	var updates []backend.Update
+	err := u.be.db.Update(func(tx *bolt.Tx) error {
+		ub := userBucket(tx, u.username)
+		if ub == nil {
+			return ErrNoSuchUser
+		}
+
+		var err error
+		updates, err = f(tx, ub)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	u.be.notify(updates)
+	return nil
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	var mailboxes []backend.Mailbox
+	err := u.view(func(tx *bolt.Tx, ub *bolt.Bucket) error {
+		subs := ub.Bucket(subscriptionsBucket)
+		return ub.Bucket(mailboxesBucket).ForEach(func(k, v []byte) error {
+			var rec mailboxRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if rec.Deleted || (subscribed && subs.Get(k) == nil) {
+				return nil
+			}
+
+			mailboxes = append(mailboxes, &Mailbox{user: u, name: string(k)})
+			return nil
+		})
+	})
+	return mailboxes, err
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	name = imap.CanonicalMailboxName(name)
+	err := u.view(func(tx *bolt.Tx, ub *bolt.Bucket) error {
+		_, err := getMailboxRecord(ub, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Mailbox{user: u, name: name}, nil
+}
+
+var errInvalidName = errors.New("kv: invalid mailbox name")
+
+func validMailboxName(name string) bool {
+	for _, part := range strings.Split(name, Delimiter) {
+		if part == "" {
+			return false
+		}
+	}
+	return !strings.ContainsRune(name, 0)
+}
+
+// createMailbox creates a mailbox. If a mailbox with the same name has been
+// deleted, its UIDVALIDITY and next UID are reused.
+func createMailbox(tx *bolt.Tx, ub *bolt.Bucket, name string) error {
+	var rec mailboxRecord
+	ok, err := getJSON(ub.Bucket(mailboxesBucket), []byte(name), &rec)
+	if err != nil {
+		return err
+	} else if ok && !rec.Deleted {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	if !ok {
+		rec.UidValidity, err = nextUidValidity(tx)
+		if err != nil {
+			return err
+		}
+		rec.UidNext = 1
+	}
+	rec.Id = newObjectId()
+	rec.Deleted = false
+	if err := newMessagesBucket(ub, &rec); err != nil {
+		return err
+	}
+	return putMailbox(ub, name, &rec)
+}
+
+func (u *User) CreateMailbox(name string) error {
+	name = strings.TrimSuffix(name, Delimiter)
+	if imap.CanonicalMailboxName(name) == imap.InboxName {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if !validMailboxName(name) {
+		return errInvalidName
+	}
+
+	return u.update(func(tx *bolt.Tx, ub *bolt.Bucket) ([]backend.Update, error) {
+		// Create superior hierarchical names
+		parts := strings.Split(name, Delimiter)
+		for i := 1; i < len(parts); i++ {
+			parent := strings.Join(parts[:i], Delimiter)
+			if err := createMailbox(tx, ub, parent); err != nil && err != backend.ErrMailboxAlreadyExists {
+				return nil, err
+			}
+		}
+
+		return nil, createMailbox(tx, ub, name)
+	})
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	name = imap.CanonicalMailboxName(name)
+	if name == imap.InboxName {
+		return errors.New("Cannot delete INBOX")
+	}
+
+	return u.update(func(tx *bolt.Tx, ub *bolt.Bucket) ([]backend.Update, error) {
+		rec, err := getMailboxRecord(ub, name)
+		if err != nil {
+			return nil, err
+		}
+
+		// Inferior hierarchical names aren't removed. The record is kept to
+		// preserve the UID counter.
+		if err := deleteMessages(tx, ub, rec); err != nil {
+			return nil, err
+		}
+		rec.Messages = 0
+		rec.Deleted = true
+		return nil, putMailbox(ub, name, rec)
+	})
+}
+
+// renameMailbox moves a mailbox record to a new name. The old name keeps its
+// UID counter.
+func renameMailbox(ub *bolt.Bucket, existingName, newName string) error {
+	rec, err := getMailboxRecord(ub, existingName)
+	if err != nil {
+		return err
+	}
+	if _, err := getMailboxRecord(ub, newName); err == nil {
+		return backend.ErrMailboxAlreadyExists
+	} else if err != backend.ErrNoSuchMailbox {
+		return err
+	}
+
+	if err := putMailbox(ub, newName, rec); err != nil {
+		return err
+	}
+	return putMailbox(ub, existingName, &mailboxRecord{
+		UidValidity: rec.UidValidity,
+		UidNext:     rec.UidNext,
+		Deleted:     true,
+	})
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	existingName = imap.CanonicalMailboxName(existingName)
+	newName = strings.TrimSuffix(newName, Delimiter)
+	if imap.CanonicalMailboxName(newName) == imap.InboxName {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if !validMailboxName(newName) {
+		return errInvalidName
+	}
+	if strings.HasPrefix(newName, existingName+Delimiter) {
+		return errors.New("Cannot rename a mailbox to one of its inferior hierarchical names")
+	}
+
+	err := u.update(func(tx *bolt.Tx, ub *bolt.Bucket) ([]backend.Update, error) {
+		if existingName == imap.InboxName {
+			return renameInbox(tx, ub, u.username, newName)
+		}
+
+		// Collect inferior hierarchical names before renaming anything
+		var inferiors []string
+		prefix := existingName + Delimiter
+		c := ub.Bucket(mailboxesBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			var rec mailboxRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return nil, err
+			}
+			if !rec.Deleted {
+				inferiors = append(inferiors, string(k))
+			}
+		}
+
+		if err := renameMailbox(ub, existingName, newName); err != nil {
+			return nil, err
+		}
+		for _, name := range inferiors {
+			to := newName + Delimiter + strings.TrimPrefix(name, prefix)
+			if err := renameMailbox(ub, name, to); err != nil {
+				return nil, err
+			}
+		}
+
+		// Create superior hierarchical names
+		parts := strings.Split(newName, Delimiter)
+		for i := 1; i < len(parts); i++ {
+			parent := strings.Join(parts[:i], Delimiter)
+			if err := createMailbox(tx, ub, parent); err != nil && err != backend.ErrMailboxAlreadyExists {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err == nil {
+		u.renameRecentSets(existingName, newName)
+	}
+	return err
+}
+
+// renameInbox moves all messages in INBOX to a new mailbox, leaving INBOX
+// empty. The new mailbox gets a new identifier, see RFC 8474 section 4.2, and
+// a new UIDVALIDITY.
+func renameInbox(tx *bolt.Tx, ub *bolt.Bucket, username, newName string) ([]backend.Update, error) {
+	inbox, err := getMailboxRecord(ub, imap.InboxName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getMailboxRecord(ub, newName); err == nil {
+		return nil, backend.ErrMailboxAlreadyExists
+	} else if err != backend.ErrNoSuchMailbox {
+		return nil, err
+	}
+
+	n := countKeys(mailboxMessages(ub, inbox))
+
+	moved := *inbox
+	moved.Id = newObjectId()
+	moved.UidValidity, err = nextUidValidity(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := putMailbox(ub, newName, &moved); err != nil {
+		return nil, err
+	}
+	if err := newMessagesBucket(ub, inbox); err != nil {
+		return nil, err
+	}
+	if err := putMailbox(ub, imap.InboxName, inbox); err != nil {
+		return nil, err
+	}
+
+	var updates []backend.Update
+	for seqNum := n; seqNum > 0; seqNum-- {
+		updates = append(updates, &backend.ExpungeUpdate{
+			Update: backend.NewUpdate(username, imap.InboxName),
+			SeqNum: uint32(seqNum),
+		})
+	}
+	return updates, nil
+}
+
+func (u *User) setSubscribed(name string, subscribed bool) error {
+	return u.update(func(tx *bolt.Tx, ub *bolt.Bucket) ([]backend.Update, error) {
+		subs := ub.Bucket(subscriptionsBucket)
+		if subscribed {
+			return nil, subs.Put([]byte(name), []byte{})
+		}
+		return nil, subs.Delete([]byte(name))
+	})
+}
+
+func (u *User) Logout() error {
+	return nil
+}
@@ -76,3 +76,21 @@ type Mailbox interface {
 	// via an expunge update.
 	Expunge() error
 }
+
+// SelectMailbox is a Mailbox keeping track of the \Recent flag per session, as
+// required by RFC 3501 section 2.3.2. Message updates are broadcast to all
+// sessions without \Recent: the server adds it to the flags sent to the
+// session which has claimed it.
+type SelectMailbox interface {
+	Mailbox
+
+	// Select is called when the mailbox is selected. Unless readOnly is set,
+	// the session claims the \Recent flag of recent messages, which aren't
+	// recent in other sessions anymore. It's called before Status, so that
+	// the number of recent messages reported to the session is accurate.
+	Select(readOnly bool) error
+
+	// Recent checks whether the session has claimed the \Recent flag of a
+	// message.
+	Recent(uid uint32) bool
+}
@@ -0,0 +1,118 @@
+// Package maildir implements an IMAP backend storing messages in Maildir++
+// directories.
+//
+// Each user has a Maildir++ directory named after its username in the root
+// directory. INBOX is stored in the user directory itself and other mailboxes
+// are stored in sub-directories whose names start with a dot, with "." as the
+// hierarchy delimiter.
+//
+// UIDs are stored in an imap-uidlist file in each mailbox directory. System
+// flags are stored in the info part of filenames, keywords are mapped to
+// lowercase letters with an imap-keywords file.
+//
+// Messages delivered to the new directory by an external MDA are detected when
+// the mailbox is polled, and reported as backend updates.
+package maildir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// Delimiter is the mailbox hierarchy delimiter.
+const Delimiter = "."
+
+// Backend is a Maildir backend.
+type Backend struct {
+	root string
+	auth func(username, password string) error
+
+	locker    sync.Mutex
+	mailboxes map[string]*mailboxState
+	notifier  backendutil.Notifier
+}
+
+// New creates a new Maildir backend storing users in the root directory. auth
+// is called to check user credentials, and should return an error if they are
+// incorrect.
+func New(root string, auth func(username, password string) error) *Backend {
+	return &Backend{
+		root:      root,
+		auth:      auth,
+		mailboxes: make(map[string]*mailboxState),
+	}
+}
+
+func validUsername(username string) bool {
+	return username != "" && !strings.HasPrefix(username, ".") && !strings.ContainsAny(username, "/\\\x00")
+}
+
+func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	if !validUsername(username) {
+		return nil, backend.ErrInvalidCredentials
+	}
+	if err := be.auth(username, password); err != nil {
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	path := filepath.Join(be.root, username)
+	if err := createMaildir(path); err != nil {
+		return nil, err
+	}
+
+	return &User{be: be, username: username, path: path}, nil
+}
+
+// Updates implements backend.BackendUpdater.
+func (be *Backend) Updates() <-chan backend.Update {
+	return be.notifier.Updates()
+}
+
+// state returns the shared state of a mailbox directory.
+func (be *Backend) state(username, name, path string) *mailboxState {
+	be.locker.Lock()
+	defer be.locker.Unlock()
+
+	s, ok := be.mailboxes[path]
+	if !ok {
+		s = &mailboxState{username: username, name: name, path: path}
+		be.mailboxes[path] = s
+	}
+	return s
+}
+
+// forgetState drops the shared state of mailbox directories whose path starts
+// with prefix, for instance after the directory has been deleted or renamed.
+func (be *Backend) forgetState(prefix string) {
+	be.locker.Lock()
+	defer be.locker.Unlock()
+
+	for path := range be.mailboxes {
+		if path == prefix || strings.HasPrefix(path, prefix+Delimiter) {
+			delete(be.mailboxes, path)
+		}
+	}
+}
+
+func createMaildir(path string) error {
+	for _, dir := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isMaildir(path string) bool {
+	fi, err := os.Stat(filepath.Join(path, "cur"))
+	return err == nil && fi.IsDir()
+}
+
+var errInvalidName = errors.New("maildir: invalid mailbox name")
@@ -0,0 +1,487 @@
+package maildir
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message/textproto"
+)
+
+var permanentFlags = []string{
+	imap.AnsweredFlag,
+	imap.FlaggedFlag,
+	imap.DeletedFlag,
+	imap.SeenFlag,
+	imap.DraftFlag,
+	"$Forwarded",
+	"\\*",
+}
+
+type Mailbox struct {
+	name  string
+	user  *User
+	state *mailboxState
+
+	// Messages whose \Recent flag has been claimed by this session
+	recent backendutil.RecentSet
+	// Set if the mailbox has been selected read-only, recent messages aren't
+	// claimed
+	readOnly bool
+}
+
+// claim gives the \Recent flag of a message to the session, if no other
+// session has it.
+func (mbox *Mailbox) claim(msg *message) {
+	if msg.recent && !mbox.readOnly {
+		msg.recent = false
+		mbox.recent.Add(msg.uid)
+	}
+}
+
+// update locks the mailbox state, synchronizes it with the directory, calls f
+// and sends the resulting updates.
+func (mbox *Mailbox) update(f func(s *mailboxState) error) error {
+	s := mbox.state
+	s.Lock()
+	updates, err := s.locked(func() ([]backend.Update, error) {
+		updates, err := s.sync()
+		if err != nil || f == nil {
+			return updates, err
+		}
+		if err := f(s); err != nil {
+			return updates, err
+		}
+		more, err := s.sync()
+		return append(updates, more...), err
+	})
+	s.Unlock()
+
+	mbox.user.be.notifier.Notify(updates...)
+	return err
+}
+
+func (mbox *Mailbox) sync() error {
+	return mbox.update(nil)
+}
+
+// snapshot returns a copy of the mailbox messages and their flags, so that they
+// can be read without holding the state lock. Recent messages are claimed by
+// the session, unless the mailbox is read-only.
+func (mbox *Mailbox) snapshot() ([]message, [][]string, error) {
+	s := mbox.state
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.loaded {
+		if _, err := s.locked(s.sync); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	messages := make([]message, len(s.messages))
+	flags := make([][]string, len(s.messages))
+	for i, msg := range s.messages {
+		mbox.claim(msg)
+		messages[i] = *msg
+		flags[i] = mbox.recent.Flags(msg.uid, s.flags(msg))
+	}
+	return messages, flags, nil
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{
+		Delimiter: Delimiter,
+		Name:      mbox.name,
+	}
+	return info, nil
+}
+
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(mbox.name, items)
+
+	err := mbox.update(func(s *mailboxState) error {
+		status.PermanentFlags = permanentFlags
+
+		flagsMap := make(map[string]bool)
+		for i, msg := range s.messages {
+			if msg.recent || mbox.recent.Has(msg.uid) {
+				status.Recent++
+			}
+
+			seen := false
+			for _, flag := range s.flags(msg) {
+				if flag == imap.SeenFlag {
+					seen = true
+				}
+				flagsMap[flag] = true
+			}
+			if !seen {
+				status.Unseen++
+				if status.UnseenSeqNum == 0 {
+					status.UnseenSeqNum = uint32(i + 1)
+				}
+			}
+		}
+		for flag := range flagsMap {
+			status.Flags = append(status.Flags, flag)
+		}
+
+		status.Messages = uint32(len(s.messages))
+		status.UidNext = s.uidNext
+		status.UidValidity = s.uidValidity
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// Select implements backend.SelectMailbox.
+func (mbox *Mailbox) Select(readOnly bool) error {
+	return mbox.update(func(s *mailboxState) error {
+		mbox.readOnly = readOnly
+		for _, msg := range s.messages {
+			mbox.claim(msg)
+		}
+		return nil
+	})
+}
+
+// Recent implements backend.SelectMailbox.
+func (mbox *Mailbox) Recent(uid uint32) bool {
+	return mbox.recent.Has(uid)
+}
+
+func (mbox *Mailbox) SetSubscribed(subscribed bool) error {
+	return mbox.user.setSubscribed(mbox.name, subscribed)
+}
+
+func (mbox *Mailbox) Check() error {
+	return mbox.sync()
+}
+
+// Poll implements backend.MailboxPoller. It detects messages delivered,
+// removed or modified by other processes.
+func (mbox *Mailbox) Poll() error {
+	return mbox.sync()
+}
+
+func (mbox *Mailbox) open(msg *message) (*os.File, error) {
+	return os.Open(filepath.Join(mbox.state.path, msg.filename()))
+}
+
+func (mbox *Mailbox) fetch(seqNum uint32, msg *message, flags []string, items []imap.FetchItem) (*imap.Message, error) {
+	f, err := mbox.open(msg)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr textproto.Header
+	var body *bufio.Reader
+	headerAndBody := func() (textproto.Header, io.Reader, error) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return hdr, nil, err
+		}
+		body = bufio.NewReader(f)
+		hdr, err = textproto.ReadHeader(body)
+		return hdr, body, err
+	}
+
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = fi.ModTime()
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(fi.Size())
+		case imap.FetchUid:
+			fetched.Uid = msg.uid
+		case imap.FetchPreview:
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Preview, _ = backendutil.FetchPreview(hdr, body)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+		}
+	}
+
+	return fetched, nil
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	messages, flags, err := mbox.snapshot()
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		msg := &messages[i]
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		m, err := mbox.fetch(seqNum, msg, flags[i], items)
+		if os.IsNotExist(err) {
+			// Removed by another process, the next sync will expunge it
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		ch <- m
+	}
+
+	return nil
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	messages, flags, err := mbox.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for i := range messages {
+		msg := &messages[i]
+		seqNum := uint32(i + 1)
+
+		fi, err := os.Stat(filepath.Join(mbox.state.path, msg.filename()))
+		if os.IsNotExist(err) {
+			// Removed by another process, the next sync will expunge it
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		md := &backendutil.Metadata{
+			SeqNum: seqNum,
+			Uid:    msg.uid,
+			Date:   fi.ModTime(),
+			Flags:  flags[i],
+			Size:   uint32(fi.Size()),
+		}
+		open := func() (io.ReadCloser, error) {
+			return mbox.open(msg)
+		}
+
+		ok, err := backendutil.MatchReader(open, md, criteria)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// deliver writes a message to the tmp directory of a mailbox, then moves it to
+// the new directory.
+func deliver(s *mailboxState, r io.Reader, date time.Time, info string) error {
+	key := newKey()
+	tmp := filepath.Join(s.path, "tmp", key)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, date, date)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	name := key + ",S=" + strconv.FormatInt(n, 10)
+	if info != "" {
+		name += infoSep + info
+	}
+	if err := os.Rename(tmp, filepath.Join(s.path, "new", name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	return mbox.update(func(s *mailboxState) error {
+		info, err := s.formatInfo(flags)
+		if err != nil {
+			return err
+		}
+		return deliver(s, body, date, info)
+	})
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	var updates []backend.Update
+	err := mbox.update(func(s *mailboxState) error {
+		return s.forEach(uid, seqset, func(seqNum uint32, msg *message) error {
+			newFlags := backendutil.UpdateFlags(s.flags(msg), op, flags)
+			info, err := s.formatInfo(newFlags)
+			if err != nil {
+				return err
+			}
+
+			if info != msg.info {
+				from := filepath.Join(s.path, msg.filename())
+				to := filepath.Join(s.path, "cur", msg.key+infoSep+info)
+				if err := os.Rename(from, to); os.IsNotExist(err) {
+					// Removed by another process, the next sync will expunge it
+					return nil
+				} else if err != nil {
+					return err
+				}
+				msg.info = info
+			}
+
+			updates = append(updates, s.messageUpdate(seqNum, msg))
+			return nil
+		})
+	})
+
+	mbox.user.be.notifier.Notify(updates...)
+	return err
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	dest, err := mbox.user.GetMailbox(destName)
+	if err != nil {
+		return err
+	}
+	destMbox := dest.(*Mailbox)
+
+	messages, flags, err := mbox.snapshot()
+	if err != nil {
+		return err
+	}
+
+	return destMbox.update(func(s *mailboxState) error {
+		for i := range messages {
+			msg := &messages[i]
+			seqNum := uint32(i + 1)
+
+			id := seqNum
+			if uid {
+				id = msg.uid
+			}
+			if !seqset.Contains(id) {
+				continue
+			}
+
+			info, err := s.formatInfo(flags[i])
+			if err != nil {
+				return err
+			}
+
+			f, err := mbox.open(msg)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			fi, err := f.Stat()
+			if err == nil {
+				err = deliver(s, f, fi.ModTime(), info)
+			}
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (mbox *Mailbox) Expunge() error {
+	return mbox.update(func(s *mailboxState) error {
+		for _, msg := range s.messages {
+			deleted := false
+			for _, flag := range s.flags(msg) {
+				if flag == imap.DeletedFlag {
+					deleted = true
+					break
+				}
+			}
+			if !deleted {
+				continue
+			}
+
+			if err := os.Remove(filepath.Join(s.path, msg.filename())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	})
+}
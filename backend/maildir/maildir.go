@@ -0,0 +1,562 @@
+package maildir
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+const (
+	// infoSep separates the unique name of a message from its info, see
+	// https://cr.yp.to/proto/maildir.html
+	infoSep = ":2,"
+
+	uidListFile  = "imap-uidlist"
+	keywordsFile = "imap-keywords"
+)
+
+// maxKeywords is the maximum number of keywords per mailbox. Keywords are
+// stored as lowercase letters in the info of the filename.
+const maxKeywords = 26
+
+// infoFlags maps info letters to IMAP flags. Letters must be sorted.
+var infoFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', imap.DraftFlag},
+	{'F', imap.FlaggedFlag},
+	{'P', "$Forwarded"},
+	{'R', imap.AnsweredFlag},
+	{'S', imap.SeenFlag},
+	{'T', imap.DeletedFlag},
+}
+
+var deliveryCounter uint32
+
+// newKey generates a unique name for a new message, as defined in
+// https://cr.yp.to/proto/maildir.html.
+func newKey() string {
+	now := time.Now()
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+
+	n := atomic.AddUint32(&deliveryCounter, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, host)
+}
+
+// splitFilename splits a message filename into its unique name and its info.
+func splitFilename(name string) (key, info string) {
+	if i := strings.Index(name, infoSep); i >= 0 {
+		return name[:i], name[i+len(infoSep):]
+	}
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		// Experimental or unknown info semantics, drop them
+		return name[:i], ""
+	}
+	return name, ""
+}
+
+type message struct {
+	uid  uint32
+	key  string
+	info string
+	// True if the message was found in the new directory and no session has
+	// claimed its \Recent flag yet
+	recent bool
+}
+
+func (msg *message) filename() string {
+	return filepath.Join("cur", msg.key+infoSep+msg.info)
+}
+
+// mailboxState is the in-memory index of a Maildir directory. All Mailbox
+// values referring to the same directory share the same state, so that all
+// clients see the same sequence numbers. Other processes may change the
+// directory too: the UID list is locked and read again each time the state is
+// synchronized.
+type mailboxState struct {
+	sync.Mutex
+
+	username string
+	name     string
+	path     string
+
+	loaded bool
+	// Modification times of the files read by sync, when it was last called
+	stamp       stamp
+	uidValidity uint32
+	uidNext     uint32
+	keywords    []string
+	messages    []*message
+}
+
+// flags returns the IMAP flags of a message, without \Recent which depends on
+// the session.
+func (s *mailboxState) flags(msg *message) []string {
+	var flags []string
+	for i := 0; i < len(msg.info); i++ {
+		c := msg.info[i]
+		if c >= 'a' && c <= 'z' {
+			if idx := int(c - 'a'); idx < len(s.keywords) {
+				flags = append(flags, s.keywords[idx])
+			}
+			continue
+		}
+		for _, f := range infoFlags {
+			if f.letter == c {
+				flags = append(flags, f.flag)
+				break
+			}
+		}
+	}
+	return flags
+}
+
+// formatInfo converts IMAP flags to info letters, allocating keyword letters
+// as necessary.
+func (s *mailboxState) formatInfo(flags []string) (string, error) {
+	letters := make(map[byte]bool)
+	for _, flag := range flags {
+		flag = imap.CanonicalFlag(flag)
+		if flag == imap.RecentFlag {
+			continue
+		}
+
+		found := false
+		for _, f := range infoFlags {
+			if imap.CanonicalFlag(f.flag) == flag {
+				letters[f.letter] = true
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		letter, err := s.keywordLetter(flag)
+		if err != nil {
+			return "", err
+		}
+		letters[letter] = true
+	}
+
+	var b []byte
+	for c := range letters {
+		b = append(b, c)
+	}
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	return string(b), nil
+}
+
+func (s *mailboxState) keywordLetter(keyword string) (byte, error) {
+	for i, kw := range s.keywords {
+		if kw == keyword {
+			return byte('a' + i), nil
+		}
+	}
+	if strings.HasPrefix(keyword, "\\") {
+		return 0, fmt.Errorf("maildir: unsupported system flag %v", keyword)
+	}
+	if len(s.keywords) >= maxKeywords {
+		return 0, fmt.Errorf("maildir: too many keywords in mailbox %v", s.name)
+	}
+
+	s.keywords = append(s.keywords, keyword)
+	if err := s.writeKeywords(); err != nil {
+		s.keywords = s.keywords[:len(s.keywords)-1]
+		return 0, err
+	}
+	return byte('a' + len(s.keywords) - 1), nil
+}
+
+// writeFileAtomic writes a file in a mailbox directory. The file is first
+// written in tmp, then renamed, so that readers never see a partial file.
+func (s *mailboxState) writeFileAtomic(name string, data []byte) error {
+	tmp := filepath.Join(s.path, "tmp", name+"."+newKey())
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.path, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s *mailboxState) readKeywords() error {
+	f, err := os.Open(filepath.Join(s.path, keywordsFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.keywords = nil
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		i, err := strconv.Atoi(fields[0])
+		if err != nil || i != len(s.keywords) || i >= maxKeywords {
+			return fmt.Errorf("maildir: malformed keywords file in %v", s.path)
+		}
+		s.keywords = append(s.keywords, fields[1])
+	}
+	return scanner.Err()
+}
+
+func (s *mailboxState) writeKeywords() error {
+	var sb strings.Builder
+	for i, kw := range s.keywords {
+		fmt.Fprintf(&sb, "%d %s\n", i, kw)
+	}
+	return s.writeFileAtomic(keywordsFile, []byte(sb.String()))
+}
+
+// readUidList reads the UID list file. The first line contains a version
+// number, the UIDVALIDITY and the next UID. Each following line contains a
+// UID and the unique name of a message.
+func (s *mailboxState) readUidList() error {
+	f, err := os.Open(filepath.Join(s.path, uidListFile))
+	if os.IsNotExist(err) {
+		s.uidValidity = backendutil.NewUidValidity()
+		s.uidNext = 1
+		s.messages = nil
+		return s.writeUidList()
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	malformed := fmt.Errorf("maildir: malformed UID list in %v", s.path)
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return malformed
+	}
+	var version int
+	if _, err := fmt.Sscanf(scanner.Text(), "%d %d %d", &version, &s.uidValidity, &s.uidNext); err != nil || version != 1 {
+		return malformed
+	}
+
+	s.messages = nil
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return malformed
+		}
+		uid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return malformed
+		}
+		s.messages = append(s.messages, &message{uid: uint32(uid), key: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(s.messages, func(i, j int) bool {
+		return s.messages[i].uid < s.messages[j].uid
+	})
+	return nil
+}
+
+func (s *mailboxState) writeUidList() error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "1 %d %d\n", s.uidValidity, s.uidNext)
+	for _, msg := range s.messages {
+		fmt.Fprintf(&sb, "%d %s\n", msg.uid, msg.key)
+	}
+	return s.writeFileAtomic(uidListFile, []byte(sb.String()))
+}
+
+func (s *mailboxState) newUpdate() backend.Update {
+	return backend.NewUpdate(s.username, s.name)
+}
+
+type newFile struct {
+	key, info string
+	modTime   time.Time
+	recent    bool
+}
+
+// lock locks the UID list and keywords files against other processes. It
+// returns a function releasing the lock. The caller must hold the state mutex.
+func (s *mailboxState) lock() (func(), error) {
+	return backendutil.Dotlock(filepath.Join(s.path, uidListFile))
+}
+
+// locked calls f while holding the lock returned by lock.
+func (s *mailboxState) locked(f func() ([]backend.Update, error)) ([]backend.Update, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return f()
+}
+
+// stamp contains the modification times of the files and directories read by
+// sync, in nanoseconds.
+type stamp [4]int64
+
+// stampGranularity is the coarsest modification time granularity of supported
+// file systems. Files modified less than stampGranularity ago may be modified
+// again without changing their modification time.
+const stampGranularity = time.Second
+
+// readStamp returns the modification times of the files read by sync. ok is
+// false if some of them have been modified too recently for the stamp to
+// reliably detect changes.
+func (s *mailboxState) readStamp() (st stamp, ok bool, err error) {
+	ok = true
+	for i, name := range []string{"new", "cur", uidListFile, keywordsFile} {
+		fi, err := os.Stat(filepath.Join(s.path, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return st, false, err
+		}
+		st[i] = fi.ModTime().UnixNano()
+		if time.Since(fi.ModTime()) < stampGranularity {
+			ok = false
+		}
+	}
+	return st, ok, nil
+}
+
+// sync synchronizes the state with the directory contents. Messages delivered
+// to the new directory are moved to cur and get the \Recent flag. It returns
+// the updates describing the changes since the last synchronization. The
+// directory isn't read again if it hasn't been modified since the last
+// synchronization. The caller must hold the lock returned by lock.
+func (s *mailboxState) sync() ([]backend.Update, error) {
+	// Read the stamp first, so that changes made while synchronizing are
+	// detected next time
+	st, stable, err := s.readStamp()
+	if err != nil {
+		return nil, err
+	}
+	if s.loaded && s.stamp == st {
+		return nil, nil
+	}
+
+	notify := s.loaded
+	prev := s.messages
+
+	// Other processes may have assigned UIDs and keywords
+	if err := s.readKeywords(); err != nil {
+		return nil, err
+	}
+	if err := s.readUidList(); err != nil {
+		return nil, err
+	}
+	s.loaded = true
+
+	found := make(map[string]*newFile)
+
+	newEntries, err := ioutil.ReadDir(filepath.Join(s.path, "new"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range newEntries {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+
+		key, info := splitFilename(fi.Name())
+		src := filepath.Join(s.path, "new", fi.Name())
+		dst := filepath.Join(s.path, "cur", key+infoSep+info)
+		if err := os.Rename(src, dst); err != nil {
+			if os.IsNotExist(err) {
+				// Another process moved it first
+				continue
+			}
+			return nil, err
+		}
+		found[key] = &newFile{key: key, info: info, modTime: fi.ModTime(), recent: true}
+	}
+
+	curEntries, err := ioutil.ReadDir(filepath.Join(s.path, "cur"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range curEntries {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+
+		key, info := splitFilename(fi.Name())
+		if f, ok := found[key]; ok {
+			f.info = info
+			continue
+		}
+		found[key] = &newFile{key: key, info: info, modTime: fi.ModTime()}
+	}
+
+	known := make(map[string]*message, len(prev))
+	for _, msg := range prev {
+		known[msg.key] = msg
+	}
+
+	var messages []*message
+	var changed []*message
+	listChanged := false
+	appended := 0
+	for _, msg := range s.messages {
+		f, ok := found[msg.key]
+		if !ok {
+			// The message has been removed
+			listChanged = true
+			continue
+		}
+		delete(found, msg.key)
+
+		if old, ok := known[msg.key]; ok && old.uid == msg.uid {
+			if old.info != f.info {
+				changed = append(changed, old)
+			}
+			msg = old
+		} else {
+			// UID assigned by another process
+			appended++
+		}
+		msg.info = f.info
+		if f.recent {
+			msg.recent = true
+		}
+		messages = append(messages, msg)
+	}
+
+	// Assign UIDs to new messages, in delivery order
+	var added []*newFile
+	for _, f := range found {
+		added = append(added, f)
+	}
+	sort.Slice(added, func(i, j int) bool {
+		if !added[i].modTime.Equal(added[j].modTime) {
+			return added[i].modTime.Before(added[j].modTime)
+		}
+		return added[i].key < added[j].key
+	})
+	for _, f := range added {
+		messages = append(messages, &message{
+			uid:    s.uidNext,
+			key:    f.key,
+			info:   f.info,
+			recent: f.recent,
+		})
+		s.uidNext++
+		appended++
+		listChanged = true
+	}
+
+	s.messages = messages
+	if listChanged {
+		if err := s.writeUidList(); err != nil {
+			return nil, err
+		}
+	}
+	if stable {
+		s.stamp = st
+	} else {
+		s.stamp = stamp{}
+	}
+
+	if !notify {
+		return nil, nil
+	}
+
+	var updates []backend.Update
+	for i := len(prev) - 1; i >= 0; i-- {
+		if _, ok := s.seqNum(prev[i].uid); !ok {
+			updates = append(updates, &backend.ExpungeUpdate{
+				Update: s.newUpdate(),
+				SeqNum: uint32(i + 1),
+				Uid:    prev[i].uid,
+			})
+		}
+	}
+	for _, msg := range changed {
+		seqNum, _ := s.seqNum(msg.uid)
+		updates = append(updates, s.messageUpdate(seqNum, msg))
+	}
+	if appended > 0 {
+		status := imap.NewMailboxStatus(s.name, []imap.StatusItem{imap.StatusMessages, imap.StatusRecent})
+		status.Messages = uint32(len(s.messages))
+		status.Recent = s.recent()
+		updates = append(updates, &backend.MailboxUpdate{
+			Update:        s.newUpdate(),
+			MailboxStatus: status,
+		})
+	}
+	return updates, nil
+}
+
+func (s *mailboxState) messageUpdate(seqNum uint32, msg *message) backend.Update {
+	m := imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+	m.Flags = s.flags(msg)
+	m.Uid = msg.uid
+	return &backend.MessageUpdate{Update: s.newUpdate(), Message: m}
+}
+
+func (s *mailboxState) seqNum(uid uint32) (uint32, bool) {
+	i := sort.Search(len(s.messages), func(i int) bool {
+		return s.messages[i].uid >= uid
+	})
+	if i < len(s.messages) && s.messages[i].uid == uid {
+		return uint32(i + 1), true
+	}
+	return 0, false
+}
+
+func (s *mailboxState) recent() uint32 {
+	var n uint32
+	for _, msg := range s.messages {
+		if msg.recent {
+			n++
+		}
+	}
+	return n
+}
+
+// forEach calls f for each message in seqset.
+func (s *mailboxState) forEach(uid bool, seqset *imap.SeqSet, f func(seqNum uint32, msg *message) error) error {
+	for i, msg := range s.messages {
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if !seqset.Contains(id) {
+			continue
+		}
+
+		if err := f(seqNum, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
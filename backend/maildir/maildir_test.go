@@ -0,0 +1,370 @@
+package maildir
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendtest"
+)
+
+const testMessage = "From: contact@example.org\r\n" +
+	"To: contact@example.org\r\n" +
+	"Subject: A little message, just for you\r\n" +
+	"Date: Wed, 11 May 2016 14:31:59 +0000\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hi there :)"
+
+func newTestBackend(root string) *Backend {
+	return New(root, func(username, password string) error {
+		if username != backendtest.Username || password != backendtest.Password {
+			return errors.New("invalid credentials")
+		}
+		return nil
+	})
+}
+
+// getInbox logs in and returns the INBOX of the test user.
+func getInbox(t *testing.T, be *Backend) backend.Mailbox {
+	u, err := be.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	mbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal("Expected no error while getting INBOX, got:", err)
+	}
+	return mbox
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range entries {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.RunTests(t, func() backend.Backend {
+		return newTestBackend(t.TempDir())
+	})
+}
+
+func TestLogin_invalidUsername(t *testing.T) {
+	be := New(t.TempDir(), func(username, password string) error {
+		return nil
+	})
+
+	for _, username := range []string{"../username", ".username", ""} {
+		if _, err := be.Login(nil, username, "password"); err != backend.ErrInvalidCredentials {
+			t.Errorf("Expected invalid credentials error for %q, got: %v", username, err)
+		}
+	}
+}
+
+func TestMailbox_CreateMessage_layout(t *testing.T) {
+	root := t.TempDir()
+	mbox := getInbox(t, newTestBackend(root))
+
+	flags := []string{imap.SeenFlag, "$Important", imap.AnsweredFlag}
+	if err := mbox.CreateMessage(flags, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("Expected no error while creating message, got:", err)
+	}
+
+	// The message must have been moved to cur, with its flags in its info
+	dir := filepath.Join(root, backendtest.Username)
+	names := dirNames(t, filepath.Join(dir, "cur"))
+	if len(names) != 1 {
+		t.Fatalf("Expected one message in cur, got %v", names)
+	}
+	if !strings.HasSuffix(names[0], ":2,RSa") {
+		t.Errorf("Invalid message filename: %v", names[0])
+	}
+	if len(dirNames(t, filepath.Join(dir, "new"))) != 0 {
+		t.Error("Expected new to be empty")
+	}
+	if len(dirNames(t, filepath.Join(dir, "tmp"))) != 0 {
+		t.Error("Expected tmp to be empty")
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, keywordsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "$important") {
+		t.Errorf("Expected the keyword to be defined, got %q", string(b))
+	}
+}
+
+func TestMailbox_persistence(t *testing.T) {
+	root := t.TempDir()
+	mbox := getInbox(t, newTestBackend(root))
+
+	for i := 0; i < 3; i++ {
+		if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items := []imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext, imap.StatusMessages}
+	status, err := mbox.Status(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload everything from disk
+	mbox = getInbox(t, newTestBackend(root))
+	newStatus, err := mbox.Status(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newStatus.UidValidity != status.UidValidity {
+		t.Errorf("UIDVALIDITY changed: got %v, want %v", newStatus.UidValidity, status.UidValidity)
+	}
+	if newStatus.UidNext != 4 || newStatus.Messages != 3 {
+		t.Errorf("Invalid status: got UIDNEXT %v and MESSAGES %v", newStatus.UidNext, newStatus.Messages)
+	}
+}
+
+func TestMailbox_concurrentProcesses(t *testing.T) {
+	root := t.TempDir()
+	// Two backends sharing a directory behave like two processes
+	mboxes := []backend.Mailbox{
+		getInbox(t, newTestBackend(root)),
+		getInbox(t, newTestBackend(root)),
+	}
+
+	for i := 0; i < 6; i++ {
+		if err := mboxes[i%2].CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, mbox := range mboxes {
+		// Changes made by other processes are picked up when polling
+		if err := mbox.(backend.MailboxPoller).Poll(); err != nil {
+			t.Fatal(err)
+		}
+
+		seqSet, _ := imap.ParseSeqSet("1:*")
+		ch := make(chan *imap.Message, 10)
+		if err := mbox.ListMessages(false, seqSet, []imap.FetchItem{imap.FetchUid}, ch); err != nil {
+			t.Fatal("Expected no error while listing messages, got:", err)
+		}
+		var uids []uint32
+		for msg := range ch {
+			uids = append(uids, msg.Uid)
+		}
+		if want := []uint32{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(uids, want) {
+			t.Errorf("Invalid UIDs seen by backend #%v: got %v, want %v", i+1, uids, want)
+		}
+	}
+}
+
+func TestMailbox_externalDelivery(t *testing.T) {
+	root := t.TempDir()
+	be := newTestBackend(root)
+	mbox := getInbox(t, be)
+
+	updates := be.Updates()
+	done := make(chan []backend.Update)
+	go func() {
+		var received []backend.Update
+		for update := range updates {
+			received = append(received, update)
+			close(update.Done())
+			if _, ok := update.(*backend.MailboxUpdate); ok {
+				break
+			}
+		}
+		done <- received
+	}()
+
+	// Simulate an MDA delivery
+	dir := filepath.Join(root, backendtest.Username)
+	tmp := filepath.Join(dir, "tmp", "1234.external")
+	if err := ioutil.WriteFile(tmp, []byte(testMessage), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "new", "1234.external")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mbox.(backend.MailboxPoller).Poll(); err != nil {
+		t.Fatal("Expected no error while polling, got:", err)
+	}
+
+	received := <-done
+	update, ok := received[len(received)-1].(*backend.MailboxUpdate)
+	if !ok {
+		t.Fatalf("Expected a mailbox update, got %T", received[len(received)-1])
+	}
+	if update.Username() != backendtest.Username || update.Mailbox() != imap.InboxName {
+		t.Errorf("Invalid update target: %v %v", update.Username(), update.Mailbox())
+	}
+	if update.MailboxStatus.Messages != 1 || update.MailboxStatus.Recent != 1 {
+		t.Errorf("Invalid mailbox update: %+v", update.MailboxStatus)
+	}
+
+	if names := dirNames(t, filepath.Join(dir, "cur")); !reflect.DeepEqual(names, []string{"1234.external:2,"}) {
+		t.Errorf("Expected the message to be moved to cur, got %v", names)
+	}
+}
+
+func TestMailbox_Select(t *testing.T) {
+	be := newTestBackend(t.TempDir())
+	first := getInbox(t, be).(backend.SelectMailbox)
+	if err := first.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	second := getInbox(t, be).(backend.SelectMailbox)
+	examined := getInbox(t, be).(backend.SelectMailbox)
+
+	for _, test := range []struct {
+		name     string
+		mbox     backend.SelectMailbox
+		readOnly bool
+		recent   bool
+	}{
+		{"read-only", examined, true, false},
+		{"first", first, false, true},
+		{"second", second, false, false},
+	} {
+		if err := test.mbox.Select(test.readOnly); err != nil {
+			t.Fatalf("Expected no error while selecting %v, got: %v", test.name, err)
+		}
+		status, err := test.mbox.Status([]imap.StatusItem{imap.StatusRecent})
+		if err != nil {
+			t.Fatalf("Expected no error while getting %v status, got: %v", test.name, err)
+		}
+
+		want := uint32(0)
+		if test.recent || test.readOnly {
+			want = 1
+		}
+		if status.Recent != want {
+			t.Errorf("Expected %v recent messages in %v session, got %v", want, test.name, status.Recent)
+		}
+		if recent := test.mbox.Recent(1); recent != test.recent {
+			t.Errorf("Expected Recent to return %v in %v session, got %v", test.recent, test.name, recent)
+		}
+	}
+}
+
+func TestMailbox_syncUnchanged(t *testing.T) {
+	root := t.TempDir()
+	mbox := getInbox(t, newTestBackend(root))
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(root, backendtest.Username)
+	old := time.Now().Add(-time.Hour)
+	setModTimes := func(t time.Time) {
+		for _, name := range []string{"new", "cur", uidListFile} {
+			if err := os.Chtimes(filepath.Join(dir, name), t, t); err != nil {
+				panic(err)
+			}
+		}
+	}
+	messages := func() uint32 {
+		if err := mbox.(backend.MailboxPoller).Poll(); err != nil {
+			t.Fatal("Expected no error while polling, got:", err)
+		}
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal("Expected no error while getting status, got:", err)
+		}
+		return status.Messages
+	}
+
+	setModTimes(old)
+	if n := messages(); n != 1 {
+		t.Fatalf("Expected 1 message, got %v", n)
+	}
+
+	// A change which doesn't update modification times isn't noticed
+	if err := ioutil.WriteFile(filepath.Join(dir, "cur", "1234.external:2,"), []byte(testMessage), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setModTimes(old)
+	if n := messages(); n != 1 {
+		t.Errorf("Expected the directory not to be read again, got %v messages", n)
+	}
+
+	setModTimes(time.Now())
+	if n := messages(); n != 2 {
+		t.Errorf("Expected the modified directory to be read again, got %v messages", n)
+	}
+}
+
+func TestMailbox_ListMessages_readError(t *testing.T) {
+	root := t.TempDir()
+	mbox := getInbox(t, newTestBackend(root))
+
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the message file with a directory, which can't be read
+	cur := filepath.Join(root, backendtest.Username, "cur")
+	names := dirNames(t, cur)
+	if err := os.Remove(filepath.Join(cur, names[0])); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(cur, names[0]), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	seqSet, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	if err := mbox.ListMessages(false, seqSet, []imap.FetchItem{"BODY[]"}, ch); err == nil {
+		t.Error("Expected an error while listing an unreadable message")
+	}
+
+	criteria := &imap.SearchCriteria{Body: []string{"hi there"}}
+	if _, err := mbox.SearchMessages(false, criteria); err == nil {
+		t.Error("Expected an error while searching an unreadable message")
+	}
+}
+
+func TestMailbox_ListMessages_preview(t *testing.T) {
+	mbox := getInbox(t, newTestBackend(t.TempDir()))
+
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := backendtest.ListMessages(t, mbox, false, "1", imap.FetchPreview)
+	if len(messages) != 1 {
+		t.Fatalf("Expected one message, got %v", len(messages))
+	}
+	if messages[0].Preview != "Hi there :)" {
+		t.Errorf("Invalid preview: %q", messages[0].Preview)
+	}
+}
+
+func TestUser_CreateMailbox_invalidName(t *testing.T) {
+	be := newTestBackend(t.TempDir())
+	u, err := be.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.CreateMailbox("Work..Bad"); err == nil {
+		t.Error("Expected an error when creating a mailbox with an empty name part")
+	}
+}
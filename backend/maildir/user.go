@@ -0,0 +1,328 @@
+package maildir
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+const subscriptionsFile = "subscriptions"
+
+type User struct {
+	be       *Backend
+	username string
+	path     string
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+// mailboxPath returns the directory of a mailbox.
+func (u *User) mailboxPath(name string) (string, error) {
+	name = imap.CanonicalMailboxName(name)
+	if name == imap.InboxName {
+		return u.path, nil
+	}
+
+	for _, part := range strings.Split(name, Delimiter) {
+		if part == "" || strings.ContainsAny(part, "/\\\x00") {
+			return "", errInvalidName
+		}
+	}
+	return filepath.Join(u.path, Delimiter+name), nil
+}
+
+func (u *User) mailboxNames() ([]string, error) {
+	entries, err := ioutil.ReadDir(u.path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{imap.InboxName}
+	for _, fi := range entries {
+		name := fi.Name()
+		if !fi.IsDir() || !strings.HasPrefix(name, Delimiter) || name == "." || name == ".." {
+			continue
+		}
+		if !isMaildir(filepath.Join(u.path, name)) {
+			continue
+		}
+		names = append(names, strings.TrimPrefix(name, Delimiter))
+	}
+	sort.Strings(names[1:])
+	return names, nil
+}
+
+func (u *User) readSubscriptions() (map[string]bool, error) {
+	subscribed := make(map[string]bool)
+
+	f, err := os.Open(filepath.Join(u.path, subscriptionsFile))
+	if os.IsNotExist(err) {
+		return subscribed, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name := scanner.Text(); name != "" {
+			subscribed[name] = true
+		}
+	}
+	return subscribed, scanner.Err()
+}
+
+func (u *User) setSubscribed(name string, subscribed bool) error {
+	u.be.locker.Lock()
+	defer u.be.locker.Unlock()
+
+	subs, err := u.readSubscriptions()
+	if err != nil {
+		return err
+	}
+	if subs[name] == subscribed {
+		return nil
+	}
+	if subscribed {
+		subs[name] = true
+	} else {
+		delete(subs, name)
+	}
+
+	var names []string
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tmp := filepath.Join(u.path, "tmp", subscriptionsFile+"."+newKey())
+	data := strings.Join(names, "\n") + "\n"
+	if err := ioutil.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(u.path, subscriptionsFile))
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	names, err := u.mailboxNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var subs map[string]bool
+	if subscribed {
+		u.be.locker.Lock()
+		subs, err = u.readSubscriptions()
+		u.be.locker.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var mailboxes []backend.Mailbox
+	for _, name := range names {
+		if subscribed && !subs[name] {
+			continue
+		}
+
+		path, _ := u.mailboxPath(name)
+		mailboxes = append(mailboxes, u.newMailbox(name, path))
+	}
+	return mailboxes, nil
+}
+
+func (u *User) newMailbox(name, path string) *Mailbox {
+	return &Mailbox{
+		name:  name,
+		user:  u,
+		state: u.be.state(u.username, name, path),
+	}
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	name = imap.CanonicalMailboxName(name)
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	if !isMaildir(path) {
+		return nil, backend.ErrNoSuchMailbox
+	}
+
+	mbox := u.newMailbox(name, path)
+	if err := mbox.sync(); err != nil {
+		return nil, err
+	}
+	return mbox, nil
+}
+
+func (u *User) CreateMailbox(name string) error {
+	name = strings.TrimSuffix(name, Delimiter)
+	if imap.CanonicalMailboxName(name) == imap.InboxName {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return err
+	}
+	if isMaildir(path) {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	// Create superior hierarchical names
+	parts := strings.Split(name, Delimiter)
+	for i := 1; i < len(parts); i++ {
+		parent, _ := u.mailboxPath(strings.Join(parts[:i], Delimiter))
+		if err := createMaildir(parent); err != nil {
+			return err
+		}
+	}
+
+	return createMaildir(path)
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	if imap.CanonicalMailboxName(name) == imap.InboxName {
+		return errors.New("Cannot delete INBOX")
+	}
+
+	path, err := u.mailboxPath(name)
+	if err != nil || !isMaildir(path) {
+		return backend.ErrNoSuchMailbox
+	}
+
+	// Inferior hierarchical names are stored in sibling directories, they
+	// aren't removed. A new mailbox created with the same name will get a new
+	// UIDVALIDITY.
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	u.be.forgetState(path)
+	return nil
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	existingName = imap.CanonicalMailboxName(existingName)
+	newName = strings.TrimSuffix(newName, Delimiter)
+
+	src, err := u.mailboxPath(existingName)
+	if err != nil || !isMaildir(src) {
+		return backend.ErrNoSuchMailbox
+	}
+	if imap.CanonicalMailboxName(newName) == imap.InboxName {
+		return backend.ErrMailboxAlreadyExists
+	}
+	dst, err := u.mailboxPath(newName)
+	if err != nil {
+		return err
+	}
+	if isMaildir(dst) {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	parts := strings.Split(newName, Delimiter)
+	for i := 1; i < len(parts); i++ {
+		parent, _ := u.mailboxPath(strings.Join(parts[:i], Delimiter))
+		if err := createMaildir(parent); err != nil {
+			return err
+		}
+	}
+
+	if existingName == imap.InboxName {
+		return u.renameInbox(dst)
+	}
+
+	names, err := u.mailboxNames()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	// Rename inferior hierarchical names
+	prefix := existingName + Delimiter
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		from, _ := u.mailboxPath(name)
+		to, _ := u.mailboxPath(newName + Delimiter + strings.TrimPrefix(name, prefix))
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+
+	u.be.forgetState(src)
+	return nil
+}
+
+// renameInbox moves all messages in INBOX to a new mailbox, leaving INBOX
+// empty.
+func (u *User) renameInbox(dst string) error {
+	if err := createMaildir(dst); err != nil {
+		return err
+	}
+
+	inbox := u.be.state(u.username, imap.InboxName, u.path)
+	inbox.Lock()
+	updates, err := inbox.locked(func() ([]backend.Update, error) {
+		return u.moveInboxMessages(inbox, dst)
+	})
+	inbox.Unlock()
+	u.be.notifier.Notify(updates...)
+	return err
+}
+
+// moveInboxMessages moves INBOX messages to dst. The caller must hold the INBOX
+// lock.
+func (u *User) moveInboxMessages(inbox *mailboxState, dst string) ([]backend.Update, error) {
+	// Make sure INBOX clients get expunge updates for the moved messages
+	pending, err := inbox.sync()
+	if err != nil {
+		return nil, err
+	}
+
+	// Keyword letters are kept as-is in filenames, copy their definitions
+	if b, err := ioutil.ReadFile(filepath.Join(u.path, keywordsFile)); err == nil {
+		if err := ioutil.WriteFile(filepath.Join(dst, keywordsFile), b, 0600); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, dir := range []string{"new", "cur"} {
+		entries, err := ioutil.ReadDir(filepath.Join(u.path, dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range entries {
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			from := filepath.Join(u.path, dir, fi.Name())
+			to := filepath.Join(dst, dir, fi.Name())
+			if err := os.Rename(from, to); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	updates, err := inbox.sync()
+	return append(pending, updates...), err
+}
+
+func (u *User) Logout() error {
+	return nil
+}
@@ -0,0 +1,126 @@
+// Package mbox implements an IMAP backend storing messages in mboxrd files.
+//
+// Each user has a directory named after its username in the root directory.
+// Each mailbox is an mbox file, INBOX being stored in the INBOX file. Inferior
+// hierarchical names are stored in a directory named after the parent mailbox
+// with a ".sbd" suffix, with "/" as the hierarchy delimiter.
+//
+// Flags are stored in Status, X-Status and X-Keywords header fields, which are
+// hidden from IMAP clients. Messages are stored with LF line endings and are
+// returned with CRLF line endings.
+//
+// Each mailbox has a hidden index file storing UIDs, flags and message offsets,
+// so that messages can be read without parsing the whole mbox file. Messages
+// appended by an external MDA are detected when the mailbox is polled, and
+// reported as backend updates.
+//
+// The mbox file is locked with both a dotlock and an fcntl lock when it is
+// modified. Updating flags or expunging messages rewrites the whole file to a
+// temporary file, which then replaces the mbox file.
+package mbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// Delimiter is the mailbox hierarchy delimiter.
+const Delimiter = "/"
+
+// Backend is an mbox backend.
+type Backend struct {
+	root string
+	auth func(username, password string) error
+
+	locker    sync.Mutex
+	mailboxes map[string]*mailboxState
+	notifier  backendutil.Notifier
+}
+
+// New creates a new mbox backend storing users in the root directory. auth is
+// called to check user credentials, and should return an error if they are
+// incorrect.
+func New(root string, auth func(username, password string) error) *Backend {
+	return &Backend{
+		root:      root,
+		auth:      auth,
+		mailboxes: make(map[string]*mailboxState),
+	}
+}
+
+func validUsername(username string) bool {
+	return username != "" && !strings.HasPrefix(username, ".") && !strings.ContainsAny(username, "/\\\x00")
+}
+
+func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	if !validUsername(username) {
+		return nil, backend.ErrInvalidCredentials
+	}
+	if err := be.auth(username, password); err != nil {
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	path := filepath.Join(be.root, username)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	if err := createMbox(filepath.Join(path, imap.InboxName)); err != nil {
+		return nil, err
+	}
+
+	return &User{be: be, username: username, path: path}, nil
+}
+
+// Updates implements backend.BackendUpdater.
+func (be *Backend) Updates() <-chan backend.Update {
+	return be.notifier.Updates()
+}
+
+// state returns the shared state of an mbox file.
+func (be *Backend) state(username, name, path string) *mailboxState {
+	be.locker.Lock()
+	defer be.locker.Unlock()
+
+	s, ok := be.mailboxes[path]
+	if !ok {
+		s = &mailboxState{username: username, name: name, path: path}
+		be.mailboxes[path] = s
+	}
+	return s
+}
+
+// forgetState drops the shared state of mbox files whose path starts with
+// prefix, for instance after the file has been deleted or renamed.
+func (be *Backend) forgetState(prefix string) {
+	be.locker.Lock()
+	defer be.locker.Unlock()
+
+	for path := range be.mailboxes {
+		if path == prefix || strings.HasPrefix(path, prefix+sbdSuffix+string(filepath.Separator)) {
+			delete(be.mailboxes, path)
+		}
+	}
+}
+
+// createMbox creates an empty mbox file if it doesn't exist.
+func createMbox(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func isMbox(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+var errInvalidName = errors.New("mbox: invalid mailbox name")
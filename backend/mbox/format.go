@@ -0,0 +1,344 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// fromLineLayout is the date layout used in "From " separator lines.
+const fromLineLayout = "Mon Jan _2 15:04:05 2006"
+
+// statusHeaders are header fields used to store flags. They are hidden from
+// IMAP clients.
+var statusHeaders = []string{"Status", "X-Status", "X-Keywords"}
+
+// xStatusFlags maps X-Status letters to IMAP flags.
+var xStatusFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'A', imap.AnsweredFlag},
+	{'F', imap.FlaggedFlag},
+	{'T', imap.DraftFlag},
+	{'D', imap.DeletedFlag},
+}
+
+var fromPrefix = []byte("From ")
+
+// isFromLine checks whether a line separates two messages.
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, fromPrefix)
+}
+
+// isEscapedFromLine checks whether a line matches ^>*From , in which case it
+// must be escaped with a leading '>' in mboxrd.
+func isEscapedFromLine(line []byte) bool {
+	return isFromLine(bytes.TrimLeft(line, ">"))
+}
+
+func statusHeaderKey(line []byte) (string, bool) {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 {
+		return "", false
+	}
+	key := string(bytes.TrimSpace(line[:i]))
+	for _, k := range statusHeaders {
+		if strings.EqualFold(k, key) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+func isContinuationLine(line []byte) bool {
+	return len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+}
+
+// trimLine removes the line ending.
+func trimLine(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
+
+// parseFromLine parses the date of a "From " line. If it cannot be parsed,
+// the zero time is returned.
+func parseFromLine(line []byte) time.Time {
+	fields := strings.Fields(string(trimLine(line)))
+	if len(fields) < 7 {
+		return time.Time{}
+	}
+	// The date is made of the last 5 fields, e.g. "Mon Jan  2 15:04:05 2006"
+	s := strings.Join(fields[len(fields)-5:], " ")
+	t, err := time.ParseInLocation("Mon Jan 2 15:04:05 2006", s, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func formatFromLine(date time.Time) string {
+	return "From MAILER-DAEMON " + date.In(time.Local).Format(fromLineLayout) + "\n"
+}
+
+// flagsToHeaders formats flags as Status, X-Status and X-Keywords header
+// fields. Messages without the \Recent flag get the O status.
+func flagsToHeaders(flags []string) string {
+	seen, recent := false, false
+	var xStatus, keywords []string
+	for _, flag := range flags {
+		flag = imap.CanonicalFlag(flag)
+		switch flag {
+		case imap.RecentFlag:
+			recent = true
+			continue
+		case imap.SeenFlag:
+			seen = true
+			continue
+		}
+
+		found := false
+		for _, f := range xStatusFlags {
+			if f.flag == flag {
+				xStatus = append(xStatus, string(f.letter))
+				found = true
+				break
+			}
+		}
+		if !found {
+			keywords = append(keywords, flag)
+		}
+	}
+
+	var s string
+	switch {
+	case seen && recent:
+		s = "Status: R\n"
+	case seen:
+		s = "Status: RO\n"
+	case !recent:
+		s = "Status: O\n"
+	}
+	s += "X-Status: " + strings.Join(xStatus, "") + "\n"
+	if len(keywords) > 0 {
+		s += "X-Keywords: " + strings.Join(keywords, " ") + "\n"
+	}
+	return s
+}
+
+// headersToFlags parses Status, X-Status and X-Keywords header fields. Messages
+// without the O status are recent.
+func headersToFlags(values map[string]string) []string {
+	var flags []string
+
+	status := values["Status"]
+	if strings.ContainsRune(status, 'R') {
+		flags = append(flags, imap.SeenFlag)
+	}
+	xStatus := values["X-Status"]
+	for _, f := range xStatusFlags {
+		if strings.IndexByte(xStatus, f.letter) >= 0 {
+			flags = append(flags, f.flag)
+		}
+	}
+	for _, kw := range strings.Fields(values["X-Keywords"]) {
+		flags = append(flags, imap.CanonicalFlag(kw))
+	}
+	if !strings.ContainsRune(status, 'O') {
+		flags = append(flags, imap.RecentFlag)
+	}
+	return flags
+}
+
+// entryDecoder converts the lines of an mboxrd entry, excluding its "From "
+// line, to an IMAP message: status header fields are removed, From lines are
+// unescaped, line endings are converted to CRLF and the trailing separator
+// line is removed.
+type entryDecoder struct {
+	w io.Writer
+	n int64
+
+	body     bool
+	skipping string
+	blanks   int
+
+	// Values of the status header fields
+	values map[string]string
+}
+
+func newEntryDecoder(w io.Writer) *entryDecoder {
+	return &entryDecoder{w: w, values: make(map[string]string)}
+}
+
+func (d *entryDecoder) write(b []byte) error {
+	n, err := d.w.Write(b)
+	d.n += int64(n)
+	return err
+}
+
+func (d *entryDecoder) writeLine(line []byte) error {
+	if err := d.write(line); err != nil {
+		return err
+	}
+	return d.write([]byte("\r\n"))
+}
+
+func (d *entryDecoder) flushBlanks(n int) error {
+	for ; n > 0; n-- {
+		if err := d.write([]byte("\r\n")); err != nil {
+			return err
+		}
+	}
+	d.blanks = 0
+	return nil
+}
+
+// line processes a line, without its line ending.
+func (d *entryDecoder) line(line []byte) error {
+	if !d.body {
+		if isContinuationLine(line) {
+			if d.skipping != "" {
+				d.values[d.skipping] += " " + string(bytes.TrimSpace(line))
+				return nil
+			}
+			return d.writeLine(line)
+		}
+		d.skipping = ""
+
+		if len(line) == 0 {
+			// The blank line ending the header may be the separator of
+			// a message without a body
+			d.body = true
+			d.blanks = 1
+			return nil
+		}
+
+		if key, ok := statusHeaderKey(line); ok {
+			d.skipping = key
+			d.values[key] = string(bytes.TrimSpace(line[len(key)+1:]))
+			return nil
+		}
+		return d.writeLine(line)
+	}
+
+	if len(line) == 0 {
+		d.blanks++
+		return nil
+	}
+	if err := d.flushBlanks(d.blanks); err != nil {
+		return err
+	}
+
+	if line[0] == '>' && isEscapedFromLine(line) {
+		line = line[1:]
+	}
+	return d.writeLine(line)
+}
+
+// close ends the entry. The last blank line is the separator and is dropped.
+func (d *entryDecoder) close() error {
+	if d.blanks > 0 {
+		return d.flushBlanks(d.blanks - 1)
+	}
+	return nil
+}
+
+// decodeEntry decodes a whole mboxrd entry, including its "From " line.
+func decodeEntry(w io.Writer, r io.Reader) (*entryDecoder, error) {
+	br := bufio.NewReader(r)
+	d := newEntryDecoder(w)
+
+	first := true
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Very long line, read it entirely
+			rest, err2 := br.ReadBytes('\n')
+			line = append(append([]byte(nil), line...), rest...)
+			err = err2
+		}
+		if len(line) > 0 {
+			if first {
+				first = false
+			} else if err := d.line(trimLine(line)); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return d, d.close()
+}
+
+// encodeEntry converts an IMAP message to an mboxrd entry: flags are stored in
+// status header fields, From lines are escaped, line endings are converted to
+// LF and a separator line is added.
+func encodeEntry(w io.Writer, r io.Reader, date time.Time, flags []string) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(formatFromLine(date))
+	if err := encodeLines(bw, bufio.NewReader(r), flags, false); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// encodeLines copies message lines from br to bw, replacing status header
+// fields with flags. If raw is true, br contains an already-encoded mboxrd
+// entry without its "From " line. Write errors are reported by bw.Flush.
+func encodeLines(bw *bufio.Writer, br *bufio.Reader, flags []string, raw bool) error {
+	inHeader := true
+	skipping := false
+	lastEmpty := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			line = trimLine(line)
+
+			write := true
+			if inHeader {
+				if len(line) == 0 {
+					inHeader = false
+					skipping = false
+					bw.WriteString(flagsToHeaders(flags))
+				} else if !isContinuationLine(line) {
+					_, skipping = statusHeaderKey(line)
+				}
+				write = !skipping
+			} else if !raw && isEscapedFromLine(line) {
+				bw.WriteByte('>')
+			}
+
+			if write {
+				bw.Write(line)
+				bw.WriteByte('\n')
+				lastEmpty = len(line) == 0
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if inHeader {
+		// No body, end the header
+		bw.WriteString(flagsToHeaders(flags))
+		bw.WriteByte('\n')
+		lastEmpty = true
+	}
+	if !raw || !lastEmpty {
+		// Separator line
+		bw.WriteByte('\n')
+	}
+	return nil
+}
@@ -0,0 +1,600 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// entry is a message in an mbox file.
+type entry struct {
+	uid uint32
+	// The offset of the "From " line and the length of the entry, including
+	// its separator line
+	offset int64
+	length int64
+	// The size of the message as seen by IMAP clients
+	size  uint32
+	date  time.Time
+	flags []string
+}
+
+func (e *entry) key() string {
+	return fmt.Sprintf("%d.%d", e.date.Unix(), e.size)
+}
+
+func (e *entry) hasFlag(flag string) bool {
+	for _, f := range e.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// open returns a reader for the IMAP message of an entry.
+func (e *entry) open(r io.ReaderAt) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := decodeEntry(&buf, io.NewSectionReader(r, e.offset, e.length)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mailboxState is the in-memory copy of the index of an mbox file. All Mailbox
+// values referring to the same file share the same state, so that all clients
+// see the same sequence numbers.
+type mailboxState struct {
+	sync.Mutex
+
+	username string
+	name     string
+	path     string
+
+	loaded      bool
+	uidValidity uint32
+	uidNext     uint32
+	// The size and modification time of the mbox file when the index was last
+	// updated
+	fileSize int64
+	modTime  time.Time
+	entries  []*entry
+}
+
+// indexPath returns the path of the index of an mbox file. It's hidden so that
+// it isn't listed as a mailbox.
+func indexPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".index")
+}
+
+// readIndex reads the index file. The first line contains a version number,
+// the UIDVALIDITY, the next UID and the size and modification time of the mbox
+// file. Each following line describes a message with its UID, offset, length,
+// size, internal date and flags.
+func (s *mailboxState) readIndex() error {
+	f, err := os.Open(indexPath(s.path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	malformed := fmt.Errorf("mbox: malformed index for %v", s.path)
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return malformed
+	}
+	var version int
+	var modTime int64
+	if _, err := fmt.Sscanf(scanner.Text(), "%d %d %d %d %d", &version, &s.uidValidity, &s.uidNext, &s.fileSize, &modTime); err != nil || version != 1 {
+		return malformed
+	}
+	s.modTime = time.Unix(0, modTime)
+
+	s.entries = nil
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			return malformed
+		}
+
+		var nums [5]int64
+		for i := range nums {
+			if nums[i], err = strconv.ParseInt(fields[i], 10, 64); err != nil {
+				return malformed
+			}
+		}
+
+		s.entries = append(s.entries, &entry{
+			uid:    uint32(nums[0]),
+			offset: nums[1],
+			length: nums[2],
+			size:   uint32(nums[3]),
+			date:   time.Unix(nums[4], 0),
+			flags:  fields[5:],
+		})
+	}
+	return scanner.Err()
+}
+
+func (s *mailboxState) writeIndex() error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "1 %d %d %d %d\n", s.uidValidity, s.uidNext, s.fileSize, s.modTime.UnixNano())
+	for _, e := range s.entries {
+		fmt.Fprintf(&sb, "%d %d %d %d %d", e.uid, e.offset, e.length, e.size, e.date.Unix())
+		for _, flag := range e.flags {
+			sb.WriteString(" " + flag)
+		}
+		sb.WriteString("\n")
+	}
+
+	path := indexPath(s.path)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(sb.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// parseEntries parses the messages of an mbox file, starting at offset.
+func parseEntries(f *os.File, offset int64) ([]*entry, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+
+	var entries []*entry
+	var cur *entry
+	var dec *entryDecoder
+	finish := func() error {
+		if cur == nil {
+			return nil
+		}
+		if err := dec.close(); err != nil {
+			return err
+		}
+		cur.length = offset - cur.offset
+		cur.size = uint32(dec.n)
+		cur.flags = headersToFlags(dec.values)
+		entries = append(entries, cur)
+		return nil
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if isFromLine(line) {
+				if err := finish(); err != nil {
+					return nil, err
+				}
+				cur = &entry{offset: offset, date: parseFromLine(line)}
+				dec = newEntryDecoder(ioutil.Discard)
+			} else if cur != nil {
+				if err := dec.line(trimLine(line)); err != nil {
+					return nil, err
+				}
+			}
+			offset += int64(len(line))
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// isBoundary checks whether a message starts at offset.
+func isBoundary(f *os.File, offset int64) bool {
+	if offset == 0 {
+		return true
+	}
+	b := make([]byte, len(fromPrefix)+1)
+	if _, err := f.ReadAt(b, offset-1); err != nil {
+		return false
+	}
+	return b[0] == '\n' && isFromLine(b[1:])
+}
+
+func (s *mailboxState) newUpdate() backend.Update {
+	return backend.NewUpdate(s.username, s.name)
+}
+
+func (s *mailboxState) messageUpdate(seqNum uint32, e *entry) backend.Update {
+	m := imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+	m.Flags = e.flags
+	m.Uid = e.uid
+	return &backend.MessageUpdate{Update: s.newUpdate(), Message: m}
+}
+
+func (s *mailboxState) mailboxUpdate() backend.Update {
+	status := imap.NewMailboxStatus(s.name, []imap.StatusItem{imap.StatusMessages, imap.StatusRecent})
+	status.Messages = uint32(len(s.entries))
+	status.Recent = s.recent()
+	return &backend.MailboxUpdate{Update: s.newUpdate(), MailboxStatus: status}
+}
+
+func (s *mailboxState) recent() uint32 {
+	var n uint32
+	for _, e := range s.entries {
+		if e.hasFlag(imap.RecentFlag) {
+			n++
+		}
+	}
+	return n
+}
+
+// sync updates the index if the mbox file has been modified by another process,
+// and returns updates describing the changes. Messages appended at the end of
+// the file are parsed incrementally. Otherwise, the file is parsed again and
+// messages are matched with the index by internal date and size: messages can
+// only be appended or removed in mbox files.
+func (s *mailboxState) sync() ([]backend.Update, error) {
+	notify := s.loaded
+	if !s.loaded {
+		if err := s.readIndex(); err != nil {
+			// Build a new index
+			s.uidValidity = backendutil.NewUidValidity()
+			s.uidNext = 1
+			s.fileSize = -1
+			s.entries = nil
+		}
+		s.loaded = true
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == s.fileSize && fi.ModTime().Equal(s.modTime) {
+		return nil, nil
+	}
+
+	if err := lockFile(f, false); err != nil {
+		return nil, err
+	}
+	defer unlockFile(f)
+
+	return s.syncFile(f, notify)
+}
+
+// syncFile updates the index from an open mbox file. The caller must hold a
+// lock on the file.
+func (s *mailboxState) syncFile(f *os.File, notify bool) ([]backend.Update, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == s.fileSize && fi.ModTime().Equal(s.modTime) {
+		return nil, nil
+	}
+
+	var updates []backend.Update
+	var added []*entry
+	if s.fileSize >= 0 && fi.Size() > s.fileSize && isBoundary(f, s.fileSize) {
+		added, err = parseEntries(f, s.fileSize)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		entries, err := parseEntries(f, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var kept []*entry
+		old := s.entries
+		i := 0
+		for j, e := range entries {
+			k := i
+			for k < len(old) && old[k].key() != e.key() {
+				k++
+			}
+			if k == len(old) {
+				// Not in the index, this is a new message
+				added = entries[j:]
+				break
+			}
+
+			// Messages between i and k have been removed
+			for ; i < k; i++ {
+				if notify {
+					// Expunges are sent in order, so the sequence number
+					// of each removed message follows the kept ones
+					updates = append(updates, &backend.ExpungeUpdate{
+						Update: s.newUpdate(),
+						SeqNum: uint32(len(kept) + 1),
+						Uid:    old[i].uid,
+					})
+				}
+			}
+
+			// Other programs don't know about our sessions, keep the
+			// \Recent flag from the index
+			e.uid = old[k].uid
+			e.flags = removeFlag(e.flags, imap.RecentFlag)
+			if old[k].hasFlag(imap.RecentFlag) {
+				e.flags = append(e.flags, imap.RecentFlag)
+			}
+			if notify && !sameFlags(old[k].flags, e.flags) {
+				updates = append(updates, s.messageUpdate(uint32(len(kept)+1), e))
+			}
+			kept = append(kept, e)
+			i = k + 1
+		}
+		if added == nil {
+			for ; i < len(old); i++ {
+				if notify {
+					updates = append(updates, &backend.ExpungeUpdate{
+						Update: s.newUpdate(),
+						SeqNum: uint32(len(kept) + 1),
+						Uid:    old[i].uid,
+					})
+				}
+			}
+		}
+		s.entries = kept
+	}
+
+	for _, e := range added {
+		e.uid = s.uidNext
+		s.uidNext++
+		s.entries = append(s.entries, e)
+	}
+	if notify && len(added) > 0 {
+		updates = append(updates, s.mailboxUpdate())
+	}
+
+	s.fileSize = fi.Size()
+	s.modTime = fi.ModTime()
+	if err := s.writeIndex(); err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+func removeFlag(flags []string, flag string) []string {
+	var l []string
+	for _, f := range flags {
+		if f != flag {
+			l = append(l, f)
+		}
+	}
+	return l
+}
+
+func sameFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// appendEntry appends a message at the end of an mbox file. The caller must
+// hold the file lock.
+func appendEntry(f *os.File, r io.Reader, date time.Time, flags []string) error {
+	var buf bytes.Buffer
+	if err := encodeEntry(&buf, r, date, flags); err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if size := fi.Size(); size > 0 {
+		// Make sure the "From " line starts on a new line
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, size-1); err != nil {
+			return err
+		}
+		if last[0] != '\n' {
+			if _, err := f.WriteAt([]byte("\n\n"), size); err != nil {
+				return err
+			}
+			size += 2
+		}
+		_, err = f.WriteAt(buf.Bytes(), size)
+	} else {
+		_, err = f.WriteAt(buf.Bytes(), 0)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// rewrite writes a new version of the mbox file, with updated flags and without
+// removed messages, and atomically replaces the current one. flags returns the
+// new flags of a message, or false if it must be removed. The caller must hold
+// the file lock. It returns the indexes of removed messages.
+func (s *mailboxState) rewrite(f *os.File, flags func(e *entry) ([]string, bool)) ([]int, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path)+".rewrite")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	cw := &countWriter{w: tmp}
+	bw := bufio.NewWriter(cw)
+
+	var removed []int
+	var entries []*entry
+	for i, e := range s.entries {
+		newFlags, ok := flags(e)
+		if !ok {
+			removed = append(removed, i)
+			continue
+		}
+
+		offset := cw.n + int64(bw.Buffered())
+
+		br := bufio.NewReader(io.NewSectionReader(f, e.offset, e.length))
+		fromLine, err := br.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		bw.Write(fromLine)
+		// Messages are only recent for the first session, mark them as
+		// old in the file
+		if err := encodeLines(bw, br, removeFlag(newFlags, imap.RecentFlag), true); err != nil {
+			return nil, err
+		}
+
+		newEntry := *e
+		newEntry.offset = offset
+		newEntry.length = cw.n + int64(bw.Buffered()) - offset
+		newEntry.flags = newFlags
+		entries = append(entries, &newEntry)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return nil, err
+	}
+
+	newFi, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	s.entries = entries
+	s.fileSize = newFi.Size()
+	s.modTime = newFi.ModTime()
+	return removed, s.writeIndex()
+}
+
+// modify opens and locks the mbox file for writing, synchronizes the index and
+// calls f.
+func (s *mailboxState) modify(f func(file *os.File) ([]backend.Update, error)) ([]backend.Update, error) {
+	file, err := os.OpenFile(s.path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	unlock, err := lock(file)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	updates, err := s.syncFile(file, true)
+	if err != nil {
+		return updates, err
+	}
+	more, err := f(file)
+	return append(updates, more...), err
+}
+
+// moveTo moves all messages to a new mbox file, leaving the current one empty.
+// UIDs are kept in the new mbox file, which gets a new UIDVALIDITY, and aren't
+// reused in the current one.
+func (s *mailboxState) moveTo(dst string) ([]backend.Update, error) {
+	pending, err := s.sync()
+	if err != nil {
+		return nil, err
+	}
+
+	updates, err := s.modify(func(file *os.File) ([]backend.Update, error) {
+		if err := os.Rename(s.path, dst); err != nil {
+			return nil, err
+		}
+		// The new mailbox gets a new UIDVALIDITY, the messages keep
+		// their UIDs
+		moved := &mailboxState{
+			path:        dst,
+			uidValidity: backendutil.NewUidValidity(),
+			uidNext:     s.uidNext,
+			fileSize:    s.fileSize,
+			modTime:     s.modTime,
+			entries:     s.entries,
+		}
+		if err := moved.writeIndex(); err != nil {
+			return nil, err
+		}
+		if err := createMbox(s.path); err != nil {
+			return nil, err
+		}
+
+		var updates []backend.Update
+		for seqNum := len(s.entries); seqNum > 0; seqNum-- {
+			updates = append(updates, &backend.ExpungeUpdate{
+				Update: s.newUpdate(),
+				SeqNum: uint32(seqNum),
+				Uid:    s.entries[seqNum-1].uid,
+			})
+		}
+
+		fi, err := os.Stat(s.path)
+		if err != nil {
+			return nil, err
+		}
+		s.entries = nil
+		s.fileSize = fi.Size()
+		s.modTime = fi.ModTime()
+		return updates, s.writeIndex()
+	})
+	return append(pending, updates...), err
+}
@@ -0,0 +1,26 @@
+package mbox
+
+import (
+	"os"
+
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// lock locks an mbox file for writing, with both a dotlock and an fcntl lock.
+// It returns a function releasing the locks. fcntl locks are owned by the
+// process, they only protect against other processes: the mailbox state mutex
+// serializes accesses within the backend.
+func lock(f *os.File) (func(), error) {
+	unlockDot, err := backendutil.Dotlock(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, true); err != nil {
+		unlockDot()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		unlockDot()
+	}, nil
+}
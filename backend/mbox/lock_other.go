@@ -0,0 +1,16 @@
+//go:build !unix
+
+package mbox
+
+import (
+	"os"
+)
+
+// lockFile is a no-op on systems without fcntl locks, only dotlocks are used.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
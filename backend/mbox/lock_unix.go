@@ -0,0 +1,23 @@
+//go:build unix
+
+package mbox
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile places an fcntl lock on a whole file, waiting for conflicting locks
+// to be released.
+func lockFile(f *os.File, exclusive bool) error {
+	lk := syscall.Flock_t{Type: syscall.F_RDLCK}
+	if exclusive {
+		lk.Type = syscall.F_WRLCK
+	}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &lk)
+}
+
+func unlockFile(f *os.File) error {
+	lk := syscall.Flock_t{Type: syscall.F_UNLCK}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+}
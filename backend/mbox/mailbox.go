@@ -0,0 +1,425 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message/textproto"
+)
+
+var permanentFlags = []string{
+	imap.AnsweredFlag,
+	imap.FlaggedFlag,
+	imap.DeletedFlag,
+	imap.SeenFlag,
+	imap.DraftFlag,
+	"\\*",
+}
+
+type Mailbox struct {
+	name  string
+	user  *User
+	state *mailboxState
+}
+
+// view locks the mailbox state, synchronizes it with the mbox file, calls f
+// and sends the resulting updates.
+func (mbox *Mailbox) view(f func(s *mailboxState)) error {
+	s := mbox.state
+	s.Lock()
+	updates, err := s.sync()
+	if err == nil && f != nil {
+		f(s)
+	}
+	s.Unlock()
+
+	mbox.user.be.notifier.Notify(updates...)
+	return err
+}
+
+// update is like view, but locks the mbox file for writing and calls f with it.
+func (mbox *Mailbox) update(f func(s *mailboxState, file *os.File) ([]backend.Update, error)) error {
+	s := mbox.state
+	s.Lock()
+	updates, err := s.sync()
+	if err == nil {
+		var more []backend.Update
+		more, err = s.modify(func(file *os.File) ([]backend.Update, error) {
+			return f(s, file)
+		})
+		updates = append(updates, more...)
+	}
+	if err == nil {
+		// Index messages appended by f
+		var more []backend.Update
+		more, err = s.sync()
+		updates = append(updates, more...)
+	}
+	s.Unlock()
+
+	mbox.user.be.notifier.Notify(updates...)
+	return err
+}
+
+func (mbox *Mailbox) sync() error {
+	return mbox.view(nil)
+}
+
+// snapshot returns a copy of the mailbox messages and the open mbox file, so
+// that messages can be read without holding the state lock. Offsets remain
+// valid even if the file is replaced, since the old file is still open.
+func (mbox *Mailbox) snapshot() ([]entry, *os.File, error) {
+	s := mbox.state
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.loaded {
+		if _, err := s.sync(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := make([]entry, len(s.entries))
+	for i, e := range s.entries {
+		entries[i] = *e
+		entries[i].flags = append([]string(nil), e.flags...)
+	}
+	return entries, f, nil
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{
+		Delimiter: Delimiter,
+		Name:      mbox.name,
+	}
+	return info, nil
+}
+
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(mbox.name, items)
+
+	err := mbox.view(func(s *mailboxState) {
+		status.PermanentFlags = permanentFlags
+
+		flagsMap := make(map[string]bool)
+		for i, e := range s.entries {
+			for _, flag := range e.flags {
+				if flag != imap.RecentFlag {
+					flagsMap[flag] = true
+				}
+			}
+			if !e.hasFlag(imap.SeenFlag) {
+				status.Unseen++
+				if status.UnseenSeqNum == 0 {
+					status.UnseenSeqNum = uint32(i + 1)
+				}
+			}
+		}
+		for flag := range flagsMap {
+			status.Flags = append(status.Flags, flag)
+		}
+
+		status.Messages = uint32(len(s.entries))
+		status.Recent = s.recent()
+		status.UidNext = s.uidNext
+		status.UidValidity = s.uidValidity
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+func (mbox *Mailbox) SetSubscribed(subscribed bool) error {
+	return mbox.user.setSubscribed(mbox.name, subscribed)
+}
+
+func (mbox *Mailbox) Check() error {
+	return mbox.sync()
+}
+
+// Poll implements backend.MailboxPoller. It detects messages appended, removed
+// or modified by other processes.
+func (mbox *Mailbox) Poll() error {
+	return mbox.sync()
+}
+
+func (mbox *Mailbox) fetch(f *os.File, seqNum uint32, e *entry, items []imap.FetchItem) (*imap.Message, error) {
+	var b []byte
+	headerAndBody := func() (textproto.Header, io.Reader, error) {
+		if b == nil {
+			var err error
+			if b, err = e.open(f); err != nil {
+				return textproto.Header{}, nil, err
+			}
+		}
+		body := bufio.NewReader(bytes.NewReader(b))
+		hdr, err := textproto.ReadHeader(body)
+		return hdr, body, err
+	}
+
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = e.flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = e.date
+		case imap.FetchRFC822Size:
+			fetched.Size = e.size
+		case imap.FetchUid:
+			fetched.Uid = e.uid
+		case imap.FetchPreview:
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			fetched.Preview, _ = backendutil.FetchPreview(hdr, body)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+
+			hdr, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+		}
+	}
+
+	return fetched, nil
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	entries, f, err := mbox.snapshot()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for i := range entries {
+		e := &entries[i]
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = e.uid
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		m, err := mbox.fetch(f, seqNum, e, items)
+		if err != nil {
+			return err
+		}
+
+		ch <- m
+	}
+
+	return nil
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	entries, f, err := mbox.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ids []uint32
+	for i := range entries {
+		e := &entries[i]
+		seqNum := uint32(i + 1)
+
+		md := &backendutil.Metadata{
+			SeqNum: seqNum,
+			Uid:    e.uid,
+			Date:   e.date,
+			Flags:  e.flags,
+			Size:   e.size,
+		}
+		open := func() (io.ReadCloser, error) {
+			b, err := e.open(f)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}
+
+		ok, err := backendutil.MatchReader(open, md, criteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		id := seqNum
+		if uid {
+			id = e.uid
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	return mbox.update(func(s *mailboxState, file *os.File) ([]backend.Update, error) {
+		flags = append(removeFlag(flags, imap.RecentFlag), imap.RecentFlag)
+		return nil, appendEntry(file, body, date, flags)
+	})
+}
+
+// forEach calls f for each message in a sequence set.
+func (s *mailboxState) forEach(uid bool, seqset *imap.SeqSet, f func(seqNum uint32, e *entry)) {
+	for i, e := range s.entries {
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = e.uid
+		}
+		if seqset.Contains(id) {
+			f(seqNum, e)
+		}
+	}
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return mbox.update(func(s *mailboxState, file *os.File) ([]backend.Update, error) {
+		newFlags := make(map[uint32][]string)
+		var seqNums []uint32
+		s.forEach(uid, seqset, func(seqNum uint32, e *entry) {
+			current := append([]string(nil), e.flags...)
+			newFlags[e.uid] = backendutil.UpdateFlags(current, op, flags)
+			seqNums = append(seqNums, seqNum)
+		})
+		if len(seqNums) == 0 {
+			return nil, nil
+		}
+
+		_, err := s.rewrite(file, func(e *entry) ([]string, bool) {
+			if flags, ok := newFlags[e.uid]; ok {
+				return flags, true
+			}
+			return e.flags, true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var updates []backend.Update
+		for _, seqNum := range seqNums {
+			updates = append(updates, s.messageUpdate(seqNum, s.entries[seqNum-1]))
+		}
+		return updates, nil
+	})
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	dest, err := mbox.user.GetMailbox(destName)
+	if err != nil {
+		return err
+	}
+	destMbox := dest.(*Mailbox)
+
+	entries, f, err := mbox.snapshot()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return destMbox.update(func(s *mailboxState, file *os.File) ([]backend.Update, error) {
+		for i := range entries {
+			e := &entries[i]
+			seqNum := uint32(i + 1)
+
+			id := seqNum
+			if uid {
+				id = e.uid
+			}
+			if !seqset.Contains(id) {
+				continue
+			}
+
+			b, err := e.open(f)
+			if err != nil {
+				return nil, err
+			}
+			flags := append(removeFlag(e.flags, imap.RecentFlag), imap.RecentFlag)
+			if err := appendEntry(file, bytes.NewReader(b), e.date, flags); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+}
+
+func (mbox *Mailbox) Expunge() error {
+	return mbox.update(func(s *mailboxState, file *os.File) ([]backend.Update, error) {
+		deleted := false
+		for _, e := range s.entries {
+			if e.hasFlag(imap.DeletedFlag) {
+				deleted = true
+				break
+			}
+		}
+		if !deleted {
+			return nil, nil
+		}
+
+		removed, err := s.rewrite(file, func(e *entry) ([]string, bool) {
+			return e.flags, !e.hasFlag(imap.DeletedFlag)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Send expunges from the end, so that sequence numbers stay valid
+		var updates []backend.Update
+		for i := len(removed) - 1; i >= 0; i-- {
+			updates = append(updates, &backend.ExpungeUpdate{
+				Update: s.newUpdate(),
+				SeqNum: uint32(removed[i] + 1),
+			})
+		}
+		return updates, nil
+	})
+}
@@ -0,0 +1,531 @@
+package mbox
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendtest"
+)
+
+const testMessage = "From: contact@example.org\r\n" +
+	"To: contact@example.org\r\n" +
+	"Subject: A little message, just for you\r\n" +
+	"Date: Wed, 11 May 2016 14:31:59 +0000\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hi there :)\r\n"
+
+func newTestBackend(t *testing.T, root string) (*Backend, backend.User) {
+	be := New(root, func(username, password string) error {
+		if password != "password" {
+			return errors.New("invalid password")
+		}
+		return nil
+	})
+
+	return be, backendtest.Login(t, be)
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// receiveUpdates closes updates and forwards them to the returned channel.
+func receiveUpdates(be *Backend) <-chan backend.Update {
+	updates := be.Updates()
+	received := make(chan backend.Update, 10)
+	go func() {
+		for update := range updates {
+			received <- update
+			close(update.Done())
+		}
+	}()
+	return received
+}
+
+func TestLogin(t *testing.T) {
+	be := New(t.TempDir(), func(username, password string) error {
+		return errors.New("invalid password")
+	})
+
+	if _, err := be.Login(nil, "username", "password"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Expected invalid credentials error, got: %v", err)
+	}
+	if _, err := be.Login(nil, "../username", "password"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Expected invalid credentials error, got: %v", err)
+	}
+}
+
+func TestMailbox_CreateMessage(t *testing.T) {
+	root := t.TempDir()
+	_, u := newTestBackend(t, root)
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	date := time.Date(2016, time.May, 11, 14, 31, 59, 0, time.UTC)
+	flags := []string{imap.SeenFlag, "$Important", imap.AnsweredFlag}
+	if err := mbox.CreateMessage(flags, date, bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("Expected no error while creating message, got:", err)
+	}
+
+	// Flags must be stored in header fields, with LF line endings
+	data := readFile(t, filepath.Join(root, "username", "INBOX"))
+	if !strings.HasPrefix(data, "From MAILER-DAEMON "+date.Local().Format(fromLineLayout)+"\n") {
+		t.Errorf("Invalid From line in %q", data)
+	}
+	for _, s := range []string{"\nStatus: R\n", "\nX-Status: A\n", "\nX-Keywords: $important\n", "\nHi there :)\n\n"} {
+		if !strings.Contains(data, s) {
+			t.Errorf("Expected %q in %q", s, data)
+		}
+	}
+	if strings.Contains(data, "\r") {
+		t.Errorf("Expected LF line endings in %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(root, "username", ".INBOX.index")); err != nil {
+		t.Error("Expected an index file, got:", err)
+	}
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, "BODY[]"}
+	msgs := backendtest.ListMessages(t, mbox, false, "1:*", items...)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one message, got %v", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.Uid != 1 {
+		t.Errorf("Expected UID 1, got %v", msg.Uid)
+	}
+	sort.Strings(msg.Flags)
+	wantFlags := []string{"$important", imap.AnsweredFlag, imap.RecentFlag, imap.SeenFlag}
+	if !reflect.DeepEqual(msg.Flags, wantFlags) {
+		t.Errorf("Invalid flags: got %v, want %v", msg.Flags, wantFlags)
+	}
+	if !msg.InternalDate.Equal(date) {
+		t.Errorf("Invalid internal date: got %v, want %v", msg.InternalDate, date)
+	}
+	if msg.Size != uint32(len(testMessage)) {
+		t.Errorf("Invalid size: got %v, want %v", msg.Size, len(testMessage))
+	}
+	section, _ := imap.ParseBodySectionName("BODY[]")
+	if b, _ := ioutil.ReadAll(msg.GetBody(section)); string(b) != testMessage {
+		t.Errorf("Invalid body: got %q", string(b))
+	}
+}
+
+func TestMailbox_fromEscaping(t *testing.T) {
+	root := t.TempDir()
+	_, u := newTestBackend(t, root)
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	body := "Subject: Quoting\r\n" +
+		"\r\n" +
+		"From here\r\n" +
+		">From there\r\n" +
+		"\r\n" +
+		"\r\n" +
+		"From everywhere\r\n"
+	for i := 0; i < 2; i++ {
+		if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := readFile(t, filepath.Join(root, "username", "INBOX"))
+	if !strings.Contains(data, "\n>From here\n>>From there\n") {
+		t.Errorf("Expected From lines to be escaped in %q", data)
+	}
+
+	msgs := backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchRFC822Size, "BODY[]")
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %v", len(msgs))
+	}
+	section, _ := imap.ParseBodySectionName("BODY[]")
+	for _, msg := range msgs {
+		if b, _ := ioutil.ReadAll(msg.GetBody(section)); string(b) != body {
+			t.Errorf("Invalid body: got %q, want %q", string(b), body)
+		}
+		if msg.Size != uint32(len(body)) {
+			t.Errorf("Invalid size: got %v, want %v", msg.Size, len(body))
+		}
+	}
+}
+
+func TestMailbox_persistence(t *testing.T) {
+	root := t.TempDir()
+	_, u := newTestBackend(t, root)
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	for i := 0; i < 3; i++ {
+		if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload everything from disk
+	_, u = newTestBackend(t, root)
+	mbox = backendtest.GetMailbox(t, u, "INBOX")
+
+	newStatus, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext, imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newStatus.UidValidity != status.UidValidity {
+		t.Errorf("UIDVALIDITY changed: got %v, want %v", newStatus.UidValidity, status.UidValidity)
+	}
+	if newStatus.UidNext != 4 || newStatus.Messages != 3 {
+		t.Errorf("Invalid status: got UIDNEXT %v and MESSAGES %v", newStatus.UidNext, newStatus.Messages)
+	}
+
+	msgs := backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchUid)
+	for i, msg := range msgs {
+		if msg.Uid != uint32(i+1) {
+			t.Errorf("Expected message #%v to have UID %v, got %v", i+1, i+1, msg.Uid)
+		}
+	}
+
+	// Without an index, the mbox file is parsed again
+	if err := os.Remove(filepath.Join(root, "username", ".INBOX.index")); err != nil {
+		t.Fatal(err)
+	}
+	_, u = newTestBackend(t, root)
+	mbox = backendtest.GetMailbox(t, u, "INBOX")
+	if msgs := backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchUid); len(msgs) != 3 {
+		t.Errorf("Expected 3 messages after rebuilding the index, got %v", len(msgs))
+	}
+}
+
+func TestMailbox_externalAppend(t *testing.T) {
+	root := t.TempDir()
+	be, u := newTestBackend(t, root)
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	if err := mbox.CreateMessage([]string{imap.SeenFlag}, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	received := receiveUpdates(be)
+
+	// Simulate an MDA delivery
+	path := filepath.Join(root, "username", "INBOX")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := "From sender@example.org Wed May 11 14:31:59 2016\n" +
+		"Subject: Delivered\n" +
+		"Status: O\n" +
+		"X-Status: F\n" +
+		"\n" +
+		"Hello\n" +
+		"\n"
+	if _, err := f.WriteString(delivered); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := mbox.(backend.MailboxPoller).Poll(); err != nil {
+		t.Fatal("Expected no error while polling, got:", err)
+	}
+
+	update, ok := (<-received).(*backend.MailboxUpdate)
+	if !ok {
+		t.Fatalf("Expected a mailbox update, got %T", update)
+	}
+	if update.Username() != "username" || update.Mailbox() != "INBOX" {
+		t.Errorf("Invalid update target: %v %v", update.Username(), update.Mailbox())
+	}
+	if update.MailboxStatus.Messages != 2 || update.MailboxStatus.Recent != 1 {
+		t.Errorf("Invalid mailbox update: %+v", update.MailboxStatus)
+	}
+
+	msgs := backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchUid, imap.FetchFlags, "BODY[]")
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %v", len(msgs))
+	}
+	if msgs[1].Uid != 2 || !reflect.DeepEqual(msgs[1].Flags, []string{imap.FlaggedFlag}) {
+		t.Errorf("Invalid delivered message: UID %v, flags %v", msgs[1].Uid, msgs[1].Flags)
+	}
+	section, _ := imap.ParseBodySectionName("BODY[]")
+	if b, _ := ioutil.ReadAll(msgs[1].GetBody(section)); string(b) != "Subject: Delivered\r\n\r\nHello\r\n" {
+		t.Errorf("Invalid body: got %q", string(b))
+	}
+}
+
+func TestMailbox_externalRewrite(t *testing.T) {
+	root := t.TempDir()
+	be, u := newTestBackend(t, root)
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	for i := 0; i < 3; i++ {
+		date := time.Date(2016, time.May, 11+i, 14, 31, 59, 0, time.UTC)
+		if err := mbox.CreateMessage(nil, date, bytes.NewBufferString(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := receiveUpdates(be)
+
+	// Simulate another mail client removing the first message and marking
+	// the last one as seen
+	path := filepath.Join(root, "username", "INBOX")
+	data := readFile(t, path)
+	entries := strings.SplitAfter(data, "\n\nFrom ")
+	data = "From " + entries[1] + strings.Replace(entries[2], "X-Status:", "Status: RO\nX-Status:", 1)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mbox.(backend.MailboxPoller).Poll(); err != nil {
+		t.Fatal("Expected no error while polling, got:", err)
+	}
+
+	if update, ok := (<-received).(*backend.ExpungeUpdate); !ok || update.SeqNum != 1 {
+		t.Errorf("Expected an expunge update for 1, got %+v", update)
+	}
+	if update, ok := (<-received).(*backend.MessageUpdate); !ok || update.Message.SeqNum != 2 || update.Message.Uid != 3 {
+		t.Errorf("Expected a message update for 2, got %+v", update)
+	}
+
+	msgs := backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchUid)
+	if len(msgs) != 2 || msgs[0].Uid != 2 || msgs[1].Uid != 3 {
+		t.Errorf("Expected UIDs to be kept, got %v", msgs)
+	}
+}
+
+func TestMailbox_Expunge(t *testing.T) {
+	root := t.TempDir()
+	be, u := newTestBackend(t, root)
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	for i := 0; i < 3; i++ {
+		if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := receiveUpdates(be)
+
+	seqSet, _ := imap.ParseSeqSet("1,3")
+	if err := mbox.UpdateMessagesFlags(false, seqSet, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal("Expected no error while updating flags, got:", err)
+	}
+	for i := 0; i < 2; i++ {
+		update, ok := (<-received).(*backend.MessageUpdate)
+		if !ok || !reflect.DeepEqual(update.Message.Flags, []string{imap.RecentFlag, imap.DeletedFlag}) {
+			t.Errorf("Invalid message update: %+v", update)
+		}
+	}
+
+	path := filepath.Join(root, "username", "INBOX")
+	if n := strings.Count(readFile(t, path), "X-Status: D\n"); n != 2 {
+		t.Errorf("Expected 2 messages with the D status, got %v", n)
+	}
+
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expected no error while expunging, got:", err)
+	}
+	for _, seqNum := range []uint32{3, 1} {
+		update, ok := (<-received).(*backend.ExpungeUpdate)
+		if !ok || update.SeqNum != seqNum {
+			t.Errorf("Expected expunge update for %v, got %+v", seqNum, update)
+		}
+	}
+
+	msgs := backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchUid, "BODY[]")
+	if len(msgs) != 1 || msgs[0].Uid != 2 {
+		t.Fatalf("Expected only message with UID 2 to remain, got %v", msgs)
+	}
+	section, _ := imap.ParseBodySectionName("BODY[]")
+	if b, _ := ioutil.ReadAll(msgs[0].GetBody(section)); string(b) != testMessage {
+		t.Errorf("Invalid body: got %q", string(b))
+	}
+	if n := strings.Count(readFile(t, path), "From "); n != 1 {
+		t.Errorf("Expected one message in the mbox file, got %v", n)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(root, "username", ".INBOX.rewrite*"))
+	if len(matches) != 0 {
+		t.Errorf("Expected temporary files to be removed, got %v", matches)
+	}
+}
+
+func TestMailbox_SearchMessages(t *testing.T) {
+	_, u := newTestBackend(t, t.TempDir())
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	if err := mbox.CreateMessage([]string{imap.SeenFlag}, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	criteria := &imap.SearchCriteria{
+		WithoutFlags: []string{imap.SeenFlag},
+		Body:         []string{"hi there"},
+	}
+	ids, err := mbox.SearchMessages(true, criteria)
+	if err != nil {
+		t.Fatal("Expected no error while searching, got:", err)
+	}
+	if !reflect.DeepEqual(ids, []uint32{2}) {
+		t.Errorf("Invalid search results: %v", ids)
+	}
+
+	// Status header fields are hidden
+	criteria = &imap.SearchCriteria{Text: []string{"X-Status"}}
+	if ids, _ := mbox.SearchMessages(true, criteria); len(ids) != 0 {
+		t.Errorf("Expected no search results, got %v", ids)
+	}
+}
+
+func TestMailbox_CopyMessages(t *testing.T) {
+	_, u := newTestBackend(t, t.TempDir())
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	date := time.Date(2016, time.May, 11, 14, 31, 59, 0, time.UTC)
+	if err := mbox.CreateMessage([]string{"$Important"}, date, bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	seqSet, _ := imap.ParseSeqSet("1")
+	if err := mbox.CopyMessages(false, seqSet, "Archive"); err != nil {
+		t.Fatal("Expected no error while copying, got:", err)
+	}
+	if err := mbox.CopyMessages(false, seqSet, "Missing"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected no such mailbox error, got: %v", err)
+	}
+
+	msgs := backendtest.ListMessages(t, backendtest.GetMailbox(t, u, "Archive"), false, "1:*", imap.FetchFlags, imap.FetchInternalDate)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one message, got %v", len(msgs))
+	}
+	if !reflect.DeepEqual(msgs[0].Flags, []string{"$important", imap.RecentFlag}) {
+		t.Errorf("Invalid flags: %v", msgs[0].Flags)
+	}
+	if !msgs[0].InternalDate.Equal(date) {
+		t.Errorf("Invalid internal date: %v", msgs[0].InternalDate)
+	}
+}
+
+func TestUser_mailboxes(t *testing.T) {
+	root := t.TempDir()
+	_, u := newTestBackend(t, root)
+
+	if err := u.CreateMailbox("Work/Projects"); err != nil {
+		t.Fatal("Expected no error while creating mailbox, got:", err)
+	}
+	if err := u.CreateMailbox("Work"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("Expected mailbox already exists error, got: %v", err)
+	}
+	if err := u.CreateMailbox("Work//Bad"); err == nil {
+		t.Error("Expected an error when creating a mailbox with an empty name part")
+	}
+	if _, err := os.Stat(filepath.Join(root, "username", "Work.sbd", "Projects")); err != nil {
+		t.Error("Expected an mbox file in the .sbd directory, got:", err)
+	}
+
+	// Index files must not be listed
+	backendtest.GetMailbox(t, u, "Work")
+
+	names := backendtest.MailboxNames(t, u, false)
+	if want := []string{"INBOX", "Work", "Work/Projects"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Invalid mailboxes: got %v, want %v", names, want)
+	}
+
+	if err := u.RenameMailbox("Work", "Jobs"); err != nil {
+		t.Fatal("Expected no error while renaming mailbox, got:", err)
+	}
+	names = backendtest.MailboxNames(t, u, false)
+	if want := []string{"INBOX", "Jobs", "Jobs/Projects"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Invalid mailboxes after rename: got %v, want %v", names, want)
+	}
+	if err := u.RenameMailbox("Jobs", "Jobs/Old"); err == nil {
+		t.Error("Expected an error when renaming a mailbox to an inferior name")
+	}
+
+	mbox := backendtest.GetMailbox(t, u, "Jobs/Projects")
+	if err := mbox.SetSubscribed(true); err != nil {
+		t.Fatal(err)
+	}
+	if names := backendtest.MailboxNames(t, u, true); !reflect.DeepEqual(names, []string{"Jobs/Projects"}) {
+		t.Errorf("Invalid subscribed mailboxes: %v", names)
+	}
+
+	if err := u.DeleteMailbox("Jobs"); err != nil {
+		t.Fatal("Expected no error while deleting mailbox, got:", err)
+	}
+	if err := u.DeleteMailbox("INBOX"); err == nil {
+		t.Error("Expected an error when deleting INBOX")
+	}
+	names = backendtest.MailboxNames(t, u, false)
+	if want := []string{"INBOX", "Jobs/Projects"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Invalid mailboxes after delete: got %v, want %v", names, want)
+	}
+
+	if _, err := u.GetMailbox("Jobs"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected no such mailbox error, got: %v", err)
+	}
+}
+
+func TestUser_RenameMailbox_inbox(t *testing.T) {
+	_, u := newTestBackend(t, t.TempDir())
+	inbox := backendtest.GetMailbox(t, u, "INBOX")
+	if err := inbox.CreateMessage([]string{"$Important"}, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.RenameMailbox("INBOX", "Old"); err != nil {
+		t.Fatal("Expected no error while renaming INBOX, got:", err)
+	}
+
+	if msgs := backendtest.ListMessages(t, inbox, false, "1:*", imap.FetchUid); len(msgs) != 0 {
+		t.Errorf("Expected INBOX to be empty, got %v messages", len(msgs))
+	}
+	status, err := inbox.Status([]imap.StatusItem{imap.StatusUidNext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.UidNext != 2 {
+		t.Errorf("Expected UIDNEXT to be kept, got %v", status.UidNext)
+	}
+
+	msgs := backendtest.ListMessages(t, backendtest.GetMailbox(t, u, "Old"), false, "1:*", imap.FetchFlags)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one message in the renamed mailbox, got %v", len(msgs))
+	}
+	if !reflect.DeepEqual(msgs[0].Flags, []string{"$important", imap.RecentFlag}) {
+		t.Errorf("Invalid flags: %v", msgs[0].Flags)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.RunTests(t, func() backend.Backend {
+		return New(t.TempDir(), func(username, password string) error {
+			if username != backendtest.Username || password != backendtest.Password {
+				return errors.New("invalid credentials")
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,317 @@
+package mbox
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+const (
+	subscriptionsFile = ".subscriptions"
+	// sbdSuffix is the suffix of directories containing inferior hierarchical
+	// names.
+	sbdSuffix = ".sbd"
+)
+
+type User struct {
+	be       *Backend
+	username string
+	path     string
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+// mailboxPath returns the mbox file of a mailbox.
+func (u *User) mailboxPath(name string) (string, error) {
+	name = imap.CanonicalMailboxName(name)
+	if name == imap.InboxName {
+		return filepath.Join(u.path, imap.InboxName), nil
+	}
+
+	parts := strings.Split(name, Delimiter)
+	for _, part := range parts {
+		if part == "" || strings.HasPrefix(part, ".") || strings.ContainsAny(part, "\\\x00") {
+			return "", errInvalidName
+		}
+		if strings.HasSuffix(part, sbdSuffix) || strings.HasSuffix(part, ".lock") {
+			return "", errInvalidName
+		}
+	}
+
+	path := u.path
+	for _, part := range parts[:len(parts)-1] {
+		path = filepath.Join(path, part+sbdSuffix)
+	}
+	return filepath.Join(path, parts[len(parts)-1]), nil
+}
+
+func (u *User) mailboxNames() ([]string, error) {
+	names := []string{imap.InboxName}
+	if err := walkMailboxes(u.path, "", &names); err != nil {
+		return nil, err
+	}
+	sort.Strings(names[1:])
+	return names, nil
+}
+
+func walkMailboxes(dir, prefix string, names *[]string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range entries {
+		name := fi.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		if fi.IsDir() && strings.HasSuffix(name, sbdSuffix) {
+			child := prefix + strings.TrimSuffix(name, sbdSuffix) + Delimiter
+			if err := walkMailboxes(filepath.Join(dir, name), child, names); err != nil {
+				return err
+			}
+		} else if fi.Mode().IsRegular() && !strings.HasSuffix(name, ".lock") {
+			if prefix == "" && name == imap.InboxName {
+				continue
+			}
+			*names = append(*names, prefix+name)
+		}
+	}
+	return nil
+}
+
+func (u *User) readSubscriptions() (map[string]bool, error) {
+	subscribed := make(map[string]bool)
+
+	f, err := os.Open(filepath.Join(u.path, subscriptionsFile))
+	if os.IsNotExist(err) {
+		return subscribed, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name := scanner.Text(); name != "" {
+			subscribed[name] = true
+		}
+	}
+	return subscribed, scanner.Err()
+}
+
+func (u *User) setSubscribed(name string, subscribed bool) error {
+	u.be.locker.Lock()
+	defer u.be.locker.Unlock()
+
+	subs, err := u.readSubscriptions()
+	if err != nil {
+		return err
+	}
+	if subs[name] == subscribed {
+		return nil
+	}
+	if subscribed {
+		subs[name] = true
+	} else {
+		delete(subs, name)
+	}
+
+	var names []string
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	path := filepath.Join(u.path, subscriptionsFile)
+	data := strings.Join(names, "\n") + "\n"
+	if err := ioutil.WriteFile(path+".tmp", []byte(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	names, err := u.mailboxNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var subs map[string]bool
+	if subscribed {
+		u.be.locker.Lock()
+		subs, err = u.readSubscriptions()
+		u.be.locker.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var mailboxes []backend.Mailbox
+	for _, name := range names {
+		if subscribed && !subs[name] {
+			continue
+		}
+
+		path, err := u.mailboxPath(name)
+		if err != nil {
+			// Not a valid mailbox name, e.g. a file created by another program
+			continue
+		}
+		mailboxes = append(mailboxes, u.newMailbox(name, path))
+	}
+	return mailboxes, nil
+}
+
+func (u *User) newMailbox(name, path string) *Mailbox {
+	return &Mailbox{
+		name:  name,
+		user:  u,
+		state: u.be.state(u.username, name, path),
+	}
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	name = imap.CanonicalMailboxName(name)
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	if !isMbox(path) {
+		return nil, backend.ErrNoSuchMailbox
+	}
+
+	mbox := u.newMailbox(name, path)
+	if err := mbox.sync(); err != nil {
+		return nil, err
+	}
+	return mbox, nil
+}
+
+// createParents creates superior hierarchical names of a mailbox.
+func (u *User) createParents(name string) error {
+	parts := strings.Split(name, Delimiter)
+	for i := 1; i < len(parts); i++ {
+		parent, _ := u.mailboxPath(strings.Join(parts[:i], Delimiter))
+		if err := createMbox(parent); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent+sbdSuffix, 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *User) CreateMailbox(name string) error {
+	name = strings.TrimSuffix(name, Delimiter)
+	if imap.CanonicalMailboxName(name) == imap.InboxName {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return err
+	}
+	if isMbox(path) {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	if err := u.createParents(name); err != nil {
+		return err
+	}
+	return createMbox(path)
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	if imap.CanonicalMailboxName(name) == imap.InboxName {
+		return errors.New("Cannot delete INBOX")
+	}
+
+	path, err := u.mailboxPath(name)
+	if err != nil || !isMbox(path) {
+		return backend.ErrNoSuchMailbox
+	}
+
+	// Inferior hierarchical names are stored in the .sbd directory, they
+	// aren't removed. A new mailbox created with the same name will get a new
+	// UIDVALIDITY.
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if err := os.Remove(indexPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	u.be.forgetState(path)
+	return nil
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	existingName = imap.CanonicalMailboxName(existingName)
+	newName = strings.TrimSuffix(newName, Delimiter)
+
+	src, err := u.mailboxPath(existingName)
+	if err != nil || !isMbox(src) {
+		return backend.ErrNoSuchMailbox
+	}
+	if imap.CanonicalMailboxName(newName) == imap.InboxName {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if strings.HasPrefix(newName, existingName+Delimiter) {
+		return errors.New("Cannot rename a mailbox to one of its inferior hierarchical names")
+	}
+	dst, err := u.mailboxPath(newName)
+	if err != nil {
+		return err
+	}
+	if isMbox(dst) {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	if err := u.createParents(newName); err != nil {
+		return err
+	}
+
+	if existingName == imap.InboxName {
+		return u.renameInbox(dst)
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	if err := os.Rename(indexPath(src), indexPath(dst)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Rename inferior hierarchical names
+	if err := os.Rename(src+sbdSuffix, dst+sbdSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	u.be.forgetState(src)
+	return nil
+}
+
+// renameInbox moves all messages in INBOX to a new mailbox, leaving INBOX
+// empty.
+func (u *User) renameInbox(dst string) error {
+	inbox := u.be.state(u.username, imap.InboxName, filepath.Join(u.path, imap.InboxName))
+	inbox.Lock()
+	updates, err := inbox.moveTo(dst)
+	inbox.Unlock()
+	u.be.notifier.Notify(updates...)
+	return err
+}
+
+func (u *User) Logout() error {
+	return nil
+}
@@ -1,29 +1,83 @@
 // A memory backend.
+//
+// All operations are safe for concurrent use by multiple connections. Each
+// successful login creates a new session: the \Recent flag is set on a new
+// message for the first session that accesses it, as required by RFC 3501.
+// Changes are reported to other sessions through backend.BackendUpdater.
 package memory
 
 import (
-	"errors"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
 )
 
 type Backend struct {
-	users map[string]*User
+	// locker protects all users, mailboxes and messages
+	locker      sync.Mutex
+	users       map[string]*userData
+	uidValidity uint32
+	sessions    uint64
+
+	notifier backendutil.Notifier
 }
 
 func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
-	user, ok := be.users[username]
-	if ok && user.password == password {
-		return user, nil
+	be.locker.Lock()
+	defer be.locker.Unlock()
+
+	data, ok := be.users[username]
+	if !ok || data.password != password {
+		return nil, backend.ErrInvalidCredentials
 	}
 
-	return nil, errors.New("Bad username or password")
+	be.sessions++
+	return &User{be: be, data: data, session: be.sessions}, nil
+}
+
+func (be *Backend) Capabilities() []string {
+	return []string{"STATUS=SIZE", "SAVEDATE", "OBJECTID", "PREVIEW", "WITHIN"}
+}
+
+// Updates implements backend.BackendUpdater.
+func (be *Backend) Updates() <-chan backend.Update {
+	return be.notifier.Updates()
+}
+
+// nextUidValidity returns a new UIDVALIDITY value. The caller must hold the
+// backend lock.
+func (be *Backend) nextUidValidity() uint32 {
+	v := uint32(time.Now().Unix())
+	if v <= be.uidValidity {
+		v = be.uidValidity + 1
+	}
+	be.uidValidity = v
+	return v
+}
+
+// newObjectId generates a new random object identifier, as defined in RFC
+// 8474.
+func newObjectId() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
 }
 
 func New() *Backend {
-	user := &User{username: "username", password: "password"}
+	data := &userData{
+		username:      "username",
+		password:      "password",
+		mailboxes:     make(map[string]*mailboxData),
+		subscriptions: make(map[string]bool),
+		deleted:       make(map[string]uidCounter),
+	}
 
 	body := "From: contact@example.org\r\n" +
 		"To: contact@example.org\r\n" +
@@ -34,23 +88,26 @@ func New() *Backend {
 		"\r\n" +
 		"Hi there :)"
 
-	user.mailboxes = map[string]*Mailbox{
-		"INBOX": {
-			name: "INBOX",
-			user: user,
-			Messages: []*Message{
-				{
-					Uid:   6,
-					Date:  time.Now(),
-					Flags: []string{"\\Seen"},
-					Size:  uint32(len(body)),
-					Body:  []byte(body),
-				},
+	data.mailboxes[imap.InboxName] = &mailboxData{
+		name:        imap.InboxName,
+		id:          newObjectId(),
+		uidValidity: 1,
+		uidNext:     7,
+		messages: []*Message{
+			{
+				Uid:      6,
+				Date:     time.Now(),
+				SaveDate: time.Now(),
+				EmailId:  newObjectId(),
+				Flags:    []string{"\\Seen"},
+				Size:     uint32(len(body)),
+				Body:     []byte(body),
 			},
 		},
 	}
 
 	return &Backend{
-		users: map[string]*User{user.username: user},
+		users:       map[string]*userData{data.username: data},
+		uidValidity: 1,
 	}
 }
@@ -0,0 +1,101 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// Operations other than listing and searching messages don't block, they only
+// check whether the context has been cancelled before doing any work.
+
+func (u *User) ListMailboxesContext(ctx context.Context, subscribed bool) ([]backend.Mailbox, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return u.ListMailboxes(subscribed)
+}
+
+func (u *User) GetMailboxContext(ctx context.Context, name string) (backend.Mailbox, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return u.GetMailbox(name)
+}
+
+func (u *User) CreateMailboxContext(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return u.CreateMailbox(name)
+}
+
+func (u *User) DeleteMailboxContext(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return u.DeleteMailbox(name)
+}
+
+func (u *User) RenameMailboxContext(ctx context.Context, existingName, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return u.RenameMailbox(existingName, newName)
+}
+
+func (mbox *Mailbox) StatusContext(ctx context.Context, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return mbox.Status(items)
+}
+
+func (mbox *Mailbox) SetSubscribedContext(ctx context.Context, subscribed bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mbox.SetSubscribed(subscribed)
+}
+
+func (mbox *Mailbox) CheckContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mbox.Check()
+}
+
+func (mbox *Mailbox) CreateMessageContext(ctx context.Context, flags []string, date time.Time, body imap.Literal) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mbox.CreateMessage(flags, date, body)
+}
+
+func (mbox *Mailbox) UpdateMessagesFlagsContext(ctx context.Context, uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mbox.UpdateMessagesFlags(uid, seqset, op, flags)
+}
+
+func (mbox *Mailbox) CopyMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, dest string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mbox.CopyMessages(uid, seqset, dest)
+}
+
+func (mbox *Mailbox) ExpungeContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mbox.Expunge()
+}
+
+var (
+	_ backend.UserContext    = (*User)(nil)
+	_ backend.MailboxContext = (*Mailbox)(nil)
+)
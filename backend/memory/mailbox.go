@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"context"
 	"io/ioutil"
 	"time"
 
@@ -11,123 +12,234 @@ import (
 
 var Delimiter = "/"
 
-type Mailbox struct {
-	Subscribed bool
-	Messages   []*Message
+// mailboxData is shared by all sessions of a user.
+type mailboxData struct {
+	name        string
+	id          string
+	uidValidity uint32
+	uidNext     uint32
+	messages    []*Message
+	removed     bool
+}
 
-	name string
+// Mailbox is a mailbox accessed by a session.
+type Mailbox struct {
 	user *User
+	data *mailboxData
+
+	// Set if the mailbox has been selected read-only, recent messages aren't
+	// claimed
+	readOnly bool
+}
+
+// lock locks the backend. It fails if the mailbox has been deleted.
+func (mbox *Mailbox) lock() error {
+	mbox.user.be.locker.Lock()
+	if mbox.data.removed {
+		mbox.user.be.locker.Unlock()
+		return backend.ErrNoSuchMailbox
+	}
+	return nil
+}
+
+func (mbox *Mailbox) unlock() {
+	mbox.user.be.locker.Unlock()
+}
+
+func (mbox *Mailbox) newUpdate() backend.Update {
+	return backend.NewUpdate(mbox.user.data.username, mbox.data.name)
+}
+
+// snapshotMessage is a message with the flags seen by a session.
+type snapshotMessage struct {
+	*Message
+	seqNum uint32
+	flags  []string
+	recent bool
+}
+
+// snapshot returns the messages of the mailbox, so that they can be read
+// without holding the backend lock. Recent messages are claimed by the session,
+// unless the mailbox is read-only.
+func (mbox *Mailbox) snapshot() ([]snapshotMessage, error) {
+	if err := mbox.lock(); err != nil {
+		return nil, err
+	}
+	defer mbox.unlock()
+
+	session := mbox.user.session
+	messages := make([]snapshotMessage, len(mbox.data.messages))
+	for i, msg := range mbox.data.messages {
+		if !mbox.readOnly {
+			msg.claim(session)
+		}
+		messages[i] = snapshotMessage{
+			Message: msg,
+			seqNum:  uint32(i + 1),
+			flags:   msg.flags(session),
+			recent:  msg.isRecent(session),
+		}
+	}
+	return messages, nil
 }
 
 func (mbox *Mailbox) Name() string {
-	return mbox.name
+	mbox.user.be.locker.Lock()
+	defer mbox.user.be.locker.Unlock()
+	return mbox.data.name
 }
 
 func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
 	info := &imap.MailboxInfo{
 		Delimiter: Delimiter,
-		Name:      mbox.name,
+		Name:      mbox.Name(),
 	}
 	return info, nil
 }
 
-func (mbox *Mailbox) uidNext() uint32 {
-	var uid uint32
-	for _, msg := range mbox.Messages {
-		if msg.Uid > uid {
-			uid = msg.Uid
-		}
-	}
-	uid++
-	return uid
-}
-
-func (mbox *Mailbox) flags() []string {
-	flagsMap := make(map[string]bool)
-	for _, msg := range mbox.Messages {
-		for _, f := range msg.Flags {
-			if !flagsMap[f] {
-				flagsMap[f] = true
-			}
-		}
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	if err := mbox.lock(); err != nil {
+		return nil, err
 	}
+	defer mbox.unlock()
 
-	var flags []string
-	for f := range flagsMap {
-		flags = append(flags, f)
-	}
-	return flags
-}
+	data := mbox.data
+	session := mbox.user.session
 
-func (mbox *Mailbox) unseenSeqNum() uint32 {
-	for i, msg := range mbox.Messages {
-		seqNum := uint32(i + 1)
+	status := imap.NewMailboxStatus(data.name, items)
+	status.PermanentFlags = []string{"\\*"}
 
+	flagsMap := make(map[string]bool)
+	var recent, unseen uint32
+	var size uint64
+	for i, msg := range data.messages {
 		seen := false
 		for _, flag := range msg.Flags {
 			if flag == imap.SeenFlag {
 				seen = true
-				break
+			}
+			if !flagsMap[flag] {
+				flagsMap[flag] = true
+				status.Flags = append(status.Flags, flag)
 			}
 		}
-
 		if !seen {
-			return seqNum
+			unseen++
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+		}
+		if msg.isRecent(session) {
+			recent++
 		}
+		size += uint64(msg.Size)
 	}
-	return 0
-}
-
-func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
-	status := imap.NewMailboxStatus(mbox.name, items)
-	status.Flags = mbox.flags()
-	status.PermanentFlags = []string{"\\*"}
-	status.UnseenSeqNum = mbox.unseenSeqNum()
 
 	for _, name := range items {
 		switch name {
 		case imap.StatusMessages:
-			status.Messages = uint32(len(mbox.Messages))
+			status.Messages = uint32(len(data.messages))
 		case imap.StatusUidNext:
-			status.UidNext = mbox.uidNext()
+			status.UidNext = data.uidNext
 		case imap.StatusUidValidity:
-			status.UidValidity = 1
+			status.UidValidity = data.uidValidity
 		case imap.StatusRecent:
-			status.Recent = 0 // TODO
+			status.Recent = recent
 		case imap.StatusUnseen:
-			status.Unseen = 0 // TODO
+			status.Unseen = unseen
+		case imap.StatusSize:
+			status.Size = size
+		case imap.StatusMailboxId:
+			status.MailboxId = data.id
 		}
 	}
 
 	return status, nil
 }
 
+// Select implements backend.SelectMailbox.
+func (mbox *Mailbox) Select(readOnly bool) error {
+	if err := mbox.lock(); err != nil {
+		return err
+	}
+	defer mbox.unlock()
+
+	mbox.readOnly = readOnly
+	if !readOnly {
+		for _, msg := range mbox.data.messages {
+			msg.claim(mbox.user.session)
+		}
+	}
+	return nil
+}
+
+// Recent implements backend.SelectMailbox.
+func (mbox *Mailbox) Recent(uid uint32) bool {
+	if err := mbox.lock(); err != nil {
+		return false
+	}
+	defer mbox.unlock()
+
+	for _, msg := range mbox.data.messages {
+		if msg.Uid == uid {
+			return msg.recent == mbox.user.session
+		}
+	}
+	return false
+}
+
 func (mbox *Mailbox) SetSubscribed(subscribed bool) error {
-	mbox.Subscribed = subscribed
+	if err := mbox.lock(); err != nil {
+		return err
+	}
+	defer mbox.unlock()
+
+	if subscribed {
+		mbox.user.data.subscriptions[mbox.data.name] = true
+	} else {
+		delete(mbox.user.data.subscriptions, mbox.data.name)
+	}
 	return nil
 }
 
 func (mbox *Mailbox) Check() error {
+	if err := mbox.lock(); err != nil {
+		return err
+	}
+	mbox.unlock()
 	return nil
 }
 
 func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.ListMessagesContext(context.Background(), uid, seqSet, items, ch)
+}
+
+// ListMessagesContext implements backend.MailboxContext. Listing stops when the
+// context is cancelled.
+func (mbox *Mailbox) ListMessagesContext(ctx context.Context, uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
 	defer close(ch)
 
-	for i, msg := range mbox.Messages {
-		seqNum := uint32(i + 1)
+	messages, err := mbox.snapshot()
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		var id uint32
 		if uid {
 			id = msg.Uid
 		} else {
-			id = seqNum
+			id = msg.seqNum
 		}
 		if !seqSet.Contains(id) {
 			continue
 		}
 
-		m, err := msg.Fetch(seqNum, items)
+		m, err := msg.fetch(msg.seqNum, msg.flags, items)
 		if err != nil {
 			continue
 		}
@@ -139,11 +251,24 @@ func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.Fe
 }
 
 func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return mbox.SearchMessagesContext(context.Background(), uid, criteria)
+}
+
+// SearchMessagesContext implements backend.MailboxContext. The search stops
+// when the context is cancelled.
+func (mbox *Mailbox) SearchMessagesContext(ctx context.Context, uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	messages, err := mbox.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
 	var ids []uint32
-	for i, msg := range mbox.Messages {
-		seqNum := uint32(i + 1)
+	for _, msg := range messages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-		ok, err := msg.Match(seqNum, criteria)
+		ok, err := msg.match(msg.seqNum, msg.flags, msg.recent, criteria)
 		if err != nil || !ok {
 			continue
 		}
@@ -152,13 +277,26 @@ func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]
 		if uid {
 			id = msg.Uid
 		} else {
-			id = seqNum
+			id = msg.seqNum
 		}
 		ids = append(ids, id)
 	}
 	return ids, nil
 }
 
+// appendMessage adds a message to a mailbox, and returns an update with the new
+// number of messages. The caller must hold the backend lock.
+func (data *mailboxData) appendMessage(msg *Message, update backend.Update) backend.Update {
+	msg.Uid = data.uidNext
+	msg.recent = recentUnclaimed
+	data.uidNext++
+	data.messages = append(data.messages, msg)
+
+	status := imap.NewMailboxStatus(data.name, []imap.StatusItem{imap.StatusMessages})
+	status.Messages = uint32(len(data.messages))
+	return &backend.MailboxUpdate{Update: update, MailboxStatus: status}
+}
+
 func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
 	if date.IsZero() {
 		date = time.Now()
@@ -169,18 +307,37 @@ func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Lit
 		return err
 	}
 
-	mbox.Messages = append(mbox.Messages, &Message{
-		Uid:   mbox.uidNext(),
-		Date:  date,
-		Size:  uint32(len(b)),
-		Flags: flags,
-		Body:  b,
-	})
+	if err := mbox.lock(); err != nil {
+		return err
+	}
+	update := mbox.data.appendMessage(&Message{
+		Date:     date,
+		SaveDate: time.Now(),
+		EmailId:  newObjectId(),
+		Size:     uint32(len(b)),
+		Flags:    withoutRecent(flags),
+		Body:     b,
+	}, mbox.newUpdate())
+	mbox.unlock()
+
+	mbox.user.be.notifier.Notify(update)
 	return nil
 }
 
 func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
-	for i, msg := range mbox.Messages {
+	// \Recent cannot be changed by clients
+	flags = withoutRecent(flags)
+
+	items := []imap.FetchItem{imap.FetchFlags}
+	if uid {
+		items = append(items, imap.FetchUid)
+	}
+
+	if err := mbox.lock(); err != nil {
+		return err
+	}
+	var updates []backend.Update
+	for i, msg := range mbox.data.messages {
 		var id uint32
 		if uid {
 			id = msg.Uid
@@ -191,19 +348,36 @@ func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.
 			continue
 		}
 
-		msg.Flags = backendutil.UpdateFlags(msg.Flags, op, flags)
+		current := append([]string(nil), msg.Flags...)
+		msg.Flags = backendutil.UpdateFlags(current, op, flags)
+
+		// \Recent is per-session, it's not included in updates broadcast
+		// to all sessions
+		m := imap.NewMessage(uint32(i+1), items)
+		m.Flags = msg.Flags
+		m.Uid = msg.Uid
+		updates = append(updates, &backend.MessageUpdate{Update: mbox.newUpdate(), Message: m})
 	}
+	mbox.unlock()
 
+	mbox.user.be.notifier.Notify(updates...)
 	return nil
 }
 
 func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
-	dest, ok := mbox.user.mailboxes[destName]
+	if err := mbox.lock(); err != nil {
+		return err
+	}
+
+	dest, ok := mbox.user.data.mailboxes[imap.CanonicalMailboxName(destName)]
 	if !ok {
+		mbox.unlock()
 		return backend.ErrNoSuchMailbox
 	}
 
-	for i, msg := range mbox.Messages {
+	var update backend.Update
+	destUpdate := backend.NewUpdate(mbox.user.data.username, dest.name)
+	for i, msg := range mbox.data.messages {
 		var id uint32
 		if uid {
 			id = msg.Uid
@@ -215,16 +389,28 @@ func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string
 		}
 
 		msgCopy := *msg
-		msgCopy.Uid = dest.uidNext()
-		dest.Messages = append(dest.Messages, &msgCopy)
+		msgCopy.Flags = append([]string(nil), msg.Flags...)
+		msgCopy.SaveDate = time.Now()
+		update = dest.appendMessage(&msgCopy, destUpdate)
 	}
+	mbox.unlock()
 
+	if update != nil {
+		mbox.user.be.notifier.Notify(update)
+	}
 	return nil
 }
 
 func (mbox *Mailbox) Expunge() error {
-	for i := len(mbox.Messages) - 1; i >= 0; i-- {
-		msg := mbox.Messages[i]
+	if err := mbox.lock(); err != nil {
+		return err
+	}
+
+	// Send expunges from the end, so that sequence numbers stay valid
+	var updates []backend.Update
+	messages := mbox.data.messages
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg := messages[i]
 
 		deleted := false
 		for _, flag := range msg.Flags {
@@ -235,9 +421,17 @@ func (mbox *Mailbox) Expunge() error {
 		}
 
 		if deleted {
-			mbox.Messages = append(mbox.Messages[:i], mbox.Messages[i+1:]...)
+			messages = append(messages[:i], messages[i+1:]...)
+			updates = append(updates, &backend.ExpungeUpdate{
+				Update: mbox.newUpdate(),
+				SeqNum: uint32(i + 1),
+				Uid:    msg.Uid,
+			})
 		}
 	}
+	mbox.data.messages = messages
+	mbox.unlock()
 
+	mbox.user.be.notifier.Notify(updates...)
 	return nil
 }
@@ -0,0 +1,311 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendtest"
+)
+
+const testMessage = "From: contact@example.org\r\n" +
+	"To: contact@example.org\r\n" +
+	"Subject: A little message, just for you\r\n" +
+	"Date: Wed, 11 May 2016 14:31:59 +0000\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hi there :)"
+
+func createMessage(t *testing.T, mbox backend.Mailbox, flags []string) {
+	if err := mbox.CreateMessage(flags, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("Expected no error while creating message, got:", err)
+	}
+}
+
+func TestMailbox_Recent(t *testing.T) {
+	be := New()
+	u1, u2 := backendtest.Login(t, be), backendtest.Login(t, be)
+	mbox1, mbox2 := backendtest.GetMailbox(t, u1, "INBOX"), backendtest.GetMailbox(t, u2, "INBOX")
+
+	createMessage(t, mbox1, []string{imap.RecentFlag})
+
+	items := []imap.StatusItem{imap.StatusRecent, imap.StatusUnseen}
+	status := backendtest.GetStatus(t, mbox2, items...)
+	if status.Recent != 1 || status.Unseen != 1 {
+		t.Fatalf("Expected 1 recent and 1 unseen message, got %v and %v", status.Recent, status.Unseen)
+	}
+
+	// The first session to see the message claims the Recent flag
+	msgs := backendtest.ListMessages(t, mbox2, false, "1:*", imap.FetchFlags)
+	if want := []string{imap.RecentFlag}; !reflect.DeepEqual(msgs[1].Flags, want) {
+		t.Errorf("Expected flags %v, got %v", want, msgs[1].Flags)
+	}
+
+	msgs = backendtest.ListMessages(t, mbox1, false, "1:*", imap.FetchFlags)
+	if len(msgs[1].Flags) != 0 {
+		t.Errorf("Expected no flags for the other session, got %v", msgs[1].Flags)
+	}
+	if status := backendtest.GetStatus(t, mbox1, items...); status.Recent != 0 {
+		t.Errorf("Expected no recent message for the other session, got %v", status.Recent)
+	}
+}
+
+func TestMailbox_RecentExamine(t *testing.T) {
+	be := New()
+	u1, u2 := backendtest.Login(t, be), backendtest.Login(t, be)
+	mbox1, mbox2 := backendtest.GetMailbox(t, u1, "INBOX"), backendtest.GetMailbox(t, u2, "INBOX")
+
+	createMessage(t, mbox1, []string{imap.RecentFlag})
+
+	// EXAMINE must not claim the Recent flag
+	if err := mbox1.(backend.SelectMailbox).Select(true); err != nil {
+		t.Fatal("Expected no error while examining mailbox, got:", err)
+	}
+	backendtest.ListMessages(t, mbox1, false, "1:*", imap.FetchUid, imap.FetchFlags)
+	if _, err := mbox1.SearchMessages(true, imap.NewSearchCriteria()); err != nil {
+		t.Fatal("Expected no error while searching messages, got:", err)
+	}
+
+	if err := mbox2.(backend.SelectMailbox).Select(false); err != nil {
+		t.Fatal("Expected no error while selecting mailbox, got:", err)
+	}
+	msgs := backendtest.ListMessages(t, mbox2, false, "1:*", imap.FetchUid, imap.FetchFlags)
+	if !mbox2.(backend.SelectMailbox).Recent(msgs[1].Uid) {
+		t.Error("Expected the message to be recent for the session which selected the mailbox")
+	}
+	if want := []string{imap.RecentFlag}; !reflect.DeepEqual(msgs[1].Flags, want) {
+		t.Errorf("Expected flags %v, got %v", want, msgs[1].Flags)
+	}
+}
+
+func TestMailbox_SearchMessagesContext(t *testing.T) {
+	be := New()
+	mbox := backendtest.GetMailbox(t, backendtest.Login(t, be), "INBOX").(*Mailbox)
+	for i := 0; i < 10; i++ {
+		createMessage(t, mbox, nil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ids, err := mbox.SearchMessagesContext(ctx, false, &imap.SearchCriteria{Body: []string{"Hi there"}})
+	if err != context.Canceled {
+		t.Errorf("Expected the search to be cancelled, got: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("Expected no result, got %v", ids)
+	}
+}
+
+func TestMailbox_ListMessagesContext(t *testing.T) {
+	be := New()
+	mbox := backendtest.GetMailbox(t, backendtest.Login(t, be), "INBOX").(*Mailbox)
+	for i := 0; i < 10; i++ {
+		createMessage(t, mbox, nil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	seqSet, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- mbox.ListMessagesContext(ctx, false, seqSet, []imap.FetchItem{imap.FetchUid}, ch)
+	}()
+
+	// Cancel the context once the first message has been received
+	n := 0
+	for range ch {
+		if n == 0 {
+			cancel()
+		}
+		n++
+	}
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected the listing to be cancelled, got: %v", err)
+	}
+	if n >= 10 {
+		t.Errorf("Expected the listing to stop early, got %v messages", n)
+	}
+}
+
+func TestMailbox_UidValidity(t *testing.T) {
+	be := New()
+	u := backendtest.Login(t, be)
+
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal("Expected no error while creating mailbox, got:", err)
+	}
+	mbox := backendtest.GetMailbox(t, u, "Archive")
+	createMessage(t, mbox, nil)
+	createMessage(t, mbox, nil)
+
+	items := []imap.StatusItem{imap.StatusUidNext, imap.StatusUidValidity}
+	before := backendtest.GetStatus(t, mbox, items...)
+	if before.UidNext != 3 {
+		t.Fatalf("Expected UIDNEXT 3, got %v", before.UidNext)
+	}
+
+	if err := u.DeleteMailbox("Archive"); err != nil {
+		t.Fatal("Expected no error while deleting mailbox, got:", err)
+	}
+	if _, err := mbox.Status(items); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected ErrNoSuchMailbox for a deleted mailbox, got: %v", err)
+	}
+
+	// UIDs must not be reused by a mailbox with the same name
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal("Expected no error while creating mailbox, got:", err)
+	}
+	after := backendtest.GetStatus(t, backendtest.GetMailbox(t, u, "Archive"), items...)
+	if after.UidNext != before.UidNext || after.UidValidity != before.UidValidity {
+		t.Errorf("Expected UIDNEXT %v and UIDVALIDITY %v, got %v and %v",
+			before.UidNext, before.UidValidity, after.UidNext, after.UidValidity)
+	}
+
+	if err := u.CreateMailbox("Other"); err != nil {
+		t.Fatal("Expected no error while creating mailbox, got:", err)
+	}
+	other := backendtest.GetStatus(t, backendtest.GetMailbox(t, u, "Other"), items...)
+	if other.UidValidity <= before.UidValidity {
+		t.Errorf("Expected UIDVALIDITY greater than %v, got %v", before.UidValidity, other.UidValidity)
+	}
+}
+
+func TestUser_Hierarchy(t *testing.T) {
+	be := New()
+	u := backendtest.Login(t, be)
+
+	if err := u.CreateMailbox("a/b/c/"); err != nil {
+		t.Fatal("Expected no error while creating mailbox, got:", err)
+	}
+	want := []string{"INBOX", "a", "a/b", "a/b/c"}
+	if names := backendtest.MailboxNames(t, u, false); !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected mailboxes %v, got %v", want, names)
+	}
+
+	if err := u.CreateMailbox("a/b"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("Expected ErrMailboxAlreadyExists, got: %v", err)
+	}
+
+	if err := u.RenameMailbox("a/b", "x/y"); err != nil {
+		t.Fatal("Expected no error while renaming mailbox, got:", err)
+	}
+	want = []string{"INBOX", "a", "x", "x/y", "x/y/c"}
+	if names := backendtest.MailboxNames(t, u, false); !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected mailboxes %v, got %v", want, names)
+	}
+
+	if err := u.RenameMailbox("x", "a"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("Expected ErrMailboxAlreadyExists, got: %v", err)
+	}
+}
+
+func TestUser_RenameInbox(t *testing.T) {
+	be := New()
+	u := backendtest.Login(t, be)
+
+	if err := u.RenameMailbox("INBOX", "Old"); err != nil {
+		t.Fatal("Expected no error while renaming INBOX, got:", err)
+	}
+
+	items := []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext}
+	if status := backendtest.GetStatus(t, backendtest.GetMailbox(t, u, "INBOX"), items...); status.Messages != 0 {
+		t.Errorf("Expected INBOX to be empty, got %v messages", status.Messages)
+	}
+	status := backendtest.GetStatus(t, backendtest.GetMailbox(t, u, "Old"), items...)
+	if status.Messages != 1 || status.UidNext != 7 {
+		t.Errorf("Expected 1 message and UIDNEXT 7, got %v and %v", status.Messages, status.UidNext)
+	}
+}
+
+func TestBackend_Updates(t *testing.T) {
+	be := New()
+	u := backendtest.Login(t, be)
+	mbox := backendtest.GetMailbox(t, u, "INBOX")
+
+	updates := be.Updates()
+	received := make(chan backend.Update, 10)
+	go func() {
+		for update := range updates {
+			received <- update
+			close(update.Done())
+		}
+	}()
+
+	createMessage(t, mbox, nil)
+	update, ok := (<-received).(*backend.MailboxUpdate)
+	if !ok || update.Mailbox() != "INBOX" || update.Messages != 2 {
+		t.Errorf("Expected a mailbox update with 2 messages, got %#v", update)
+	}
+
+	seqSet, _ := imap.ParseSeqSet("1")
+	if err := mbox.UpdateMessagesFlags(false, seqSet, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal("Expected no error while updating flags, got:", err)
+	}
+	msgUpdate, ok := (<-received).(*backend.MessageUpdate)
+	if !ok || msgUpdate.SeqNum != 1 {
+		t.Fatalf("Expected a message update for message 1, got %#v", msgUpdate)
+	}
+	if want := []string{imap.SeenFlag, imap.DeletedFlag}; !reflect.DeepEqual(msgUpdate.Flags, want) {
+		t.Errorf("Expected flags %v, got %v", want, msgUpdate.Flags)
+	}
+
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal("Expected no error while expunging, got:", err)
+	}
+	expunge, ok := (<-received).(*backend.ExpungeUpdate)
+	if !ok || expunge.SeqNum != 1 {
+		t.Errorf("Expected an expunge update for message 1, got %#v", expunge)
+	}
+}
+
+func TestBackend_Concurrent(t *testing.T) {
+	be := New()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			u := backendtest.Login(t, be)
+			mbox := backendtest.GetMailbox(t, u, "INBOX")
+			name := fmt.Sprintf("Folder%v", i)
+			if err := u.CreateMailbox(name); err != nil {
+				t.Error("Expected no error while creating mailbox, got:", err)
+			}
+			for j := 0; j < 10; j++ {
+				createMessage(t, mbox, nil)
+				backendtest.ListMessages(t, mbox, false, "1:*", imap.FetchFlags, imap.FetchUid)
+				seqSet, _ := imap.ParseSeqSet("1:*")
+				if err := mbox.CopyMessages(false, seqSet, name); err != nil {
+					t.Error("Expected no error while copying messages, got:", err)
+				}
+			}
+			if err := u.DeleteMailbox(name); err != nil {
+				t.Error("Expected no error while deleting mailbox, got:", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	u := backendtest.Login(t, be)
+	status := backendtest.GetStatus(t, backendtest.GetMailbox(t, u, "INBOX"), imap.StatusMessages, imap.StatusUidNext)
+	if status.Messages != 81 || status.UidNext != 87 {
+		t.Errorf("Expected 81 messages and UIDNEXT 87, got %v and %v", status.Messages, status.UidNext)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.RunTests(t, func() backend.Backend {
+		return New()
+	})
+}
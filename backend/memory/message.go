@@ -4,24 +4,62 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"io/ioutil"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend/backendutil"
-	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/textproto"
 )
 
 type Message struct {
-	Uid   uint32
-	Date  time.Time
-	Size  uint32
-	Flags []string
-	Body  []byte
+	Uid      uint32
+	Date     time.Time
+	SaveDate time.Time
+	EmailId  string
+	Size     uint32
+	Flags    []string
+	Body     []byte
+
+	// recent is the session which has claimed the \Recent flag, 0 if the
+	// message isn't recent or recentUnclaimed.
+	recent uint64
+}
+
+// recentUnclaimed means that the message is recent and hasn't been seen by any
+// session yet.
+const recentUnclaimed = ^uint64(0)
+
+// claim gives the \Recent flag to a session, if no other session has it.
+func (m *Message) claim(session uint64) {
+	if m.recent == recentUnclaimed {
+		m.recent = session
+	}
+}
+
+// isRecent checks whether the message is recent for a session.
+func (m *Message) isRecent(session uint64) bool {
+	return m.recent == recentUnclaimed || m.recent == session
 }
 
-func (m *Message) entity() (*message.Entity, error) {
-	return message.Read(bytes.NewReader(m.Body))
+// flags returns a copy of the message flags as seen by a session.
+func (m *Message) flags(session uint64) []string {
+	flags := append([]string(nil), m.Flags...)
+	if m.recent == session {
+		flags = append(flags, imap.RecentFlag)
+	}
+	return flags
+}
+
+// withoutRecent returns flags without \Recent, which is managed by the server.
+func withoutRecent(flags []string) []string {
+	var l []string
+	for _, flag := range flags {
+		if imap.CanonicalFlag(flag) != imap.RecentFlag {
+			l = append(l, flag)
+		}
+	}
+	return l
 }
 
 func (m *Message) headerAndBody() (textproto.Header, io.Reader, error) {
@@ -30,7 +68,7 @@ func (m *Message) headerAndBody() (textproto.Header, io.Reader, error) {
 	return hdr, body, err
 }
 
-func (m *Message) Fetch(seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+func (m *Message) fetch(seqNum uint32, flags []string, items []imap.FetchItem) (*imap.Message, error) {
 	fetched := imap.NewMessage(seqNum, items)
 	for _, item := range items {
 		switch item {
@@ -41,13 +79,22 @@ func (m *Message) Fetch(seqNum uint32, items []imap.FetchItem) (*imap.Message, e
 			hdr, body, _ := m.headerAndBody()
 			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
 		case imap.FetchFlags:
-			fetched.Flags = m.Flags
+			fetched.Flags = flags
 		case imap.FetchInternalDate:
 			fetched.InternalDate = m.Date
 		case imap.FetchRFC822Size:
 			fetched.Size = m.Size
 		case imap.FetchUid:
 			fetched.Uid = m.Uid
+		case imap.FetchSaveDate:
+			fetched.SaveDate = m.SaveDate
+		case imap.FetchEmailId:
+			fetched.EmailId = m.EmailId
+		case imap.FetchThreadId:
+			// Threads are not supported, leave ThreadId empty
+		case imap.FetchPreview:
+			hdr, body, _ := m.headerAndBody()
+			fetched.Preview, _ = backendutil.FetchPreview(hdr, body)
 		default:
 			section, err := imap.ParseBodySectionName(item)
 			if err != nil {
@@ -68,7 +115,19 @@ func (m *Message) Fetch(seqNum uint32, items []imap.FetchItem) (*imap.Message, e
 	return fetched, nil
 }
 
-func (m *Message) Match(seqNum uint32, c *imap.SearchCriteria) (bool, error) {
-	e, _ := m.entity()
-	return backendutil.Match(e, seqNum, m.Uid, m.Date, m.Flags, c)
+func (m *Message) match(seqNum uint32, flags []string, recent bool, c *imap.SearchCriteria) (bool, error) {
+	md := &backendutil.Metadata{
+		SeqNum:   seqNum,
+		Uid:      m.Uid,
+		Date:     m.Date,
+		Flags:    flags,
+		Recent:   recent,
+		Size:     m.Size,
+		SaveDate: m.SaveDate,
+		EmailId:  m.EmailId,
+	}
+	open := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(m.Body)), nil
+	}
+	return backendutil.MatchReader(open, md, c)
 }
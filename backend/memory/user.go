@@ -2,79 +2,251 @@ package memory
 
 import (
 	"errors"
+	"sort"
+	"strings"
 
+	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
 )
 
+// uidCounter is the UIDVALIDITY and next UID of a mailbox.
+type uidCounter struct {
+	uidValidity uint32
+	uidNext     uint32
+}
+
+// userData is shared by all sessions of a user.
+type userData struct {
+	username      string
+	password      string
+	mailboxes     map[string]*mailboxData
+	subscriptions map[string]bool
+	// UID counters of deleted and renamed mailboxes, so that a new mailbox
+	// created with the same name doesn't reuse UIDs
+	deleted map[string]uidCounter
+}
+
+// User is a session of a user.
 type User struct {
-	username  string
-	password  string
-	mailboxes map[string]*Mailbox
+	be      *Backend
+	data    *userData
+	session uint64
 }
 
 func (u *User) Username() string {
-	return u.username
+	return u.data.username
 }
 
-func (u *User) ListMailboxes(subscribed bool) (mailboxes []backend.Mailbox, err error) {
-	for _, mailbox := range u.mailboxes {
-		if subscribed && !mailbox.Subscribed {
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	u.be.locker.Lock()
+	defer u.be.locker.Unlock()
+
+	var names []string
+	for name := range u.data.mailboxes {
+		if subscribed && !u.data.subscriptions[name] {
 			continue
 		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-		mailboxes = append(mailboxes, mailbox)
+	mailboxes := make([]backend.Mailbox, len(names))
+	for i, name := range names {
+		mailboxes[i] = &Mailbox{user: u, data: u.data.mailboxes[name]}
 	}
-	return
+	return mailboxes, nil
 }
 
-func (u *User) GetMailbox(name string) (mailbox backend.Mailbox, err error) {
-	mailbox, ok := u.mailboxes[name]
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	u.be.locker.Lock()
+	defer u.be.locker.Unlock()
+
+	data, ok := u.data.mailboxes[imap.CanonicalMailboxName(name)]
 	if !ok {
-		err = errors.New("No such mailbox")
+		return nil, backend.ErrNoSuchMailbox
 	}
-	return
+	return &Mailbox{user: u, data: data}, nil
 }
 
-func (u *User) CreateMailbox(name string) error {
-	if _, ok := u.mailboxes[name]; ok {
-		return errors.New("Mailbox already exists")
+func validMailboxName(name string) bool {
+	for _, part := range strings.Split(name, Delimiter) {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// createMailbox creates a mailbox, reusing the UID counter of a deleted mailbox
+// with the same name. The caller must hold the backend lock.
+func (u *User) createMailbox(name string) error {
+	if _, ok := u.data.mailboxes[name]; ok {
+		return backend.ErrMailboxAlreadyExists
 	}
 
-	u.mailboxes[name] = &Mailbox{name: name, user: u}
+	counter, ok := u.data.deleted[name]
+	if ok {
+		delete(u.data.deleted, name)
+	} else {
+		counter = uidCounter{uidValidity: u.be.nextUidValidity(), uidNext: 1}
+	}
+
+	u.data.mailboxes[name] = &mailboxData{
+		name:        name,
+		id:          newObjectId(),
+		uidValidity: counter.uidValidity,
+		uidNext:     counter.uidNext,
+	}
 	return nil
 }
 
+// createParents creates superior hierarchical names of a mailbox. The caller
+// must hold the backend lock.
+func (u *User) createParents(name string) {
+	parts := strings.Split(name, Delimiter)
+	for i := 1; i < len(parts); i++ {
+		// Ignore existing mailboxes
+		u.createMailbox(strings.Join(parts[:i], Delimiter))
+	}
+}
+
+func (u *User) CreateMailbox(name string) error {
+	name = strings.TrimSuffix(name, Delimiter)
+	if imap.CanonicalMailboxName(name) == imap.InboxName {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if !validMailboxName(name) {
+		return errors.New("Invalid mailbox name")
+	}
+
+	u.be.locker.Lock()
+	defer u.be.locker.Unlock()
+
+	if _, ok := u.data.mailboxes[name]; ok {
+		return backend.ErrMailboxAlreadyExists
+	}
+	u.createParents(name)
+	return u.createMailbox(name)
+}
+
+// removeMailbox removes a mailbox and keeps its UID counter. The caller must
+// hold the backend lock.
+func (u *User) removeMailbox(name string) *mailboxData {
+	data := u.data.mailboxes[name]
+	delete(u.data.mailboxes, name)
+	u.data.deleted[name] = uidCounter{uidValidity: data.uidValidity, uidNext: data.uidNext}
+	return data
+}
+
 func (u *User) DeleteMailbox(name string) error {
-	if name == "INBOX" {
+	name = imap.CanonicalMailboxName(name)
+	if name == imap.InboxName {
 		return errors.New("Cannot delete INBOX")
 	}
-	if _, ok := u.mailboxes[name]; !ok {
-		return errors.New("No such mailbox")
+
+	u.be.locker.Lock()
+	defer u.be.locker.Unlock()
+
+	if _, ok := u.data.mailboxes[name]; !ok {
+		return backend.ErrNoSuchMailbox
 	}
 
-	delete(u.mailboxes, name)
+	// Inferior hierarchical names aren't removed
+	data := u.removeMailbox(name)
+	data.removed = true
+	data.messages = nil
 	return nil
 }
 
 func (u *User) RenameMailbox(existingName, newName string) error {
-	mbox, ok := u.mailboxes[existingName]
-	if !ok {
-		return errors.New("No such mailbox")
+	existingName = imap.CanonicalMailboxName(existingName)
+	newName = strings.TrimSuffix(newName, Delimiter)
+	if imap.CanonicalMailboxName(newName) == imap.InboxName {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if !validMailboxName(newName) {
+		return errors.New("Invalid mailbox name")
+	}
+	if strings.HasPrefix(newName, existingName+Delimiter) {
+		return errors.New("Cannot rename a mailbox to one of its inferior hierarchical names")
 	}
 
-	u.mailboxes[newName] = &Mailbox{
-		name:     newName,
-		Messages: mbox.Messages,
-		user:     u,
+	u.be.locker.Lock()
+	updates, err := u.renameMailbox(existingName, newName)
+	u.be.locker.Unlock()
+	if err != nil {
+		return err
 	}
 
-	mbox.Messages = nil
+	u.be.notifier.Notify(updates...)
+	return nil
+}
 
-	if existingName != "INBOX" {
-		delete(u.mailboxes, existingName)
+// renameMailbox renames a mailbox and its inferior hierarchical names. The
+// caller must hold the backend lock.
+func (u *User) renameMailbox(existingName, newName string) ([]backend.Update, error) {
+	if _, ok := u.data.mailboxes[existingName]; !ok {
+		return nil, backend.ErrNoSuchMailbox
 	}
 
-	return nil
+	// Inferior hierarchical names of INBOX are left in place
+	names := []string{existingName}
+	if existingName != imap.InboxName {
+		prefix := existingName + Delimiter
+		for name := range u.data.mailboxes {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, name := range names {
+		if _, ok := u.data.mailboxes[newName+strings.TrimPrefix(name, existingName)]; ok {
+			return nil, backend.ErrMailboxAlreadyExists
+		}
+	}
+
+	u.createParents(newName)
+
+	if existingName == imap.InboxName {
+		return u.renameInbox(newName), nil
+	}
+
+	for _, name := range names {
+		to := newName + strings.TrimPrefix(name, existingName)
+		data := u.removeMailbox(name)
+		data.name = to
+		delete(u.data.deleted, to)
+		u.data.mailboxes[to] = data
+	}
+	return nil, nil
+}
+
+// renameInbox moves all messages in INBOX to a new mailbox, leaving INBOX
+// empty. The caller must hold the backend lock.
+func (u *User) renameInbox(newName string) []backend.Update {
+	inbox := u.data.mailboxes[imap.InboxName]
+
+	// Renaming a mailbox preserves its identifier, except for INBOX which
+	// keeps existing. See RFC 8474 section 4.2.
+	delete(u.data.deleted, newName)
+	u.data.mailboxes[newName] = &mailboxData{
+		name:        newName,
+		id:          newObjectId(),
+		uidValidity: u.be.nextUidValidity(),
+		uidNext:     inbox.uidNext,
+		messages:    inbox.messages,
+	}
+
+	var updates []backend.Update
+	for seqNum := len(inbox.messages); seqNum > 0; seqNum-- {
+		updates = append(updates, &backend.ExpungeUpdate{
+			Update: backend.NewUpdate(u.data.username, imap.InboxName),
+			SeqNum: uint32(seqNum),
+			Uid:    inbox.messages[seqNum-1].Uid,
+		})
+	}
+	inbox.messages = nil
+	return updates
 }
 
 func (u *User) Logout() error {
@@ -0,0 +1,175 @@
+// Package remote implements an IMAP backend forwarding commands to an upstream
+// IMAP server.
+//
+// Login opens a connection to the upstream server and authenticates with the
+// same credentials. Sessions of the same user share a single upstream
+// connection, which is closed when the last session logs out. Commands are
+// serialized on this connection, and the upstream mailbox is selected when a
+// mailbox is selected or its messages are accessed. The status of other
+// mailboxes is requested with STATUS.
+//
+// Contexts are checked before commands are sent upstream: a command waiting
+// for the shared connection is abandoned once its context is cancelled, but
+// commands already sent run to completion.
+//
+// Unilateral updates sent by the upstream server for the selected mailbox
+// (EXISTS, EXPUNGE and FETCH responses) and ALERT status responses are
+// reported as backend updates. The UIDs of the messages of the selected
+// mailbox are kept, so that expunged and modified messages are reported with
+// their UID.
+package remote
+
+import (
+	"crypto/subtle"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+)
+
+// Backend is a backend proxying an upstream IMAP server.
+type Backend struct {
+	dial func() (*client.Client, error)
+
+	locker sync.Mutex
+	// Upstream connections shared by the sessions of a user
+	conns   map[string]*upstream
+	updates chan backend.Update
+}
+
+// New creates a new backend proxying an upstream server. dial is called to
+// connect to the upstream server, for instance:
+//
+//	be := remote.New(func() (*client.Client, error) {
+//		return client.DialTLS("mail.example.org:993", nil)
+//	})
+func New(dial func() (*client.Client, error)) *Backend {
+	return &Backend{
+		dial:  dial,
+		conns: make(map[string]*upstream),
+	}
+}
+
+func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	up, err := be.connect(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &User{be: be, username: username, up: up}, nil
+}
+
+// connect returns an upstream connection for a user, reusing an existing one if
+// the credentials match. A new connection replaces the shared one, so that a
+// password which isn't accepted upstream anymore can't be reused.
+func (be *Backend) connect(username, password string) (*upstream, error) {
+	be.locker.Lock()
+	up, ok := be.conns[username]
+	if ok && subtle.ConstantTimeCompare([]byte(up.password), []byte(password)) == 1 {
+		up.refs++
+		be.locker.Unlock()
+		return up, nil
+	}
+	be.locker.Unlock()
+
+	c, err := be.dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := login(c, username, password); err != nil {
+		select {
+		case <-c.LoggedOut():
+			// The connection is broken
+		default:
+			c.Logout()
+		}
+		return nil, err
+	}
+
+	up = newUpstream(be, c, username, password)
+
+	be.locker.Lock()
+	be.conns[username] = up
+	be.locker.Unlock()
+
+	go up.forward()
+	return up, nil
+}
+
+// login authenticates on the upstream server. A tagged NO response is reported
+// as backend.ErrInvalidCredentials, unless its code indicates that the server
+// can't authenticate the user for another reason.
+func login(c *client.Client, username, password string) error {
+	status, err := c.Execute(&commands.Login{Username: username, Password: password}, nil)
+	if err != nil {
+		return err
+	}
+	if err := status.Err(); err != nil {
+		if status.Type != imap.StatusRespNo {
+			return err
+		}
+		switch status.Code {
+		case imap.CodeUnavailable, imap.CodePrivacyRequired, imap.CodeLimit:
+			return err
+		}
+		return backend.ErrInvalidCredentials
+	}
+
+	c.SetState(imap.AuthenticatedState, nil)
+	return nil
+}
+
+// release is called when a session stops using an upstream connection. The
+// connection is closed if it isn't used anymore.
+func (be *Backend) release(up *upstream) error {
+	be.locker.Lock()
+	up.refs--
+	last := up.refs == 0
+	if last {
+		be.remove(up)
+	}
+	be.locker.Unlock()
+
+	if !last {
+		return nil
+	}
+	return up.c.Logout()
+}
+
+// remove removes an upstream connection from the shared ones. The caller must
+// hold the backend lock.
+func (be *Backend) remove(up *upstream) {
+	if be.conns[up.username] == up {
+		delete(be.conns, up.username)
+	}
+}
+
+// Updates implements backend.BackendUpdater.
+func (be *Backend) Updates() <-chan backend.Update {
+	be.locker.Lock()
+	defer be.locker.Unlock()
+
+	if be.updates == nil {
+		be.updates = make(chan backend.Update)
+	}
+	return be.updates
+}
+
+// notify sends updates and waits for them to be broadcast. Updates are dropped
+// if Updates has never been called.
+func (be *Backend) notify(updates []backend.Update) {
+	be.locker.Lock()
+	ch := be.updates
+	be.locker.Unlock()
+
+	if ch == nil {
+		return
+	}
+	for _, update := range updates {
+		// Done lazily creates the channel, call it before sharing the update
+		done := update.Done()
+		ch <- update
+		<-done
+	}
+}
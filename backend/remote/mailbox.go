@@ -0,0 +1,305 @@
+package remote
+
+import (
+	"context"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+)
+
+// Mailbox is a mailbox on the upstream server.
+type Mailbox struct {
+	user *User
+	name string
+	info *imap.MailboxInfo
+
+	// Set if the mailbox has been selected read-only, it's examined upstream
+	readOnly bool
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
+	info := *mbox.info
+	return &info, nil
+}
+
+// do selects the mailbox upstream and executes f.
+func (mbox *Mailbox) do(ctx context.Context, f func(c *client.Client) error) error {
+	return mbox.user.up.do(ctx, func(c *client.Client) error {
+		if _, err := mbox.user.up.selectMailbox(mbox.name, mbox.readOnly); err != nil {
+			return err
+		}
+		return f(c)
+	})
+}
+
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	return mbox.StatusContext(context.Background(), items)
+}
+
+// StatusContext implements backend.MailboxContext. Mailboxes which aren't
+// selected upstream are queried with STATUS: selecting them would clear the
+// \Recent flag of their messages and change the mailbox selected by other
+// sessions. FLAGS, PERMANENTFLAGS and UNSEEN are only known for the selected
+// mailbox.
+func (mbox *Mailbox) StatusContext(ctx context.Context, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	var status *imap.MailboxStatus
+	err := mbox.user.up.do(ctx, func(c *client.Client) error {
+		selected := c.Mailbox()
+		if mbox.user.up.selected != mbox.name || selected == nil {
+			var err error
+			status, err = c.Status(mbox.name, items)
+			if err == nil {
+				status.Name = mbox.name
+			}
+			return err
+		}
+
+		status = imap.NewMailboxStatus(mbox.name, items)
+		status.Flags = selected.Flags
+		status.PermanentFlags = selected.PermanentFlags
+		status.UnseenSeqNum = selected.UnseenSeqNum
+
+		// The number of messages is kept up-to-date by EXISTS responses, the
+		// other items are requested with STATUS
+		var remaining []imap.StatusItem
+		for _, item := range items {
+			switch item {
+			case imap.StatusMessages:
+				status.Messages = selected.Messages
+			case imap.StatusRecent:
+				status.Recent = selected.Recent
+			default:
+				remaining = append(remaining, item)
+			}
+		}
+		if len(remaining) == 0 {
+			return nil
+		}
+
+		res, err := c.Status(mbox.name, remaining)
+		if err != nil {
+			return err
+		}
+		status.UidNext = res.UidNext
+		status.UidValidity = res.UidValidity
+		status.Unseen = res.Unseen
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Select implements backend.SelectMailbox. The mailbox is selected upstream,
+// the upstream connection is shared by all sessions of the user: \Recent flags
+// are the ones reported by the upstream server. If readOnly is set, the mailbox
+// is examined upstream.
+func (mbox *Mailbox) Select(readOnly bool) error {
+	mbox.readOnly = readOnly
+	return mbox.do(context.Background(), func(c *client.Client) error {
+		return nil
+	})
+}
+
+// Recent implements backend.SelectMailbox.
+func (mbox *Mailbox) Recent(uid uint32) bool {
+	return false
+}
+
+func (mbox *Mailbox) SetSubscribed(subscribed bool) error {
+	return mbox.SetSubscribedContext(context.Background(), subscribed)
+}
+
+func (mbox *Mailbox) SetSubscribedContext(ctx context.Context, subscribed bool) error {
+	return mbox.user.up.do(ctx, func(c *client.Client) error {
+		if subscribed {
+			return c.Subscribe(mbox.name)
+		}
+		return c.Unsubscribe(mbox.name)
+	})
+}
+
+func (mbox *Mailbox) Check() error {
+	return mbox.CheckContext(context.Background())
+}
+
+func (mbox *Mailbox) CheckContext(ctx context.Context) error {
+	return mbox.do(ctx, func(c *client.Client) error {
+		return c.Check()
+	})
+}
+
+// Poll implements backend.MailboxPoller. Upstream servers send pending updates
+// in response to NOOP.
+func (mbox *Mailbox) Poll() error {
+	return mbox.do(context.Background(), func(c *client.Client) error {
+		return c.Noop()
+	})
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.ListMessagesContext(context.Background(), uid, seqset, items, ch)
+}
+
+func (mbox *Mailbox) ListMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	return mbox.do(ctx, func(c *client.Client) error {
+		messages := make(chan *imap.Message)
+		done := make(chan struct{})
+		go func() {
+			for msg := range messages {
+				ch <- msg
+			}
+			close(done)
+		}()
+
+		var err error
+		if uid {
+			err = c.UidFetch(seqset, items, messages)
+		} else {
+			err = c.Fetch(seqset, items, messages)
+		}
+		<-done
+		return err
+	})
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return mbox.SearchMessagesContext(context.Background(), uid, criteria)
+}
+
+func (mbox *Mailbox) SearchMessagesContext(ctx context.Context, uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	var ids []uint32
+	err := mbox.do(ctx, func(c *client.Client) error {
+		var err error
+		if uid {
+			ids, err = c.UidSearch(criteria)
+		} else {
+			ids, err = c.Search(criteria)
+		}
+		return err
+	})
+	return ids, err
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return mbox.CreateMessageContext(context.Background(), flags, date, body)
+}
+
+func (mbox *Mailbox) CreateMessageContext(ctx context.Context, flags []string, date time.Time, body imap.Literal) error {
+	// The \Recent flag cannot be set by clients
+	var appendFlags []string
+	for _, flag := range flags {
+		if imap.CanonicalFlag(flag) != imap.RecentFlag {
+			appendFlags = append(appendFlags, flag)
+		}
+	}
+
+	return mbox.user.up.do(ctx, func(c *client.Client) error {
+		if err := c.Append(mbox.name, appendFlags, date, body); err != nil {
+			return err
+		}
+		return mbox.user.up.notifyExists(mbox.name)
+	})
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return mbox.UpdateMessagesFlagsContext(context.Background(), uid, seqset, op, flags)
+}
+
+func (mbox *Mailbox) UpdateMessagesFlagsContext(ctx context.Context, uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	var messages []*imap.Message
+	err := mbox.do(ctx, func(c *client.Client) error {
+		value := make([]interface{}, len(flags))
+		for i, flag := range flags {
+			value[i] = flag
+		}
+
+		// The client doesn't close ch if the command can't be sent
+		ch := make(chan *imap.Message)
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case msg, ok := <-ch:
+					if !ok {
+						return
+					}
+					messages = append(messages, msg)
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		item := imap.FormatFlagsOp(op, false)
+		var err error
+		if uid {
+			err = c.UidStore(seqset, item, value, ch)
+		} else {
+			err = c.Store(seqset, item, value, ch)
+		}
+		close(stop)
+		<-done
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	updates := make([]backend.Update, len(messages))
+	for i, msg := range messages {
+		updates[i] = &backend.MessageUpdate{
+			Update:  backend.NewUpdate(mbox.user.username, mbox.name),
+			Message: msg,
+		}
+	}
+	mbox.user.be.notify(updates)
+	return nil
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	return mbox.CopyMessagesContext(context.Background(), uid, seqset, destName)
+}
+
+func (mbox *Mailbox) CopyMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, destName string) error {
+	return mbox.do(ctx, func(c *client.Client) error {
+		if info, err := mbox.user.up.info(destName); err != nil {
+			return err
+		} else if info == nil {
+			return backend.ErrNoSuchMailbox
+		}
+
+		var err error
+		if uid {
+			err = c.UidCopy(seqset, destName)
+		} else {
+			err = c.Copy(seqset, destName)
+		}
+		if err != nil {
+			return err
+		}
+		return mbox.user.up.notifyExists(destName)
+	})
+}
+
+func (mbox *Mailbox) Expunge() error {
+	return mbox.ExpungeContext(context.Background())
+}
+
+func (mbox *Mailbox) ExpungeContext(ctx context.Context) error {
+	return mbox.do(ctx, func(c *client.Client) error {
+		// EXPUNGE responses are reported as updates
+		return c.Expunge(nil)
+	})
+}
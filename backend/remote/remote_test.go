@@ -0,0 +1,450 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendtest"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+)
+
+const testMessage = "From: contact@example.org\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hi there :)"
+
+// newTestBackend starts an upstream server with a memory backend, and returns
+// a backend proxying it with the number of upstream connections.
+func newTestBackend(t *testing.T) (*Backend, *int32) {
+	return newProxyBackend(t, memory.New())
+}
+
+// newProxyBackend starts an upstream server with the provided backend, and
+// returns a backend proxying it with the number of upstream connections.
+func newProxyBackend(t *testing.T, upstream backend.Backend) (*Backend, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s := server.New(upstream)
+	s.AllowInsecureAuth = true
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	var dialed int32
+	be := New(func() (*client.Client, error) {
+		atomic.AddInt32(&dialed, 1)
+		c, err := client.Dial(l.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		c.ErrorLog = log.New(ioutil.Discard, "", 0)
+		return c, nil
+	})
+	return be, &dialed
+}
+
+func dialUpstream(t *testing.T, be *Backend) *client.Client {
+	c, err := be.dial()
+	if err != nil {
+		t.Fatal("Cannot connect to upstream server:", err)
+	}
+	if err := c.Login(backendtest.Username, backendtest.Password); err != nil {
+		t.Fatal("Cannot login to upstream server:", err)
+	}
+	return c
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.RunTests(t, func() backend.Backend {
+		be, _ := newTestBackend(t)
+		return be
+	})
+}
+
+func TestLogin_InvalidCredentials(t *testing.T) {
+	be, _ := newTestBackend(t)
+
+	if _, err := be.Login(nil, backendtest.Username, "wrong"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func TestLogin_Reuse(t *testing.T) {
+	be, dialed := newTestBackend(t)
+
+	u1, err := be.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	u2, err := be.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	if n := atomic.LoadInt32(dialed); n != 1 {
+		t.Errorf("Expected 1 upstream connection, got %v", n)
+	}
+
+	// Credentials are checked again if the password is different
+	if _, err := be.Login(nil, backendtest.Username, "wrong"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+	}
+
+	if err := u1.Logout(); err != nil {
+		t.Fatal("Expected no error while logging out, got:", err)
+	}
+	if _, err := u2.ListMailboxes(false); err != nil {
+		t.Fatal("Expected the connection to be usable by other sessions, got:", err)
+	}
+	if err := u2.Logout(); err != nil {
+		t.Fatal("Expected no error while logging out, got:", err)
+	}
+
+	u3, err := be.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	defer u3.Logout()
+	if n := atomic.LoadInt32(dialed); n != 3 {
+		t.Errorf("Expected a new upstream connection once all sessions logged out, got %v connections", n)
+	}
+}
+
+// passwordBackend is a memory backend whose password can be changed.
+type passwordBackend struct {
+	backend.Backend
+	password atomic.Value
+}
+
+func (be *passwordBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	if password != be.password.Load().(string) {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return be.Backend.Login(connInfo, username, backendtest.Password)
+}
+
+func TestLogin_PasswordChanged(t *testing.T) {
+	upstream := &passwordBackend{Backend: memory.New()}
+	upstream.password.Store("old")
+	be, _ := newProxyBackend(t, upstream)
+
+	u1, err := be.Login(nil, backendtest.Username, "old")
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	defer u1.Logout()
+
+	upstream.password.Store("new")
+	u2, err := be.Login(nil, backendtest.Username, "new")
+	if err != nil {
+		t.Fatal("Expected no error while logging in with the new password, got:", err)
+	}
+	defer u2.Logout()
+
+	// The old password must be checked upstream again
+	if _, err := be.Login(nil, backendtest.Username, "old"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials for the old password, got %v", err)
+	}
+}
+
+func TestLogin_UpstreamError(t *testing.T) {
+	for _, test := range []struct {
+		resp    string
+		invalid bool
+	}{
+		{"NO Invalid credentials", true},
+		{"NO [UNAVAILABLE] Try again later", false},
+		{"NO [PRIVACYREQUIRED] Use TLS", false},
+		{"BAD Internal error", false},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("Cannot listen:", err)
+		}
+		defer l.Close()
+
+		// The upstream server replies to LOGIN with test.resp
+		go func(resp string) {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.WriteString(conn, "* OK [CAPABILITY IMAP4rev1] Service Ready\r\n")
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				tag := strings.SplitN(line, " ", 2)[0]
+				if strings.HasPrefix(line, tag+" LOGOUT") {
+					io.WriteString(conn, "* BYE\r\n"+tag+" OK LOGOUT completed\r\n")
+					return
+				}
+				io.WriteString(conn, tag+" "+resp+"\r\n")
+			}
+		}(test.resp)
+
+		be := New(func() (*client.Client, error) {
+			c, err := client.Dial(l.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			c.ErrorLog = log.New(ioutil.Discard, "", 0)
+			return c, nil
+		})
+		_, err = be.Login(nil, backendtest.Username, backendtest.Password)
+		if err == nil {
+			t.Errorf("Expected an error for %q", test.resp)
+		} else if invalid := err == backend.ErrInvalidCredentials; invalid != test.invalid {
+			t.Errorf("Expected invalid credentials to be %v for %q, got error %v", test.invalid, test.resp, err)
+		}
+	}
+}
+
+func TestSelect_ReadOnly(t *testing.T) {
+	be, _ := newTestBackend(t)
+
+	// A recent message is added upstream
+	c := dialUpstream(t, be)
+	defer c.Logout()
+	if err := c.Append(imap.InboxName, nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("Expected no error while appending a message, got:", err)
+	}
+
+	u, err := be.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	defer u.Logout()
+	mbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal("Expected no error while getting INBOX, got:", err)
+	}
+	if err := mbox.(backend.SelectMailbox).Select(true); err != nil {
+		t.Fatal("Expected no error while examining, got:", err)
+	}
+	if _, err := mbox.SearchMessages(true, imap.NewSearchCriteria()); err != nil {
+		t.Fatal("Expected no error while searching, got:", err)
+	}
+
+	// The message is still recent for other upstream sessions
+	status, err := c.Select(imap.InboxName, false)
+	if err != nil {
+		t.Fatal("Expected no error while selecting, got:", err)
+	}
+	if status.Recent != 1 {
+		t.Errorf("Expected the message to stay recent upstream, got %v recent messages", status.Recent)
+	}
+}
+
+func TestSearchMessagesContext(t *testing.T) {
+	be, _ := newTestBackend(t)
+
+	u, err := be.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	defer u.Logout()
+	mbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal("Expected no error while getting INBOX, got:", err)
+	}
+
+	// Another session is using the upstream connection
+	up := u.(*User).up
+	up.locker.Lock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := mbox.(*Mailbox).SearchMessagesContext(ctx, false, imap.NewSearchCriteria())
+		done <- err
+	}()
+
+	cancel()
+	up.locker.Unlock()
+
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected the search to be cancelled, got: %v", err)
+	}
+}
+
+func TestUpstreamUpdates(t *testing.T) {
+	be, _ := newTestBackend(t)
+	updates := be.Updates()
+
+	u, err := be.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	defer u.Logout()
+
+	mbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal("Expected no error while getting INBOX, got:", err)
+	}
+	if err := mbox.(backend.SelectMailbox).Select(false); err != nil {
+		t.Fatal("Expected no error while selecting, got:", err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal("Expected no error while getting status, got:", err)
+	}
+
+	// Another client of the upstream server adds a message
+	c := dialUpstream(t, be)
+	defer c.Logout()
+	if err := c.Append(imap.InboxName, nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("Expected no error while appending a message, got:", err)
+	}
+
+	received := make(chan backend.Update, 1)
+	go func() {
+		update := <-updates
+		close(update.Done())
+		received <- update
+	}()
+
+	if err := mbox.(backend.MailboxPoller).Poll(); err != nil {
+		t.Fatal("Expected no error while polling, got:", err)
+	}
+
+	select {
+	case update := <-received:
+		mboxUpdate, ok := update.(*backend.MailboxUpdate)
+		if !ok {
+			t.Fatalf("Expected a mailbox update, got %T", update)
+		}
+		if mboxUpdate.Username() != backendtest.Username || mboxUpdate.Mailbox() != imap.InboxName {
+			t.Errorf("Invalid update target: %q %q", mboxUpdate.Username(), mboxUpdate.Mailbox())
+		}
+		if mboxUpdate.Messages != status.Messages+1 {
+			t.Errorf("Expected %v messages, got %v", status.Messages+1, mboxUpdate.Messages)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout while waiting for an update")
+	}
+}
+
+func TestUpstreamUpdates_Expunge(t *testing.T) {
+	be, _ := newTestBackend(t)
+	updates := be.Updates()
+	received := make(chan backend.Update, 10)
+	go func() {
+		for update := range updates {
+			close(update.Done())
+			received <- update
+		}
+	}()
+
+	u, err := be.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	defer u.Logout()
+
+	mbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal("Expected no error while getting INBOX, got:", err)
+	}
+	if err := mbox.(backend.SelectMailbox).Select(false); err != nil {
+		t.Fatal("Expected no error while selecting, got:", err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUidNext})
+	if err != nil {
+		t.Fatal("Expected no error while getting status, got:", err)
+	}
+
+	// Another client of the upstream server adds a message, then removes it
+	c := dialUpstream(t, be)
+	defer c.Logout()
+	if err := c.Append(imap.InboxName, nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("Expected no error while appending a message, got:", err)
+	}
+	if err := mbox.(backend.MailboxPoller).Poll(); err != nil {
+		t.Fatal("Expected no error while polling, got:", err)
+	}
+
+	if _, err := c.Select(imap.InboxName, false); err != nil {
+		t.Fatal("Expected no error while selecting, got:", err)
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(status.Messages + 1)
+	if err := c.Store(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+		t.Fatal("Expected no error while storing flags, got:", err)
+	}
+	if err := c.Expunge(nil); err != nil {
+		t.Fatal("Expected no error while expunging, got:", err)
+	}
+	if err := mbox.(backend.MailboxPoller).Poll(); err != nil {
+		t.Fatal("Expected no error while polling, got:", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case update := <-received:
+			expunge, ok := update.(*backend.ExpungeUpdate)
+			if !ok {
+				continue
+			}
+			if expunge.SeqNum != status.Messages+1 || expunge.Uid != status.UidNext {
+				t.Errorf("Expected message %v with UID %v to be expunged, got %v with UID %v", status.Messages+1, status.UidNext, expunge.SeqNum, expunge.Uid)
+			}
+			return
+		case <-timeout:
+			t.Fatal("Timeout while waiting for an expunge update")
+		}
+	}
+}
+
+func TestStatus_NotSelected(t *testing.T) {
+	be, _ := newTestBackend(t)
+
+	// A recent message is added upstream
+	c := dialUpstream(t, be)
+	defer c.Logout()
+	if err := c.Append(imap.InboxName, nil, time.Now(), bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("Expected no error while appending a message, got:", err)
+	}
+
+	u, err := be.Login(nil, backendtest.Username, backendtest.Password)
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	defer u.Logout()
+	mbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal("Expected no error while getting INBOX, got:", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusRecent})
+		if err != nil {
+			t.Fatal("Expected no error while getting status, got:", err)
+		}
+		if status.Recent != 1 {
+			t.Errorf("Expected the message to stay recent, got %v recent messages", status.Recent)
+		}
+	}
+	if selected := u.(*User).up.selected; selected != "" {
+		t.Errorf("Expected no mailbox to be selected upstream, got %q", selected)
+	}
+}
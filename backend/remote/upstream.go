@@ -0,0 +1,345 @@
+package remote
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+)
+
+// upstream is a connection to the upstream server, shared by the sessions of a
+// user.
+type upstream struct {
+	be       *Backend
+	c        *client.Client
+	username string
+	password string
+	// refs is the number of sessions using the connection, protected by the
+	// backend lock
+	refs int
+
+	// locker serializes commands
+	locker sync.Mutex
+	// selected is the name of the selected mailbox and readOnly is set if it
+	// has been examined, protected by locker
+	selected string
+	readOnly bool
+
+	// uidsLocker protects uids
+	uidsLocker sync.Mutex
+	// uids contains the UIDs of the messages of the selected mailbox, 0 if
+	// not known yet, so that updates referring to messages by sequence
+	// number can be reported with UIDs
+	uids []uint32
+
+	updates chan client.Update
+	flush   chan chan []backend.Update
+	// pending contains updates which haven't been reported yet, it's only
+	// accessed by forward
+	pending []backend.Update
+}
+
+func newUpstream(be *Backend, c *client.Client, username, password string) *upstream {
+	up := &upstream{
+		be:       be,
+		c:        c,
+		username: username,
+		password: password,
+		refs:     1,
+		updates:  make(chan client.Update),
+		flush:    make(chan chan []backend.Update),
+	}
+	c.Updates = up.updates
+	return up
+}
+
+// forward queues unilateral updates sent by the upstream server until the
+// connection is closed.
+func (up *upstream) forward() {
+	for {
+		select {
+		case update := <-up.updates:
+			if u := up.translate(update); u != nil {
+				up.pending = append(up.pending, u)
+			}
+		case ch := <-up.flush:
+			ch <- up.pending
+			up.pending = nil
+		case <-up.c.LoggedOut():
+			up.be.locker.Lock()
+			up.be.remove(up)
+			up.be.locker.Unlock()
+			return
+		}
+	}
+}
+
+// translate converts an upstream update to a backend update. It returns nil if
+// the update must not be reported.
+func (up *upstream) translate(update client.Update) backend.Update {
+	switch update := update.(type) {
+	case *client.StatusUpdate:
+		if update.Status.Code != imap.CodeAlert {
+			return nil
+		}
+		return &backend.StatusUpdate{
+			Update:     backend.NewUpdate(up.username, ""),
+			StatusResp: update.Status,
+		}
+	}
+
+	mbox := up.c.Mailbox()
+	if mbox == nil {
+		return nil
+	}
+	u := backend.NewUpdate(up.username, mbox.Name)
+
+	up.uidsLocker.Lock()
+	defer up.uidsLocker.Unlock()
+
+	switch update := update.(type) {
+	case *client.MailboxUpdate:
+		// New messages get their UID later, see resolveUids
+		if n := int(update.Mailbox.Messages); n > len(up.uids) {
+			up.uids = append(up.uids, make([]uint32, n-len(up.uids))...)
+		}
+
+		status := imap.NewMailboxStatus(mbox.Name, []imap.StatusItem{imap.StatusMessages, imap.StatusRecent})
+		status.Messages = update.Mailbox.Messages
+		status.Recent = update.Mailbox.Recent
+		return &backend.MailboxUpdate{Update: u, MailboxStatus: status}
+	case *client.MessageUpdate:
+		msg := update.Message
+		i := int(msg.SeqNum) - 1
+		if i < 0 || i >= len(up.uids) {
+			return &backend.MessageUpdate{Update: u, Message: msg}
+		}
+		if msg.Uid != 0 {
+			up.uids[i] = msg.Uid
+		} else if up.uids[i] != 0 {
+			msg = withUid(msg, up.uids[i])
+		}
+		return &backend.MessageUpdate{Update: u, Message: msg}
+	case *client.ExpungeUpdate:
+		var uid uint32
+		if i := int(update.SeqNum) - 1; i >= 0 && i < len(up.uids) {
+			uid = up.uids[i]
+			up.uids = append(up.uids[:i:i], up.uids[i+1:]...)
+		}
+		return &backend.ExpungeUpdate{Update: u, SeqNum: update.SeqNum, Uid: uid}
+	}
+	return nil
+}
+
+// withUid returns a copy of a message with its UID.
+func withUid(msg *imap.Message, uid uint32) *imap.Message {
+	copied := *msg
+	copied.Items = make(map[imap.FetchItem]interface{}, len(msg.Items)+1)
+	for k, v := range msg.Items {
+		copied.Items[k] = v
+	}
+	copied.Items[imap.FetchUid] = nil
+	copied.Uid = uid
+	return &copied
+}
+
+// pendingUpdates returns the updates received since the last call. Since the
+// client waits for updates to be received before completing a command, they
+// include all updates sent during previous commands. The caller must hold the
+// lock.
+func (up *upstream) pendingUpdates() []backend.Update {
+	ch := make(chan []backend.Update)
+	select {
+	case up.flush <- ch:
+		return <-ch
+	case <-up.c.LoggedOut():
+		return nil
+	}
+}
+
+// do executes f with exclusive access to the upstream connection, and reports
+// the updates received in the meantime. f isn't executed if the context is
+// cancelled before the connection is available. Upstream commands cannot be
+// interrupted once sent.
+func (up *upstream) do(ctx context.Context, f func(c *client.Client) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	up.locker.Lock()
+	defer up.locker.Unlock()
+
+	// Commands of other sessions may have taken a while
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := f(up.c)
+	if resolveErr := up.resolveUids(); err == nil {
+		err = resolveErr
+	}
+	up.be.notify(up.pendingUpdates())
+	return err
+}
+
+// resolveUids fetches the UIDs of the messages added to the selected mailbox,
+// before updates are reported. The caller must hold the lock.
+func (up *upstream) resolveUids() error {
+	if up.selected == "" {
+		return nil
+	}
+
+	var seqSet imap.SeqSet
+	up.uidsLocker.Lock()
+	for i, uid := range up.uids {
+		if uid == 0 {
+			seqSet.AddNum(uint32(i + 1))
+		}
+	}
+	up.uidsLocker.Unlock()
+	if seqSet.Empty() {
+		return nil
+	}
+
+	// FETCH responses are sent to ch, not reported as updates. The client
+	// doesn't close ch if the command can't be sent.
+	ch := make(chan *imap.Message)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				up.uidsLocker.Lock()
+				if i := int(msg.SeqNum) - 1; i >= 0 && i < len(up.uids) {
+					up.uids[i] = msg.Uid
+				}
+				up.uidsLocker.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	err := up.c.Fetch(&seqSet, []imap.FetchItem{imap.FetchUid}, ch)
+	close(stop)
+	<-done
+	return err
+}
+
+// selectMailbox selects a mailbox upstream, if it isn't already selected with
+// the same mode. Read-only mailboxes are examined, so that the \Recent flag of
+// their messages isn't cleared. The caller must hold the lock.
+func (up *upstream) selectMailbox(name string, readOnly bool) (*imap.MailboxStatus, error) {
+	if up.selected == name && up.readOnly == readOnly {
+		if mbox := up.c.Mailbox(); mbox != nil {
+			return mbox, nil
+		}
+	}
+
+	up.selected = ""
+	mbox, err := up.c.Select(name, readOnly)
+	// The responses to SELECT describe the new mailbox, they aren't updates
+	up.pendingUpdates()
+	if err != nil {
+		return nil, err
+	}
+
+	up.uidsLocker.Lock()
+	up.uids = make([]uint32, mbox.Messages)
+	up.uidsLocker.Unlock()
+	up.selected = name
+	up.readOnly = readOnly
+	if err := up.resolveUids(); err != nil {
+		up.selected = ""
+		return nil, err
+	}
+	return mbox, nil
+}
+
+// list lists mailboxes matching pattern. The caller must hold the lock.
+func (up *upstream) list(subscribed bool, pattern string) ([]*imap.MailboxInfo, error) {
+	// The client doesn't close ch if the command can't be sent
+	ch := make(chan *imap.MailboxInfo)
+	stop := make(chan struct{})
+	done := make(chan []*imap.MailboxInfo)
+	go func() {
+		var infos []*imap.MailboxInfo
+		for {
+			select {
+			case info, ok := <-ch:
+				if !ok {
+					done <- infos
+					return
+				}
+				infos = append(infos, info)
+			case <-stop:
+				done <- infos
+				return
+			}
+		}
+	}()
+
+	var err error
+	if subscribed {
+		err = up.c.Lsub("", pattern, ch)
+	} else {
+		err = up.c.List("", pattern, ch)
+	}
+	close(stop)
+	return <-done, err
+}
+
+// info returns information about a mailbox, or nil if it doesn't exist. The
+// caller must hold the lock.
+func (up *upstream) info(name string) (*imap.MailboxInfo, error) {
+	// There is no way to escape wildcards, names containing some are matched
+	// by the pattern too
+	infos, err := up.list(false, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if sameName(info.Name, name) {
+			return info, nil
+		}
+	}
+	return nil, nil
+}
+
+// sameName checks whether two mailbox names are equal. INBOX is
+// case-insensitive.
+func sameName(a, b string) bool {
+	if strings.EqualFold(a, imap.InboxName) {
+		return strings.EqualFold(b, imap.InboxName)
+	}
+	return a == b
+}
+
+// notifyExists reports the number of messages of a mailbox after messages have
+// been added to it. The caller must hold the lock.
+func (up *upstream) notifyExists(name string) error {
+	if up.selected == name {
+		// The upstream server sends an EXISTS response
+		return up.c.Noop()
+	}
+
+	res, err := up.c.Status(name, []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		return err
+	}
+	status := imap.NewMailboxStatus(name, []imap.StatusItem{imap.StatusMessages})
+	status.Messages = res.Messages
+	up.be.notify([]backend.Update{&backend.MailboxUpdate{
+		Update:        backend.NewUpdate(up.username, name),
+		MailboxStatus: status,
+	}})
+	return nil
+}
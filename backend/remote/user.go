@@ -0,0 +1,119 @@
+package remote
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+)
+
+// User is a session of a user on the upstream server.
+type User struct {
+	be       *Backend
+	username string
+	up       *upstream
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	return u.ListMailboxesContext(context.Background(), subscribed)
+}
+
+func (u *User) ListMailboxesContext(ctx context.Context, subscribed bool) ([]backend.Mailbox, error) {
+	var mailboxes []backend.Mailbox
+	err := u.up.do(ctx, func(c *client.Client) error {
+		infos, err := u.up.list(subscribed, "*")
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			mailboxes = append(mailboxes, &Mailbox{user: u, name: info.Name, info: info})
+		}
+		return nil
+	})
+	return mailboxes, err
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	return u.GetMailboxContext(context.Background(), name)
+}
+
+func (u *User) GetMailboxContext(ctx context.Context, name string) (backend.Mailbox, error) {
+	var mbox *Mailbox
+	err := u.up.do(ctx, func(c *client.Client) error {
+		info, err := u.up.info(name)
+		if err != nil {
+			return err
+		} else if info == nil {
+			return backend.ErrNoSuchMailbox
+		}
+		mbox = &Mailbox{user: u, name: info.Name, info: info}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mbox, nil
+}
+
+func (u *User) CreateMailbox(name string) error {
+	return u.CreateMailboxContext(context.Background(), name)
+}
+
+func (u *User) CreateMailboxContext(ctx context.Context, name string) error {
+	return u.up.do(ctx, func(c *client.Client) error {
+		if info, err := u.up.info(name); err != nil {
+			return err
+		} else if info != nil {
+			return backend.ErrMailboxAlreadyExists
+		}
+		return c.Create(name)
+	})
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	return u.DeleteMailboxContext(context.Background(), name)
+}
+
+func (u *User) DeleteMailboxContext(ctx context.Context, name string) error {
+	return u.up.do(ctx, func(c *client.Client) error {
+		if info, err := u.up.info(name); err != nil {
+			return err
+		} else if info == nil {
+			return backend.ErrNoSuchMailbox
+		}
+
+		// Make sure the mailbox is selected again if it's re-created
+		u.up.selected = ""
+		return c.Delete(name)
+	})
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	return u.RenameMailboxContext(context.Background(), existingName, newName)
+}
+
+func (u *User) RenameMailboxContext(ctx context.Context, existingName, newName string) error {
+	return u.up.do(ctx, func(c *client.Client) error {
+		if info, err := u.up.info(existingName); err != nil {
+			return err
+		} else if info == nil {
+			return backend.ErrNoSuchMailbox
+		}
+		if info, err := u.up.info(newName); err != nil {
+			return err
+		} else if info != nil {
+			return backend.ErrMailboxAlreadyExists
+		}
+
+		u.up.selected = ""
+		return c.Rename(existingName, newName)
+	})
+}
+
+func (u *User) Logout() error {
+	return u.be.release(u.up)
+}
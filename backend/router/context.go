@@ -0,0 +1,50 @@
+package router
+
+import (
+	"context"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// The methods below forward contexts to the mounted backends, they would be
+// hidden by the embedded interfaces otherwise.
+
+func (mbox *Mailbox) SetSubscribedContext(ctx context.Context, subscribed bool) error {
+	return backendutil.SetSubscribed(ctx, mbox.Mailbox, subscribed)
+}
+
+func (mbox *Mailbox) CheckContext(ctx context.Context) error {
+	return backendutil.Check(ctx, mbox.Mailbox)
+}
+
+func (mbox *Mailbox) ListMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return backendutil.ListMessages(ctx, mbox.Mailbox, uid, seqset, items, ch)
+}
+
+func (mbox *Mailbox) SearchMessagesContext(ctx context.Context, uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return backendutil.SearchMessages(ctx, mbox.Mailbox, uid, criteria)
+}
+
+func (mbox *Mailbox) CreateMessageContext(ctx context.Context, flags []string, date time.Time, body imap.Literal) error {
+	return backendutil.CreateMessage(ctx, mbox.Mailbox, flags, date, body)
+}
+
+func (mbox *Mailbox) UpdateMessagesFlagsContext(ctx context.Context, uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return backendutil.UpdateMessagesFlags(ctx, mbox.Mailbox, uid, seqset, op, flags)
+}
+
+func (mbox *Mailbox) ExpungeContext(ctx context.Context) error {
+	return backendutil.Expunge(ctx, mbox.Mailbox)
+}
+
+var (
+	_ backend.BackendContext            = (*Backend)(nil)
+	_ backend.CertificateBackendContext = (*Backend)(nil)
+	_ backend.ExtendedBackend           = (*Backend)(nil)
+	_ backend.UserContext               = (*User)(nil)
+	_ backend.MailboxContext            = (*Mailbox)(nil)
+	_ backend.SelectMailbox             = (*Mailbox)(nil)
+)
@@ -0,0 +1,196 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// Mailbox is a mailbox of a mounted backend.
+type Mailbox struct {
+	backend.Mailbox
+
+	user *User
+	name string
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
+	info, err := mbox.Mailbox.Info()
+	if err != nil {
+		return nil, err
+	}
+	copied := *info
+	copied.Name = mbox.name
+	return &copied, nil
+}
+
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	return mbox.StatusContext(context.Background(), items)
+}
+
+func (mbox *Mailbox) StatusContext(ctx context.Context, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := backendutil.Status(ctx, mbox.Mailbox, items)
+	if err != nil {
+		return nil, err
+	}
+	status.Name = mbox.name
+	return status, nil
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	return mbox.CopyMessagesContext(context.Background(), uid, seqset, destName)
+}
+
+func (mbox *Mailbox) CopyMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, destName string) error {
+	src, _ := mbox.user.route(mbox.name)
+	ns, name := mbox.user.route(destName)
+	if ns == nil || name == "" {
+		return backend.ErrNoSuchMailbox
+	}
+	if ns.user == src.user {
+		return backendutil.CopyMessages(ctx, mbox.Mailbox, uid, seqset, name)
+	}
+
+	dest, err := backendutil.GetMailbox(ctx, ns.user, name)
+	if err != nil {
+		return err
+	}
+	return copyMessages(ctx, mbox.Mailbox, uid, seqset, dest)
+}
+
+// copySection is the section fetched to copy a message.
+var copySection = &imap.BodySectionName{Peek: true}
+
+// copyMessages copies messages to a mailbox of another backend, by fetching
+// them from src and appending them to dest.
+func copyMessages(ctx context.Context, src backend.Mailbox, uid bool, seqset *imap.SeqSet, dest backend.Mailbox) error {
+	items := []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, copySection.FetchItem()}
+
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- backendutil.ListMessages(ctx, src, uid, seqset, items, ch)
+	}()
+
+	var err error
+	for msg := range ch {
+		if err != nil {
+			// Drain the channel
+			continue
+		}
+		err = createMessage(ctx, dest, msg)
+	}
+	if listErr := <-done; err == nil {
+		err = listErr
+	}
+	return err
+}
+
+func createMessage(ctx context.Context, dest backend.Mailbox, msg *imap.Message) error {
+	var body imap.Literal
+	for section, l := range msg.Body {
+		if section.Equal(copySection) {
+			body = l
+		}
+	}
+	if body == nil {
+		return errors.New("router: message body missing")
+	}
+
+	var flags []string
+	for _, flag := range msg.Flags {
+		if flag != imap.RecentFlag {
+			flags = append(flags, flag)
+		}
+	}
+	return backendutil.CreateMessage(ctx, dest, flags, msg.InternalDate, body)
+}
+
+// Select implements backend.SelectMailbox. It selects the mounted mailbox, if
+// it supports it.
+func (mbox *Mailbox) Select(readOnly bool) error {
+	if selecter, ok := mbox.Mailbox.(backend.SelectMailbox); ok {
+		return selecter.Select(readOnly)
+	}
+	return nil
+}
+
+// Recent implements backend.SelectMailbox.
+func (mbox *Mailbox) Recent(uid uint32) bool {
+	if selecter, ok := mbox.Mailbox.(backend.SelectMailbox); ok {
+		return selecter.Recent(uid)
+	}
+	return false
+}
+
+// Poll implements backend.MailboxPoller. It polls the mounted mailbox, if it
+// supports it.
+func (mbox *Mailbox) Poll() error {
+	if poller, ok := mbox.Mailbox.(backend.MailboxPoller); ok {
+		return poller.Poll()
+	}
+	return nil
+}
+
+// rootMailbox is the mailbox at the root of a namespace. It cannot be selected,
+// and is only listed so that clients can discover the namespace.
+type rootMailbox struct {
+	prefix string
+}
+
+func (mbox *rootMailbox) Name() string {
+	return rootName(mbox.prefix)
+}
+
+func (mbox *rootMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{
+		Attributes: []string{imap.NoSelectAttr},
+		Delimiter:  delimiter(mbox.prefix),
+		Name:       mbox.Name(),
+	}, nil
+}
+
+func (mbox *rootMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	return nil, errNamespaceRoot
+}
+
+func (mbox *rootMailbox) SetSubscribed(subscribed bool) error {
+	return errNamespaceRoot
+}
+
+func (mbox *rootMailbox) Check() error {
+	return errNamespaceRoot
+}
+
+func (mbox *rootMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	close(ch)
+	return errNamespaceRoot
+}
+
+func (mbox *rootMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return nil, errNamespaceRoot
+}
+
+func (mbox *rootMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return errNamespaceRoot
+}
+
+func (mbox *rootMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	return errNamespaceRoot
+}
+
+func (mbox *rootMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	return errNamespaceRoot
+}
+
+func (mbox *rootMailbox) Expunge() error {
+	return errNamespaceRoot
+}
@@ -0,0 +1,257 @@
+// Package router implements a backend mounting several backends under mailbox
+// namespaces.
+//
+// Each namespace is identified by a prefix ending with the hierarchy
+// delimiter, for instance "Archive/". Mailboxes whose name starts with a
+// prefix are stored in the backend mounted on the longest matching prefix,
+// without the prefix: "Archive/2020" is the mailbox "2020" of the backend
+// mounted on "Archive/". Other mailboxes, including INBOX, are stored in the
+// default backend. Mailbox names are not translated otherwise, so all backends
+// should use the same hierarchy delimiter.
+//
+// By default, users are logged in all backends with the same credentials.
+// Backend.Credentials can map them to other credentials per namespace, for
+// instance to mount the mailboxes of a shared account. A namespace whose
+// backend rejects the credentials is hidden to the user. Users logged in with
+// a TLS client certificate are logged in the mounted backends supporting
+// certificates with the same identity, other namespaces are hidden.
+//
+// Messages copied between namespaces are fetched from the source backend and
+// appended one by one to the destination backend: such copies aren't atomic.
+// Renaming a mailbox to another namespace isn't supported.
+package router
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+var (
+	errNamespaceRoot  = errors.New("router: mailbox is a namespace root")
+	errCrossRename    = errors.New("router: cannot rename a mailbox to another namespace")
+	errNoCertificates = errors.New("router: default backend doesn't support certificates")
+)
+
+// mount is a backend mounted on a namespace prefix.
+type mount struct {
+	prefix string
+	be     backend.Backend
+}
+
+// Backend is a backend routing mailboxes to other backends depending on their
+// namespace.
+type Backend struct {
+	// Credentials, if not nil, returns the credentials used to log in the
+	// backend mounted on prefix, given the credentials of the user. If ok is
+	// false, the namespace is hidden to the user.
+	Credentials func(prefix, username, password string) (mountUsername, mountPassword string, ok bool)
+
+	def    backend.Backend
+	mounts []mount
+
+	updatesOnce sync.Once
+	updates     chan backend.Update
+}
+
+// New creates a new backend storing mailboxes in def, except mailboxes in the
+// namespaces defined by the keys of mounts. Keys must be prefixes ending with
+// the hierarchy delimiter, for instance:
+//
+//	be := router.New(maildirBackend, map[string]backend.Backend{
+//		"Archive/": mboxBackend,
+//	})
+func New(def backend.Backend, mounts map[string]backend.Backend) *Backend {
+	be := &Backend{def: def}
+	for prefix, mounted := range mounts {
+		if prefix == "" {
+			panic("router: empty namespace prefix")
+		}
+		be.mounts = append(be.mounts, mount{prefix: prefix, be: mounted})
+	}
+	sort.Slice(be.mounts, func(i, j int) bool {
+		return be.mounts[i].prefix < be.mounts[j].prefix
+	})
+	return be
+}
+
+func (be *Backend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	return be.LoginContext(context.Background(), connInfo, username, password)
+}
+
+func (be *Backend) LoginContext(ctx context.Context, connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	def, err := backendutil.Login(ctx, be.def, connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return be.loginMounts(def, func(m mount) (backend.User, error) {
+		mountUsername, mountPassword := username, password
+		if be.Credentials != nil {
+			var ok bool
+			mountUsername, mountPassword, ok = be.Credentials(m.prefix, username, password)
+			if !ok {
+				return nil, backend.ErrInvalidCredentials
+			}
+		}
+		return backendutil.Login(ctx, m.be, connInfo, mountUsername, mountPassword)
+	})
+}
+
+// LoginCertificate implements backend.CertificateBackend. It fails if the
+// default backend doesn't support certificates.
+func (be *Backend) LoginCertificate(connInfo *imap.ConnInfo, identity string) (backend.User, error) {
+	return be.LoginCertificateContext(context.Background(), connInfo, identity)
+}
+
+func (be *Backend) LoginCertificateContext(ctx context.Context, connInfo *imap.ConnInfo, identity string) (backend.User, error) {
+	certBe, ok := be.def.(backend.CertificateBackend)
+	if !ok {
+		return nil, errNoCertificates
+	}
+	def, err := backendutil.LoginCertificate(ctx, certBe, connInfo, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	return be.loginMounts(def, func(m mount) (backend.User, error) {
+		certBe, ok := m.be.(backend.CertificateBackend)
+		if !ok {
+			return nil, backend.ErrInvalidCredentials
+		}
+		return backendutil.LoginCertificate(ctx, certBe, connInfo, identity)
+	})
+}
+
+// loginMounts logs in the mounted backends with login, once the user is logged
+// in the default backend. Namespaces whose backend returns
+// ErrInvalidCredentials are hidden.
+func (be *Backend) loginMounts(def backend.User, login func(m mount) (backend.User, error)) (backend.User, error) {
+	u := &User{def: def}
+	for _, m := range be.mounts {
+		mounted, err := login(m)
+		if err == backend.ErrInvalidCredentials {
+			continue
+		} else if err != nil {
+			u.Logout()
+			return nil, err
+		}
+		u.namespaces = append(u.namespaces, &namespace{prefix: m.prefix, user: mounted})
+	}
+	return u, nil
+}
+
+// Capabilities implements backend.ExtendedBackend. It returns the
+// capabilities supported by the default backend and by all mounted backends.
+func (be *Backend) Capabilities() []string {
+	caps := capabilities(be.def)
+	for _, m := range be.mounts {
+		supported := make(map[string]bool)
+		for _, c := range capabilities(m.be) {
+			supported[strings.ToUpper(c)] = true
+		}
+
+		var shared []string
+		for _, c := range caps {
+			if supported[strings.ToUpper(c)] {
+				shared = append(shared, c)
+			}
+		}
+		caps = shared
+	}
+	return caps
+}
+
+func capabilities(be backend.Backend) []string {
+	if extended, ok := be.(backend.ExtendedBackend); ok {
+		return extended.Capabilities()
+	}
+	return nil
+}
+
+// Updates implements backend.BackendUpdater. It merges the updates of the
+// mounted backends, or returns nil if none of them sends updates.
+func (be *Backend) Updates() <-chan backend.Update {
+	be.updatesOnce.Do(func() {
+		var sources []mount
+		for _, m := range append([]mount{{be: be.def}}, be.mounts...) {
+			if _, ok := m.be.(backend.BackendUpdater); ok {
+				sources = append(sources, m)
+			}
+		}
+		if len(sources) == 0 {
+			return
+		}
+
+		be.updates = make(chan backend.Update)
+		for _, m := range sources {
+			go be.forward(m.prefix, m.be.(backend.BackendUpdater).Updates())
+		}
+	})
+
+	if be.updates == nil {
+		return nil
+	}
+	return be.updates
+}
+
+// forward sends the updates of a mounted backend to the merged channel, with
+// mailbox names prefixed by the namespace.
+func (be *Backend) forward(prefix string, updates <-chan backend.Update) {
+	for update := range updates {
+		be.updates <- prefixUpdate(prefix, update)
+	}
+}
+
+// prefixedUpdate is an update whose mailbox name is prefixed by a namespace.
+// Done is forwarded to the original update, so that the mounted backend is
+// notified once the update has been broadcast.
+type prefixedUpdate struct {
+	backend.Update
+
+	mailbox string
+}
+
+func (u *prefixedUpdate) Mailbox() string {
+	return u.mailbox
+}
+
+func prefixUpdate(prefix string, update backend.Update) backend.Update {
+	if prefix == "" || update.Mailbox() == "" {
+		return update
+	}
+
+	wrapped := &prefixedUpdate{Update: update, mailbox: prefix + update.Mailbox()}
+	switch update := update.(type) {
+	case *backend.StatusUpdate:
+		return &backend.StatusUpdate{Update: wrapped, StatusResp: update.StatusResp}
+	case *backend.MailboxUpdate:
+		return &backend.MailboxUpdate{Update: wrapped, MailboxStatus: update.MailboxStatus}
+	case *backend.MessageUpdate:
+		return &backend.MessageUpdate{Update: wrapped, Message: update.Message}
+	case *backend.ExpungeUpdate:
+		return &backend.ExpungeUpdate{Update: wrapped, SeqNum: update.SeqNum, Uid: update.Uid}
+	default:
+		return wrapped
+	}
+}
+
+// rootName returns the name of the mailbox at the root of a namespace, that is
+// its prefix without the trailing hierarchy delimiter.
+func rootName(prefix string) string {
+	return strings.TrimSuffix(prefix, delimiter(prefix))
+}
+
+// delimiter returns the hierarchy delimiter ending a namespace prefix.
+func delimiter(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return prefix[len(prefix)-1:]
+}
@@ -0,0 +1,281 @@
+package router
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendtest"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+const testMessage = "From: contact@example.org\r\n" +
+	"To: contact@example.org\r\n" +
+	"Subject: A little message, just for you\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hi there :)"
+
+// rejectingBackend is a backend rejecting all credentials.
+type rejectingBackend struct{}
+
+func (rejectingBackend) Login(*imap.ConnInfo, string, string) (backend.User, error) {
+	return nil, backend.ErrInvalidCredentials
+}
+
+func newTestBackend() (*Backend, *memory.Backend, *memory.Backend) {
+	def, archive := memory.New(), memory.New()
+	be := New(def, map[string]backend.Backend{
+		"Archive/": archive,
+		"Other/":   rejectingBackend{},
+	})
+	return be, def, archive
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.RunTests(t, func() backend.Backend {
+		be, _, _ := newTestBackend()
+		return be
+	})
+}
+
+func TestCreateMailbox(t *testing.T) {
+	be, def, archive := newTestBackend()
+	u := backendtest.Login(t, be)
+
+	if err := u.CreateMailbox("Archive/2020"); err != nil {
+		t.Fatal("Expected no error while creating a mailbox, got:", err)
+	}
+	if err := u.CreateMailbox("Drafts"); err != nil {
+		t.Fatal("Expected no error while creating a mailbox, got:", err)
+	}
+
+	if names, want := backendtest.MailboxNames(t, u, false), []string{"Archive", "Archive/2020", "Archive/INBOX", "Drafts", "INBOX"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected mailboxes %v, got %v", want, names)
+	}
+	if names, want := backendtest.MailboxNames(t, backendtest.Login(t, archive), false), []string{"2020", "INBOX"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected archive mailboxes %v, got %v", want, names)
+	}
+	if names, want := backendtest.MailboxNames(t, backendtest.Login(t, def), false), []string{"Drafts", "INBOX"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected default mailboxes %v, got %v", want, names)
+	}
+
+	info, err := backendtest.GetMailbox(t, u, "Archive/2020").Info()
+	if err != nil {
+		t.Fatal("Expected no error while getting mailbox info, got:", err)
+	}
+	if info.Name != "Archive/2020" {
+		t.Errorf("Expected mailbox name to be prefixed, got %q", info.Name)
+	}
+}
+
+func TestNamespaceRoot(t *testing.T) {
+	be, _, _ := newTestBackend()
+	u := backendtest.Login(t, be)
+
+	if _, err := u.GetMailbox("Archive"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected ErrNoSuchMailbox while getting a namespace root, got: %v", err)
+	}
+	if err := u.CreateMailbox("Archive"); err != backend.ErrMailboxAlreadyExists {
+		t.Errorf("Expected ErrMailboxAlreadyExists while creating a namespace root, got: %v", err)
+	}
+	if err := u.DeleteMailbox("Archive/"); err == nil {
+		t.Error("Expected an error while deleting a namespace root")
+	}
+	if _, err := u.GetMailbox("Other/INBOX"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected namespaces rejecting credentials to be hidden, got: %v", err)
+	}
+}
+
+func TestRenameMailbox(t *testing.T) {
+	be, _, _ := newTestBackend()
+	u := backendtest.Login(t, be)
+
+	if err := u.CreateMailbox("Archive/2020"); err != nil {
+		t.Fatal("Expected no error while creating a mailbox, got:", err)
+	}
+	if err := u.RenameMailbox("Archive/2020", "Archive/2021"); err != nil {
+		t.Fatal("Expected no error while renaming a mailbox, got:", err)
+	}
+	if err := u.RenameMailbox("Archive/2021", "2021"); err != errCrossRename {
+		t.Errorf("Expected an error while renaming a mailbox to another namespace, got: %v", err)
+	}
+	backendtest.GetMailbox(t, u, "Archive/2021")
+}
+
+func TestCopyMessages(t *testing.T) {
+	be, _, _ := newTestBackend()
+	u := backendtest.Login(t, be)
+
+	if err := u.CreateMailbox("Archive/2020"); err != nil {
+		t.Fatal("Expected no error while creating a mailbox, got:", err)
+	}
+
+	inbox := backendtest.GetMailbox(t, u, imap.InboxName)
+	date := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := inbox.CreateMessage([]string{imap.FlaggedFlag}, date, bytes.NewBufferString(testMessage)); err != nil {
+		t.Fatal("Expected no error while creating a message, got:", err)
+	}
+	status, err := inbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal("Expected no error while getting mailbox status, got:", err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(status.Messages)
+	if err := inbox.CopyMessages(false, seqSet, "Archive/2020"); err != nil {
+		t.Fatal("Expected no error while copying messages, got:", err)
+	}
+	if err := inbox.CopyMessages(false, seqSet, "Archive/2019"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("Expected ErrNoSuchMailbox while copying to a missing mailbox, got: %v", err)
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+	ch := make(chan *imap.Message, 10)
+	all, _ := imap.ParseSeqSet("1:*")
+	if err := backendtest.GetMailbox(t, u, "Archive/2020").ListMessages(false, all, items, ch); err != nil {
+		t.Fatal("Expected no error while listing messages, got:", err)
+	}
+
+	var messages []*imap.Message
+	for msg := range ch {
+		messages = append(messages, msg)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 copied message, got %v", len(messages))
+	}
+	msg := messages[0]
+
+	sort.Strings(msg.Flags)
+	if want := []string{imap.FlaggedFlag, imap.RecentFlag}; !reflect.DeepEqual(msg.Flags, want) {
+		t.Errorf("Expected flags %v, got %v", want, msg.Flags)
+	}
+	if !msg.InternalDate.Equal(date) {
+		t.Errorf("Expected internal date %v, got %v", date, msg.InternalDate)
+	}
+	var body []byte
+	for s, l := range msg.Body {
+		if s.Equal(section) {
+			body, _ = ioutil.ReadAll(l)
+		}
+	}
+	if string(body) != testMessage {
+		t.Errorf("Invalid copied body: %q", body)
+	}
+}
+
+func TestUpdates(t *testing.T) {
+	be, _, _ := newTestBackend()
+	updates := be.Updates()
+	u := backendtest.Login(t, be)
+
+	if err := u.CreateMailbox("Archive/2020"); err != nil {
+		t.Fatal("Expected no error while creating a mailbox, got:", err)
+	}
+	mbox := backendtest.GetMailbox(t, u, "Archive/2020")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(testMessage))
+	}()
+
+	update := <-updates
+	if _, ok := update.(*backend.MailboxUpdate); !ok {
+		t.Errorf("Expected a mailbox update, got %T", update)
+	}
+	if update.Mailbox() != "Archive/2020" {
+		t.Errorf("Expected update mailbox to be prefixed, got %q", update.Mailbox())
+	}
+	close(update.Done())
+
+	if err := <-done; err != nil {
+		t.Fatal("Expected no error while creating a message, got:", err)
+	}
+}
+
+// extendedBackend is a memory backend supporting a subset of its extensions.
+type extendedBackend struct {
+	*memory.Backend
+
+	caps []string
+}
+
+func (be extendedBackend) Capabilities() []string {
+	return be.caps
+}
+
+func TestCapabilities(t *testing.T) {
+	be := New(memory.New(), map[string]backend.Backend{
+		"Archive/": extendedBackend{memory.New(), []string{"OBJECTID", "status=size", "X-UNKNOWN"}},
+	})
+	if caps, want := be.Capabilities(), []string{"STATUS=SIZE", "OBJECTID"}; !reflect.DeepEqual(caps, want) {
+		t.Errorf("Expected capabilities %v, got %v", want, caps)
+	}
+
+	// Mounted backends without extensions don't support any
+	be, _, _ = newTestBackend()
+	if caps := be.Capabilities(); len(caps) != 0 {
+		t.Errorf("Expected no capabilities, got %v", caps)
+	}
+}
+
+// sharedBackend is a memory backend only accepting the credentials of a shared
+// account.
+type sharedBackend struct {
+	*memory.Backend
+}
+
+func (be sharedBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	if username != "shared" || password != "secret" {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return be.Backend.Login(connInfo, backendtest.Username, backendtest.Password)
+}
+
+func TestCredentials(t *testing.T) {
+	be := New(memory.New(), map[string]backend.Backend{
+		"Archive/": memory.New(),
+		"Shared/":  sharedBackend{memory.New()},
+	})
+	if names := backendtest.MailboxNames(t, backendtest.Login(t, be), false); !reflect.DeepEqual(names, []string{"Archive", "Archive/INBOX", "INBOX"}) {
+		t.Errorf("Expected the shared namespace to be hidden, got %v", names)
+	}
+
+	be.Credentials = func(prefix, username, password string) (string, string, bool) {
+		switch prefix {
+		case "Shared/":
+			return "shared", "secret", true
+		default:
+			return "", "", false
+		}
+	}
+	if names := backendtest.MailboxNames(t, backendtest.Login(t, be), false); !reflect.DeepEqual(names, []string{"INBOX", "Shared", "Shared/INBOX"}) {
+		t.Errorf("Expected the shared namespace only, got %v", names)
+	}
+}
+
+func TestLoginCertificate(t *testing.T) {
+	be := New(backendtest.CertificateBackend{Backend: memory.New()}, map[string]backend.Backend{
+		"Archive/": backendtest.CertificateBackend{Backend: memory.New()},
+		"Other/":   memory.New(),
+	})
+	u, err := be.LoginCertificate(nil, "")
+	if err != nil {
+		t.Fatal("Expected no error while logging in, got:", err)
+	}
+	defer u.Logout()
+	if names := backendtest.MailboxNames(t, u, false); !reflect.DeepEqual(names, []string{"Archive", "Archive/INBOX", "INBOX"}) {
+		t.Errorf("Expected namespaces without certificate support to be hidden, got %v", names)
+	}
+
+	be, _, _ = newTestBackend()
+	if _, err := be.LoginCertificate(nil, ""); err == nil {
+		t.Error("Expected an error when the default backend doesn't support certificates")
+	}
+}
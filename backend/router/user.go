@@ -0,0 +1,171 @@
+package router
+
+import (
+	"context"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// namespace is a namespace available to a user.
+type namespace struct {
+	prefix string
+	user   backend.User
+}
+
+// User is a user logged in the default backend and in the mounted backends.
+type User struct {
+	def        backend.User
+	namespaces []*namespace
+}
+
+func (u *User) Username() string {
+	return u.def.Username()
+}
+
+// route returns the namespace of a mailbox, and the name of the mailbox in this
+// namespace. It returns a nil namespace if the mailbox is the root of a
+// namespace.
+func (u *User) route(name string) (*namespace, string) {
+	var match *namespace
+	if !strings.EqualFold(name, imap.InboxName) {
+		for _, ns := range u.namespaces {
+			if name == rootName(ns.prefix) {
+				return nil, ""
+			}
+			if strings.HasPrefix(name, ns.prefix) && (match == nil || len(ns.prefix) > len(match.prefix)) {
+				match = ns
+			}
+		}
+	}
+	if match == nil {
+		return &namespace{user: u.def}, name
+	}
+	return match, strings.TrimPrefix(name, match.prefix)
+}
+
+// isMounted checks whether a mailbox of the default backend is hidden by a
+// namespace.
+func (u *User) isMounted(name string) bool {
+	for _, ns := range u.namespaces {
+		if name == rootName(ns.prefix) || strings.HasPrefix(name, ns.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) wrapMailbox(ns *namespace, mbox backend.Mailbox) *Mailbox {
+	return &Mailbox{Mailbox: mbox, user: u, name: ns.prefix + mbox.Name()}
+}
+
+func (u *User) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	return u.ListMailboxesContext(context.Background(), subscribed)
+}
+
+func (u *User) ListMailboxesContext(ctx context.Context, subscribed bool) ([]backend.Mailbox, error) {
+	mailboxes, err := backendutil.ListMailboxes(ctx, u.def, subscribed)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []backend.Mailbox
+	def := &namespace{user: u.def}
+	for _, mbox := range mailboxes {
+		if !u.isMounted(mbox.Name()) {
+			list = append(list, u.wrapMailbox(def, mbox))
+		}
+	}
+
+	for _, ns := range u.namespaces {
+		if !subscribed {
+			list = append(list, &rootMailbox{prefix: ns.prefix})
+		}
+
+		mailboxes, err := backendutil.ListMailboxes(ctx, ns.user, subscribed)
+		if err != nil {
+			return nil, err
+		}
+		for _, mbox := range mailboxes {
+			// Mailboxes of a nested namespace hide mailboxes of the outer one
+			full := ns.prefix + mbox.Name()
+			if routed, _ := u.route(full); routed == ns {
+				list = append(list, u.wrapMailbox(ns, mbox))
+			}
+		}
+	}
+
+	return list, nil
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	return u.GetMailboxContext(context.Background(), name)
+}
+
+func (u *User) GetMailboxContext(ctx context.Context, name string) (backend.Mailbox, error) {
+	ns, name := u.route(name)
+	if ns == nil || name == "" {
+		return nil, backend.ErrNoSuchMailbox
+	}
+
+	mbox, err := backendutil.GetMailbox(ctx, ns.user, name)
+	if err != nil {
+		return nil, err
+	}
+	return u.wrapMailbox(ns, mbox), nil
+}
+
+func (u *User) CreateMailbox(name string) error {
+	return u.CreateMailboxContext(context.Background(), name)
+}
+
+func (u *User) CreateMailboxContext(ctx context.Context, name string) error {
+	ns, name := u.route(name)
+	if ns == nil || name == "" {
+		return backend.ErrMailboxAlreadyExists
+	}
+	return backendutil.CreateMailbox(ctx, ns.user, name)
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	return u.DeleteMailboxContext(context.Background(), name)
+}
+
+func (u *User) DeleteMailboxContext(ctx context.Context, name string) error {
+	ns, name := u.route(name)
+	if ns == nil || name == "" {
+		return errNamespaceRoot
+	}
+	return backendutil.DeleteMailbox(ctx, ns.user, name)
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	return u.RenameMailboxContext(context.Background(), existingName, newName)
+}
+
+func (u *User) RenameMailboxContext(ctx context.Context, existingName, newName string) error {
+	ns, existingName := u.route(existingName)
+	if ns == nil || existingName == "" {
+		return errNamespaceRoot
+	}
+	newNs, newName := u.route(newName)
+	if newNs == nil || newName == "" {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if newNs.user != ns.user {
+		return errCrossRename
+	}
+	return backendutil.RenameMailbox(ctx, ns.user, existingName, newName)
+}
+
+func (u *User) Logout() error {
+	err := u.def.Logout()
+	for _, ns := range u.namespaces {
+		if nsErr := ns.user.Logout(); err == nil {
+			err = nsErr
+		}
+	}
+	return err
+}
@@ -60,7 +60,8 @@ type MailboxUpdate struct {
 	*imap.MailboxStatus
 }
 
-// MessageUpdate is a message update.
+// MessageUpdate is a message update. The message UID should be set, so that
+// the server can find the message in the mailbox snapshot of each connection.
 type MessageUpdate struct {
 	Update
 	*imap.Message
@@ -70,6 +71,9 @@ type MessageUpdate struct {
 type ExpungeUpdate struct {
 	Update
 	SeqNum uint32
+	// The UID of the expunged message. If not zero, the server uses it instead
+	// of SeqNum to find the message in the mailbox snapshot of each connection.
+	Uid uint32
 }
 
 // BackendUpdater is a Backend that implements Updater is able to send
@@ -40,9 +40,21 @@ func (cmd *Fetch) Parse(fields []interface{}) error {
 	switch items := fields[1].(type) {
 	case string: // A macro or a single item
 		cmd.Items = imap.FetchItem(strings.ToUpper(items)).Expand()
+		if len(fields) > 2 && len(cmd.Items) == 1 && cmd.Items[0] == imap.FetchPreview {
+			// Ignore PREVIEW modifiers, e.g. "FETCH 1 PREVIEW (LAZY)"
+			if _, ok := fields[2].([]interface{}); !ok {
+				return errors.New("PREVIEW modifiers must be a list")
+			}
+		}
 	case []interface{}: // A list of items
 		cmd.Items = make([]imap.FetchItem, 0, len(items))
 		for _, v := range items {
+			if _, ok := v.([]interface{}); ok && len(cmd.Items) > 0 && cmd.Items[len(cmd.Items)-1] == imap.FetchPreview {
+				// Ignore PREVIEW modifiers, previews are always generated
+				// See RFC 8970 section 3.2
+				continue
+			}
+
 			itemStr, _ := v.(string)
 			item := imap.FetchItem(strings.ToUpper(itemStr))
 			cmd.Items = append(cmd.Items, item.Expand()...)
@@ -190,6 +190,13 @@ func (c *Conn) init() {
 			remoteDebug = localDebug
 		}
 
+		// Don't mirror credentials sent by clients
+		if c.Reader.continues != nil && remoteDebug != nil {
+			remoteDebug = newCredentialsRedactor(remoteDebug)
+		} else if c.Writer.continues != nil && localDebug != nil {
+			localDebug = newCredentialsRedactor(localDebug)
+		}
+
 		if localDebug != nil {
 			w = io.MultiWriter(c.Conn, localDebug)
 		}
@@ -17,6 +17,11 @@ const (
 	StatusUidNext     StatusItem = "UIDNEXT"
 	StatusUidValidity StatusItem = "UIDVALIDITY"
 	StatusUnseen      StatusItem = "UNSEEN"
+
+	// Defined in RFC 8438.
+	StatusSize StatusItem = "SIZE"
+	// Defined in RFC 8474.
+	StatusMailboxId StatusItem = "MAILBOXID"
 )
 
 // A FetchItem is a message data item that can be fetched.
@@ -40,6 +45,14 @@ const (
 	FetchRFC822Size    FetchItem = "RFC822.SIZE"
 	FetchRFC822Text    FetchItem = "RFC822.TEXT"
 	FetchUid           FetchItem = "UID"
+
+	// Defined in RFC 8514.
+	FetchSaveDate FetchItem = "SAVEDATE"
+	// Defined in RFC 8474.
+	FetchEmailId  FetchItem = "EMAILID"
+	FetchThreadId FetchItem = "THREADID"
+	// Defined in RFC 8970.
+	FetchPreview FetchItem = "PREVIEW"
 )
 
 // Expand expands the item if it's a macro.
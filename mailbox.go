@@ -3,6 +3,7 @@ package imap
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
@@ -173,6 +174,10 @@ type MailboxStatus struct {
 	// Together with a UID, it is a unique identifier for a message.
 	// Must be greater than or equal to 1.
 	UidValidity uint32
+	// The total size of the mailbox in octets. See RFC 8438.
+	Size uint64
+	// The unique and immutable identifier of this mailbox. See RFC 8474.
+	MailboxId string
 }
 
 // Create a new mailbox status that will contain the specified items.
@@ -215,6 +220,10 @@ func (status *MailboxStatus) Parse(fields []interface{}) error {
 				status.UidNext, err = ParseNumber(f)
 			case StatusUidValidity:
 				status.UidValidity, err = ParseNumber(f)
+			case StatusSize:
+				status.Size, err = ParseNumber64(f)
+			case StatusMailboxId:
+				status.MailboxId, err = parseObjectId(f)
 			default:
 				status.Items[k] = f
 			}
@@ -229,8 +238,17 @@ func (status *MailboxStatus) Parse(fields []interface{}) error {
 }
 
 func (status *MailboxStatus) Format() []interface{} {
+	// Sort items so that the output is deterministic
+	keys := make([]string, 0, len(status.Items))
+	for k := range status.Items {
+		keys = append(keys, string(k))
+	}
+	sort.Strings(keys)
+
 	var fields []interface{}
-	for k, v := range status.Items {
+	for _, key := range keys {
+		k := StatusItem(key)
+		v := status.Items[k]
 		switch k {
 		case StatusMessages:
 			v = status.Messages
@@ -242,6 +260,10 @@ func (status *MailboxStatus) Format() []interface{} {
 			v = status.UidNext
 		case StatusUidValidity:
 			v = status.UidValidity
+		case StatusSize:
+			v = status.Size
+		case StatusMailboxId:
+			v = formatObjectId(status.MailboxId)
 		}
 
 		fields = append(fields, RawString(k), v)
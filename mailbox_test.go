@@ -150,6 +150,20 @@ var mailboxStatusTests = [...]struct {
 			UidValidity: 4242,
 		},
 	},
+	{
+		fields: []interface{}{
+			"SIZE", uint64(8589934592),
+			"MAILBOXID", []interface{}{imap.RawString("F2212ea87-6097-4256-9d51-71338625")},
+		},
+		status: &imap.MailboxStatus{
+			Items: map[imap.StatusItem]interface{}{
+				imap.StatusSize:      nil,
+				imap.StatusMailboxId: nil,
+			},
+			Size:      8589934592,
+			MailboxId: "F2212ea87-6097-4256-9d51-71338625",
+		},
+	},
 }
 
 func TestMailboxStatus_Parse(t *testing.T) {
@@ -134,6 +134,27 @@ func formatHeaderParamList(params map[string]string) []interface{} {
 	return FormatParamList(encoded)
 }
 
+// parseObjectId parses an object identifier, as defined in RFC 8474 section
+// 7. Object identifiers are sent as a single-element list.
+func parseObjectId(f interface{}) (string, error) {
+	if f == nil {
+		return "", nil
+	}
+
+	list, ok := f.([]interface{})
+	if !ok || len(list) != 1 {
+		return "", errors.New("Object identifier must be a list with a single element")
+	}
+	return ParseString(list[0])
+}
+
+func formatObjectId(id string) interface{} {
+	if id == "" {
+		return nil
+	}
+	return []interface{}{RawString(id)}
+}
+
 // A message.
 type Message struct {
 	// The message sequence number. It must be greater than or equal to 1.
@@ -157,6 +178,18 @@ type Message struct {
 	Uid uint32
 	// The message body sections.
 	Body map[*BodySectionName]Literal
+	// The date the message was saved to its current mailbox. Zero if the save
+	// date is not available. See RFC 8514.
+	SaveDate time.Time
+	// The unique and immutable identifier of the message content. See RFC
+	// 8474.
+	EmailId string
+	// The identifier of the thread the message belongs to. Empty if the server
+	// doesn't support threads. See RFC 8474.
+	ThreadId string
+	// A plain text abbreviated version of the message content, at most 256
+	// characters long. See RFC 8970.
+	Preview string
 
 	// The order in which items were requested. This order must be preserved
 	// because some bad IMAP clients (looking at you, Outlook!) refuse responses
@@ -240,6 +273,26 @@ func (m *Message) Parse(fields []interface{}) error {
 				m.Size, _ = ParseNumber(f)
 			case FetchUid:
 				m.Uid, _ = ParseNumber(f)
+			case FetchSaveDate:
+				// NIL if the mailbox doesn't support save dates
+				if f == nil {
+					break
+				}
+				date, ok := f.(string)
+				if !ok {
+					return fmt.Errorf("cannot parse message: SAVEDATE is not a string, but a %T", f)
+				}
+				saveDate, err := time.Parse(DateTimeLayout, date)
+				if err != nil {
+					return fmt.Errorf("cannot parse message: invalid SAVEDATE: %v", err)
+				}
+				m.SaveDate = saveDate
+			case FetchEmailId:
+				m.EmailId, _ = parseObjectId(f)
+			case FetchThreadId:
+				m.ThreadId, _ = parseObjectId(f)
+			case FetchPreview:
+				m.Preview, _ = ParseString(f)
 			default:
 				// Likely to be a section of the body
 				// First check that the section name is correct
@@ -279,6 +332,16 @@ func (m *Message) formatItem(k FetchItem) []interface{} {
 		v = m.Size
 	case FetchUid:
 		v = m.Uid
+	case FetchSaveDate:
+		if !m.SaveDate.IsZero() {
+			v = m.SaveDate
+		}
+	case FetchEmailId:
+		v = formatObjectId(m.EmailId)
+	case FetchThreadId:
+		v = formatObjectId(m.ThreadId)
+	case FetchPreview:
+		v = m.Preview
 	default:
 		for section, literal := range m.Body {
 			if section.value == k {
@@ -73,6 +73,27 @@ var messageTests = []struct {
 			RawString("UID"), RawString("2424"),
 		},
 	},
+	{
+		message: &Message{
+			Items: map[FetchItem]interface{}{
+				FetchSaveDate: nil,
+				FetchEmailId:  nil,
+				FetchThreadId: nil,
+				FetchPreview:  nil,
+			},
+			Body:       map[*BodySectionName]Literal{},
+			SaveDate:   t,
+			EmailId:    "M6d99ac3275bb4e",
+			Preview:    "What's your name?",
+			itemsOrder: []FetchItem{FetchSaveDate, FetchEmailId, FetchThreadId, FetchPreview},
+		},
+		fields: []interface{}{
+			RawString("SAVEDATE"), "10-Nov-2009 23:00:00 -0600",
+			RawString("EMAILID"), []interface{}{RawString("M6d99ac3275bb4e")},
+			RawString("THREADID"), nil,
+			RawString("PREVIEW"), "What's your name?",
+		},
+	},
 }
 
 func TestMessage_Parse(t *testing.T) {
@@ -86,6 +107,23 @@ func TestMessage_Parse(t *testing.T) {
 	}
 }
 
+func TestMessage_Parse_invalidSaveDate(t *testing.T) {
+	for _, v := range []interface{}{uint32(42), "not a date"} {
+		m := &Message{}
+		fields := []interface{}{RawString("SAVEDATE"), v}
+		if err := m.Parse(fields); err == nil {
+			t.Errorf("Expected an error when parsing SAVEDATE %v", v)
+		}
+	}
+
+	m := &Message{}
+	if err := m.Parse([]interface{}{RawString("SAVEDATE"), nil}); err != nil {
+		t.Error("Expected no error when parsing a NIL SAVEDATE, got:", err)
+	} else if !m.SaveDate.IsZero() {
+		t.Error("Expected a zero save date, got:", m.SaveDate)
+	}
+}
+
 func TestMessage_Format(t *testing.T) {
 	for i, test := range messageTests {
 		fields := test.message.Format()
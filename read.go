@@ -87,6 +87,34 @@ func ParseNumber(f interface{}) (uint32, error) {
 	return uint32(nbr), nil
 }
 
+// ParseNumber64 parses a 64-bit number, as defined in RFC 9051 as number64.
+func ParseNumber64(f interface{}) (uint64, error) {
+	// Useful for tests
+	switch n := f.(type) {
+	case uint64:
+		return n, nil
+	case uint32:
+		return uint64(n), nil
+	}
+
+	var s string
+	switch f := f.(type) {
+	case RawString:
+		s = string(f)
+	case string:
+		s = f
+	default:
+		return 0, newParseError("expected a number, got a non-atom")
+	}
+
+	nbr, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, &parseError{err}
+	}
+
+	return nbr, nil
+}
+
 // ParseString parses a string, which is either a literal, a quoted string or an
 // atom.
 func ParseString(f interface{}) (string, error) {
@@ -0,0 +1,142 @@
+package imap
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// redacted replaces credentials in debug output.
+const redacted = "***"
+
+// credentialsRedactor is an io.Writer forwarding client commands to another
+// io.Writer, with credentials replaced: LOGIN arguments, AUTHENTICATE initial
+// responses and SASL responses. Data is forwarded line by line, literals are
+// forwarded as is, except the ones of LOGIN commands which are dropped.
+type credentialsRedactor struct {
+	w    io.Writer
+	line []byte
+
+	// Number of bytes of the current literal
+	literal int
+	// True if the current command continues after a literal
+	continued bool
+	// True if the current command is a LOGIN command
+	login bool
+	// True if SASL responses are expected
+	sasl bool
+}
+
+func newCredentialsRedactor(w io.Writer) io.Writer {
+	return &credentialsRedactor{w: w}
+}
+
+func (r *credentialsRedactor) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if r.literal > 0 {
+			m := r.literal
+			if m > len(b) {
+				m = len(b)
+			}
+			if !r.login {
+				if _, err := r.w.Write(b[:m]); err != nil {
+					return n, err
+				}
+			}
+			r.literal -= m
+			b = b[m:]
+			continue
+		}
+
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			r.line = append(r.line, b...)
+			break
+		}
+		r.line = append(r.line, b[:i+1]...)
+		b = b[i+1:]
+
+		line := r.redactLine(string(r.line))
+		r.line = r.line[:0]
+		if _, err := io.WriteString(r.w, line); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// literalSize returns the size of the literal ending a line, or -1.
+func literalSize(line string) int {
+	if !strings.HasSuffix(line, string(literalEnd)) {
+		return -1
+	}
+	i := strings.LastIndexByte(line, byte(literalStart))
+	if i < 0 {
+		return -1
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[i+1:len(line)-1], "+"))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// isSASLResponse checks whether a line is a base64-encoded SASL response or a
+// cancellation.
+func isSASLResponse(line string) bool {
+	if line == "*" {
+		return true
+	}
+	for _, c := range line {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '/' || c == '=') {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *credentialsRedactor) redactLine(line string) string {
+	trimmed := strings.TrimRight(line, "\r\n")
+	eol := line[len(trimmed):]
+
+	literal := literalSize(trimmed)
+	if literal >= 0 {
+		r.literal = literal
+	}
+
+	if r.continued {
+		// The remaining arguments of a command after a literal
+		r.continued = literal >= 0
+		if r.login {
+			r.login = r.continued
+			return redacted + eol
+		}
+		return line
+	}
+	r.continued = literal >= 0
+
+	if r.sasl {
+		if isSASLResponse(trimmed) {
+			return redacted + eol
+		}
+		r.sasl = false
+	}
+
+	fields := strings.SplitN(trimmed, string(sp), 4)
+	if len(fields) < 3 {
+		return line
+	}
+	switch strings.ToUpper(fields[1]) {
+	case "LOGIN":
+		r.login = r.continued
+		return fields[0] + " " + fields[1] + " " + redacted + eol
+	case "AUTHENTICATE":
+		r.sasl = true
+		if len(fields) == 4 {
+			return strings.Join(fields[:3], " ") + " " + redacted + eol
+		}
+	}
+	return line
+}
@@ -0,0 +1,75 @@
+package imap
+
+import (
+	"bytes"
+	"testing"
+)
+
+var credentialsRedactorTests = []struct {
+	name     string
+	in       []string
+	expected string
+}{
+	{
+		name:     "login",
+		in:       []string{"a001 LOGIN username password\r\n", "a002 NOOP\r\n"},
+		expected: "a001 LOGIN ***\r\na002 NOOP\r\n",
+	},
+	{
+		name:     "login_literals",
+		in:       []string{"a001 login {8}\r\n", "username {8}\r\n", "password", "\r\n", "a002 NOOP\r\n"},
+		expected: "a001 login ***\r\n***\r\n***\r\na002 NOOP\r\n",
+	},
+	{
+		name:     "authenticate",
+		in:       []string{"a001 AUTHENTICATE PLAIN\r\n", "AHVzZXJuYW1lAHBhc3N3b3Jk\r\n", "a002 NOOP\r\n"},
+		expected: "a001 AUTHENTICATE PLAIN\r\n***\r\na002 NOOP\r\n",
+	},
+	{
+		name:     "authenticate_initial_response",
+		in:       []string{"a001 AUTHENTICATE PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n"},
+		expected: "a001 AUTHENTICATE PLAIN ***\r\n",
+	},
+	{
+		name:     "partial_lines",
+		in:       []string{"a001 LOG", "IN username pass", "word\r\na002 SELECT INBOX\r\n"},
+		expected: "a001 LOGIN ***\r\na002 SELECT INBOX\r\n",
+	},
+	{
+		name:     "login_literals_single_write",
+		in:       []string{"a001 LOGIN username {8+}\r\npassword\r\na002 NOOP\r\n"},
+		expected: "a001 LOGIN ***\r\n***\r\na002 NOOP\r\n",
+	},
+	{
+		name:     "other_literals",
+		in:       []string{"a001 APPEND INBOX {11}\r\n", "Hello world\r\n"},
+		expected: "a001 APPEND INBOX {11}\r\nHello world\r\n",
+	},
+	{
+		name:     "other_literals_not_parsed",
+		in:       []string{"a001 APPEND INBOX {30}\r\n", "a002 LOGIN username password\r\n", "\r\n"},
+		expected: "a001 APPEND INBOX {30}\r\na002 LOGIN username password\r\n\r\n",
+	},
+	{
+		name:     "other_literals_continued",
+		in:       []string{"a001 SEARCH TEXT {5}\r\n", "hello", " SUBJECT {5}\r\n", "LOGIN", " a b\r\n", "a002 LOGIN username password\r\n"},
+		expected: "a001 SEARCH TEXT {5}\r\nhello SUBJECT {5}\r\nLOGIN a b\r\na002 LOGIN ***\r\n",
+	},
+}
+
+func TestCredentialsRedactor(t *testing.T) {
+	for _, test := range credentialsRedactorTests {
+		t.Run(test.name, func(t *testing.T) {
+			var b bytes.Buffer
+			w := newCredentialsRedactor(&b)
+			for _, s := range test.in {
+				if _, err := w.Write([]byte(s)); err != nil {
+					t.Fatal("Expected no error while writing, got:", err)
+				}
+			}
+			if b.String() != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, b.String())
+			}
+		})
+	}
+}
@@ -56,6 +56,15 @@ func popSearchField(fields []interface{}) (interface{}, []interface{}, error) {
 	return fields[0], fields[1:], nil
 }
 
+// parseSearchKeyword parses a flag keyword.
+func parseSearchKeyword(f interface{}) (string, error) {
+	s := maybeString(f)
+	if s == "" {
+		return "", errors.New("imap: invalid keyword")
+	}
+	return CanonicalFlag(s), nil
+}
+
 // SearchCriteria is a search criteria. A message matches the criteria if and
 // only if it matches each one of its fields.
 type SearchCriteria struct {
@@ -63,10 +72,18 @@ type SearchCriteria struct {
 	Uid    *SeqSet // UID is in sequence set
 
 	// Time and timezone are ignored
-	Since      time.Time // Internal date is since this date
-	Before     time.Time // Internal date is before this date
-	SentSince  time.Time // Date header field is since this date
-	SentBefore time.Time // Date header field is before this date
+	Since       time.Time // Internal date is since this date
+	Before      time.Time // Internal date is before this date
+	SentSince   time.Time // Date header field is since this date
+	SentBefore  time.Time // Date header field is before this date
+	SavedSince  time.Time // Save date is since this date (RFC 8514)
+	SavedBefore time.Time // Save date is before this date (RFC 8514)
+
+	SaveDateSupported bool // Mailbox supports save dates (RFC 8514)
+
+	// Precision is one second
+	Older   time.Duration // Internal date is older than this duration (RFC 5032)
+	Younger time.Duration // Internal date is younger than this duration (RFC 5032)
 
 	Header textproto.MIMEHeader // Each header field value is present
 	Body   []string             // Each string is in the body
@@ -78,8 +95,12 @@ type SearchCriteria struct {
 	Larger  uint32 // Size is larger than this number
 	Smaller uint32 // Size is smaller than this number
 
-	Not []*SearchCriteria    // Each criteria doesn't match
-	Or  [][2]*SearchCriteria // Each criteria pair has at least one match of two
+	EmailId  []string // Email object identifier is equal to each value (RFC 8474)
+	ThreadId []string // Thread object identifier is equal to each value (RFC 8474)
+
+	Not   []*SearchCriteria    // Each criteria doesn't match
+	Or    [][2]*SearchCriteria // Each criteria pair has at least one match of two
+	Fuzzy []*SearchCriteria    // Each criteria matches approximately (RFC 6203)
 }
 
 // NewSearchCriteria creates a new search criteria.
@@ -133,6 +154,18 @@ func (c *SearchCriteria) parseField(fields []interface{}, charsetReader func(io.
 		} else {
 			c.Body = append(c.Body, convertField(f, charsetReader))
 		}
+	case "EMAILID":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else {
+			c.EmailId = append(c.EmailId, maybeString(f))
+		}
+	case "FUZZY":
+		fuzzy := new(SearchCriteria)
+		if fields, err = fuzzy.parseField(fields, charsetReader); err != nil {
+			return nil, err
+		}
+		c.Fuzzy = append(c.Fuzzy, fuzzy)
 	case "HEADER":
 		var f1, f2 interface{}
 		if f1, fields, err = popSearchField(fields); err != nil {
@@ -148,8 +181,10 @@ func (c *SearchCriteria) parseField(fields []interface{}, charsetReader func(io.
 	case "KEYWORD":
 		if f, fields, err = popSearchField(fields); err != nil {
 			return nil, err
+		} else if flag, err := parseSearchKeyword(f); err != nil {
+			return nil, err
 		} else {
-			c.WithFlags = append(c.WithFlags, CanonicalFlag(maybeString(f)))
+			c.WithFlags = append(c.WithFlags, flag)
 		}
 	case "LARGER":
 		if f, fields, err = popSearchField(fields); err != nil {
@@ -170,6 +205,16 @@ func (c *SearchCriteria) parseField(fields []interface{}, charsetReader func(io.
 		c.Not = append(c.Not, not)
 	case "OLD":
 		c.WithoutFlags = append(c.WithoutFlags, RecentFlag)
+	case "OLDER":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if n, err := ParseNumber(f); err != nil {
+			return nil, err
+		} else if n == 0 {
+			return nil, errors.New("imap: OLDER interval must be greater than zero")
+		} else if d := time.Duration(n) * time.Second; d > c.Older {
+			c.Older = d
+		}
 	case "ON":
 		if f, fields, err = popSearchField(fields); err != nil {
 			return nil, err
@@ -187,6 +232,33 @@ func (c *SearchCriteria) parseField(fields []interface{}, charsetReader func(io.
 			return nil, err
 		}
 		c.Or = append(c.Or, [2]*SearchCriteria{c1, c2})
+	case "SAVEDBEFORE":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if t, err := time.Parse(DateLayout, maybeString(f)); err != nil {
+			return nil, err
+		} else if c.SavedBefore.IsZero() || t.Before(c.SavedBefore) {
+			c.SavedBefore = t
+		}
+	case "SAVEDON":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if t, err := time.Parse(DateLayout, maybeString(f)); err != nil {
+			return nil, err
+		} else {
+			c.SavedSince = t
+			c.SavedBefore = t.Add(24 * time.Hour)
+		}
+	case "SAVEDATESUPPORTED":
+		c.SaveDateSupported = true
+	case "SAVEDSINCE":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if t, err := time.Parse(DateLayout, maybeString(f)); err != nil {
+			return nil, err
+		} else if c.SavedSince.IsZero() || t.After(c.SavedSince) {
+			c.SavedSince = t
+		}
 	case "SENTBEFORE":
 		if f, fields, err = popSearchField(fields); err != nil {
 			return nil, err
@@ -234,6 +306,12 @@ func (c *SearchCriteria) parseField(fields []interface{}, charsetReader func(io.
 		} else {
 			c.Text = append(c.Text, convertField(f, charsetReader))
 		}
+	case "THREADID":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else {
+			c.ThreadId = append(c.ThreadId, maybeString(f))
+		}
 	case "UID":
 		if f, fields, err = popSearchField(fields); err != nil {
 			return nil, err
@@ -246,8 +324,20 @@ func (c *SearchCriteria) parseField(fields []interface{}, charsetReader func(io.
 	case "UNKEYWORD":
 		if f, fields, err = popSearchField(fields); err != nil {
 			return nil, err
+		} else if flag, err := parseSearchKeyword(f); err != nil {
+			return nil, err
 		} else {
-			c.WithoutFlags = append(c.WithoutFlags, CanonicalFlag(maybeString(f)))
+			c.WithoutFlags = append(c.WithoutFlags, flag)
+		}
+	case "YOUNGER":
+		if f, fields, err = popSearchField(fields); err != nil {
+			return nil, err
+		} else if n, err := ParseNumber(f); err != nil {
+			return nil, err
+		} else if n == 0 {
+			return nil, errors.New("imap: YOUNGER interval must be greater than zero")
+		} else if d := time.Duration(n) * time.Second; c.Younger == 0 || d < c.Younger {
+			c.Younger = d
 		}
 	default: // Try to parse a sequence set
 		if c.SeqNum, err = ParseSeqSet(key); err != nil {
@@ -302,6 +392,25 @@ func (c *SearchCriteria) Format() []interface{} {
 			fields = append(fields, RawString("SENTBEFORE"), searchDate(c.SentBefore))
 		}
 	}
+	if !c.SavedSince.IsZero() && !c.SavedBefore.IsZero() && c.SavedBefore.Sub(c.SavedSince) == 24*time.Hour {
+		fields = append(fields, RawString("SAVEDON"), searchDate(c.SavedSince))
+	} else {
+		if !c.SavedSince.IsZero() {
+			fields = append(fields, RawString("SAVEDSINCE"), searchDate(c.SavedSince))
+		}
+		if !c.SavedBefore.IsZero() {
+			fields = append(fields, RawString("SAVEDBEFORE"), searchDate(c.SavedBefore))
+		}
+	}
+	if c.SaveDateSupported {
+		fields = append(fields, RawString("SAVEDATESUPPORTED"))
+	}
+	if c.Older > 0 {
+		fields = append(fields, RawString("OLDER"), uint32(c.Older/time.Second))
+	}
+	if c.Younger > 0 {
+		fields = append(fields, RawString("YOUNGER"), uint32(c.Younger/time.Second))
+	}
 
 	for key, values := range c.Header {
 		var prefields []interface{}
@@ -354,6 +463,13 @@ func (c *SearchCriteria) Format() []interface{} {
 		fields = append(fields, RawString("SMALLER"), c.Smaller)
 	}
 
+	for _, id := range c.EmailId {
+		fields = append(fields, RawString("EMAILID"), RawString(id))
+	}
+	for _, id := range c.ThreadId {
+		fields = append(fields, RawString("THREADID"), RawString(id))
+	}
+
 	for _, not := range c.Not {
 		fields = append(fields, RawString("NOT"), not.Format())
 	}
@@ -362,5 +478,9 @@ func (c *SearchCriteria) Format() []interface{} {
 		fields = append(fields, RawString("OR"), or[0].Format(), or[1].Format())
 	}
 
+	for _, fuzzy := range c.Fuzzy {
+		fields = append(fields, RawString("FUZZY"), fuzzy.Format())
+	}
+
 	return fields
 }
@@ -65,6 +65,29 @@ var searchCriteriaTests = []struct {
 			}},
 		},
 	},
+	{
+		expected: `(SAVEDSINCE "5-Nov-1984" SAVEDBEFORE "21-Nov-1997" SAVEDATESUPPORTED OLDER 3600 YOUNGER 86400 ` +
+			`EMAILID M6d99ac3275bb4e THREADID T64b478a75b7ea9 ` +
+			`NOT (SAVEDON "21-Nov-1997") FUZZY (SUBJECT "reunion"))`,
+		criteria: &SearchCriteria{
+			SavedSince:        searchDate2,
+			SavedBefore:       searchDate1,
+			SaveDateSupported: true,
+			Older:             time.Hour,
+			Younger:           24 * time.Hour,
+			EmailId:           []string{"M6d99ac3275bb4e"},
+			ThreadId:          []string{"T64b478a75b7ea9"},
+			Not: []*SearchCriteria{{
+				SavedSince:  searchDate1,
+				SavedBefore: searchDate1.Add(24 * time.Hour),
+			}},
+			Fuzzy: []*SearchCriteria{{
+				Header: textproto.MIMEHeader{
+					"Subject": {"reunion"},
+				},
+			}},
+		},
+	},
 }
 
 func TestSearchCriteria_Format(t *testing.T) {
@@ -123,6 +146,13 @@ var searchCriteriaParseTests = []struct {
 			return r
 		},
 	},
+	{
+		fields: []interface{}{"EMAILID", "M6d99ac3275bb4e", "EMAILID", "Mf2b0a1e3c4d5e6", "THREADID", "T64b478a75b7ea9", "THREADID", "T0a1b2c3d4e5f6a"},
+		criteria: &SearchCriteria{
+			EmailId:  []string{"M6d99ac3275bb4e", "Mf2b0a1e3c4d5e6"},
+			ThreadId: []string{"T64b478a75b7ea9", "T0a1b2c3d4e5f6a"},
+		},
+	},
 }
 
 func TestSearchCriteria_Parse_others(t *testing.T) {
@@ -135,3 +165,27 @@ func TestSearchCriteria_Parse_others(t *testing.T) {
 		}
 	}
 }
+
+func TestSearchCriteria_Parse_systemKeyword(t *testing.T) {
+	criteria := new(SearchCriteria)
+	fields := []interface{}{"KEYWORD", "\\seen", "UNKEYWORD", DeletedFlag}
+	if err := criteria.ParseWithCharset(fields, nil); err != nil {
+		t.Fatal("Expected no error while parsing system flags as keywords, got:", err)
+	}
+	if !reflect.DeepEqual(criteria.WithFlags, []string{SeenFlag}) {
+		t.Errorf("Invalid WithFlags: %v", criteria.WithFlags)
+	}
+	if !reflect.DeepEqual(criteria.WithoutFlags, []string{DeletedFlag}) {
+		t.Errorf("Invalid WithoutFlags: %v", criteria.WithoutFlags)
+	}
+}
+
+func TestSearchCriteria_Parse_zeroInterval(t *testing.T) {
+	for _, key := range []string{"OLDER", "YOUNGER"} {
+		criteria := new(SearchCriteria)
+		fields := []interface{}{key, "0"}
+		if err := criteria.ParseWithCharset(fields, nil); err == nil {
+			t.Errorf("Expected an error when parsing %v with a zero interval", key)
+		}
+	}
+}
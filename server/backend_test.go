@@ -0,0 +1,172 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// ctxBackend is a backend recording the contexts passed to its mailboxes.
+// Searches block until their context is cancelled or release is closed.
+type ctxBackend struct {
+	*memory.Backend
+
+	contexts chan context.Context
+	release  chan struct{}
+}
+
+func (be *ctxBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &ctxUser{User: u, be: be}, nil
+}
+
+type ctxUser struct {
+	backend.User
+
+	be *ctxBackend
+}
+
+func (u *ctxUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &ctxMailbox{Mailbox: mbox, be: u.be}, nil
+}
+
+type ctxMailbox struct {
+	backend.Mailbox
+
+	be *ctxBackend
+}
+
+func (mbox *ctxMailbox) StatusContext(ctx context.Context, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	mbox.be.contexts <- ctx
+	return mbox.Status(items)
+}
+
+func (mbox *ctxMailbox) SetSubscribedContext(ctx context.Context, subscribed bool) error {
+	return mbox.SetSubscribed(subscribed)
+}
+
+func (mbox *ctxMailbox) CheckContext(ctx context.Context) error {
+	return mbox.Check()
+}
+
+func (mbox *ctxMailbox) ListMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return mbox.ListMessages(uid, seqset, items, ch)
+}
+
+func (mbox *ctxMailbox) SearchMessagesContext(ctx context.Context, uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	mbox.be.contexts <- ctx
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-mbox.be.release:
+		return nil, nil
+	}
+}
+
+func (mbox *ctxMailbox) CreateMessageContext(ctx context.Context, flags []string, date time.Time, body imap.Literal) error {
+	return mbox.CreateMessage(flags, date, body)
+}
+
+func (mbox *ctxMailbox) UpdateMessagesFlagsContext(ctx context.Context, uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	return mbox.UpdateMessagesFlags(uid, seqset, op, flags)
+}
+
+func (mbox *ctxMailbox) CopyMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, dest string) error {
+	return mbox.CopyMessages(uid, seqset, dest)
+}
+
+func (mbox *ctxMailbox) ExpungeContext(ctx context.Context) error {
+	return mbox.Expunge()
+}
+
+func testServerContext(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner, be *ctxBackend) {
+	be = &ctxBackend{
+		Backend:  memory.New(),
+		contexts: make(chan context.Context, 1),
+		release:  make(chan struct{}),
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s = server.New(be)
+	s.AllowInsecureAuth = true
+	go s.Serve(l)
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	scanner = bufio.NewScanner(c)
+
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan() // OK response
+	return s, c, scanner, be
+}
+
+func TestContext_CommandCompleted(t *testing.T) {
+	s, c, scanner, be := testServerContext(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a001 ") {
+			break
+		}
+	}
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	ctx := <-be.contexts
+	if err := ctx.Err(); err != context.Canceled {
+		t.Errorf("Expected the command context to be cancelled, got: %v", err)
+	}
+}
+
+func TestContext_ServerClosed(t *testing.T) {
+	s, c, scanner, be := testServerContext(t)
+	defer c.Close()
+
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a001 ") {
+			break
+		}
+	}
+	<-be.contexts
+
+	io.WriteString(c, "a002 UID SEARCH ALL\r\n")
+	ctx := <-be.contexts
+	if err := ctx.Err(); err != nil {
+		t.Fatal("Expected the command context not to be cancelled yet, got:", err)
+	}
+
+	s.Close()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the command context to be cancelled when the server is closed")
+	}
+}
@@ -12,7 +12,13 @@ import (
 )
 
 func testServerGreeted(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner) {
-	s, c = testServer(t)
+	return testServerGreetedConfig(t, nil)
+}
+
+// testServerGreetedConfig is like testServerGreeted, but calls configure before
+// the server starts serving connections.
+func testServerGreetedConfig(t *testing.T, configure func(s *server.Server)) (s *server.Server, c net.Conn, scanner *bufio.Scanner) {
+	s, c = testServerConfig(t, configure)
 	scanner = bufio.NewScanner(c)
 
 	scanner.Scan() // Greeting
@@ -1,10 +1,12 @@
 package server
 
 import (
+	"context"
 	"errors"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
 	"github.com/emersion/go-imap/commands"
 	"github.com/emersion/go-imap/responses"
 )
@@ -19,32 +21,64 @@ type Select struct {
 }
 
 func (cmd *Select) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Select) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
 
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	// If the command fails, no mailbox is selected anymore
+	if ctx.Mailbox != nil {
+		ctx.Mailbox = nil
+		ctx.MailboxReadOnly = false
+		conn.Server().updateMboxListener(conn, ctx.User.Username(), "")
+		conn.mailboxView().reset(nil, nil)
+	}
+
+	mbox, err := backendutil.GetMailbox(cmdCtx, ctx.User, cmd.Mailbox)
 	if err != nil {
 		return err
 	}
 
+	if mbox, ok := mbox.(backend.SelectMailbox); ok {
+		if err := mbox.Select(cmd.ReadOnly); err != nil {
+			return err
+		}
+	}
+
 	items := []imap.StatusItem{
 		imap.StatusMessages, imap.StatusRecent, imap.StatusUnseen,
 		imap.StatusUidNext, imap.StatusUidValidity,
 	}
 
-	status, err := mbox.Status(items)
+	status, err := backendutil.Status(cmdCtx, mbox, items)
 	if err != nil {
 		return err
 	}
 
-	ctx.Mailbox = mbox
-	ctx.MailboxReadOnly = cmd.ReadOnly || status.ReadOnly
 	// Update Mbox listener
 	s := conn.Server()
 	s.updateMboxListener(conn, ctx.User.Username(), mbox.Name())
 
+	// If the backend sends updates, keep track of sequence numbers. Updates
+	// received from now on are applied to the snapshot.
+	if s.Updates != nil {
+		all, _ := imap.ParseSeqSet("1:*")
+		uids, err := listUids(cmdCtx, mbox, all)
+		if err != nil {
+			s.updateMboxListener(conn, ctx.User.Username(), "")
+			return err
+		}
+		conn.mailboxView().reset(mbox, uids)
+		status.Messages = uint32(len(uids))
+	}
+
+	ctx.Mailbox = mbox
+	ctx.MailboxReadOnly = cmd.ReadOnly || status.ReadOnly
+
 	res := &responses.Select{Mailbox: status}
 	if err := conn.WriteResp(res); err != nil {
 		return err
@@ -65,12 +99,16 @@ type Create struct {
 }
 
 func (cmd *Create) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Create) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
 
-	return ctx.User.CreateMailbox(cmd.Mailbox)
+	return backendutil.CreateMailbox(cmdCtx, ctx.User, cmd.Mailbox)
 }
 
 type Delete struct {
@@ -78,12 +116,16 @@ type Delete struct {
 }
 
 func (cmd *Delete) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Delete) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
 
-	return ctx.User.DeleteMailbox(cmd.Mailbox)
+	return backendutil.DeleteMailbox(cmdCtx, ctx.User, cmd.Mailbox)
 }
 
 type Rename struct {
@@ -91,12 +133,16 @@ type Rename struct {
 }
 
 func (cmd *Rename) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Rename) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
 
-	return ctx.User.RenameMailbox(cmd.Existing, cmd.New)
+	return backendutil.RenameMailbox(cmdCtx, ctx.User, cmd.Existing, cmd.New)
 }
 
 type Subscribe struct {
@@ -104,17 +150,21 @@ type Subscribe struct {
 }
 
 func (cmd *Subscribe) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Subscribe) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
 
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	mbox, err := backendutil.GetMailbox(cmdCtx, ctx.User, cmd.Mailbox)
 	if err != nil {
 		return err
 	}
 
-	return mbox.SetSubscribed(true)
+	return backendutil.SetSubscribed(cmdCtx, mbox, true)
 }
 
 type Unsubscribe struct {
@@ -122,17 +172,21 @@ type Unsubscribe struct {
 }
 
 func (cmd *Unsubscribe) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Unsubscribe) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
 
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	mbox, err := backendutil.GetMailbox(cmdCtx, ctx.User, cmd.Mailbox)
 	if err != nil {
 		return err
 	}
 
-	return mbox.SetSubscribed(false)
+	return backendutil.SetSubscribed(cmdCtx, mbox, false)
 }
 
 type List struct {
@@ -140,6 +194,10 @@ type List struct {
 }
 
 func (cmd *List) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *List) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
 		return ErrNotAuthenticated
@@ -156,7 +214,7 @@ func (cmd *List) Handle(conn Conn) error {
 		}
 	})()
 
-	mailboxes, err := ctx.User.ListMailboxes(cmd.Subscribed)
+	mailboxes, err := backendutil.ListMailboxes(cmdCtx, ctx.User, cmd.Subscribed)
 	if err != nil {
 		// Close channel to signal end of results
 		close(ch)
@@ -198,17 +256,21 @@ type Status struct {
 }
 
 func (cmd *Status) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Status) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
 
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	mbox, err := backendutil.GetMailbox(cmdCtx, ctx.User, cmd.Mailbox)
 	if err != nil {
 		return err
 	}
 
-	status, err := mbox.Status(cmd.Items)
+	status, err := backendutil.Status(cmdCtx, mbox, cmd.Items)
 	if err != nil {
 		return err
 	}
@@ -229,12 +291,16 @@ type Append struct {
 }
 
 func (cmd *Append) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Append) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
 
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	mbox, err := backendutil.GetMailbox(cmdCtx, ctx.User, cmd.Mailbox)
 	if err == backend.ErrNoSuchMailbox {
 		return ErrStatusResp(&imap.StatusResp{
 			Type: imap.StatusRespNo,
@@ -245,14 +311,14 @@ func (cmd *Append) Handle(conn Conn) error {
 		return err
 	}
 
-	if err := mbox.CreateMessage(cmd.Flags, cmd.Date, cmd.Message); err != nil {
+	if err := backendutil.CreateMessage(cmdCtx, mbox, cmd.Flags, cmd.Date, cmd.Message); err != nil {
 		return err
 	}
 
 	// If APPEND targets the currently selected mailbox, send an untagged EXISTS
 	// Do this only if the backend doesn't send updates itself
 	if conn.Server().Updates == nil && ctx.Mailbox != nil && ctx.Mailbox.Name() == mbox.Name() {
-		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+		status, err := backendutil.Status(cmdCtx, mbox, []imap.StatusItem{imap.StatusMessages})
 		if err != nil {
 			return err
 		}
@@ -87,6 +87,70 @@ func TestSelect_ReadOnly(t *testing.T) {
 	}
 }
 
+func TestSelect_Recent(t *testing.T) {
+	s, c1, scanner1 := testServerAuthenticated(t)
+	defer s.Close()
+	defer c1.Close()
+
+	c2, err := net.Dial("tcp", c1.RemoteAddr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan() // Greeting
+	io.WriteString(c2, "b000 LOGIN username password\r\n")
+	scanner2.Scan()
+
+	// readUntil returns the responses to a command
+	readUntil := func(scanner *bufio.Scanner, tag string) []string {
+		var lines []string
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+			if strings.HasPrefix(scanner.Text(), tag+" ") {
+				break
+			}
+		}
+		return lines
+	}
+	hasLine := func(lines []string, prefix, substr string) bool {
+		for _, line := range lines {
+			if strings.HasPrefix(line, prefix) && strings.Contains(line, substr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	io.WriteString(c1, "a001 APPEND INBOX {11+}\r\nHi there :)\r\n")
+	readUntil(scanner1, "a001")
+
+	// Both sessions select the mailbox before fetching messages, only the
+	// first one gets the \Recent flag
+	io.WriteString(c1, "a002 SELECT INBOX\r\n")
+	if lines := readUntil(scanner1, "a002"); !hasLine(lines, "* 1 RECENT", "") {
+		t.Errorf("Expected 1 recent message in the first session, got %v", lines)
+	}
+	io.WriteString(c2, "b001 SELECT INBOX\r\n")
+	if lines := readUntil(scanner2, "b001"); !hasLine(lines, "* 0 RECENT", "") {
+		t.Errorf("Expected no recent message in the second session, got %v", lines)
+	}
+
+	// Flag updates sent to the first session keep \Recent
+	io.WriteString(c2, "b002 UID STORE 1:* +FLAGS.SILENT (\\Flagged)\r\n")
+	if lines := readUntil(scanner2, "b002"); hasLine(lines, "*", "\\Recent") {
+		t.Errorf("Expected no \\Recent flag in the second session, got %v", lines)
+	}
+	io.WriteString(c1, "a003 NOOP\r\n")
+	lines := readUntil(scanner1, "a003")
+	if !hasLine(lines, "* 2 FETCH ", "\\Recent") {
+		t.Errorf("Expected the \\Recent flag in the update of the new message, got %v", lines)
+	}
+	if hasLine(lines, "* 1 FETCH ", "\\Recent") {
+		t.Errorf("Expected no \\Recent flag in the update of the old message, got %v", lines)
+	}
+}
+
 func TestSelect_InvalidMailbox(t *testing.T) {
 	s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -464,6 +528,31 @@ func TestStatus(t *testing.T) {
 	}
 }
 
+func TestStatus_SizeAndMailboxId(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 STATUS INBOX (SIZE MAILBOXID)\r\n")
+
+	scanner.Scan()
+	line := scanner.Text()
+	if !strings.HasPrefix(line, "* STATUS INBOX (") {
+		t.Fatal("Invalid STATUS response:", line)
+	}
+	parts := []string{"SIZE 205", "MAILBOXID ("}
+	for _, p := range parts {
+		if !strings.Contains(line, p) {
+			t.Fatal("Invalid STATUS response:", line)
+		}
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
 func TestStatus_InvalidMailbox(t *testing.T) {
 	s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
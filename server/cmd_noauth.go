@@ -1,11 +1,14 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
 	"github.com/emersion/go-imap/commands"
 	"github.com/emersion/go-imap/responses"
 	"github.com/emersion/go-sasl"
@@ -89,6 +92,10 @@ type Login struct {
 }
 
 func (cmd *Login) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Login) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.State != imap.NotAuthenticatedState {
 		return ErrAlreadyAuthenticated
@@ -97,17 +104,51 @@ func (cmd *Login) Handle(conn Conn) error {
 		return ErrAuthDisabled
 	}
 
-	user, err := conn.Server().Backend.Login(conn.Info(), cmd.Username, cmd.Password)
+	err := authenticate(cmdCtx, conn, cmd.Username, cmd.Password)
+	observeAuth(conn, cmd.Username, err)
+	if err != nil {
+		return err
+	}
+	return afterAuthStatus(conn)
+}
+
+// authenticate logs a user in with the backend, and sets the connection state
+// accordingly. Failed attempts and concurrent sessions are limited. Only
+// invalid credentials count as failed attempts, so that backend outages don't
+// lock users out.
+func authenticate(cmdCtx context.Context, conn Conn, username, password string) error {
+	s := conn.Server()
+	ipKey := "ip:" + remoteIP(conn.Info().RemoteAddr)
+	userKey := "user:" + username
+	if s.authThrottled(ipKey, userKey) {
+		return errAuthThrottled()
+	}
+
+	user, err := backendutil.Login(cmdCtx, s.Backend, conn.Info(), username, password)
+	if err == backend.ErrInvalidCredentials {
+		s.authFailed(ipKey, userKey)
+	}
 	if err != nil {
 		return err
 	}
+	s.authSucceeded(userKey)
+	return startSession(conn, user)
+}
+
+// startSession sets the user of a connection once authenticated.
+func startSession(conn Conn, user backend.User) error {
+	s := conn.Server()
+	if !s.acquireSession(conn, user.Username()) {
+		user.Logout()
+		return errTooManySessions()
+	}
 
+	ctx := conn.Context()
 	ctx.State = imap.AuthenticatedState
 	ctx.User = user
 	// Update Mbox listener
-	s := conn.Server()
 	s.updateMboxListener(conn, user.Username(), "")
-	return afterAuthStatus(conn)
+	return nil
 }
 
 type Authenticate struct {
@@ -123,15 +164,35 @@ func (cmd *Authenticate) Handle(conn Conn) error {
 		return ErrAuthDisabled
 	}
 
-	mechanisms := map[string]sasl.Server{}
-	for name, newSasl := range conn.Server().auths {
-		mechanisms[name] = newSasl(conn)
-	}
+	var err error
+	if conn.Server().authThrottled("ip:" + remoteIP(conn.Info().RemoteAddr)) {
+		err = errAuthThrottled()
+	} else {
+		mechanisms := map[string]sasl.Server{}
+		for name, newSasl := range conn.Server().auths {
+			mechanisms[name] = newSasl(conn)
+		}
 
-	err := cmd.Authenticate.Handle(mechanisms, conn)
+		err = cmd.Authenticate.Handle(mechanisms, conn)
+	}
+	observeAuth(conn, "", err)
 	if err != nil {
 		return err
 	}
 
 	return afterAuthStatus(conn)
 }
+
+// observeAuth reports an authentication attempt to the observer.
+func observeAuth(conn Conn, username string, err error) {
+	observer := conn.Server().Observer
+	if observer == nil {
+		return
+	}
+
+	if err != nil {
+		observer.AuthFailed(conn, username, err)
+	} else if user := conn.Context().User; user != nil {
+		observer.AuthSucceeded(conn, user.Username())
+	}
+}
@@ -15,8 +15,6 @@ import (
 )
 
 func testServerTLS(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner) {
-	s, c, scanner = testServerGreeted(t)
-
 	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
 	if err != nil {
 		t.Fatal(err)
@@ -27,8 +25,10 @@ func testServerTLS(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.S
 		Certificates:       []tls.Certificate{cert},
 	}
 
-	s.AllowInsecureAuth = false
-	s.TLSConfig = tlsConfig
+	s, c, scanner = testServerGreetedConfig(t, func(s *server.Server) {
+		s.AllowInsecureAuth = false
+		s.TLSConfig = tlsConfig
+	})
 
 	io.WriteString(c, "a001 CAPABILITY\r\n")
 	scanner.Scan()
@@ -90,6 +90,54 @@ func TestStartTLS_NotSupported(t *testing.T) {
 	}
 }
 
+func TestStartTLS_Required(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, c, scanner := testServerGreetedConfig(t, func(s *server.Server) {
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		s.RequireTLS = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO [PRIVACYREQUIRED] ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 CAPABILITY\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* CAPABILITY IMAP4rev1 LITERAL+ SASL-IR STARTTLS LOGINDISABLED" {
+		t.Fatal("Bad CAPABILITY response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a003 STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+	sc := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	if err := sc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	scanner = bufio.NewScanner(sc)
+	scanner.Scan() // CAPABILITY response
+
+	io.WriteString(sc, "a004 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a004 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
 func TestLogin_Ok(t *testing.T) {
 	s, c, scanner := testServerGreeted(t)
 	defer s.Close()
@@ -124,11 +172,12 @@ func TestLogin_AlreadyAuthenticated(t *testing.T) {
 }
 
 func TestLogin_AutoLogout(t *testing.T) {
-	s, c, scanner := testServerGreeted(t)
-	s.MinAutoLogout = 1 * time.Second
+	s, c, scanner := testServerGreetedConfig(t, func(s *server.Server) {
+		s.MinAutoLogout = 1 * time.Second
+		s.AutoLogout = 2 * time.Second
+	})
 	defer s.Close()
 	defer c.Close()
-	s.AutoLogout = 2 * time.Second
 
 	// Login
 	io.WriteString(c, "a001 LOGIN username password\r\n")
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"sort"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
 	"github.com/emersion/go-imap/commands"
 	"github.com/emersion/go-imap/responses"
 )
@@ -22,11 +26,24 @@ type UidHandler interface {
 	UidHandle(conn Conn) error
 }
 
+// A command handler that supports UIDs and accepts a context. If a UidHandler
+// is also a ContextUidHandler, UidHandleContext is called instead of UidHandle.
+type ContextUidHandler interface {
+	UidHandler
+
+	// Handle this command using UIDs for a given connection, with a context.
+	UidHandleContext(ctx context.Context, conn Conn) error
+}
+
 type Check struct {
 	commands.Check
 }
 
 func (cmd *Check) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Check) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.Mailbox == nil {
 		return ErrNoMailboxSelected
@@ -35,7 +52,7 @@ func (cmd *Check) Handle(conn Conn) error {
 		return ErrMailboxReadOnly
 	}
 
-	return ctx.Mailbox.Check()
+	return backendutil.Check(cmdCtx, ctx.Mailbox)
 }
 
 type Close struct {
@@ -43,20 +60,31 @@ type Close struct {
 }
 
 func (cmd *Close) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Close) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.Mailbox == nil {
 		return ErrNoMailboxSelected
 	}
 
 	mailbox := ctx.Mailbox
+	readOnly := ctx.MailboxReadOnly
 	ctx.Mailbox = nil
 	ctx.MailboxReadOnly = false
 	// Update Mbox listener
 	s := conn.Server()
 	s.updateMboxListener(conn, ctx.User.Username(), "")
+	conn.mailboxView().reset(nil, nil)
+
+	// Messages aren't removed if the mailbox was opened with EXAMINE
+	if readOnly {
+		return nil
+	}
 
 	// No need to send expunge updates here, since the mailbox is already unselected
-	return mailbox.Expunge()
+	return backendutil.Expunge(cmdCtx, mailbox)
 }
 
 type Expunge struct {
@@ -64,6 +92,10 @@ type Expunge struct {
 }
 
 func (cmd *Expunge) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Expunge) HandleContext(cmdCtx context.Context, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.Mailbox == nil {
 		return ErrNoMailboxSelected
@@ -81,13 +113,13 @@ func (cmd *Expunge) Handle(conn Conn) error {
 		}
 
 		var err error
-		seqnums, err = ctx.Mailbox.SearchMessages(false, criteria)
+		seqnums, err = backendutil.SearchMessages(cmdCtx, ctx.Mailbox, false, criteria)
 		if err != nil {
 			return err
 		}
 	}
 
-	if err := ctx.Mailbox.Expunge(); err != nil {
+	if err := backendutil.Expunge(cmdCtx, ctx.Mailbox); err != nil {
 		return err
 	}
 
@@ -128,13 +160,24 @@ type Search struct {
 	commands.Search
 }
 
-func (cmd *Search) handle(uid bool, conn Conn) error {
+func (cmd *Search) handle(cmdCtx context.Context, uid bool, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.Mailbox == nil {
 		return ErrNoMailboxSelected
 	}
 
-	ids, err := ctx.Mailbox.SearchMessages(uid, cmd.Criteria)
+	var ids []uint32
+	var err error
+	if view := conn.mailboxView(); view.active() {
+		criteria := view.translateCriteria(cmd.Criteria)
+		ids, err = backendutil.SearchMessages(cmdCtx, ctx.Mailbox, true, criteria)
+		if err == nil && !uid {
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			ids = view.seqNums(ids)
+		}
+	} else {
+		ids, err = backendutil.SearchMessages(cmdCtx, ctx.Mailbox, uid, cmd.Criteria)
+	}
 	if err != nil {
 		return err
 	}
@@ -144,18 +187,26 @@ func (cmd *Search) handle(uid bool, conn Conn) error {
 }
 
 func (cmd *Search) Handle(conn Conn) error {
-	return cmd.handle(false, conn)
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Search) HandleContext(ctx context.Context, conn Conn) error {
+	return cmd.handle(ctx, false, conn)
 }
 
 func (cmd *Search) UidHandle(conn Conn) error {
-	return cmd.handle(true, conn)
+	return cmd.UidHandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Search) UidHandleContext(ctx context.Context, conn Conn) error {
+	return cmd.handle(ctx, true, conn)
 }
 
 type Fetch struct {
 	commands.Fetch
 }
 
-func (cmd *Fetch) handle(uid bool, conn Conn) error {
+func (cmd *Fetch) handle(cmdCtx context.Context, uid bool, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.Mailbox == nil {
 		return ErrNoMailboxSelected
@@ -172,7 +223,12 @@ func (cmd *Fetch) handle(uid bool, conn Conn) error {
 		}
 	})()
 
-	err := ctx.Mailbox.ListMessages(uid, cmd.SeqSet, cmd.Items, ch)
+	var err error
+	if view := conn.mailboxView(); view.active() {
+		err = listMessagesView(cmdCtx, view, ctx.Mailbox, uid, cmd.SeqSet, cmd.Items, ch)
+	} else {
+		err = backendutil.ListMessages(cmdCtx, ctx.Mailbox, uid, cmd.SeqSet, cmd.Items, ch)
+	}
 	if err != nil {
 		return err
 	}
@@ -180,11 +236,62 @@ func (cmd *Fetch) handle(uid bool, conn Conn) error {
 	return <-done
 }
 
+// listMessagesView lists messages by UID, and sets their sequence numbers from
+// the mailbox snapshot. Messages unknown by the client are skipped.
+func listMessagesView(ctx context.Context, view *mailboxView, mbox backend.Mailbox, uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	hasUid := false
+	for _, item := range items {
+		if item == imap.FetchUid {
+			hasUid = true
+			break
+		}
+	}
+	if !uid {
+		seqset = view.uidSet(seqset)
+		if seqset.Empty() {
+			return nil
+		}
+	}
+	if !hasUid {
+		items = append(items[:len(items):len(items)], imap.FetchUid)
+	}
+
+	messages := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- backendutil.ListMessages(ctx, mbox, true, seqset, items, messages)
+	}()
+
+	for msg := range messages {
+		seqNum := view.seqNum(msg.Uid)
+		if seqNum == 0 {
+			continue
+		}
+		msg.SeqNum = seqNum
+		if !hasUid {
+			delete(msg.Items, imap.FetchUid)
+		}
+		ch <- msg
+	}
+
+	return <-done
+}
+
 func (cmd *Fetch) Handle(conn Conn) error {
-	return cmd.handle(false, conn)
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Fetch) HandleContext(ctx context.Context, conn Conn) error {
+	return cmd.handle(ctx, false, conn)
 }
 
 func (cmd *Fetch) UidHandle(conn Conn) error {
+	return cmd.UidHandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Fetch) UidHandleContext(ctx context.Context, conn Conn) error {
 	// Append UID to the list of requested items if it isn't already present
 	hasUid := false
 	for _, item := range cmd.Items {
@@ -197,14 +304,14 @@ func (cmd *Fetch) UidHandle(conn Conn) error {
 		cmd.Items = append(cmd.Items, "UID")
 	}
 
-	return cmd.handle(true, conn)
+	return cmd.handle(ctx, true, conn)
 }
 
 type Store struct {
 	commands.Store
 }
 
-func (cmd *Store) handle(uid bool, conn Conn) error {
+func (cmd *Store) handle(cmdCtx context.Context, uid bool, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.Mailbox == nil {
 		return ErrNoMailboxSelected
@@ -246,10 +353,20 @@ func (cmd *Store) handle(uid bool, conn Conn) error {
 	if silent {
 		srv.silentMboxListener(conn, true)
 	}
-	err = ctx.Mailbox.UpdateMessagesFlags(uid, cmd.SeqSet, op, flags)
+	// If sequence numbers are translated, UIDs are sent to the backend but
+	// must not be included in the FETCH responses
+	seqSet, seqNums := cmd.SeqSet, false
+	if view := conn.mailboxView(); view.active() && !uid {
+		seqSet, uid, seqNums = view.uidSet(seqSet), true, true
+		srv.seqNumMboxListener(conn, true)
+	}
+	err = backendutil.UpdateMessagesFlags(cmdCtx, ctx.Mailbox, uid, seqSet, op, flags)
 	if silent {
 		srv.silentMboxListener(conn, false)
 	}
+	if seqNums {
+		srv.seqNumMboxListener(conn, false)
+	}
 	if err != nil {
 		return err
 	}
@@ -264,7 +381,7 @@ func (cmd *Store) handle(uid bool, conn Conn) error {
 			inner.Items = append(inner.Items, "UID")
 		}
 
-		if err := inner.handle(uid, conn); err != nil {
+		if err := inner.handle(cmdCtx, uid, conn); err != nil {
 			return err
 		}
 	}
@@ -273,32 +390,60 @@ func (cmd *Store) handle(uid bool, conn Conn) error {
 }
 
 func (cmd *Store) Handle(conn Conn) error {
-	return cmd.handle(false, conn)
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Store) HandleContext(ctx context.Context, conn Conn) error {
+	return cmd.handle(ctx, false, conn)
 }
 
 func (cmd *Store) UidHandle(conn Conn) error {
-	return cmd.handle(true, conn)
+	return cmd.UidHandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Store) UidHandleContext(ctx context.Context, conn Conn) error {
+	return cmd.handle(ctx, true, conn)
 }
 
 type Copy struct {
 	commands.Copy
 }
 
-func (cmd *Copy) handle(uid bool, conn Conn) error {
+func (cmd *Copy) handle(cmdCtx context.Context, uid bool, conn Conn) error {
 	ctx := conn.Context()
 	if ctx.Mailbox == nil {
 		return ErrNoMailboxSelected
 	}
 
-	return ctx.Mailbox.CopyMessages(uid, cmd.SeqSet, cmd.Mailbox)
+	seqSet := cmd.SeqSet
+	if view := conn.mailboxView(); view.active() && !uid {
+		seqSet, uid = view.uidSet(seqSet), true
+	}
+	err := backendutil.CopyMessages(cmdCtx, ctx.Mailbox, uid, seqSet, cmd.Mailbox)
+	if err == backend.ErrNoSuchMailbox {
+		return ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: err.Error(),
+		})
+	}
+	return err
 }
 
 func (cmd *Copy) Handle(conn Conn) error {
-	return cmd.handle(false, conn)
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Copy) HandleContext(ctx context.Context, conn Conn) error {
+	return cmd.handle(ctx, false, conn)
 }
 
 func (cmd *Copy) UidHandle(conn Conn) error {
-	return cmd.handle(true, conn)
+	return cmd.UidHandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Copy) UidHandleContext(ctx context.Context, conn Conn) error {
+	return cmd.handle(ctx, true, conn)
 }
 
 type Uid struct {
@@ -306,6 +451,10 @@ type Uid struct {
 }
 
 func (cmd *Uid) Handle(conn Conn) error {
+	return cmd.HandleContext(conn.connContext(), conn)
+}
+
+func (cmd *Uid) HandleContext(cmdCtx context.Context, conn Conn) error {
 	inner := cmd.Cmd.Command()
 	hdlr, err := conn.commandHandler(inner)
 	if err != nil {
@@ -317,12 +466,16 @@ func (cmd *Uid) Handle(conn Conn) error {
 		return errors.New("Command unsupported with UID")
 	}
 
-	if err := uidHdlr.UidHandle(conn); err != nil {
-		return err
-	}
-
-	return ErrStatusResp(&imap.StatusResp{
-		Type: imap.StatusRespOk,
-		Info: "UID " + inner.Name + " completed",
+	res := conn.handleRequest(cmdCtx, conn, &CommandRequest{
+		Command: inner,
+		Uid:     true,
+		Handler: uidHdlr,
 	})
+	if res == nil {
+		return ErrNoStatusResp()
+	}
+	if res.Type == imap.StatusRespOk && res.Info == "" {
+		res.Info = "UID " + inner.Name + " completed"
+	}
+	return ErrStatusResp(res)
 }
@@ -247,6 +247,31 @@ func TestFetch(t *testing.T) {
 	}
 }
 
+func TestFetch_Preview(t *testing.T) {
+	s, c, scanner := testServerSelected(t, true)
+	defer s.Close()
+	defer c.Close()
+
+	// The modifier can be sent in a list of items or after a single item
+	for _, items := range []string{"(PREVIEW (LAZY))", "PREVIEW (LAZY)"} {
+		io.WriteString(c, "a001 FETCH 1 "+items+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != "* 1 FETCH (PREVIEW \"Hi there :)\")" {
+			t.Fatal("Invalid FETCH response:", scanner.Text())
+		}
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+			t.Fatal("Invalid status response:", scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "a002 FETCH 1 PREVIEW LAZY\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 BAD ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
 func TestFetch_NotSelected(t *testing.T) {
 	s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -442,11 +467,11 @@ func TestStore_RecentFlag(t *testing.T) {
 	defer c.Close()
 	defer s.Close()
 
-	// Add Recent flag
+	// Clients cannot change the Recent flag
 	io.WriteString(c, "a001 STORE 1 FLAGS \\Recent\r\n")
 
 	scanner.Scan()
-	if scanner.Text() != "* 1 FETCH (FLAGS (\\Recent))" {
+	if scanner.Text() != "* 1 FETCH (FLAGS ())" {
 		t.Fatal("Invalid FETCH response:", scanner.Text())
 	}
 
@@ -456,11 +481,10 @@ func TestStore_RecentFlag(t *testing.T) {
 	}
 
 	// Set flags to: something
-	// Should still get Recent flag back
 	io.WriteString(c, "a001 STORE 1 FLAGS something\r\n")
 
 	scanner.Scan()
-	if scanner.Text() != "* 1 FETCH (FLAGS (\\Recent something))" {
+	if scanner.Text() != "* 1 FETCH (FLAGS (something))" {
 		t.Fatal("Invalid FETCH response:", scanner.Text())
 	}
 
@@ -473,7 +497,7 @@ func TestStore_RecentFlag(t *testing.T) {
 	io.WriteString(c, "a001 STORE 1 FLAGS \\Recent anotherflag\r\n")
 
 	scanner.Scan()
-	if scanner.Text() != "* 1 FETCH (FLAGS (\\Recent anotherflag))" {
+	if scanner.Text() != "* 1 FETCH (FLAGS (anotherflag))" {
 		t.Fatal("Invalid FETCH response:", scanner.Text())
 	}
 
@@ -1,16 +1,20 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-sasl"
 )
 
 // Conn is a connection to a client.
@@ -38,9 +42,14 @@ type Conn interface {
 
 	Info() *imap.ConnInfo
 
+	connContext() context.Context
+	shutdown(reason string)
+	pushUpdate(update backend.Update)
+	mailboxView() *mailboxView
 	setTLSConn(*tls.Conn)
 	serve(Conn) error
 	commandHandler(cmd *imap.Command) (hdlr Handler, err error)
+	handleRequest(ctx context.Context, conn Conn, req *CommandRequest) *imap.StatusResp
 }
 
 // Context stores a connection's metadata.
@@ -62,14 +71,50 @@ type Context struct {
 type conn struct {
 	*imap.Conn
 
-	conn      Conn // With extensions overrides
-	s         *Server
-	ctx       *Context
-	tlsConn   *tls.Conn
+	conn    Conn // With extensions overrides
+	s       *Server
+	id      uint64
+	ctx     *Context
+	tlsConn *tls.Conn
+	// The TLS state sent by a trusted proxy terminating TLS
+	proxyTLS  *tls.ConnectionState
 	continues chan bool
 	upgrade   chan bool
 	responses chan imap.WriterTo
 	loggedOut chan struct{}
+
+	// Cancelled when the connection is closed or logged out
+	connCtx context.Context
+	cancel  context.CancelFunc
+
+	logoutOnce sync.Once
+
+	// Limits the rate of commands, nil if disabled
+	rate *rateLimiter
+
+	// Backend updates waiting to be sent
+	updates *updateQueue
+	// Snapshot of the selected mailbox
+	view mailboxView
+
+	// Pipelined commands in progress
+	pipelined sync.WaitGroup
+	// Limits the number of pipelined commands, nil if pipelining is disabled
+	pipelineSlots chan struct{}
+	// Closed once the responses of the last pipelined command have been sent
+	lastPipelined <-chan struct{}
+
+	stateLocker sync.Mutex
+	// Number of commands being handled
+	busy int
+	// Number of pipelined commands being handled
+	pipelinedCount int
+	// True while a command accepting updates is being handled
+	idle bool
+	// If not empty, the connection is shutting down with this BYE reason
+	byeReason string
+	// True once the BYE response has been sent by shutdown
+	byeSent bool
 }
 
 func newConn(s *Server, c net.Conn) *conn {
@@ -82,22 +127,35 @@ func newConn(s *Server, c net.Conn) *conn {
 	loggedOut := make(chan struct{})
 
 	tlsConn, _ := c.(*tls.Conn)
+	var proxyTLS *tls.ConnectionState
+	if pc, ok := c.(*proxyConn); ok {
+		proxyTLS = pc.tls
+	}
+	if s.Observer != nil {
+		c = &observedConn{Conn: c, observer: s.Observer}
+	}
 
 	conn := &conn{
 		Conn: imap.NewConn(c, r, w),
 
-		s: s,
+		s:  s,
+		id: atomic.AddUint64(&s.lastConnID, 1),
 		ctx: &Context{
 			State:     imap.ConnectingState,
 			Responses: responses,
 			LoggedOut: loggedOut,
 		},
 		tlsConn:   tlsConn,
+		proxyTLS:  proxyTLS,
 		continues: continues,
 		upgrade:   make(chan bool),
 		responses: responses,
 		loggedOut: loggedOut,
+		updates:   newUpdateQueue(),
+		// The greeting has not been sent yet
+		busy: 1,
 	}
+	conn.connCtx, conn.cancel = context.WithCancel(s.ctx)
 
 	if s.Debug != nil {
 		conn.Conn.SetDebug(s.Debug)
@@ -105,6 +163,15 @@ func newConn(s *Server, c net.Conn) *conn {
 	if s.MaxLiteralSize > 0 {
 		conn.Conn.MaxLiteralSize = s.MaxLiteralSize
 	}
+	if s.CommandRate > 0 {
+		conn.rate = newRateLimiter(s.CommandRate, s.CommandBurst)
+	}
+	if s.MaxPipelinedCommands > 1 {
+		conn.pipelineSlots = make(chan struct{}, s.MaxPipelinedCommands)
+		lastPipelined := make(chan struct{})
+		close(lastPipelined)
+		conn.lastPipelined = lastPipelined
+	}
 
 	go conn.send()
 
@@ -119,6 +186,10 @@ func (c *conn) Context() *Context {
 	return c.ctx
 }
 
+func (c *conn) connContext() context.Context {
+	return c.connCtx
+}
+
 type response struct {
 	response imap.WriterTo
 	done     chan struct{}
@@ -153,13 +224,126 @@ func (c *conn) WriteResp(r imap.WriterTo) error {
 }
 
 func (c *conn) Close() error {
-	if c.ctx.User != nil {
-		c.ctx.User.Logout()
-	}
+	c.cancel()
+
+	c.logoutOnce.Do(func() {
+		if c.ctx.User != nil {
+			c.ctx.User.Logout()
+		}
+	})
 
 	return c.Conn.Close()
 }
 
+// shutdown requests the connection to be closed with a BYE response. If no
+// command is in progress or if the command in progress waits for updates (such
+// as IDLE), this is done immediately. Otherwise, the connection is closed once
+// the current commands complete.
+func (c *conn) shutdown(reason string) {
+	c.stateLocker.Lock()
+	c.byeReason = reason
+	now := c.busy == 0 || c.idle
+	c.byeSent = now
+	c.stateLocker.Unlock()
+
+	if now {
+		c.bye(reason)
+	}
+}
+
+// bye sends a BYE response and closes the connection.
+func (c *conn) bye(reason string) {
+	bye := &imap.StatusResp{Type: imap.StatusRespBye, Info: reason}
+	done := make(chan struct{})
+	select {
+	case c.responses <- &response{bye, done}:
+		<-done
+	case <-c.loggedOut:
+	}
+
+	// Interrupt the pending read, serve will return
+	c.Conn.Close()
+}
+
+// setBusy marks the connection as busy before handling a command. It returns
+// false if the connection is shutting down.
+func (c *conn) setBusy() bool {
+	c.stateLocker.Lock()
+	defer c.stateLocker.Unlock()
+
+	if c.byeReason != "" {
+		return false
+	}
+	c.busy++
+	return true
+}
+
+// setIdle marks a command as handled. It returns the BYE reason if the
+// connection is shutting down, no command is in progress anymore and the BYE
+// response hasn't been sent yet.
+func (c *conn) setIdle() string {
+	c.stateLocker.Lock()
+	c.busy--
+	var reason string
+	if c.busy == 0 && !c.byeSent {
+		reason = c.byeReason
+	}
+	c.stateLocker.Unlock()
+
+	// Send the updates received since the command completed
+	c.updates.signal()
+	return reason
+}
+
+// setIdleCommand sets whether the command being handled accepts updates.
+func (c *conn) setIdleCommand(idle bool) {
+	c.stateLocker.Lock()
+	c.idle = idle
+	c.stateLocker.Unlock()
+
+	if idle {
+		c.updates.signal()
+	}
+}
+
+// pushUpdate queues a backend update. If too many updates are queued, the
+// connection is closed.
+func (c *conn) pushUpdate(update backend.Update) {
+	if c.updates.push(update, c.s.MaxQueuedUpdates) {
+		go c.shutdown("Too many pending updates")
+	}
+}
+
+// pendingUpdates returns the queued updates which can be sent now, or nil if
+// updates cannot be sent while the current command is handled.
+func (c *conn) pendingUpdates() *pendingUpdates {
+	c.stateLocker.Lock()
+	defer c.stateLocker.Unlock()
+
+	switch {
+	case c.idle:
+		return c.newPendingUpdates(true)
+	case c.busy > 0:
+		return nil
+	default:
+		// EXPUNGE responses cannot be sent when no command is in progress
+		return c.newPendingUpdates(false)
+	}
+}
+
+func (c *conn) newPendingUpdates(expunge bool) *pendingUpdates {
+	return &pendingUpdates{
+		queue:   c.updates,
+		view:    &c.view,
+		ctx:     c.connCtx,
+		expunge: expunge,
+	}
+}
+
+func (c *conn) mailboxView() *mailboxView {
+	return &c.view
+}
+
 func (c *conn) Capabilities() []string {
 	caps := []string{"IMAP4rev1", "LITERAL+", "SASL-IR"}
 
@@ -172,11 +356,21 @@ func (c *conn) Capabilities() []string {
 			caps = append(caps, "LOGINDISABLED")
 		} else {
 			for name := range c.s.auths {
+				if name == sasl.External && !canAuthExternal(c.conn) {
+					continue
+				}
 				caps = append(caps, "AUTH="+name)
 			}
 		}
 	}
 
+	// Backend capabilities are only relevant once the client is authenticated
+	if c.ctx.State&imap.AuthenticatedState != 0 {
+		if be, ok := c.s.Backend.(backend.ExtendedBackend); ok {
+			caps = append(caps, be.Capabilities()...)
+		}
+	}
+
 	for _, ext := range c.s.extensions {
 		caps = append(caps, ext.Capabilities(c)...)
 	}
@@ -211,6 +405,16 @@ func (c *conn) send() {
 			// Request to send the response
 			if err := c.writeAndFlush(res); err != nil {
 				c.Server().ErrorLog.Println("cannot send response: ", err)
+				// The client is likely gone, abort the current command
+				c.cancel()
+			}
+		case <-c.updates.notify:
+			// Send backend updates, if allowed
+			if res := c.pendingUpdates(); res != nil {
+				if err := c.writeAndFlush(res); err != nil {
+					c.Server().ErrorLog.Println("cannot send updates: ", err)
+					c.cancel()
+				}
 			}
 		case <-c.loggedOut:
 			return
@@ -241,8 +445,17 @@ func (c *conn) setTLSConn(tlsConn *tls.Conn) {
 	c.tlsConn = tlsConn
 }
 
+func (c *conn) Info() *imap.ConnInfo {
+	info := c.Conn.Info()
+	if info.TLS == nil {
+		// The underlying connection may be wrapped
+		info.TLS = c.TLSState()
+	}
+	return info
+}
+
 func (c *conn) IsTLS() bool {
-	return c.tlsConn != nil
+	return c.tlsConn != nil || c.proxyTLS != nil
 }
 
 func (c *conn) TLSState() *tls.ConnectionState {
@@ -250,12 +463,31 @@ func (c *conn) TLSState() *tls.ConnectionState {
 		state := c.tlsConn.ConnectionState()
 		return &state
 	}
+	if c.proxyTLS != nil {
+		state := *c.proxyTLS
+		return &state
+	}
 	return nil
 }
 
 // canAuth checks if the client can use plain text authentication.
 func (c *conn) canAuth() bool {
-	return c.IsTLS() || c.s.AllowInsecureAuth
+	return c.IsTLS() || (c.s.AllowInsecureAuth && !c.s.RequireTLS)
+}
+
+// requiresTLS checks whether a command is rejected because the server requires
+// TLS.
+func (c *conn) requiresTLS(cmd *imap.Command) bool {
+	if !c.s.RequireTLS || c.conn.IsTLS() {
+		return false
+	}
+
+	switch cmd.Name {
+	case "CAPABILITY", "NOOP", "LOGOUT", "STARTTLS":
+		return false
+	default:
+		return true
+	}
 }
 
 func (c *conn) serve(conn Conn) (err error) {
@@ -263,10 +495,14 @@ func (c *conn) serve(conn Conn) (err error) {
 
 	defer func() {
 		c.ctx.State = imap.LogoutState
+		c.cancel()
 		c.s.updateMboxListener(c, "", "")
 		close(c.loggedOut)
 	}()
 
+	// Pipelined commands may still be sending responses
+	defer c.waitPipelined()
+
 	defer func() {
 		if r := recover(); r != nil {
 			c.WriteResp(&imap.StatusResp{
@@ -291,10 +527,24 @@ func (c *conn) serve(conn Conn) (err error) {
 			return nil
 		}
 
+		if reason := c.setIdle(); reason != "" {
+			return c.WriteResp(&imap.StatusResp{
+				Type: imap.StatusRespBye,
+				Info: reason,
+			})
+		}
+
 		var res *imap.StatusResp
 		var up Upgrader
+		expunge := true
+		// The command reported to the observer and the command logger, if any
+		var started *startedCommand
 
 		fields, err := c.ReadLine()
+		if !c.setBusy() {
+			// The server is shutting down and has closed the connection
+			return nil
+		}
 		if err == io.EOF || c.ctx.State == imap.LogoutState {
 			return nil
 		}
@@ -312,28 +562,61 @@ func (c *conn) serve(conn Conn) (err error) {
 			}
 		} else {
 			cmd := &imap.Command{}
-			if err := cmd.Parse(fields); err != nil {
+			err := cmd.Parse(fields)
+			if err == nil {
+				started = c.commandStarted(cmd)
+			}
+
+			if err != nil {
 				res = &imap.StatusResp{
 					Tag:  cmd.Tag,
 					Type: imap.StatusRespBad,
 					Info: err.Error(),
 				}
-			} else {
-				var err error
-				res, up, err = c.handleCommand(cmd)
-				if err != nil {
-					res = &imap.StatusResp{
-						Tag:  cmd.Tag,
-						Type: imap.StatusRespBad,
-						Info: err.Error(),
-					}
+			} else if c.rate != nil && !c.rate.allow() {
+				res = &imap.StatusResp{
+					Tag:  cmd.Tag,
+					Type: imap.StatusRespNo,
+					Code: imap.CodeLimit,
+					Info: "Too many commands, slow down",
+				}
+			} else if c.requiresTLS(cmd) {
+				res = &imap.StatusResp{
+					Tag:  cmd.Tag,
+					Type: imap.StatusRespNo,
+					Code: imap.CodePrivacyRequired,
+					Info: "TLS is required, use STARTTLS first",
+				}
+			} else if hdlr, err := c.commandHandler(cmd); err != nil {
+				res = &imap.StatusResp{
+					Tag:  cmd.Tag,
+					Type: imap.StatusRespBad,
+					Info: err.Error(),
 				}
+			} else if c.canPipeline(cmd, hdlr) {
+				c.handlePipelined(cmd, hdlr, started)
+				continue
+			} else {
+				expunge = !holdsExpunges(cmd)
+
+				c.waitPipelined()
+				res, up = c.handleCommand(c.conn, cmd, hdlr)
 			}
 		}
 
-		if res != nil {
+		// Responses are sent in the order commands have been received
+		c.waitPipelined()
 
-			if err := c.WriteResp(res); err != nil {
+		// Send queued backend updates before completing the command, EXPUNGE
+		// responses are held back after FETCH, STORE and SEARCH
+		c.WriteResp(c.newPendingUpdates(expunge))
+
+		if res == nil {
+			c.commandCompleted(started, res)
+		} else {
+			err := c.WriteResp(res)
+			c.commandCompleted(started, res)
+			if err != nil {
 				c.s.ErrorLog.Println("cannot write response:", err)
 				continue
 			}
@@ -348,6 +631,17 @@ func (c *conn) serve(conn Conn) (err error) {
 	}
 }
 
+// holdsExpunges checks whether EXPUNGE responses cannot be sent while
+// responding to a command (RFC 3501 section 7.4.1).
+func holdsExpunges(cmd *imap.Command) bool {
+	switch cmd.Name {
+	case "FETCH", "STORE", "SEARCH":
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *conn) WaitReady() {
 	c.upgrade <- true
 	c.Conn.WaitReady()
@@ -365,25 +659,20 @@ func (c *conn) commandHandler(cmd *imap.Command) (hdlr Handler, err error) {
 	return
 }
 
-func (c *conn) handleCommand(cmd *imap.Command) (res *imap.StatusResp, up Upgrader, err error) {
-	hdlr, err := c.commandHandler(cmd)
-	if err != nil {
-		return
+func (c *conn) handleCommand(conn Conn, cmd *imap.Command, hdlr Handler) (res *imap.StatusResp, up Upgrader) {
+	if idleHdlr, ok := hdlr.(IdleHandler); ok && idleHdlr.Idle() {
+		c.setIdleCommand(true)
+		defer c.setIdleCommand(false)
 	}
 
-	hdlrErr := hdlr.Handle(c.conn)
-	if statusErr, ok := hdlrErr.(*errStatusResp); ok {
-		res = statusErr.resp
-	} else if hdlrErr != nil {
-		res = &imap.StatusResp{
-			Type: imap.StatusRespNo,
-			Info: hdlrErr.Error(),
-		}
+	ctx, cancel := context.WithCancel(c.connCtx)
+	if _, ok := hdlr.(*Uid); ok {
+		// Middlewares are applied to the inner command
+		res = callHandler(ctx, conn, &CommandRequest{Command: cmd, Handler: hdlr})
 	} else {
-		res = &imap.StatusResp{
-			Type: imap.StatusRespOk,
-		}
+		res = c.handleRequest(ctx, conn, &CommandRequest{Command: cmd, Handler: hdlr})
 	}
+	cancel()
 
 	if res != nil {
 		res.Tag = cmd.Tag
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// externalServer is the server side of the EXTERNAL SASL mechanism (RFC 4422
+// appendix A): the client is authenticated by the TLS layer, and sends the
+// identity it requests to act as.
+type externalServer struct {
+	authenticate func(identity string) error
+	challenged   bool
+}
+
+func (a *externalServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if response == nil && !a.challenged {
+		// No initial response, ask for the identity
+		a.challenged = true
+		return []byte{}, false, nil
+	}
+	return nil, true, a.authenticate(string(response))
+}
+
+// canAuthExternal checks if the client can authenticate with its TLS client
+// certificate. The TLS state sent by a trusted proxy never contains
+// certificates, so clients connected through a proxy cannot use EXTERNAL.
+func canAuthExternal(conn Conn) bool {
+	if _, ok := conn.Server().Backend.(backend.CertificateBackend); !ok {
+		return false
+	}
+	state := conn.TLSState()
+	return state != nil && len(state.VerifiedChains) > 0
+}
+
+// authenticateCertificate logs a user in with the TLS client certificate of
+// the connection.
+func authenticateCertificate(cmdCtx context.Context, conn Conn, identity string) error {
+	if !canAuthExternal(conn) {
+		return errors.New("No verified TLS client certificate")
+	}
+
+	s := conn.Server()
+	ipKey := "ip:" + remoteIP(conn.Info().RemoteAddr)
+	user, err := backendutil.LoginCertificate(cmdCtx, s.Backend.(backend.CertificateBackend), conn.Info(), identity)
+	if err == backend.ErrInvalidCredentials {
+		s.authFailed(ipKey)
+	}
+	if err != nil {
+		return err
+	}
+	return startSession(conn, user)
+}
@@ -0,0 +1,146 @@
+package server_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/backendtest"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/internal"
+	"github.com/emersion/go-imap/server"
+)
+
+// testClientCert creates a self-signed client certificate.
+func testClientCert(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func testServerExternal(t *testing.T, clientCerts ...tls.Certificate) (c net.Conn, scanner *bufio.Scanner) {
+	serverCert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range clientCerts {
+		pool.AddCert(cert.Leaf)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	l = tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+	})
+
+	s := server.New(backendtest.CertificateBackend{Backend: memory.New()})
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	c, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       clientCerts,
+	})
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	scanner = bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	return c, scanner
+}
+
+func TestAuthenticate_External(t *testing.T) {
+	c, scanner := testServerExternal(t, testClientCert(t, "username"))
+
+	io.WriteString(c, "a001 CAPABILITY\r\n")
+	scanner.Scan()
+	if !strings.Contains(scanner.Text()+" ", " AUTH=EXTERNAL ") {
+		t.Fatal("Expected EXTERNAL to be advertised, got:", scanner.Text())
+	}
+	scanner.Scan()
+
+	io.WriteString(c, "a002 AUTHENTICATE EXTERNAL\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "+") {
+		t.Fatal("Bad continuation request:", scanner.Text())
+	}
+	io.WriteString(c, "\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_ExternalIdentity(t *testing.T) {
+	c, scanner := testServerExternal(t, testClientCert(t, "username"))
+
+	// "someone"
+	io.WriteString(c, "a001 AUTHENTICATE EXTERNAL c29tZW9uZQ==\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	// "username"
+	io.WriteString(c, "a002 AUTHENTICATE EXTERNAL dXNlcm5hbWU=\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_ExternalNoCertificate(t *testing.T) {
+	c, scanner := testServerExternal(t)
+
+	io.WriteString(c, "a001 CAPABILITY\r\n")
+	scanner.Scan()
+	if strings.Contains(scanner.Text(), "AUTH=EXTERNAL") {
+		t.Fatal("Expected EXTERNAL not to be advertised, got:", scanner.Text())
+	}
+	scanner.Scan()
+
+	io.WriteString(c, "a002 AUTHENTICATE EXTERNAL =\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
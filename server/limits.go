@@ -0,0 +1,281 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// rejectTimeout is the maximum duration spent sending a BYE response to a
+// connection refused because of connection limits.
+const rejectTimeout = 5 * time.Second
+
+// maxAuthFailureKeys is the number of IP addresses and usernames with failed
+// authentication attempts above which expired entries are removed.
+const maxAuthFailureKeys = 10000
+
+// The status responses are modified when sent, a new error is created each
+// time.
+
+func errAuthThrottled() error {
+	return ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: imap.CodeUnavailable,
+		Info: "Too many failed authentication attempts, try again later",
+	})
+}
+
+func errTooManySessions() error {
+	return ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: imap.CodeLimit,
+		Info: "Too many sessions for this user",
+	})
+}
+
+type authFailures struct {
+	count int
+	last  time.Time
+}
+
+// limiter keeps track of connections, sessions and failed authentication
+// attempts to enforce the server limits. It has its own lock, so that it can be
+// used while the server lock is held.
+type limiter struct {
+	locker   sync.Mutex
+	conns    int
+	ips      map[string]int
+	sessions map[string]int
+	users    map[Conn]string
+	failures map[string]*authFailures
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		ips:      make(map[string]int),
+		sessions: make(map[string]int),
+		users:    make(map[Conn]string),
+		failures: make(map[string]*authFailures),
+	}
+}
+
+// remoteIP returns the IP address of a remote network address, or the whole
+// address if it doesn't contain one.
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// acquireConn registers a new connection from an IP address. It returns false
+// if the connection exceeds MaxConns or MaxConnsPerIP.
+func (s *Server) acquireConn(ip string) bool {
+	l := s.limits
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	if s.MaxConns > 0 && l.conns >= s.MaxConns {
+		return false
+	}
+	if s.MaxConnsPerIP > 0 && l.ips[ip] >= s.MaxConnsPerIP {
+		return false
+	}
+	l.conns++
+	l.ips[ip]++
+	return true
+}
+
+func (s *Server) releaseConn(ip string) {
+	l := s.limits
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	l.conns--
+	if l.ips[ip]--; l.ips[ip] <= 0 {
+		delete(l.ips, ip)
+	}
+}
+
+// rejectConn sends a BYE response to a connection refused because of
+// connection limits, and closes it.
+func (s *Server) rejectConn(c net.Conn) {
+	defer c.Close()
+
+	c.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	w := imap.NewWriter(c)
+	bye := &imap.StatusResp{
+		Type: imap.StatusRespBye,
+		Code: imap.CodeUnavailable,
+		Info: "Too many connections",
+	}
+	if err := bye.WriteTo(w); err == nil {
+		w.Flush()
+	}
+}
+
+// acquireSession registers a session of a user for a connection. It returns
+// false if the user has already MaxUserSessions sessions.
+func (s *Server) acquireSession(conn Conn, username string) bool {
+	l := s.limits
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	if s.MaxUserSessions > 0 && l.sessions[username] >= s.MaxUserSessions {
+		return false
+	}
+	l.sessions[username]++
+	l.users[conn] = username
+	return true
+}
+
+// releaseSession unregisters the session of a connection, if any.
+func (s *Server) releaseSession(conn Conn) {
+	l := s.limits
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	username, ok := l.users[conn]
+	if !ok {
+		return
+	}
+	delete(l.users, conn)
+	if l.sessions[username]--; l.sessions[username] <= 0 {
+		delete(l.sessions, username)
+	}
+}
+
+// authBackoff returns the delay during which authentication attempts are
+// rejected after a number of consecutive failures.
+func (s *Server) authBackoff(failures int) time.Duration {
+	if s.MaxAuthFailures <= 0 || failures < s.MaxAuthFailures {
+		return 0
+	}
+
+	backoff := s.AuthBackoff
+	for i := s.MaxAuthFailures; i < failures; i++ {
+		backoff *= 2
+		if backoff >= s.MaxAuthBackoff {
+			break
+		}
+	}
+	if backoff > s.MaxAuthBackoff {
+		backoff = s.MaxAuthBackoff
+	}
+	return backoff
+}
+
+// authThrottled checks whether authentication attempts are rejected for any of
+// the keys.
+func (s *Server) authThrottled(keys ...string) bool {
+	if s.MaxAuthFailures <= 0 {
+		return false
+	}
+
+	l := s.limits
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	now := time.Now()
+	for _, k := range keys {
+		f, ok := l.failures[k]
+		if !ok {
+			continue
+		}
+		if now.Sub(f.last) > s.MaxAuthBackoff {
+			// Failures are forgotten after a while
+			delete(l.failures, k)
+			continue
+		}
+		if now.Before(f.last.Add(s.authBackoff(f.count))) {
+			return true
+		}
+	}
+	return false
+}
+
+// authFailed records a failed authentication attempt for each key.
+func (s *Server) authFailed(keys ...string) {
+	if s.MaxAuthFailures <= 0 {
+		return
+	}
+
+	l := s.limits
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	now := time.Now()
+	if len(l.failures) >= maxAuthFailureKeys {
+		for k, f := range l.failures {
+			if now.Sub(f.last) > s.MaxAuthBackoff {
+				delete(l.failures, k)
+			}
+		}
+	}
+
+	for _, k := range keys {
+		f, ok := l.failures[k]
+		if !ok || now.Sub(f.last) > s.MaxAuthBackoff {
+			f = &authFailures{}
+			l.failures[k] = f
+		}
+		f.count++
+		f.last = now
+	}
+}
+
+// authSucceeded forgets the failed authentication attempts for a key.
+func (s *Server) authSucceeded(key string) {
+	l := s.limits
+	l.locker.Lock()
+	delete(l.failures, key)
+	l.locker.Unlock()
+}
+
+// rateLimiter is a token bucket limiting the number of commands sent by a
+// connection.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow consumes a token, if one is available.
+func (l *rateLimiter) allow() bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
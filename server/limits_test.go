@@ -0,0 +1,178 @@
+package server_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+func testServerLimits(t *testing.T, configure func(s *server.Server)) (s *server.Server, addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s = server.New(memory.New())
+	s.AllowInsecureAuth = true
+	configure(s)
+	go s.Serve(l)
+
+	return s, l.Addr().String()
+}
+
+func dialLimits(t *testing.T, addr string) (c net.Conn, scanner *bufio.Scanner) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	scanner = bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	return c, scanner
+}
+
+func TestServer_MaxConnsPerIP(t *testing.T) {
+	s, addr := testServerLimits(t, func(s *server.Server) {
+		s.MaxConnsPerIP = 1
+	})
+	defer s.Close()
+
+	_, scanner := dialLimits(t, addr)
+	if !strings.HasPrefix(scanner.Text(), "* OK ") {
+		t.Fatal("Bad greeting:", scanner.Text())
+	}
+
+	_, scanner = dialLimits(t, addr)
+	if scanner.Text() != "* BYE [UNAVAILABLE] Too many connections" {
+		t.Fatal("Bad BYE response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected the connection to be closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_MaxUserSessions(t *testing.T) {
+	s, addr := testServerLimits(t, func(s *server.Server) {
+		s.MaxUserSessions = 1
+	})
+	defer s.Close()
+
+	c, scanner := dialLimits(t, addr)
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	c, scanner = dialLimits(t, addr)
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if scanner.Text() != "a001 NO [LIMIT] Too many sessions for this user" {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestServer_AuthThrottle(t *testing.T) {
+	s, addr := testServerLimits(t, func(s *server.Server) {
+		s.MaxAuthFailures = 2
+		s.AuthBackoff = time.Hour
+	})
+	defer s.Close()
+
+	c, scanner := dialLimits(t, addr)
+	for _, tag := range []string{"a001", "a002"} {
+		io.WriteString(c, tag+" LOGIN username wrongpassword\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tag+" NO ") {
+			t.Fatal("Bad status response:", scanner.Text())
+		}
+	}
+
+	// Valid credentials are rejected too, from any connection
+	c, scanner = dialLimits(t, addr)
+	io.WriteString(c, "a003 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 NO [UNAVAILABLE] ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+	io.WriteString(c, "a004 AUTHENTICATE PLAIN\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a004 NO [UNAVAILABLE] ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+// unavailableBackend fails to log users in while unavailable is set.
+type unavailableBackend struct {
+	*memory.Backend
+	unavailable atomic.Bool
+}
+
+func (be *unavailableBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	if be.unavailable.Load() {
+		return nil, errors.New("Backend unavailable")
+	}
+	return be.Backend.Login(connInfo, username, password)
+}
+
+func TestServer_AuthThrottle_BackendError(t *testing.T) {
+	be := &unavailableBackend{Backend: memory.New()}
+	be.unavailable.Store(true)
+	s, addr := testServerLimits(t, func(s *server.Server) {
+		s.Backend = be
+		s.MaxAuthFailures = 2
+		s.AuthBackoff = time.Hour
+	})
+	defer s.Close()
+
+	c, scanner := dialLimits(t, addr)
+	for _, tag := range []string{"a001", "a002", "a003"} {
+		io.WriteString(c, tag+" LOGIN username password\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tag+" NO ") || strings.Contains(scanner.Text(), "[UNAVAILABLE]") {
+			t.Fatal("Bad status response:", scanner.Text())
+		}
+	}
+
+	// Backend errors aren't counted as failed attempts
+	be.unavailable.Store(false)
+	io.WriteString(c, "a004 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a004 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestServer_CommandRate(t *testing.T) {
+	s, addr := testServerLimits(t, func(s *server.Server) {
+		s.CommandRate = 0.001
+		s.CommandBurst = 2
+	})
+	defer s.Close()
+
+	c, scanner := dialLimits(t, addr)
+	for _, tag := range []string{"a001", "a002"} {
+		io.WriteString(c, tag+" NOOP\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tag+" OK ") {
+			t.Fatal("Bad status response:", scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "a003 NOOP\r\n")
+	scanner.Scan()
+	if scanner.Text() != "a003 NO [LIMIT] Too many commands, slow down" {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// redacted replaces credentials in logged command arguments.
+const redacted = "***"
+
+// CommandEvent describes a command handled by the server.
+type CommandEvent struct {
+	// A number identifying the connection, unique for the server.
+	ConnID     uint64
+	RemoteAddr net.Addr
+	// The logged in user and the selected mailbox once the command has
+	// completed, if any.
+	Username string
+	Mailbox  string
+
+	Tag string
+	// The command name, as reported to Observer.CommandStarted.
+	Name string
+	// The command arguments. Credentials are redacted and literals are
+	// truncated to Server.LogLiteralSize bytes.
+	Arguments string
+
+	// The status response sent to the client. Status is empty if the command
+	// didn't send one.
+	Status imap.StatusRespType
+	Code   imap.StatusRespCode
+	Info   string
+
+	Duration time.Duration
+}
+
+// CommandLogger records commands handled by the server, e.g. to keep an audit
+// trail. LogCommand is called synchronously once the status response of a
+// command has been sent: it must be safe for concurrent use.
+type CommandLogger interface {
+	LogCommand(ev *CommandEvent)
+}
+
+// CommandLoggerFunc is an adapter to use a function as a CommandLogger.
+type CommandLoggerFunc func(ev *CommandEvent)
+
+func (f CommandLoggerFunc) LogCommand(ev *CommandEvent) {
+	f(ev)
+}
+
+// startedCommand is a command being handled, reported to the observer and to
+// the command logger once completed.
+type startedCommand struct {
+	cmd   *imap.Command
+	name  string
+	args  string
+	start time.Time
+}
+
+// commandStarted reports a command to the observer. It returns nil if neither
+// an observer nor a command logger is set.
+func (c *conn) commandStarted(cmd *imap.Command) *startedCommand {
+	if c.s.Observer == nil && c.s.CommandLog == nil {
+		return nil
+	}
+
+	started := &startedCommand{cmd: cmd, name: c.s.commandName(cmd)}
+	if c.s.CommandLog != nil {
+		// Arguments must be formatted before literals are consumed
+		started.args = c.s.formatArguments(cmd)
+	}
+	if c.s.Observer != nil {
+		c.s.Observer.CommandStarted(c.conn, started.name)
+	}
+	started.start = time.Now()
+	return started
+}
+
+// commandCompleted reports a completed command to the observer and to the
+// command logger.
+func (c *conn) commandCompleted(started *startedCommand, res *imap.StatusResp) {
+	if started == nil {
+		return
+	}
+
+	duration := time.Since(started.start)
+	var status imap.StatusRespType
+	if res != nil {
+		status = res.Type
+	}
+	if c.s.Observer != nil {
+		c.s.Observer.CommandCompleted(c.conn, started.name, duration, status)
+	}
+
+	if c.s.CommandLog == nil {
+		return
+	}
+	ev := &CommandEvent{
+		ConnID:     c.id,
+		RemoteAddr: c.Info().RemoteAddr,
+		Tag:        started.cmd.Tag,
+		Name:       started.name,
+		Arguments:  started.args,
+		Status:     status,
+		Duration:   duration,
+	}
+	if res != nil {
+		ev.Code = res.Code
+		ev.Info = res.Info
+	}
+	if c.ctx.User != nil {
+		ev.Username = c.ctx.User.Username()
+	}
+	if c.ctx.Mailbox != nil {
+		ev.Mailbox = c.ctx.Mailbox.Name()
+	}
+	c.s.CommandLog.LogCommand(ev)
+}
+
+// formatArguments formats the arguments of a command for logging. LOGIN
+// passwords and AUTHENTICATE initial responses are redacted.
+func (s *Server) formatArguments(cmd *imap.Command) string {
+	args := cmd.Arguments
+	switch cmd.Name {
+	case "LOGIN", "AUTHENTICATE":
+		if len(args) > 1 {
+			args = []interface{}{args[0], imap.RawString(redacted)}
+		}
+	}
+
+	var sb strings.Builder
+	s.formatFields(&sb, args)
+	return sb.String()
+}
+
+func (s *Server) formatFields(sb *strings.Builder, fields []interface{}) {
+	for i, field := range fields {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		s.formatField(sb, field)
+	}
+}
+
+func (s *Server) formatField(sb *strings.Builder, field interface{}) {
+	switch field := field.(type) {
+	case nil:
+		sb.WriteString("NIL")
+	case imap.RawString:
+		sb.WriteString(string(field))
+	case string:
+		if isLoggedAtom(field) {
+			sb.WriteString(field)
+		} else {
+			sb.WriteString(strconv.Quote(field))
+		}
+	case []interface{}:
+		sb.WriteByte('(')
+		s.formatFields(sb, field)
+		sb.WriteByte(')')
+	case imap.Literal:
+		sb.WriteString("{" + strconv.Itoa(field.Len()) + "}")
+		s.formatLiteral(sb, field)
+	default:
+		fmt.Fprint(sb, field)
+	}
+}
+
+// formatLiteral writes the contents of a literal, truncated to
+// Server.LogLiteralSize bytes.
+func (s *Server) formatLiteral(sb *strings.Builder, lit imap.Literal) {
+	if s.LogLiteralSize == 0 {
+		return
+	}
+	// Literals read from clients are buffered, their contents can be peeked
+	// without being consumed
+	buf, ok := lit.(interface{ Bytes() []byte })
+	if !ok {
+		return
+	}
+
+	b := buf.Bytes()
+	truncated := s.LogLiteralSize > 0 && len(b) > s.LogLiteralSize
+	if truncated {
+		b = b[:s.LogLiteralSize]
+	}
+	sb.WriteString(strconv.Quote(string(b)))
+	if truncated {
+		sb.WriteString("...")
+	}
+}
+
+// isLoggedAtom checks whether a string can be logged without quotes.
+func isLoggedAtom(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`(){%"\`, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package server_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+)
+
+func TestServer_CommandLog(t *testing.T) {
+	events := make(chan *server.CommandEvent, 10)
+	s, addr := testServerLimits(t, func(s *server.Server) {
+		s.CommandLog = server.CommandLoggerFunc(func(ev *server.CommandEvent) {
+			events <- ev
+		})
+		s.LogLiteralSize = 5
+	})
+	defer s.Close()
+
+	c, scanner := dialLimits(t, addr)
+	for _, cmd := range []string{
+		"a001 LOGIN username password",
+		"a002 SELECT INBOX",
+		"a003 APPEND INBOX {11}",
+		"a004 UID FOO",
+	} {
+		io.WriteString(c, cmd+"\r\n")
+		if strings.HasSuffix(cmd, "}") {
+			scanner.Scan() // Continuation request
+			io.WriteString(c, "Hello world\r\n")
+		}
+		tag := strings.Fields(cmd)[0]
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), tag+" ") {
+				break
+			}
+		}
+	}
+
+	expected := []server.CommandEvent{
+		{Username: "username", Tag: "a001", Name: "LOGIN", Arguments: "username ***", Status: imap.StatusRespOk},
+		{Username: "username", Mailbox: "INBOX", Tag: "a002", Name: "SELECT", Arguments: "INBOX", Status: imap.StatusRespOk},
+		{Username: "username", Mailbox: "INBOX", Tag: "a003", Name: "APPEND", Arguments: `INBOX {11}"Hello"...`, Status: imap.StatusRespOk},
+		{Username: "username", Mailbox: "INBOX", Tag: "a004", Name: "UID UNKNOWN", Arguments: "FOO", Status: imap.StatusRespNo},
+	}
+	var connID uint64
+	for _, want := range expected {
+		var ev *server.CommandEvent
+		select {
+		case ev = <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected an event for %v", want.Tag)
+		}
+
+		if connID == 0 {
+			connID = ev.ConnID
+		}
+		if ev.ConnID == 0 || ev.ConnID != connID {
+			t.Errorf("Invalid connection ID for %v: %v", want.Tag, ev.ConnID)
+		}
+		if ev.RemoteAddr == nil || ev.RemoteAddr.String() != c.LocalAddr().String() {
+			t.Errorf("Invalid remote address for %v: %v", want.Tag, ev.RemoteAddr)
+		}
+		if ev.Username != want.Username || ev.Mailbox != want.Mailbox {
+			t.Errorf("Invalid user or mailbox for %v: %q, %q", want.Tag, ev.Username, ev.Mailbox)
+		}
+		if ev.Tag != want.Tag || ev.Name != want.Name || ev.Arguments != want.Arguments {
+			t.Errorf("Invalid command: expected %v %v %v, got %v %v %v", want.Tag, want.Name, want.Arguments, ev.Tag, ev.Name, ev.Arguments)
+		}
+		if ev.Status != want.Status {
+			t.Errorf("Invalid status for %v: %v", want.Tag, ev.Status)
+		}
+	}
+}
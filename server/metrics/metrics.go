@@ -0,0 +1,288 @@
+// Package metrics implements a server.Observer collecting metrics, exported in
+// the Prometheus text format.
+//
+// The exporter can be served over HTTP:
+//
+//	m := metrics.New()
+//	s.Observer = m
+//	http.Handle("/metrics", m)
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+)
+
+// DefaultBuckets are the default upper bounds of command duration histogram
+// buckets, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type commandKey struct {
+	name   string
+	status imap.StatusRespType
+}
+
+type histogram struct {
+	counts []uint64 // One per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Metrics is a server.Observer collecting metrics. It implements http.Handler
+// to export them.
+type Metrics struct {
+	// Upper bounds of command duration histogram buckets, in seconds. It must
+	// not be modified once the server is started.
+	Buckets []float64
+
+	locker        sync.Mutex
+	conns         uint64
+	activeConns   int64
+	authSuccesses uint64
+	authFailures  uint64
+	activeCmds    map[string]int64
+	commands      map[commandKey]uint64
+	durations     map[string]*histogram
+	updates       map[string]uint64
+	deliveries    map[string]uint64
+	bytesRead     uint64
+	bytesWritten  uint64
+}
+
+var _ server.Observer = (*Metrics)(nil)
+
+// New creates a new metrics collector.
+func New() *Metrics {
+	return &Metrics{
+		Buckets:    DefaultBuckets,
+		activeCmds: make(map[string]int64),
+		commands:   make(map[commandKey]uint64),
+		durations:  make(map[string]*histogram),
+		updates:    make(map[string]uint64),
+		deliveries: make(map[string]uint64),
+	}
+}
+
+func (m *Metrics) ConnOpened(conn server.Conn) {
+	m.locker.Lock()
+	m.conns++
+	m.activeConns++
+	m.locker.Unlock()
+}
+
+func (m *Metrics) ConnClosed(conn server.Conn) {
+	m.locker.Lock()
+	m.activeConns--
+	m.locker.Unlock()
+}
+
+func (m *Metrics) AuthSucceeded(conn server.Conn, username string) {
+	m.locker.Lock()
+	m.authSuccesses++
+	m.locker.Unlock()
+}
+
+func (m *Metrics) AuthFailed(conn server.Conn, username string, err error) {
+	m.locker.Lock()
+	m.authFailures++
+	m.locker.Unlock()
+}
+
+func (m *Metrics) CommandStarted(conn server.Conn, name string) {
+	m.locker.Lock()
+	m.activeCmds[name]++
+	m.locker.Unlock()
+}
+
+func (m *Metrics) CommandCompleted(conn server.Conn, name string, duration time.Duration, status imap.StatusRespType) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	m.activeCmds[name]--
+	m.commands[commandKey{name, status}]++
+
+	h, ok := m.durations[name]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.Buckets))}
+		m.durations[name] = h
+	}
+	secs := duration.Seconds()
+	for i, bound := range m.Buckets {
+		if secs <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += secs
+}
+
+// updateType returns the name of the type of a backend update.
+func updateType(update backend.Update) string {
+	switch update.(type) {
+	case *backend.StatusUpdate:
+		return "status"
+	case *backend.MailboxUpdate:
+		return "mailbox"
+	case *backend.MessageUpdate:
+		return "message"
+	case *backend.ExpungeUpdate:
+		return "expunge"
+	default:
+		return "other"
+	}
+}
+
+func (m *Metrics) UpdateDispatched(update backend.Update, n int) {
+	typ := updateType(update)
+
+	m.locker.Lock()
+	m.updates[typ]++
+	m.deliveries[typ] += uint64(n)
+	m.locker.Unlock()
+}
+
+func (m *Metrics) BytesRead(n int) {
+	m.locker.Lock()
+	m.bytesRead += uint64(n)
+	m.locker.Unlock()
+}
+
+func (m *Metrics) BytesWritten(n int) {
+	m.locker.Lock()
+	m.bytesWritten += uint64(n)
+	m.locker.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	m.locker.Lock()
+	m.write(bw)
+	m.locker.Unlock()
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (m *Metrics) write(w io.Writer) {
+	header(w, "imap_connections_total", "counter", "Connections accepted.")
+	fmt.Fprintf(w, "imap_connections_total %d\n", m.conns)
+	header(w, "imap_connections_active", "gauge", "Connections currently open.")
+	fmt.Fprintf(w, "imap_connections_active %d\n", m.activeConns)
+
+	header(w, "imap_auth_total", "counter", "Authentication attempts.")
+	fmt.Fprintf(w, "imap_auth_total{result=\"success\"} %d\n", m.authSuccesses)
+	fmt.Fprintf(w, "imap_auth_total{result=\"failure\"} %d\n", m.authFailures)
+
+	header(w, "imap_commands_active", "gauge", "Commands currently being handled.")
+	names := make([]string, 0, len(m.activeCmds))
+	for name := range m.activeCmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "imap_commands_active{command=%s} %d\n", quote(name), m.activeCmds[name])
+	}
+
+	header(w, "imap_commands_total", "counter", "Commands completed, by status response type.")
+	keys := make([]commandKey, 0, len(m.commands))
+	for k := range m.commands {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		status := string(k.status)
+		if status == "" {
+			status = "NONE"
+		}
+		fmt.Fprintf(w, "imap_commands_total{command=%s,status=%s} %d\n", quote(k.name), quote(status), m.commands[k])
+	}
+
+	header(w, "imap_command_duration_seconds", "histogram", "Command durations.")
+	names = names[:0]
+	for name := range m.durations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := m.durations[name]
+		var cumulative uint64
+		for i, bound := range m.Buckets {
+			cumulative += h.counts[i]
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(w, "imap_command_duration_seconds_bucket{command=%s,le=%s} %d\n", quote(name), quote(le), cumulative)
+		}
+		fmt.Fprintf(w, "imap_command_duration_seconds_bucket{command=%s,le=\"+Inf\"} %d\n", quote(name), h.count)
+		fmt.Fprintf(w, "imap_command_duration_seconds_sum{command=%s} %s\n", quote(name), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "imap_command_duration_seconds_count{command=%s} %d\n", quote(name), h.count)
+	}
+
+	header(w, "imap_updates_total", "counter", "Backend updates dispatched.")
+	writeByType(w, "imap_updates_total", m.updates)
+	header(w, "imap_update_deliveries_total", "counter", "Backend updates queued for connections.")
+	writeByType(w, "imap_update_deliveries_total", m.deliveries)
+
+	header(w, "imap_read_bytes_total", "counter", "Bytes received from clients.")
+	fmt.Fprintf(w, "imap_read_bytes_total %d\n", m.bytesRead)
+	header(w, "imap_written_bytes_total", "counter", "Bytes sent to clients.")
+	fmt.Fprintf(w, "imap_written_bytes_total %d\n", m.bytesWritten)
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func writeByType(w io.Writer, name string, values map[string]uint64) {
+	types := make([]string, 0, len(values))
+	for typ := range values {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		fmt.Fprintf(w, "%s{type=%s} %d\n", name, quote(typ), values[typ])
+	}
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quote formats a label value.
+func quote(v string) string {
+	return `"` + labelReplacer.Replace(v) + `"`
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+func TestMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	m := New()
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.Observer = m
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	for _, cmd := range []string{
+		"a001 LOGIN username wrongpassword",
+		"a002 LOGIN username password",
+		"a003 SELECT INBOX",
+		"a004 UID FETCH 1:* (FLAGS)",
+		"a005 FOO",
+		// Commands are reported once their response has been sent
+		"a006 NOOP",
+	} {
+		io.WriteString(c, cmd+"\r\n")
+		tag := strings.Fields(cmd)[0]
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), tag+" ") {
+				break
+			}
+		}
+	}
+
+	var sb strings.Builder
+	if _, err := m.WriteTo(&sb); err != nil {
+		t.Fatal("Expected no error while writing metrics, got:", err)
+	}
+	out := sb.String()
+
+	for _, line := range []string{
+		"imap_connections_total 1",
+		"imap_connections_active 1",
+		`imap_auth_total{result="success"} 1`,
+		`imap_auth_total{result="failure"} 1`,
+		`imap_commands_total{command="LOGIN",status="NO"} 1`,
+		`imap_commands_total{command="LOGIN",status="OK"} 1`,
+		`imap_commands_total{command="UID FETCH",status="OK"} 1`,
+		`imap_commands_total{command="UNKNOWN",status="BAD"} 1`,
+		`imap_command_duration_seconds_bucket{command="SELECT",le="+Inf"} 1`,
+		`imap_command_duration_seconds_count{command="SELECT"} 1`,
+		`imap_commands_active{command="SELECT"} 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%v", line, out)
+		}
+	}
+	if strings.Contains(out, "imap_read_bytes_total 0\n") || strings.Contains(out, "imap_written_bytes_total 0\n") {
+		t.Errorf("Expected transferred bytes to be counted, got:\n%v", out)
+	}
+}
+
+func TestMetrics_Buckets(t *testing.T) {
+	m := New()
+	m.Buckets = []float64{0.1, 1}
+	m.CommandStarted(nil, "NOOP")
+	m.CommandCompleted(nil, "NOOP", 500*time.Millisecond, imap.StatusRespOk)
+	m.CommandStarted(nil, "NOOP")
+	m.CommandCompleted(nil, "NOOP", 2*time.Second, imap.StatusRespOk)
+
+	var sb strings.Builder
+	m.WriteTo(&sb)
+	out := sb.String()
+
+	for _, line := range []string{
+		`imap_command_duration_seconds_bucket{command="NOOP",le="0.1"} 0`,
+		`imap_command_duration_seconds_bucket{command="NOOP",le="1"} 1`,
+		`imap_command_duration_seconds_bucket{command="NOOP",le="+Inf"} 2`,
+		`imap_command_duration_seconds_sum{command="NOOP"} 2.5`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%v", line, out)
+		}
+	}
+}
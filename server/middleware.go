@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap"
+)
+
+// CommandRequest is a command being handled, passed to middlewares.
+type CommandRequest struct {
+	// The command. For UID commands, this is the inner command (e.g. FETCH),
+	// without a tag.
+	Command *imap.Command
+	// True if this is a UID command.
+	Uid bool
+	// The handler which has parsed the command arguments, e.g. a *Delete for a
+	// DELETE command unless an extension overrides it.
+	Handler Handler
+}
+
+// HandleFunc handles a command for a connection. It returns the status
+// response to send, or nil if none must be sent. The response tag is set by the
+// server, so the response must not be shared between commands.
+type HandleFunc func(ctx context.Context, conn Conn, req *CommandRequest) *imap.StatusResp
+
+// Middleware wraps command handling, e.g. to enforce policies or to log
+// commands. It can inspect or replace the status response returned by next, or
+// short-circuit the command by returning its own status response without
+// calling next.
+//
+// Middlewares apply to built-in and extension commands. UID commands are passed
+// once, with the inner command.
+type Middleware func(next HandleFunc) HandleFunc
+
+// Use adds middlewares wrapping command handling. The first middleware added is
+// called first. This function must be called before the server starts serving.
+func (s *Server) Use(middlewares ...Middleware) {
+	s.middlewares = append(s.middlewares, middlewares...)
+}
+
+// handleRequest calls the command handler wrapped in middlewares.
+func (c *conn) handleRequest(ctx context.Context, conn Conn, req *CommandRequest) *imap.StatusResp {
+	h := HandleFunc(callHandler)
+	for i := len(c.s.middlewares) - 1; i >= 0; i-- {
+		h = c.s.middlewares[i](h)
+	}
+	return h(ctx, conn, req)
+}
+
+// callHandler calls a command handler and converts the returned error to a
+// status response.
+func callHandler(ctx context.Context, conn Conn, req *CommandRequest) *imap.StatusResp {
+	var err error
+	if req.Uid {
+		if ctxHdlr, ok := req.Handler.(ContextUidHandler); ok {
+			err = ctxHdlr.UidHandleContext(ctx, conn)
+		} else {
+			err = req.Handler.(UidHandler).UidHandle(conn)
+		}
+	} else if ctxHdlr, ok := req.Handler.(ContextHandler); ok {
+		err = ctxHdlr.HandleContext(ctx, conn)
+	} else {
+		err = req.Handler.Handle(conn)
+	}
+	return statusResp(err)
+}
+
+// statusResp converts an error returned by a handler to a status response.
+func statusResp(err error) *imap.StatusResp {
+	if statusErr, ok := err.(*errStatusResp); ok {
+		return statusErr.resp
+	} else if err != nil {
+		return &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Info: err.Error(),
+		}
+	}
+	return &imap.StatusResp{
+		Type: imap.StatusRespOk,
+	}
+}
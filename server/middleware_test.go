@@ -0,0 +1,75 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+)
+
+func TestServer_Use(t *testing.T) {
+	var calls []string
+	s, addr := testServerLimits(t, func(s *server.Server) {
+		s.Use(func(next server.HandleFunc) server.HandleFunc {
+			return func(ctx context.Context, conn server.Conn, req *server.CommandRequest) *imap.StatusResp {
+				res := next(ctx, conn, req)
+
+				name := req.Command.Name
+				if req.Uid {
+					name = "UID " + name
+				}
+				calls = append(calls, name+" "+string(res.Type))
+				return res
+			}
+		}, func(next server.HandleFunc) server.HandleFunc {
+			return func(ctx context.Context, conn server.Conn, req *server.CommandRequest) *imap.StatusResp {
+				if del, ok := req.Handler.(*server.Delete); ok && del.Mailbox == "Archive" {
+					return &imap.StatusResp{
+						Type: imap.StatusRespNo,
+						Info: "Cannot delete archives",
+					}
+				}
+				return next(ctx, conn, req)
+			}
+		})
+	})
+	defer s.Close()
+
+	c, scanner := dialLimits(t, addr)
+	for _, cmd := range []string{
+		"a001 LOGIN username password",
+		"a002 CREATE Archive",
+		"a003 DELETE Archive",
+		"a004 SELECT INBOX",
+		"a005 UID FETCH 1:* (FLAGS)",
+	} {
+		io.WriteString(c, cmd+"\r\n")
+		tag := strings.Fields(cmd)[0]
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), tag+" ") {
+				break
+			}
+		}
+
+		if tag == "a003" && scanner.Text() != "a003 NO Cannot delete archives" {
+			t.Error("Expected DELETE to be rejected, got:", scanner.Text())
+		}
+		if tag == "a005" && scanner.Text() != "a005 OK UID FETCH completed" {
+			t.Error("Expected UID FETCH to succeed, got:", scanner.Text())
+		}
+	}
+
+	expected := []string{
+		"LOGIN OK",
+		"CREATE OK",
+		"DELETE NO",
+		"SELECT OK",
+		"UID FETCH OK",
+	}
+	if strings.Join(calls, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected middleware calls %v, got %v", expected, calls)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// Observer is notified of server events, e.g. to collect metrics. Its methods
+// are called synchronously by the goroutines serving connections: they must be
+// safe for concurrent use and must not block.
+type Observer interface {
+	// ConnOpened is called when a connection is accepted, before the greeting
+	// is sent.
+	ConnOpened(conn Conn)
+	// ConnClosed is called once a connection has been closed.
+	ConnClosed(conn Conn)
+
+	// AuthSucceeded is called when a user logs in.
+	AuthSucceeded(conn Conn, username string)
+	// AuthFailed is called when a LOGIN or AUTHENTICATE command fails. The
+	// username is empty if it's unknown.
+	AuthFailed(conn Conn, username string, err error)
+
+	// CommandStarted is called before a command is handled. The name of UID
+	// commands includes the inner command name, e.g. "UID FETCH". Unknown
+	// commands are named "UNKNOWN".
+	CommandStarted(conn Conn, name string)
+	// CommandCompleted is called once the status response of a command has
+	// been sent. status is empty if the command didn't send one.
+	CommandCompleted(conn Conn, name string, duration time.Duration, status imap.StatusRespType)
+
+	// UpdateDispatched is called when a backend update has been queued for n
+	// connections.
+	UpdateDispatched(update backend.Update, n int)
+
+	// BytesRead and BytesWritten are called when data is received from or
+	// sent to a client.
+	BytesRead(n int)
+	BytesWritten(n int)
+}
+
+// observedConn is a network connection reporting the data transferred to an
+// Observer.
+type observedConn struct {
+	net.Conn
+	observer Observer
+}
+
+func (c *observedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.observer.BytesRead(n)
+	}
+	return n, err
+}
+
+func (c *observedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.observer.BytesWritten(n)
+	}
+	return n, err
+}
+
+// commandName returns the name of a command reported to observers.
+func (s *Server) commandName(cmd *imap.Command) string {
+	if s.Command(cmd.Name) == nil {
+		return "UNKNOWN"
+	}
+	if cmd.Name != "UID" {
+		return cmd.Name
+	}
+
+	if len(cmd.Arguments) > 0 {
+		if name, err := imap.ParseString(cmd.Arguments[0]); err == nil {
+			name = strings.ToUpper(name)
+			if s.Command(name) != nil {
+				return cmd.Name + " " + name
+			}
+		}
+	}
+	return cmd.Name + " UNKNOWN"
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"runtime/debug"
+
+	"github.com/emersion/go-imap"
+)
+
+// DefaultPipelineCommand reports whether a command can be handled concurrently
+// with other pipelined commands when Server.PipelineCommand is nil. Built-in
+// FETCH, SEARCH, STATUS, LIST and LSUB commands, and their UID variants, are
+// pipelined: they don't change the connection state nor the mailbox. FETCH
+// commands which implicitly set the \Seen flag are not.
+func DefaultPipelineCommand(req *CommandRequest) bool {
+	switch hdlr := req.Handler.(type) {
+	case *Search, *Status, *List:
+		return true
+	case *Fetch:
+		return !setsSeen(hdlr.Items)
+	default:
+		return false
+	}
+}
+
+// setsSeen checks whether fetching items sets the \Seen flag (RFC 3501 section
+// 6.4.5).
+func setsSeen(items []imap.FetchItem) bool {
+	for _, item := range items {
+		section, err := imap.ParseBodySectionName(item)
+		if err == nil && !section.Peek {
+			return true
+		}
+	}
+	return false
+}
+
+// pipelinedConn is the connection passed to the handler of a pipelined command.
+// Its responses are written once the commands received before have completed.
+type pipelinedConn struct {
+	Conn
+	turn <-chan struct{}
+}
+
+func (c *pipelinedConn) WriteResp(r imap.WriterTo) error {
+	<-c.turn
+	return c.Conn.WriteResp(r)
+}
+
+// canPipeline checks whether a command can be handled while the next commands
+// are read.
+func (c *conn) canPipeline(cmd *imap.Command, hdlr Handler) bool {
+	if c.s.MaxPipelinedCommands <= 1 {
+		return false
+	}
+
+	req := &CommandRequest{Command: cmd, Handler: hdlr}
+	if uid, ok := hdlr.(*Uid); ok {
+		inner := uid.Cmd.Command()
+		innerHdlr, err := c.commandHandler(inner)
+		if err != nil {
+			return false
+		}
+		req = &CommandRequest{Command: inner, Uid: true, Handler: innerHdlr}
+	}
+
+	pipeline := c.s.PipelineCommand
+	if pipeline == nil {
+		pipeline = DefaultPipelineCommand
+	}
+	return pipeline(req)
+}
+
+// handlePipelined handles a command in a new goroutine. Its responses are sent
+// after the ones of the previous pipelined command.
+func (c *conn) handlePipelined(cmd *imap.Command, hdlr Handler, started *startedCommand) {
+	turn := c.lastPipelined
+	done := make(chan struct{})
+	c.lastPipelined = done
+
+	c.pipelineSlots <- struct{}{}
+	c.pipelined.Add(1)
+	// The command keeps the connection busy until its response is sent
+	c.stateLocker.Lock()
+	c.busy++
+	c.pipelinedCount++
+	c.stateLocker.Unlock()
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				stack := debug.Stack()
+				c.s.ErrorLog.Printf("panic serving %v: %v\n%s", c.Info().RemoteAddr, r, stack)
+				c.Conn.Close()
+			}
+
+			c.stateLocker.Lock()
+			c.pipelinedCount--
+			c.stateLocker.Unlock()
+
+			close(done)
+			<-c.pipelineSlots
+			c.pipelined.Done()
+			if reason := c.setIdle(); reason != "" {
+				c.bye(reason)
+			}
+		}()
+
+		res, _ := c.handleCommand(&pipelinedConn{c.conn, turn}, cmd, hdlr)
+		<-turn
+
+		// EXPUNGE responses can only be sent if no other command is in progress
+		c.stateLocker.Lock()
+		expunge := c.pipelinedCount == 1 && !holdsExpunges(cmd)
+		c.stateLocker.Unlock()
+		c.WriteResp(c.newPendingUpdates(expunge))
+
+		if res != nil {
+			if err := c.WriteResp(res); err != nil {
+				c.s.ErrorLog.Println("cannot write response:", err)
+			}
+		}
+		c.commandCompleted(started, res)
+	}()
+}
+
+// waitPipelined waits for pipelined commands in progress to complete.
+func (c *conn) waitPipelined() {
+	c.pipelined.Wait()
+}
@@ -0,0 +1,119 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+)
+
+func testServerPipelined(t *testing.T, middleware server.Middleware) (c io.Writer, responses func(tag string) []string) {
+	s, addr := testServerLimits(t, func(s *server.Server) {
+		s.MaxPipelinedCommands = 4
+		s.Use(middleware)
+	})
+	t.Cleanup(func() { s.Close() })
+
+	conn, scanner := dialLimits(t, addr)
+	io.WriteString(conn, "a000 LOGIN username password\r\n")
+	scanner.Scan()
+	io.WriteString(conn, "a000 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a000 ") {
+			break
+		}
+	}
+
+	return conn, func(tag string) []string {
+		var lines []string
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+			if strings.HasPrefix(scanner.Text(), tag+" ") {
+				break
+			}
+		}
+		return lines
+	}
+}
+
+func TestServer_Pipelined(t *testing.T) {
+	searched := make(chan struct{})
+	c, responses := testServerPipelined(t, func(next server.HandleFunc) server.HandleFunc {
+		return func(ctx context.Context, conn server.Conn, req *server.CommandRequest) *imap.StatusResp {
+			switch req.Command.Name {
+			case "FETCH":
+				// Only completes if SEARCH is handled concurrently
+				select {
+				case <-searched:
+				case <-time.After(5 * time.Second):
+					return &imap.StatusResp{Type: imap.StatusRespNo, Info: "Not pipelined"}
+				}
+			case "SEARCH":
+				close(searched)
+			}
+			return next(ctx, conn, req)
+		}
+	})
+
+	io.WriteString(c, "a001 UID FETCH 1:* (FLAGS)\r\na002 UID SEARCH ALL\r\na003 NOOP\r\n")
+
+	expected := []string{
+		"* 1 FETCH (FLAGS (\\Seen) UID 6)",
+		"a001 OK UID FETCH completed",
+		"* SEARCH 6",
+		"a002 OK UID SEARCH completed",
+		"a003 OK NOOP completed",
+	}
+	if lines := responses("a003"); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected responses:\n%v\nbut got:\n%v", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestServer_Pipelined_Serialized(t *testing.T) {
+	var locker sync.Mutex
+	var events []string
+	c, responses := testServerPipelined(t, func(next server.HandleFunc) server.HandleFunc {
+		return func(ctx context.Context, conn server.Conn, req *server.CommandRequest) *imap.StatusResp {
+			locker.Lock()
+			events = append(events, "start "+req.Command.Name)
+			locker.Unlock()
+
+			if req.Command.Name == "FETCH" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			res := next(ctx, conn, req)
+
+			locker.Lock()
+			events = append(events, "end "+req.Command.Name)
+			locker.Unlock()
+			return res
+		}
+	})
+
+	// STORE changes flags and FETCH BODY[] sets \Seen: they must wait
+	io.WriteString(c, "a001 UID FETCH 1:* (FLAGS)\r\na002 STORE 1 +FLAGS (\\Flagged)\r\na003 FETCH 1 (BODY[])\r\n")
+	responses("a003")
+
+	locker.Lock()
+	defer locker.Unlock()
+	expected := []string{
+		"start LOGIN",
+		"end LOGIN",
+		"start SELECT",
+		"end SELECT",
+		"start FETCH",
+		"end FETCH",
+		"start STORE",
+		"end STORE",
+		"start FETCH",
+		"end FETCH",
+	}
+	if strings.Join(events, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected events %v, got %v", expected, events)
+	}
+}
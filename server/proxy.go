@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is the maximum duration spent reading a PROXY protocol
+// header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// PROXY protocol headers, as defined in
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// maxProxyV1Length is the maximum length of a version 1 header, including the
+// CRLF.
+const maxProxyV1Length = 107
+
+// Version 2 commands, address families and TLV types.
+const (
+	proxyV2Local = 0x0
+	proxyV2Proxy = 0x1
+
+	proxyV2Inet  = 0x1
+	proxyV2Inet6 = 0x2
+
+	proxyV2TypeAuthority  = 0x02
+	proxyV2TypeSSL        = 0x20
+	proxyV2SubtypeVersion = 0x21
+	proxyV2SubtypeCipher  = 0x23
+
+	proxyV2ClientSSL = 0x01
+)
+
+var errMissingProxyHeader = errors.New("missing PROXY protocol header")
+
+// proxyConn is a connection accepted from a trusted proxy. Its addresses and
+// TLS state are the ones sent by the proxy.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	// The TLS state of the connection between the client and the proxy, nil if
+	// the client doesn't use TLS or if the proxy didn't send it
+	tls *tls.ConnectionState
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// isTrustedProxy checks whether a connection comes from a trusted proxy.
+func (s *Server) isTrustedProxy(addr net.Addr) bool {
+	ip := net.ParseIP(remoteIP(addr))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range s.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol header, version 1 or 2, sent by a
+// trusted proxy before the client data.
+func readProxyHeader(c net.Conn) (*proxyConn, error) {
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	pc := &proxyConn{
+		Conn:       c,
+		r:          bufio.NewReader(c),
+		remoteAddr: c.RemoteAddr(),
+		localAddr:  c.LocalAddr(),
+	}
+
+	b, err := pc.r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, proxyV1Prefix) {
+		return pc, pc.readV1()
+	}
+	if !bytes.HasPrefix(proxyV2Signature, b) {
+		return nil, errMissingProxyHeader
+	}
+	if b, err = pc.r.Peek(len(proxyV2Signature)); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(b, proxyV2Signature) {
+		return nil, errMissingProxyHeader
+	}
+	return pc, pc.readV2()
+}
+
+func (c *proxyConn) readV1() error {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	if len(line) > maxProxyV1Length || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("invalid PROXY protocol header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// The connection wasn't relayed, keep the proxy addresses
+		return nil
+	}
+	if len(fields) != 6 {
+		return fmt.Errorf("invalid PROXY protocol header: %q", line)
+	}
+
+	src, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remoteAddr, c.localAddr = src, dst
+	return nil
+}
+
+func parseProxyV1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	if proto != "TCP4" && proto != "TCP6" {
+		return nil, fmt.Errorf("unsupported PROXY protocol: %q", proto)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil || (proto == "TCP4" && addr.IP.To4() == nil) {
+		return nil, fmt.Errorf("invalid PROXY protocol %v address: %q", proto, ip)
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol port: %q", port)
+	}
+	addr.Port = int(n)
+	return addr, nil
+}
+
+func (c *proxyConn) readV2() error {
+	var header [16]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version: %v", header[12]>>4)
+	}
+	cmd := header[12] & 0xF
+	family := header[13] >> 4
+
+	b := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return err
+	}
+
+	switch cmd {
+	case proxyV2Local:
+		// Health check sent by the proxy itself, keep the proxy addresses
+		return nil
+	case proxyV2Proxy:
+	default:
+		return fmt.Errorf("unsupported PROXY protocol command: %v", cmd)
+	}
+
+	var ipLen int
+	switch family {
+	case proxyV2Inet:
+		ipLen = net.IPv4len
+	case proxyV2Inet6:
+		ipLen = net.IPv6len
+	default:
+		// Unsupported address family, keep the proxy addresses
+		return nil
+	}
+	if len(b) < 2*ipLen+4 {
+		return errors.New("PROXY protocol header too short")
+	}
+	c.remoteAddr = &net.TCPAddr{
+		IP:   net.IP(b[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(b[2*ipLen:])),
+	}
+	c.localAddr = &net.TCPAddr{
+		IP:   net.IP(b[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(b[2*ipLen+2:])),
+	}
+
+	return c.parseTLVs(b[2*ipLen+4:])
+}
+
+// parseTLVs parses the type-length-value fields of a version 2 header.
+func (c *proxyConn) parseTLVs(b []byte) error {
+	var authority string
+	err := parseProxyTLVs(b, func(typ byte, value []byte) error {
+		switch typ {
+		case proxyV2TypeAuthority:
+			authority = string(value)
+		case proxyV2TypeSSL:
+			// Client flags and certificate verification result
+			if len(value) < 5 {
+				return errors.New("PROXY protocol SSL field too short")
+			}
+			if value[0]&proxyV2ClientSSL == 0 {
+				return nil
+			}
+
+			state := &tls.ConnectionState{HandshakeComplete: true}
+			c.tls = state
+			return parseProxyTLVs(value[5:], func(typ byte, value []byte) error {
+				switch typ {
+				case proxyV2SubtypeVersion:
+					state.Version = parseTLSVersion(string(value))
+				case proxyV2SubtypeCipher:
+					state.CipherSuite = parseCipherSuite(string(value))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if c.tls != nil {
+		c.tls.ServerName = authority
+	}
+	return err
+}
+
+func parseProxyTLVs(b []byte, f func(typ byte, value []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return errors.New("PROXY protocol TLV too short")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return errors.New("PROXY protocol TLV too short")
+		}
+		if err := f(b[0], b[3:3+n]); err != nil {
+			return err
+		}
+		b = b[3+n:]
+	}
+	return nil
+}
+
+// parseTLSVersion parses a TLS version name, as sent by HAProxy (e.g.
+// "TLSv1.3"). It returns zero if the version is unknown.
+func parseTLSVersion(s string) uint16 {
+	switch s {
+	case "TLSv1":
+		return tls.VersionTLS10
+	case "TLSv1.1":
+		return tls.VersionTLS11
+	case "TLSv1.2":
+		return tls.VersionTLS12
+	case "TLSv1.3":
+		return tls.VersionTLS13
+	default:
+		return 0
+	}
+}
+
+// parseCipherSuite parses a cipher suite IANA name. It returns zero if the
+// cipher suite is unknown.
+func parseCipherSuite(s string) uint16 {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == s {
+			return suite.ID
+		}
+	}
+	return 0
+}
@@ -0,0 +1,123 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/server"
+)
+
+func testServerProxied(t *testing.T) (addr string, events <-chan *server.CommandEvent) {
+	ch := make(chan *server.CommandEvent, 10)
+	s, addr := testServerLimits(t, func(s *server.Server) {
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		s.TrustedProxies = []*net.IPNet{loopback}
+		s.AllowInsecureAuth = false
+		s.CommandLog = server.CommandLoggerFunc(func(ev *server.CommandEvent) {
+			ch <- ev
+		})
+	})
+	t.Cleanup(func() { s.Close() })
+	return addr, ch
+}
+
+func dialProxied(t *testing.T, addr string, header []byte) (c net.Conn, scanner *bufio.Scanner) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	c.Write(header)
+	scanner = bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	return c, scanner
+}
+
+func nextCommandEvent(t *testing.T, events <-chan *server.CommandEvent) *server.CommandEvent {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a command event")
+		return nil
+	}
+}
+
+func TestServer_ProxyV1(t *testing.T) {
+	addr, events := testServerProxied(t)
+
+	c, scanner := dialProxied(t, addr, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 143\r\n"))
+	if !strings.HasPrefix(scanner.Text(), "* OK ") || !strings.Contains(scanner.Text(), "LOGINDISABLED") {
+		t.Fatal("Bad greeting:", scanner.Text())
+	}
+
+	io.WriteString(c, "a001 NOOP\r\n")
+	scanner.Scan()
+
+	ev := nextCommandEvent(t, events)
+	if ev.RemoteAddr.String() != "192.0.2.1:56324" {
+		t.Errorf("Expected the client address, got %v", ev.RemoteAddr)
+	}
+}
+
+func proxyV2Header(tlvs []byte) []byte {
+	b := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	b = append(b, 0x21, 0x11) // PROXY command, TCP over IPv4
+	b = binary.BigEndian.AppendUint16(b, uint16(12+len(tlvs)))
+	b = append(b, 192, 0, 2, 1, 198, 51, 100, 1)
+	b = binary.BigEndian.AppendUint16(b, 56324)
+	b = binary.BigEndian.AppendUint16(b, 993)
+	return append(b, tlvs...)
+}
+
+func proxyV2TLV(typ byte, value []byte) []byte {
+	b := []byte{typ}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+func TestServer_ProxyV2(t *testing.T) {
+	addr, events := testServerProxied(t)
+
+	ssl := []byte{0x01, 0, 0, 0, 0} // Client connected over TLS, no certificate
+	ssl = append(ssl, proxyV2TLV(0x21, []byte("TLSv1.3"))...)
+	tlvs := append(proxyV2TLV(0x02, []byte("imap.example.org")), proxyV2TLV(0x20, ssl)...)
+
+	c, scanner := dialProxied(t, addr, proxyV2Header(tlvs))
+	if !strings.HasPrefix(scanner.Text(), "* OK ") || strings.Contains(scanner.Text(), "LOGINDISABLED") {
+		t.Fatal("Bad greeting:", scanner.Text())
+	}
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Expected LOGIN to succeed over TLS, got:", scanner.Text())
+	}
+
+	ev := nextCommandEvent(t, events)
+	if ev.RemoteAddr.String() != "192.0.2.1:56324" {
+		t.Errorf("Expected the client address, got %v", ev.RemoteAddr)
+	}
+}
+
+func TestServer_ProxyMissingHeader(t *testing.T) {
+	addr, _ := testServerProxied(t)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	io.WriteString(c, "a001 NOOP\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(c); err != nil || len(b) > 0 {
+		t.Errorf("Expected the connection to be closed, got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,521 @@
+package server_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// Scripts in testdata are transcripts of IMAP sessions, in the spirit of
+// Dovecot's imaptest. Each line starts with a connection number, followed by
+// ">" for a line sent by the client or "<" for a line expected from the
+// server:
+//
+//	1> a001 LOGIN username password
+//	1< a001 OK $*
+//
+// Connections are opened on first use, their greeting is checked and skipped.
+// Lines starting with "#" and empty lines are ignored.
+//
+// Consecutive expected lines for the same connection form a block. Untagged
+// responses of a block can be received in any order. If a block contains a
+// tagged response, it must be its last line and the block ends when it's
+// received. The line "..." in a block allows any number of other untagged
+// responses.
+//
+// In expected lines, "$*" matches any text and "$name" matches an atom which
+// is saved in the variable name. Once set, a variable must have the same value
+// in later lines and can be used in sent lines. "$$" is a literal "$".
+//
+// Literals are written as on the wire: a line ending with "{n}" or "{n+}" is
+// followed by n bytes, line endings count as CRLF, and the rest of the line.
+// The harness waits for a continuation request before sending the data of a
+// synchronizing literal.
+
+// scriptTimeout is the maximum duration to wait for a block of responses.
+const scriptTimeout = 5 * time.Second
+
+// scriptLine is a logical line of a script, with its literals.
+type scriptLine struct {
+	lineno int
+	conn   int
+	send   bool
+	// Sent lines are split after each synchronizing literal
+	parts []string
+}
+
+func (l *scriptLine) text() string {
+	return strings.Join(l.parts, "")
+}
+
+var (
+	scriptPrefixRe = regexp.MustCompile(`^(\d+)([<>]) ?`)
+	literalRe      = regexp.MustCompile(`\{(\d+)(\+?)\}$`)
+)
+
+func parseScript(b []byte) ([]*scriptLine, error) {
+	lines := strings.Split(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n")
+
+	var script []*scriptLine
+	for i := 0; i < len(lines); i++ {
+		raw := lines[i]
+		if raw == "" || strings.HasPrefix(raw, "#") {
+			continue
+		}
+
+		m := scriptPrefixRe.FindStringSubmatch(raw)
+		if m == nil {
+			return nil, fmt.Errorf("line %v: missing connection prefix", i+1)
+		}
+		conn, _ := strconv.Atoi(m[1])
+		l := &scriptLine{lineno: i + 1, conn: conn, send: m[2] == ">"}
+
+		// Read literals, which may span several lines
+		cur := raw[len(m[0]):]
+		var part strings.Builder
+		for {
+			lm := literalRe.FindStringSubmatch(cur)
+			if lm == nil {
+				part.WriteString(cur)
+				break
+			}
+			n, _ := strconv.Atoi(lm[1])
+			part.WriteString(cur + "\r\n")
+			if l.send && lm[2] == "" {
+				l.parts = append(l.parts, part.String())
+				part.Reset()
+			}
+
+			for {
+				i++
+				if i >= len(lines) {
+					return nil, fmt.Errorf("line %v: unexpected end of literal", l.lineno)
+				}
+				cur = lines[i]
+				if len(cur) >= n {
+					part.WriteString(cur[:n])
+					cur = cur[n:]
+					break
+				}
+				part.WriteString(cur + "\r\n")
+				n -= len(cur) + 2
+				if n < 0 {
+					return nil, fmt.Errorf("line %v: literal doesn't end on a line boundary", i+1)
+				}
+			}
+		}
+		l.parts = append(l.parts, part.String())
+
+		script = append(script, l)
+	}
+	return script, nil
+}
+
+var patternTokenRe = regexp.MustCompile(`\$(\$|\*|[A-Za-z_][A-Za-z0-9_]*)`)
+
+// scriptVars contains the variables set by a script.
+type scriptVars map[string]string
+
+// expand replaces variables in a sent line.
+func (vars scriptVars) expand(s string) (string, error) {
+	var err error
+	s = patternTokenRe.ReplaceAllStringFunc(s, func(tok string) string {
+		name := tok[1:]
+		if name == "$" {
+			return "$"
+		}
+		v, ok := vars[name]
+		if !ok {
+			err = fmt.Errorf("undefined variable %v", name)
+		}
+		return v
+	})
+	return s, err
+}
+
+// match checks whether a response matches an expected line, and sets the
+// variables it contains.
+func (vars scriptVars) match(pattern, res string) bool {
+	var expr strings.Builder
+	expr.WriteString(`(?s)^`)
+	var names []string
+	last := 0
+	for _, loc := range patternTokenRe.FindAllStringSubmatchIndex(pattern, -1) {
+		expr.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+		last = loc[1]
+
+		name := pattern[loc[2]:loc[3]]
+		switch {
+		case name == "$":
+			expr.WriteString(`\$`)
+		case name == "*":
+			expr.WriteString(`.*?`)
+		default:
+			if v, ok := vars[name]; ok {
+				expr.WriteString(regexp.QuoteMeta(v))
+			} else {
+				expr.WriteString(`([^\s()\[\]{}"]+)`)
+				names = append(names, name)
+			}
+		}
+	}
+	expr.WriteString(regexp.QuoteMeta(pattern[last:]))
+	expr.WriteString(`$`)
+
+	m := regexp.MustCompile(expr.String()).FindStringSubmatch(res)
+	if m == nil {
+		return false
+	}
+	for i, name := range names {
+		vars[name] = m[i+1]
+	}
+	return true
+}
+
+// scriptConn is a client connection driven by a script.
+type scriptConn struct {
+	c         net.Conn
+	responses chan string
+	err       error
+}
+
+func newScriptConn(c net.Conn) *scriptConn {
+	sc := &scriptConn{c: c, responses: make(chan string, 1024)}
+	go sc.read()
+	return sc
+}
+
+// read reads responses, including their literals.
+func (sc *scriptConn) read() {
+	defer close(sc.responses)
+
+	br := bufio.NewReader(sc.c)
+	for {
+		var res strings.Builder
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				sc.err = err
+				return
+			}
+			line = strings.TrimSuffix(line, "\r\n")
+			res.WriteString(line)
+
+			lm := literalRe.FindStringSubmatch(line)
+			if lm == nil {
+				break
+			}
+			n, _ := strconv.Atoi(lm[1])
+			b := make([]byte, n)
+			if _, err := io.ReadFull(br, b); err != nil {
+				sc.err = err
+				return
+			}
+			res.WriteString("\r\n")
+			res.Write(b)
+		}
+		sc.responses <- res.String()
+	}
+}
+
+func (sc *scriptConn) next(timer <-chan time.Time) (string, error) {
+	select {
+	case res, ok := <-sc.responses:
+		if !ok {
+			return "", fmt.Errorf("connection closed: %v", sc.err)
+		}
+		return res, nil
+	case <-timer:
+		return "", errors.New("timeout")
+	}
+}
+
+// isUntagged checks whether a response is untagged or a continuation request.
+// Tags cannot contain "+".
+func isUntagged(res string) bool {
+	return strings.HasPrefix(res, "* ") || strings.HasPrefix(res, "+")
+}
+
+// expect reads responses until a block of expected lines is satisfied.
+func (sc *scriptConn) expect(vars scriptVars, block []*scriptLine) error {
+	var expected []*scriptLine
+	var tagged *scriptLine
+	allowOthers := false
+	for _, l := range block {
+		switch text := l.text(); {
+		case text == "...":
+			allowOthers = true
+		case !isUntagged(text):
+			tagged = l
+		default:
+			expected = append(expected, l)
+		}
+	}
+
+	timer := time.NewTimer(scriptTimeout)
+	defer timer.Stop()
+
+	for tagged != nil || len(expected) > 0 {
+		res, err := sc.next(timer.C)
+		if err != nil {
+			return fmt.Errorf("line %v: %v", block[0].lineno, err)
+		}
+
+		if !isUntagged(res) {
+			if tagged == nil {
+				return fmt.Errorf("line %v: unexpected response %q", block[0].lineno, res)
+			}
+			if len(expected) > 0 {
+				return fmt.Errorf("line %v: expected %q before tagged response %q", expected[0].lineno, expected[0].text(), res)
+			}
+			if !vars.match(tagged.text(), res) {
+				return fmt.Errorf("line %v: expected %q, got %q", tagged.lineno, tagged.text(), res)
+			}
+			return nil
+		}
+
+		found := false
+		for i, l := range expected {
+			if vars.match(l.text(), res) {
+				expected = append(expected[:i], expected[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found && !allowOthers {
+			return fmt.Errorf("line %v: unexpected response %q", block[0].lineno, res)
+		}
+	}
+	return nil
+}
+
+// send sends a line, waiting for continuation requests between its parts.
+func (sc *scriptConn) send(vars scriptVars, l *scriptLine) error {
+	for i, part := range l.parts {
+		if i > 0 {
+			timer := time.NewTimer(scriptTimeout)
+			res, err := sc.next(timer.C)
+			timer.Stop()
+			if err != nil {
+				return fmt.Errorf("line %v: %v", l.lineno, err)
+			}
+			if !strings.HasPrefix(res, "+") {
+				return fmt.Errorf("line %v: expected a continuation request, got %q", l.lineno, res)
+			}
+		}
+
+		s, err := vars.expand(part)
+		if err != nil {
+			return fmt.Errorf("line %v: %v", l.lineno, err)
+		}
+		if i == len(l.parts)-1 {
+			s += "\r\n"
+		}
+		if _, err := io.WriteString(sc.c, s); err != nil {
+			return fmt.Errorf("line %v: %v", l.lineno, err)
+		}
+	}
+	return nil
+}
+
+// pipeListener is a net.Listener for in-process connections.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *pipeListener) Dial() (net.Conn, error) {
+	c, s := net.Pipe()
+	select {
+	case l.conns <- s:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func runScript(t *testing.T, script []*scriptLine) {
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	l := newPipeListener()
+	go s.Serve(l)
+	defer s.Close()
+
+	conns := make(map[int]*scriptConn)
+	defer func() {
+		for _, sc := range conns {
+			sc.c.Close()
+		}
+	}()
+	getConn := func(n int) *scriptConn {
+		if sc, ok := conns[n]; ok {
+			return sc
+		}
+
+		c, err := l.Dial()
+		if err != nil {
+			t.Fatal("Cannot connect to server:", err)
+		}
+		sc := newScriptConn(c)
+		conns[n] = sc
+
+		timer := time.NewTimer(scriptTimeout)
+		defer timer.Stop()
+		if greeting, err := sc.next(timer.C); err != nil || !strings.HasPrefix(greeting, "* OK ") {
+			t.Fatalf("Invalid greeting for connection %v: %q (%v)", n, greeting, err)
+		}
+		return sc
+	}
+
+	vars := make(scriptVars)
+	for i := 0; i < len(script); {
+		l := script[i]
+		sc := getConn(l.conn)
+
+		if l.send {
+			if err := sc.send(vars, l); err != nil {
+				t.Fatal(err)
+			}
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(script) && !script[j].send && script[j].conn == l.conn {
+			j++
+		}
+		if err := sc.expect(vars, script[i:j]); err != nil {
+			t.Fatal(err)
+		}
+		i = j
+	}
+
+	// Check that no unexpected response is left
+	for n, sc := range conns {
+		select {
+		case res, ok := <-sc.responses:
+			if ok {
+				t.Errorf("Unexpected response on connection %v: %q", n, res)
+			}
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestScripts(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.imap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("No script found")
+	}
+
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".imap")
+		t.Run(name, func(t *testing.T) {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			script, err := parseScript(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runScript(t, script)
+		})
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	script, err := parseScript([]byte("# Comment\n" +
+		"1> a001 APPEND INBOX {4}\n" +
+		"ab\n" +
+		"\n" +
+		"1< a001 OK $*\n" +
+		"2< * 1 FETCH (BODY[] {3}\n" +
+		"xyz)\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(script) != 3 {
+		t.Fatalf("Expected 3 lines, got %v", len(script))
+	}
+
+	if want := []string{"a001 APPEND INBOX {4}\r\n", "ab\r\n"}; strings.Join(script[0].parts, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected parts %q, got %q", want, script[0].parts)
+	}
+	if !script[0].send || script[1].send || script[2].conn != 2 {
+		t.Errorf("Invalid line prefixes: %+v", script)
+	}
+	if want := "* 1 FETCH (BODY[] {3}\r\nxyz)"; script[2].text() != want {
+		t.Errorf("Expected %q, got %q", want, script[2].text())
+	}
+}
+
+func TestScriptVars(t *testing.T) {
+	vars := make(scriptVars)
+	if !vars.match("* OK [UIDVALIDITY $uidvalidity] $*", "* OK [UIDVALIDITY 42] UIDs valid") {
+		t.Fatal("Expected pattern to match")
+	}
+	if vars["uidvalidity"] != "42" {
+		t.Errorf("Expected variable to be 42, got %q", vars["uidvalidity"])
+	}
+	if vars.match("* $uidvalidity EXISTS", "* 43 EXISTS") {
+		t.Error("Expected pattern with a different variable value not to match")
+	}
+	if !vars.match("* FLAGS ($$Forwarded)", "* FLAGS ($Forwarded)") {
+		t.Error("Expected escaped dollar to match")
+	}
+
+	if s, err := vars.expand("a001 UID FETCH $uidvalidity FLAGS $$Forwarded"); err != nil || s != "a001 UID FETCH 42 FLAGS $Forwarded" {
+		t.Errorf("Invalid expansion: %q (%v)", s, err)
+	}
+	if _, err := vars.expand("a001 $undefined"); err == nil {
+		t.Error("Expected an error for an undefined variable")
+	}
+}
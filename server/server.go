@@ -2,7 +2,7 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
@@ -14,7 +14,6 @@ import (
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
-	"github.com/emersion/go-imap/responses"
 	"github.com/emersion/go-sasl"
 )
 
@@ -29,6 +28,29 @@ type Handler interface {
 	Handle(conn Conn) error
 }
 
+// A command handler accepting a context. If a Handler is also a
+// ContextHandler, HandleContext is called instead of Handle.
+//
+// The context is cancelled when the command completes, when the connection is
+// closed or when the server is closed.
+type ContextHandler interface {
+	Handler
+
+	// Handle this command for a given connection, with a context.
+	HandleContext(ctx context.Context, conn Conn) error
+}
+
+// A command handler waiting for updates, such as the IDLE command defined in
+// RFC 2177. Backend updates are queued while a command is handled, and sent
+// when it completes. If a Handler is also an IdleHandler and Idle returns true,
+// updates are sent as soon as they're received while it's handled.
+type IdleHandler interface {
+	Handler
+
+	// Idle reports whether updates can be sent while this command is handled.
+	Idle() bool
+}
+
 // A connection upgrader. If a Handler is also an Upgrader, the connection will
 // be upgraded after the Handler succeeds.
 //
@@ -85,21 +107,41 @@ func ErrNoStatusResp() error {
 	return &errStatusResp{nil}
 }
 
+// ErrServerClosed is returned by Serve, ListenAndServe and ListenAndServeTLS
+// after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("Server closed")
+
+// shutdownPollInterval is how often Shutdown checks whether all connections
+// have been closed.
+const shutdownPollInterval = 50 * time.Millisecond
+
 type mboxListener struct {
 	user    string
 	mailbox string
 	silent  bool
+	// If set, UIDs are removed from message updates
+	seqNums bool
 }
 
 // An IMAP server.
 type Server struct {
+	// Identifier of the last accepted connection, first to be 64-bit aligned
+	lastConnID uint64
+
 	locker    sync.Mutex
 	listeners map[net.Listener]struct{}
 	conns     map[Conn]*mboxListener
+	closed    bool
+	limits    *limiter
 
-	commands   map[string]HandlerFactory
-	auths      map[string]SASLServerFactory
-	extensions []Extension
+	// Parent of connection contexts, cancelled when the server is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	commands    map[string]HandlerFactory
+	auths       map[string]SASLServerFactory
+	extensions  []Extension
+	middlewares []Middleware
 
 	// TCP address to listen on.
 	Addr string
@@ -117,6 +159,12 @@ type Server struct {
 	MinAutoLogout time.Duration
 	// Allow authentication over unencrypted connections.
 	AllowInsecureAuth bool
+	// Require clients to enable TLS with STARTTLS before sending commands other
+	// than CAPABILITY, NOOP and LOGOUT. Other commands are rejected with a NO
+	// [PRIVACYREQUIRED] response, and authentication is disabled even if
+	// AllowInsecureAuth is set. Connections using implicit TLS, or TLS
+	// terminated by a trusted proxy, are not affected.
+	RequireTLS bool
 	// An io.Writer to which all network activity will be mirrored.
 	Debug io.Writer
 	// ErrorLog specifies an optional logger for errors accepting
@@ -127,6 +175,69 @@ type Server struct {
 	// The maximum literal size, in bytes. Literals exceeding this size will be
 	// rejected. A value of zero disables the limit (this is the default).
 	MaxLiteralSize uint32
+	// The reason sent to clients in a BYE response when the server shuts down.
+	// If empty, "Server shutting down" is used.
+	ShutdownReason string
+	// The maximum number of backend updates queued for a connection. If a client
+	// doesn't read updates fast enough and more updates are pending, it's
+	// disconnected. A value of zero disables the limit.
+	MaxQueuedUpdates int
+
+	// The maximum number of connections, and of connections from a single IP
+	// address. Further connections are refused with a BYE [UNAVAILABLE]
+	// response. A value of zero disables the limit (this is the default).
+	MaxConns      int
+	MaxConnsPerIP int
+	// The maximum number of concurrent sessions of a single user. Further
+	// logins are rejected with a NO [LIMIT] response. A value of zero disables
+	// the limit (this is the default).
+	MaxUserSessions int
+	// The number of consecutive failed authentication attempts from an IP
+	// address or for a username after which further attempts are rejected with
+	// a NO [UNAVAILABLE] response during AuthBackoff. Only attempts failing
+	// with backend.ErrInvalidCredentials are counted. The delay is doubled after
+	// each failure, up to MaxAuthBackoff. Failures are forgotten after
+	// MaxAuthBackoff. A value of zero disables throttling (this is the
+	// default).
+	MaxAuthFailures int
+	AuthBackoff     time.Duration
+	MaxAuthBackoff  time.Duration
+	// The maximum number of commands per second a connection can send, with
+	// bursts of up to CommandBurst commands. Further commands are rejected
+	// with a NO [LIMIT] response. A value of zero disables the limit (this is
+	// the default).
+	CommandRate  float64
+	CommandBurst int
+	// If set, notified of server events, e.g. to collect metrics.
+	Observer Observer
+	// If set, completed commands are logged, e.g. to keep an audit trail.
+	// LOGIN passwords and AUTHENTICATE initial responses are redacted.
+	CommandLog CommandLogger
+	// The maximum number of bytes of each literal included in logged command
+	// arguments, longer literals are truncated. A negative value disables
+	// truncation. Defaults to zero: only literal sizes are logged.
+	LogLiteralSize int
+	// The maximum number of pipelined commands of a connection handled
+	// concurrently (RFC 3501 section 5.5). Commands accepted by PipelineCommand
+	// are handled while the next commands are read, other commands wait for the
+	// pipelined commands in progress to complete. Responses are sent in the
+	// order commands have been received. A value of zero or one disables
+	// pipelining (this is the default).
+	MaxPipelinedCommands int
+	// PipelineCommand reports whether a command can be handled concurrently
+	// with other pipelined commands. Commands reading from the connection, such
+	// as IDLE or AUTHENTICATE, must not be pipelined. If nil,
+	// DefaultPipelineCommand is used.
+	PipelineCommand func(req *CommandRequest) bool
+	// Connections from these networks must start with a PROXY protocol header
+	// (version 1 or 2, as defined by HAProxy). The client addresses and TLS
+	// state sent by the proxy replace the ones of the connection, e.g. for
+	// connection limits and logging. Connections from other addresses are
+	// served as is.
+	//
+	// The PROXY protocol doesn't carry client certificates: AUTH=EXTERNAL is
+	// not offered to clients whose TLS connection ends at a proxy.
+	TrustedProxies []*net.IPNet
 }
 
 // Create a new IMAP server from an existing listener.
@@ -134,11 +245,17 @@ func New(bkd backend.Backend) *Server {
 	s := &Server{
 		listeners: make(map[net.Listener]struct{}),
 		conns:     make(map[Conn]*mboxListener),
+		limits:    newLimiter(),
 		Backend:   bkd,
 		ErrorLog:  log.New(os.Stderr, "imap/server: ", log.LstdFlags),
 		// The minimum autologout duration defined in RFC 3501 section 5.4.
-		MinAutoLogout: 30 * time.Minute,
+		MinAutoLogout:    30 * time.Minute,
+		MaxQueuedUpdates: 1000,
+		AuthBackoff:      time.Second,
+		MaxAuthBackoff:   15 * time.Minute,
+		CommandBurst:     10,
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
 	s.auths = map[string]SASLServerFactory{
 		sasl.Plain: func(conn Conn) sasl.Server {
@@ -147,17 +264,14 @@ func New(bkd backend.Backend) *Server {
 					return errors.New("Identities not supported")
 				}
 
-				user, err := bkd.Login(conn.Info(), username, password)
-				if err != nil {
-					return err
-				}
-
-				ctx := conn.Context()
-				ctx.State = imap.AuthenticatedState
-				ctx.User = user
-				return nil
+				return authenticate(conn.connContext(), conn, username, password)
 			})
 		},
+		sasl.External: func(conn Conn) sasl.Server {
+			return &externalServer{authenticate: func(identity string) error {
+				return authenticateCertificate(conn.connContext(), conn, identity)
+			}}
+		},
 	}
 
 	s.commands = map[string]HandlerFactory{
@@ -204,7 +318,17 @@ func New(bkd backend.Backend) *Server {
 
 // Serve accepts incoming connections on the Listener l.
 func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, nil)
+}
+
+// serve accepts connections, and starts TLS on them if tlsConfig isn't nil.
+func (s *Server) serve(l net.Listener, tlsConfig *tls.Config) error {
 	s.locker.Lock()
+	if s.closed {
+		s.locker.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
 	s.listeners[l] = struct{}{}
 	s.locker.Unlock()
 
@@ -224,20 +348,78 @@ func (s *Server) Serve(l net.Listener) error {
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			s.locker.Lock()
+			closed := s.closed
+			s.locker.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
 			return err
 		}
 
-		var conn Conn = newConn(s, c)
-		for _, ext := range s.extensions {
-			if ext, ok := ext.(ConnExtension); ok {
-				conn = ext.NewConn(conn)
-			}
+		if s.isTrustedProxy(c.RemoteAddr()) {
+			// Don't block while waiting for the PROXY protocol header
+			go func() {
+				pc, err := readProxyHeader(c)
+				if err != nil {
+					s.ErrorLog.Printf("cannot read PROXY protocol header from %v: %v", c.RemoteAddr(), err)
+					c.Close()
+					return
+				}
+				s.serveAccepted(pc, tlsConfig)
+			}()
+			continue
 		}
 
-		go s.serveConn(conn)
+		if err := s.serveAccepted(c, tlsConfig); err != nil {
+			return err
+		}
 	}
 }
 
+// serveAccepted serves a new connection. It returns ErrServerClosed if the
+// server has been closed.
+func (s *Server) serveAccepted(c net.Conn, tlsConfig *tls.Config) error {
+	if tlsConfig != nil {
+		c = tls.Server(c, tlsConfig)
+	}
+
+	ip := remoteIP(c.RemoteAddr())
+	if !s.acquireConn(ip) {
+		go s.rejectConn(c)
+		return nil
+	}
+
+	var conn Conn = newConn(s, c)
+	for _, ext := range s.extensions {
+		if ext, ok := ext.(ConnExtension); ok {
+			conn = ext.NewConn(conn)
+		}
+	}
+
+	// Register the connection before serving it, so that Shutdown waits for
+	// it
+	s.locker.Lock()
+	if s.closed {
+		s.locker.Unlock()
+		conn.Close()
+		s.releaseConn(ip)
+		return ErrServerClosed
+	}
+	s.conns[conn] = &mboxListener{}
+	s.locker.Unlock()
+
+	if s.Observer != nil {
+		s.Observer.ConnOpened(conn)
+	}
+
+	go func() {
+		defer s.releaseConn(ip)
+		s.serveConn(conn)
+	}()
+	return nil
+}
+
 // ListenAndServe listens on the TCP network address s.Addr and then calls Serve
 // to handle requests on incoming connections.
 //
@@ -266,24 +448,27 @@ func (s *Server) ListenAndServeTLS() error {
 		addr = ":imaps"
 	}
 
-	l, err := tls.Listen("tcp", addr, s.TLSConfig)
+	// TLS is started on accepted connections, after the PROXY protocol header
+	// if any
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	return s.Serve(l)
+	return s.serve(l, s.TLSConfig)
 }
 
 func (s *Server) serveConn(conn Conn) error {
-	s.locker.Lock()
-	s.conns[conn] = &mboxListener{}
-	s.locker.Unlock()
-
 	defer func() {
 		s.locker.Lock()
-		defer s.locker.Unlock()
 		conn.Close()
 		delete(s.conns, conn)
+		s.releaseSession(conn)
+		s.locker.Unlock()
+
+		if s.Observer != nil {
+			s.Observer.ConnClosed(conn)
+		}
 	}()
 
 	return conn.serve(conn)
@@ -306,6 +491,14 @@ func (s *Server) silentMboxListener(conn Conn, silent bool) {
 	s.locker.Unlock()
 }
 
+func (s *Server) seqNumMboxListener(conn Conn, seqNums bool) {
+	s.locker.Lock()
+	if sub, ok := s.conns[conn]; ok {
+		sub.seqNums = seqNums
+	}
+	s.locker.Unlock()
+}
+
 // Command gets a command handler factory for the provided command name.
 func (s *Server) Command(name string) HandlerFactory {
 	// Extensions can override builtin commands
@@ -318,59 +511,17 @@ func (s *Server) Command(name string) HandlerFactory {
 	return s.commands[name]
 }
 
-type bufResp struct {
-	bytes.Buffer
-}
-
-func (br *bufResp) WriteTo(w *imap.Writer) error {
-	_, err := w.Write(br.Buffer.Bytes())
-	return err
-}
-
-func bufferResp(res imap.WriterTo) (imap.WriterTo, error) {
-	buf := bufResp{}
-	bufWriter := imap.NewWriter(&buf)
-	if err := res.WriteTo(bufWriter); err != nil {
-		return nil, err
-	}
-	return &buf, nil
-}
-
 func (s *Server) listenUpdates() {
 	for {
 		update := <-s.Updates
 
-		var res imap.WriterTo
-		switch update := update.(type) {
-		case *backend.StatusUpdate:
-			res = update.StatusResp
-		case *backend.MailboxUpdate:
-			res = &responses.Select{Mailbox: update.MailboxStatus}
-		case *backend.MessageUpdate:
-			ch := make(chan *imap.Message, 1)
-			ch <- update.Message
-			close(ch)
-
-			res = &responses.Fetch{Messages: ch}
-		case *backend.ExpungeUpdate:
-			ch := make(chan uint32, 1)
-			ch <- update.SeqNum
-			close(ch)
-
-			res = &responses.Expunge{SeqNums: ch}
-		default:
+		if updateResp(update) == nil {
 			s.ErrorLog.Printf("unhandled update: %T\n", update)
-		}
-		if res == nil {
-			continue
-		}
-		// Write response to buffer, so we can send it to multiple connections.
-		buf, err := bufferResp(res)
-		if err != nil {
-			s.ErrorLog.Printf("Failed to buffer update: %s\n", err)
+			close(update.Done())
 			continue
 		}
 
+		n := 0
 		s.locker.Lock()
 		for conn, sub := range s.conns {
 			username := update.Username()
@@ -383,20 +534,24 @@ func (s *Server) listenUpdates() {
 			}
 			if sub.silent {
 				// If silent is set, do not send message updates
-				if _, ok := res.(*responses.Fetch); ok {
+				if _, ok := update.(*backend.MessageUpdate); ok {
 					continue
 				}
 			}
 
-			// Try sending to client.
-			select {
-			case conn.Context().Responses <- buf:
-			default:
-				// Connection's response channel is blocked (busy).  Skipping
+			if sub.seqNums {
+				conn.pushUpdate(withoutUid(update))
+			} else {
+				conn.pushUpdate(update)
 			}
+			n++
 		}
 		s.locker.Unlock()
 
+		if s.Observer != nil {
+			s.Observer.UpdateDispatched(update, n)
+		}
+
 		close(update.Done())
 	}
 }
@@ -415,6 +570,9 @@ func (s *Server) Close() error {
 	s.locker.Lock()
 	defer s.locker.Unlock()
 
+	s.closed = true
+	s.cancel()
+
 	for l := range s.listeners {
 		l.Close()
 	}
@@ -426,6 +584,55 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// Shutdown gracefully shuts down the server. It stops listening, sends a BYE
+// response to idle connections and closes them, and waits for in-progress
+// commands to complete before closing their connections. Connections handling
+// a command waiting for updates, such as IDLE, are considered idle. Users are
+// logged out when their connection is closed.
+//
+// If ctx expires before all connections have been closed, the remaining
+// connections are closed as with Close, and the context error is returned.
+// Shutdown always waits for all connections to be served before returning.
+func (s *Server) Shutdown(ctx context.Context) error {
+	reason := s.ShutdownReason
+	if reason == "" {
+		reason = "Server shutting down"
+	}
+
+	s.locker.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		go conn.shutdown(reason)
+	}
+	s.locker.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	var err error
+	done := ctx.Done()
+	for {
+		s.locker.Lock()
+		n := len(s.conns)
+		s.locker.Unlock()
+		if n == 0 {
+			return err
+		}
+
+		select {
+		case <-done:
+			err = ctx.Err()
+			s.Close()
+			// Keep waiting for connections to be served
+			done = nil
+		case <-ticker.C:
+		}
+	}
+}
+
 // Enable some IMAP extensions on this server.
 //
 // This function should not be called directly, it must only be used by
@@ -2,14 +2,25 @@ package server_test
 
 import (
 	"bufio"
+	"context"
+	"io"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend/memory"
 	"github.com/emersion/go-imap/server"
 )
 
 func testServer(t *testing.T) (s *server.Server, conn net.Conn) {
+	return testServerConfig(t, nil)
+}
+
+// testServerConfig is like testServer, but calls configure before the server
+// starts serving connections, if it's not nil.
+func testServerConfig(t *testing.T, configure func(s *server.Server)) (s *server.Server, conn net.Conn) {
 	bkd := memory.New()
 
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -19,6 +30,9 @@ func testServer(t *testing.T) (s *server.Server, conn net.Conn) {
 
 	s = server.New(bkd)
 	s.AllowInsecureAuth = true
+	if configure != nil {
+		configure(s)
+	}
 
 	go s.Serve(l)
 
@@ -44,3 +58,224 @@ func TestServer_greeting(t *testing.T) {
 		t.Fatal("Bad greeting:", greeting)
 	}
 }
+
+func TestServer_Shutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s := server.New(memory.New())
+	s.ShutdownReason = "Maintenance"
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(l)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal("Expected no error while shutting down, got:", err)
+	}
+
+	scanner.Scan()
+	if scanner.Text() != "* BYE Maintenance" {
+		t.Fatal("Bad BYE response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected the connection to be closed, got:", scanner.Text())
+	}
+	if err := <-served; err != server.ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed from Serve, got: %v", err)
+	}
+}
+
+func TestServer_Shutdown_InProgress(t *testing.T) {
+	s, c, scanner, be := testServerContext(t)
+	defer c.Close()
+
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a001 ") {
+			break
+		}
+	}
+	<-be.contexts
+
+	io.WriteString(c, "a002 UID SEARCH ALL\r\n")
+	<-be.contexts
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatal("Expected Shutdown to wait for the command to complete, got:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(be.release)
+
+	for _, want := range []string{"* SEARCH", "a002 OK ", "* BYE "} {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), want) {
+			t.Fatalf("Expected %q, got: %v", want, scanner.Text())
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Expected no error while shutting down, got:", err)
+	}
+}
+
+func TestServer_Shutdown_Timeout(t *testing.T) {
+	s, c, scanner, be := testServerContext(t)
+	defer c.Close()
+
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a001 ") {
+			break
+		}
+	}
+	<-be.contexts
+
+	io.WriteString(c, "a002 UID SEARCH ALL\r\n")
+	cmdCtx := <-be.contexts
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected DeadlineExceeded while shutting down, got:", err)
+	}
+	if cmdCtx.Err() == nil {
+		t.Error("Expected the command context to be cancelled")
+	}
+}
+
+// idleExtension provides an IDLE command waiting for DONE, as defined in
+// RFC 2177.
+type idleExtension struct{}
+
+func (idleExtension) Capabilities(c server.Conn) []string {
+	return []string{"IDLE"}
+}
+
+func (idleExtension) Command(name string) server.HandlerFactory {
+	if name != "IDLE" {
+		return nil
+	}
+	return func() server.Handler {
+		return &idleHandler{}
+	}
+}
+
+type idleHandler struct{}
+
+func (*idleHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+func (*idleHandler) Handle(conn server.Conn) error {
+	if err := conn.WriteResp(&imap.ContinuationReq{Info: "idling"}); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(conn, make([]byte, len("DONE\r\n")))
+	return err
+}
+
+func (*idleHandler) Idle() bool {
+	return true
+}
+
+func TestServer_Shutdown_Idle(t *testing.T) {
+	s, c := testServerConfig(t, func(s *server.Server) {
+		s.Enable(idleExtension{})
+	})
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a002 IDLE\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "+ ") {
+		t.Fatal("Bad continuation request:", scanner.Text())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(ctx)
+	}()
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "* BYE ") {
+		t.Fatal("Bad BYE response:", scanner.Text())
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Expected idle connections to be closed before the deadline, got:", err)
+	}
+}
+
+func TestServer_UpdatesOverflow(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.MaxQueuedUpdates = 1
+	go s.Serve(l)
+	defer s.Close()
+
+	dial := func(tag string) (net.Conn, *bufio.Scanner) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("Cannot connect to server:", err)
+		}
+		scanner := bufio.NewScanner(c)
+		scanner.Scan() // Greeting
+		io.WriteString(c, tag+" LOGIN username password\r\n")
+		scanner.Scan()
+		io.WriteString(c, tag+" SELECT INBOX\r\n")
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), tag+" ") {
+				break
+			}
+		}
+		return c, scanner
+	}
+
+	c1, scanner1 := dial("a000")
+	defer c1.Close()
+	c2, scanner2 := dial("b000")
+	defer c2.Close()
+
+	// EXPUNGE responses are queued while the second connection is idle
+	io.WriteString(c1, "a001 APPEND INBOX {11+}\r\nHi there :)\r\n")
+	io.WriteString(c1, "a002 STORE 1:* +FLAGS.SILENT (\\Deleted)\r\n")
+	io.WriteString(c1, "a003 EXPUNGE\r\n")
+	for scanner1.Scan() {
+		if strings.HasPrefix(scanner1.Text(), "a003 ") {
+			break
+		}
+	}
+
+	var last string
+	for scanner2.Scan() {
+		last = scanner2.Text()
+	}
+	if last != "* BYE Too many pending updates" {
+		t.Fatal("Expected the connection to be closed with BYE, got:", last)
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+)
+
+// updateQueue holds the backend updates waiting to be sent to a connection.
+//
+// Updates are sent in order. EXISTS, RECENT and FETCH responses can be sent at
+// any time, but EXPUNGE responses cannot be sent when no command is in
+// progress (RFC 3501 section 7.4.1): updates are held back from the first
+// expunge update until a command completes.
+type updateQueue struct {
+	locker   sync.Mutex
+	updates  []backend.Update
+	overflow bool
+
+	// Receives a value when updates are pushed
+	notify chan struct{}
+}
+
+func newUpdateQueue() *updateQueue {
+	return &updateQueue{notify: make(chan struct{}, 1)}
+}
+
+// push queues an update, coalescing it with the queued ones if possible. If
+// max is not zero and more than max updates are queued, the queue is cleared
+// and further updates are dropped: push returns true the first time this
+// happens.
+func (q *updateQueue) push(update backend.Update, max int) (overflow bool) {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	if q.overflow {
+		return false
+	}
+
+	if !q.coalesce(update) {
+		q.updates = append(q.updates, update)
+	}
+	if max > 0 && len(q.updates) > max {
+		q.updates = nil
+		q.overflow = true
+		return true
+	}
+
+	q.signal()
+	return false
+}
+
+// coalesce replaces a queued update with update if they're redundant. It
+// returns false if update needs to be queued.
+func (q *updateQueue) coalesce(update backend.Update) bool {
+	switch update := update.(type) {
+	case *backend.MailboxUpdate:
+		// Only the last mailbox status matters, unless another update refers to
+		// the previous one
+		if n := len(q.updates); n > 0 {
+			last, ok := q.updates[n-1].(*backend.MailboxUpdate)
+			if ok && hasStatusItems(update.MailboxStatus, last.MailboxStatus) {
+				q.updates[n-1] = update
+				return true
+			}
+		}
+	case *backend.MessageUpdate:
+		// Look for a previous update of the same message, in the updates of
+		// other messages queued last
+		for i := len(q.updates) - 1; i >= 0; i-- {
+			queued, ok := q.updates[i].(*backend.MessageUpdate)
+			if !ok {
+				break
+			}
+			if queued.SeqNum == update.SeqNum && hasMessageItems(update.Message, queued.Message) {
+				q.updates[i] = update
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasStatusItems checks whether status contains all the items of other.
+func hasStatusItems(status, other *imap.MailboxStatus) bool {
+	if status == nil || other == nil {
+		return false
+	}
+	for k := range other.Items {
+		if _, ok := status.Items[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// hasMessageItems checks whether msg contains all the items of other.
+func hasMessageItems(msg, other *imap.Message) bool {
+	if msg == nil || other == nil {
+		return false
+	}
+	for k := range other.Items {
+		if _, ok := msg.Items[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *updateQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes and returns the updates which can be sent. If expunge is false,
+// updates are returned until the first expunge update. If reorder is also
+// true, updates referring to messages by UID are returned even if they follow
+// expunge updates.
+func (q *updateQueue) pop(expunge, reorder bool) []backend.Update {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	if expunge {
+		updates := q.updates
+		q.updates = nil
+		return updates
+	}
+
+	var updates, held []backend.Update
+	for i, update := range q.updates {
+		if _, ok := update.(*backend.ExpungeUpdate); ok && reorder {
+			held = append(held, update)
+			continue
+		} else if ok || (len(held) > 0 && !hasUid(update)) {
+			held = append(held, q.updates[i:]...)
+			break
+		}
+		updates = append(updates, update)
+	}
+
+	q.updates = held
+	return updates
+}
+
+// hasUid returns false for updates referring to a message by its sequence
+// number only.
+func hasUid(update backend.Update) bool {
+	if update, ok := update.(*backend.MessageUpdate); ok {
+		return update.Message != nil && update.Uid != 0
+	}
+	return true
+}
+
+// withoutUid returns a copy of a message update without the UID item. Other
+// updates are returned unchanged.
+func withoutUid(update backend.Update) backend.Update {
+	msgUpdate, ok := update.(*backend.MessageUpdate)
+	if !ok || msgUpdate.Message == nil {
+		return update
+	}
+	if _, ok := msgUpdate.Items[imap.FetchUid]; !ok {
+		return update
+	}
+
+	msg := *msgUpdate.Message
+	msg.Items = make(map[imap.FetchItem]interface{}, len(msgUpdate.Items))
+	for k, v := range msgUpdate.Items {
+		if k != imap.FetchUid {
+			msg.Items[k] = v
+		}
+	}
+	return &backend.MessageUpdate{Update: msgUpdate.Update, Message: &msg}
+}
+
+// updateResp returns the response sent to clients for a backend update, or
+// nil if the update is unknown.
+func updateResp(update backend.Update) imap.WriterTo {
+	switch update := update.(type) {
+	case *backend.StatusUpdate:
+		return update.StatusResp
+	case *backend.MailboxUpdate:
+		return &responses.Select{Mailbox: update.MailboxStatus}
+	case *backend.MessageUpdate:
+		ch := make(chan *imap.Message, 1)
+		ch <- update.Message
+		close(ch)
+
+		return &responses.Fetch{Messages: ch}
+	case *backend.ExpungeUpdate:
+		ch := make(chan uint32, 1)
+		ch <- update.SeqNum
+		close(ch)
+
+		return &responses.Expunge{SeqNums: ch}
+	default:
+		return nil
+	}
+}
+
+// pendingUpdates is a response writing the updates which can be sent from a
+// queue. It's written by the goroutine sending responses, so that updates are
+// never reordered.
+type pendingUpdates struct {
+	queue   *updateQueue
+	view    *mailboxView
+	ctx     context.Context
+	expunge bool
+}
+
+func (r *pendingUpdates) WriteTo(w *imap.Writer) error {
+	// Updates are translated with the mailbox snapshot, messages known by
+	// the client can be updated before expunges are sent
+	for _, update := range r.queue.pop(r.expunge, r.view.active()) {
+		res := r.view.updateResp(r.ctx, update)
+		if res == nil {
+			continue
+		}
+		if err := res.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
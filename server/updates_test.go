@@ -0,0 +1,130 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func mailboxUpdate(messages uint32) backend.Update {
+	status := imap.NewMailboxStatus("INBOX", []imap.StatusItem{imap.StatusMessages})
+	status.Messages = messages
+	return &backend.MailboxUpdate{Update: backend.NewUpdate("username", "INBOX"), MailboxStatus: status}
+}
+
+func messageUpdate(seqNum uint32, flags ...string) backend.Update {
+	msg := imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags})
+	msg.Flags = flags
+	return &backend.MessageUpdate{Update: backend.NewUpdate("username", "INBOX"), Message: msg}
+}
+
+func expungeUpdate(seqNum uint32) backend.Update {
+	return &backend.ExpungeUpdate{Update: backend.NewUpdate("username", "INBOX"), SeqNum: seqNum}
+}
+
+func TestUpdateQueue_Coalesce(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []backend.Update
+		want    []int
+	}{
+		{
+			name:    "mailbox",
+			updates: []backend.Update{mailboxUpdate(2), mailboxUpdate(3)},
+			want:    []int{1},
+		},
+		{
+			name:    "mailbox after message",
+			updates: []backend.Update{mailboxUpdate(2), messageUpdate(2), mailboxUpdate(3)},
+			want:    []int{0, 1, 2},
+		},
+		{
+			name:    "mailbox after expunge",
+			updates: []backend.Update{mailboxUpdate(2), expungeUpdate(2), mailboxUpdate(2)},
+			want:    []int{0, 1, 2},
+		},
+		{
+			name:    "same message",
+			updates: []backend.Update{messageUpdate(1), messageUpdate(2), messageUpdate(1, imap.SeenFlag)},
+			want:    []int{2, 1},
+		},
+		{
+			name:    "same message after expunge",
+			updates: []backend.Update{messageUpdate(2), expungeUpdate(1), messageUpdate(2)},
+			want:    []int{0, 1, 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newUpdateQueue()
+			for _, update := range test.updates {
+				q.push(update, 0)
+			}
+
+			popped := q.pop(true, false)
+			if len(popped) != len(test.want) {
+				t.Fatalf("Expected %v updates, got %v", len(test.want), len(popped))
+			}
+			for i, j := range test.want {
+				if popped[i] != test.updates[j] {
+					t.Errorf("Expected update #%v to be %v", i, j)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateQueue_Expunge(t *testing.T) {
+	q := newUpdateQueue()
+	updates := []backend.Update{mailboxUpdate(2), expungeUpdate(1), messageUpdate(1)}
+	for _, update := range updates {
+		q.push(update, 0)
+	}
+
+	if popped := q.pop(false, false); len(popped) != 1 || popped[0] != updates[0] {
+		t.Fatalf("Expected updates before the expunge update, got %v", popped)
+	}
+	if popped := q.pop(false, false); len(popped) != 0 {
+		t.Fatalf("Expected no update, got %v", popped)
+	}
+	if popped := q.pop(true, false); len(popped) != 2 {
+		t.Fatalf("Expected 2 updates, got %v", popped)
+	}
+}
+
+func TestUpdateQueue_Reorder(t *testing.T) {
+	q := newUpdateQueue()
+	withUid := messageUpdate(2, imap.SeenFlag).(*backend.MessageUpdate)
+	withUid.Uid = 42
+	updates := []backend.Update{expungeUpdate(1), withUid, mailboxUpdate(3), messageUpdate(1), mailboxUpdate(4)}
+	for _, update := range updates {
+		q.push(update, 0)
+	}
+
+	popped := q.pop(false, true)
+	if len(popped) != 2 || popped[0] != updates[1] || popped[1] != updates[2] {
+		t.Fatalf("Expected updates referring to messages by UID, got %v", popped)
+	}
+	popped = q.pop(true, true)
+	if len(popped) != 3 || popped[0] != updates[0] || popped[1] != updates[3] || popped[2] != updates[4] {
+		t.Fatalf("Expected the held updates in order, got %v", popped)
+	}
+}
+
+func TestUpdateQueue_Overflow(t *testing.T) {
+	q := newUpdateQueue()
+	if q.push(expungeUpdate(1), 2) || q.push(expungeUpdate(1), 2) {
+		t.Fatal("Expected no overflow")
+	}
+	if !q.push(expungeUpdate(1), 2) {
+		t.Fatal("Expected an overflow")
+	}
+	if q.push(expungeUpdate(1), 2) {
+		t.Fatal("Expected the overflow to be reported once")
+	}
+	if popped := q.pop(true, false); len(popped) != 0 {
+		t.Fatalf("Expected updates to be dropped, got %v", popped)
+	}
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/responses"
+)
+
+// mailboxView is a connection's snapshot of the selected mailbox: the UIDs of
+// the messages known by the client, in sequence number order.
+//
+// Sequence numbers sent by the backend don't match the ones known by the client
+// while EXPUNGE responses are held back. If the backend sends updates, the
+// server translates sequence numbers in commands and in updates with the
+// snapshot, and uses UIDs when talking to the backend.
+type mailboxView struct {
+	locker sync.Mutex
+	// The selected mailbox, nil if the view is inactive
+	mbox backend.Mailbox
+	name string
+	uids []uint32
+}
+
+// reset replaces the snapshot. If mbox is nil, the view becomes inactive.
+func (v *mailboxView) reset(mbox backend.Mailbox, uids []uint32) {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+
+	v.mbox = mbox
+	v.name = ""
+	if mbox != nil {
+		v.name = mbox.Name()
+	}
+	v.uids = uids
+}
+
+// active checks whether sequence numbers are translated with the snapshot.
+func (v *mailboxView) active() bool {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+	return v.mbox != nil
+}
+
+// index returns the index of uid in the snapshot, or -1 if the message isn't
+// known by the client.
+func (v *mailboxView) index(uid uint32) int {
+	i := sort.Search(len(v.uids), func(i int) bool {
+		return v.uids[i] >= uid
+	})
+	if i < len(v.uids) && v.uids[i] == uid {
+		return i
+	}
+	return -1
+}
+
+// seqNum returns the sequence number of a message, or zero if the message
+// isn't known by the client.
+func (v *mailboxView) seqNum(uid uint32) uint32 {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+
+	if uid == 0 {
+		return 0
+	}
+	return uint32(v.index(uid) + 1)
+}
+
+// seqNums translates a sorted list of UIDs into sequence numbers, skipping
+// messages unknown by the client.
+func (v *mailboxView) seqNums(uids []uint32) []uint32 {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+
+	seqNums := make([]uint32, 0, len(uids))
+	for _, uid := range uids {
+		if i := v.index(uid); i >= 0 {
+			seqNums = append(seqNums, uint32(i+1))
+		}
+	}
+	return seqNums
+}
+
+// uidSet translates a sequence set into a UID set. Sequence numbers greater
+// than the number of messages are ignored.
+func (v *mailboxView) uidSet(seqSet *imap.SeqSet) *imap.SeqSet {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+
+	uidSet := new(imap.SeqSet)
+	n := uint32(len(v.uids))
+	for _, seq := range seqSet.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 {
+			start = n
+		}
+		if stop == 0 {
+			stop = n
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if stop > n {
+			stop = n
+		}
+		for seqNum := start; seqNum >= 1 && seqNum <= stop; seqNum++ {
+			uidSet.AddNum(v.uids[seqNum-1])
+		}
+	}
+	return uidSet
+}
+
+// translateCriteria returns a copy of criteria matching UIDs instead of
+// sequence numbers.
+func (v *mailboxView) translateCriteria(criteria *imap.SearchCriteria) *imap.SearchCriteria {
+	c := *criteria
+
+	if c.SeqNum != nil {
+		uidSet := v.uidSet(c.SeqNum)
+		c.SeqNum = nil
+		if c.Uid == nil {
+			c.Uid = uidSet
+		} else {
+			// Both sets need to match
+			c.Not = append(c.Not[:len(c.Not):len(c.Not)], &imap.SearchCriteria{
+				Not: []*imap.SearchCriteria{{Uid: uidSet}},
+			})
+		}
+	}
+
+	if c.Not != nil {
+		not := make([]*imap.SearchCriteria, len(c.Not))
+		for i, sub := range c.Not {
+			not[i] = v.translateCriteria(sub)
+		}
+		c.Not = not
+	}
+	if c.Or != nil {
+		or := make([][2]*imap.SearchCriteria, len(c.Or))
+		for i, pair := range c.Or {
+			or[i] = [2]*imap.SearchCriteria{
+				v.translateCriteria(pair[0]),
+				v.translateCriteria(pair[1]),
+			}
+		}
+		c.Or = or
+	}
+	if c.Fuzzy != nil {
+		fuzzy := make([]*imap.SearchCriteria, len(c.Fuzzy))
+		for i, sub := range c.Fuzzy {
+			fuzzy[i] = v.translateCriteria(sub)
+		}
+		c.Fuzzy = fuzzy
+	}
+
+	return &c
+}
+
+// updateResp returns the response sent to the client for a backend update,
+// translated with the snapshot. It returns nil if the update is irrelevant.
+func (v *mailboxView) updateResp(ctx context.Context, update backend.Update) imap.WriterTo {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+
+	if v.mbox == nil || update.Mailbox() == "" {
+		return updateResp(update)
+	}
+	if update.Mailbox() != v.name {
+		// Sent before another mailbox has been selected
+		return nil
+	}
+
+	switch update := update.(type) {
+	case *backend.MailboxUpdate:
+		if update.MailboxStatus == nil {
+			return nil
+		}
+		if _, ok := update.Items[imap.StatusMessages]; !ok {
+			return updateResp(update)
+		}
+		if err := v.sync(ctx); err != nil {
+			return nil
+		}
+		return &responses.Select{Mailbox: v.status(update.MailboxStatus)}
+	case *backend.MessageUpdate:
+		if update.Message == nil || update.Uid == 0 {
+			return updateResp(update)
+		}
+		i := v.index(update.Uid)
+		if i < 0 {
+			return nil
+		}
+		msg := *update.Message
+		msg.SeqNum = uint32(i + 1)
+		if _, ok := msg.Items[imap.FetchFlags]; ok {
+			// \Recent isn't included in updates broadcast to all sessions
+			if mbox, ok := v.mbox.(backend.SelectMailbox); ok && mbox.Recent(update.Uid) {
+				msg.Flags = append(append([]string(nil), msg.Flags...), imap.RecentFlag)
+			}
+		}
+		return updateResp(&backend.MessageUpdate{Update: update.Update, Message: &msg})
+	case *backend.ExpungeUpdate:
+		i := int(update.SeqNum) - 1
+		if update.Uid != 0 {
+			i = v.index(update.Uid)
+		}
+		if i < 0 || i >= len(v.uids) {
+			return nil
+		}
+		v.uids = append(v.uids[:i:i], v.uids[i+1:]...)
+		return updateResp(&backend.ExpungeUpdate{Update: update.Update, SeqNum: uint32(i + 1)})
+	default:
+		return updateResp(update)
+	}
+}
+
+// sync appends the messages added to the mailbox to the snapshot.
+func (v *mailboxView) sync(ctx context.Context) error {
+	var last uint32
+	if n := len(v.uids); n > 0 {
+		last = v.uids[n-1]
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(last+1, 0)
+	uids, err := listUids(ctx, v.mbox, seqSet)
+	if err != nil {
+		return err
+	}
+
+	// "n:*" always matches the last message, even if its UID is lower than n
+	for _, uid := range uids {
+		if uid > last {
+			v.uids = append(v.uids, uid)
+			last = uid
+		}
+	}
+	return nil
+}
+
+// listUids returns the sorted UIDs of the messages in a UID set.
+func listUids(ctx context.Context, mbox backend.Mailbox, seqSet *imap.SeqSet) ([]uint32, error) {
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- backendutil.ListMessages(ctx, mbox, true, seqSet, []imap.FetchItem{imap.FetchUid}, ch)
+	}()
+
+	var uids []uint32
+	for msg := range ch {
+		uids = append(uids, msg.Uid)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, nil
+}
+
+// status returns a copy of a mailbox status with the number of messages known
+// by the client.
+func (v *mailboxView) status(status *imap.MailboxStatus) *imap.MailboxStatus {
+	status.ItemsLocker.Lock()
+	defer status.ItemsLocker.Unlock()
+
+	res := &imap.MailboxStatus{
+		Name:           status.Name,
+		ReadOnly:       status.ReadOnly,
+		Items:          make(map[imap.StatusItem]interface{}, len(status.Items)),
+		Flags:          status.Flags,
+		PermanentFlags: status.PermanentFlags,
+		Messages:       uint32(len(v.uids)),
+		Recent:         status.Recent,
+		Unseen:         status.Unseen,
+		UidNext:        status.UidNext,
+		UidValidity:    status.UidValidity,
+		Size:           status.Size,
+		MailboxId:      status.MailboxId,
+	}
+	for k, val := range status.Items {
+		res.Items[k] = val
+	}
+	return res
+}
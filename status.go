@@ -56,6 +56,13 @@ const (
 	CodeUnseen         StatusRespCode = "UNSEEN"
 )
 
+// Status response codes defined in RFC 5530.
+const (
+	CodeUnavailable     StatusRespCode = "UNAVAILABLE"
+	CodeLimit           StatusRespCode = "LIMIT"
+	CodePrivacyRequired StatusRespCode = "PRIVACYREQUIRED"
+)
+
 // A status response.
 // See RFC 3501 section 7.1
 type StatusResp struct {
@@ -176,6 +176,8 @@ func (w *Writer) writeField(field interface{}) error {
 		return w.writeNumber(uint32(field))
 	case uint32:
 		return w.writeNumber(field)
+	case uint64:
+		return w.writeString(strconv.FormatUint(field, 10))
 	case Literal:
 		return w.writeLiteral(field)
 	case []interface{}: